@@ -9,10 +9,10 @@ tup.rule({"../util/assetbuilder/*", "../util/cedarish/<image>"},
           "^ docker build installer-builder^ cat ../image/cedarish.json > /dev/null && ../util/assetbuilder/build.sh image installer | tee %o",
           {"../log/docker-installer-builder.log", "<image>"})
 
-tup.rule("../util/_toolchain/go/bin/go build -o ../installer/bin/go-bindata ../vendor/github.com/jteeuwen/go-bindata/go-bindata",
+tup.rule("GO111MODULE=off ../util/_toolchain/go/bin/go build -o ../installer/bin/go-bindata ../vendor/github.com/jteeuwen/go-bindata/go-bindata",
           {"../installer/bin/go-bindata"})
 
-tup.rule("../util/_toolchain/go/bin/go build -o ../installer/app/compiler ../installer/app",
+tup.rule("GO111MODULE=off ../util/_toolchain/go/bin/go build -o ../installer/app/compiler ../installer/app",
           {"../installer/app/compiler"})
 
 tup.rule({"../installer/bin/go-bindata", "../installer/app/compiler", "../log/docker-installer-builder.log"},
@@ -27,7 +27,7 @@ vpkg = "github.com/flynn/flynn/pkg/version"
 for os, arches in pairs({darwin = {"amd64"}, freebsd = {"amd64"}, linux = {"amd64", "386"}, windows = {"amd64", "386"}}) do
   for j, arch in ipairs(arches) do
     tup.rule({"../installer/bindata.go", "tuf.go"},
-             "^c go build %o^ GOOS="..os.." GOARCH="..arch.." CGO_ENABLED=0  ../util/_toolchain/go/bin/go build -installsuffix nocgo -o %o -ldflags=\"-X "..vpkg..".commit=$GIT_COMMIT -X "..vpkg..".branch=$GIT_BRANCH -X "..vpkg..".tag=$GIT_TAG -X "..vpkg..".dirty=$GIT_DIRTY\"",
+             "^c go build %o^ GOOS="..os.." GOARCH="..arch.." CGO_ENABLED=0 GO111MODULE=off ../util/_toolchain/go/bin/go build -installsuffix nocgo -o %o -ldflags=\"-X "..vpkg..".commit=$GIT_COMMIT -X "..vpkg..".branch=$GIT_BRANCH -X "..vpkg..".tag=$GIT_TAG -X "..vpkg..".dirty=$GIT_DIRTY\"",
              {string.format("bin/flynn-%s-%s", os, arch)})
   end
 end
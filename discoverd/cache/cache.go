@@ -14,6 +14,7 @@ func New(s discoverd.Service) (*ServiceCache, error) {
 		instances: make(map[string]*discoverd.Instance),
 		stop:      make(chan struct{}),
 		done:      make(chan struct{}),
+		stale:     make(chan struct{}),
 	}
 	return d, d.start(s)
 }
@@ -28,8 +29,15 @@ type ServiceCache struct {
 	// used by the test suite
 	watchers map[chan *discoverd.Event]struct{}
 
+	// closed is set by Close so that streams connected afterwards are
+	// closed rather than leaked
+	closed bool
+
 	stop chan struct{}
 	done chan struct{}
+
+	stale     chan struct{}
+	staleOnce sync.Once
 }
 
 var connectAttempts = attempt.Strategy{
@@ -42,10 +50,28 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 	// unexpectedly (ideally the discoverd client would use a ResumingStream
 	// but service events do not yet support it).
 	var events chan *discoverd.Event
-	connect := func() (err error) {
+	connect := func() error {
+		// stop retrying once the cache is closed, leaving the loop
+		// to return
+		select {
+		case <-d.stop:
+			return nil
+		default:
+		}
 		events = make(chan *discoverd.Event)
-		d.stream, err = s.Watch(events)
-		return
+		// keep the previous stream if watching fails so that it can
+		// still be closed
+		stream, err := s.Watch(events)
+		if err != nil {
+			return err
+		}
+		d.Lock()
+		defer d.Unlock()
+		if d.closed {
+			return stream.Close()
+		}
+		d.stream = stream
+		return nil
 	}
 	if err := connect(); err != nil {
 		return err
@@ -60,6 +86,7 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 				return
 			case event, ok := <-events:
 				if !ok {
+					d.staleOnce.Do(func() { close(d.stale) })
 					if err := connectAttempts.Run(connect); err != nil {
 						once.Do(func() { current <- err })
 						return
@@ -94,9 +121,21 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 	return <-current
 }
 
+// Stale returns a channel which is closed when the cache loses its connection
+// to discoverd. The cache reconnects, but instances which went down while it
+// was disconnected are never removed, so it should be replaced with a new
+// cache.
+func (d *ServiceCache) Stale() <-chan struct{} {
+	return d.stale
+}
+
 func (d *ServiceCache) Close() error {
+	d.Lock()
+	d.closed = true
+	stream := d.stream
+	d.Unlock()
 	close(d.stop)
-	return d.stream.Close()
+	return stream.Close()
 }
 
 func (d *ServiceCache) Addrs() []string {
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultABBucketCookie is the name of the cookie storing the variant
+	// users are assigned if the A/B test has no BucketCookie
+	defaultABBucketCookie = "_ab_bucket"
+
+	// abBucketCookieMaxAge is how long users stay assigned to their
+	// variant, in seconds
+	abBucketCookieMaxAge = 365 * 24 * 60 * 60
+)
+
+// tokenPattern matches RFC 7230 tokens, such as cookie names and methods.
+// A/B test variant names are also restricted to them so that they are safe
+// cookie values.
+var tokenPattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// validateABTest checks that the route's A/B test is valid.
+func validateABTest(r *router.Route) error {
+	ab := r.ABTest
+	if ab == nil {
+		return nil
+	}
+	var msg string
+	switch {
+	case len(ab.Variants) == 0:
+		msg = "variants must be set"
+	case ab.BucketCookie != "" && !tokenPattern.MatchString(ab.BucketCookie):
+		msg = fmt.Sprintf("bucket_cookie %q is not a valid cookie name", ab.BucketCookie)
+	case r.RequestCollapsingEnabled || r.RequestFingerprintDedup || len(r.PushPaths) > 0:
+		msg = "responses can't be shared between users with request collapsing, deduplication or push paths"
+	case r.TLSPassthrough:
+		msg = "requests aren't handled by the router with TLS passthrough"
+	}
+	names := make(map[string]struct{}, len(ab.Variants))
+	for _, v := range ab.Variants {
+		if msg != "" {
+			break
+		}
+		switch {
+		case !tokenPattern.MatchString(v.Name):
+			msg = fmt.Sprintf("variant name %q must only contain letters, digits and !#$%%&'*+.^_`|~-", v.Name)
+		case v.Weight <= 0:
+			msg = fmt.Sprintf("variant %q must have a positive weight", v.Name)
+		case v.Service == "":
+			msg = fmt.Sprintf("variant %q must have a service", v.Name)
+		default:
+			if _, ok := names[v.Name]; ok {
+				msg = fmt.Sprintf("variant name %q is not unique", v.Name)
+			}
+			names[v.Name] = struct{}{}
+		}
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "A/B test invalid: " + msg,
+	}
+}
+
+// abTestColumnValues are the values of a route's A/B test columns, with the
+// variants stored as parallel arrays
+type abTestColumnValues struct {
+	Names        []string
+	Weights      []int32
+	Services     []string
+	BucketCookie string
+}
+
+// abTestColumns returns the A/B test column values to store, which are
+// empty if the route has no A/B test.
+func abTestColumns(ab *router.ABTest) abTestColumnValues {
+	var cols abTestColumnValues
+	if ab == nil {
+		return cols
+	}
+	for _, v := range ab.Variants {
+		cols.Names = append(cols.Names, v.Name)
+		cols.Weights = append(cols.Weights, int32(v.Weight))
+		cols.Services = append(cols.Services, v.Service)
+	}
+	cols.BucketCookie = ab.BucketCookie
+	return cols
+}
+
+func abTestFromColumns(cols abTestColumnValues) *router.ABTest {
+	if len(cols.Names) == 0 {
+		return nil
+	}
+	ab := &router.ABTest{BucketCookie: cols.BucketCookie}
+	for i, name := range cols.Names {
+		v := router.ABVariant{Name: name}
+		if i < len(cols.Weights) {
+			v.Weight = int(cols.Weights[i])
+		}
+		if i < len(cols.Services) {
+			v.Service = cols.Services[i]
+		}
+		ab.Variants = append(ab.Variants, v)
+	}
+	return ab
+}
+
+// abTest routes the requests of each user of a route to the service of the
+// variant they are assigned.
+type abTest struct {
+	cookie      string
+	variants    []*abVariant
+	totalWeight uint64
+}
+
+type abVariant struct {
+	router.ABVariant
+
+	service *service
+	rp      *proxy.ReverseProxy
+
+	// requests is the number of requests routed to the variant, which is
+	// shared with the previous abTest of the route if the variant existed
+	requests *int64
+}
+
+// newABTest returns an abTest for the given config, without the services
+// and proxies of its variants.
+func newABTest(config *router.ABTest) *abTest {
+	ab := &abTest{cookie: config.BucketCookie}
+	if ab.cookie == "" {
+		ab.cookie = defaultABBucketCookie
+	}
+	for _, v := range config.Variants {
+		ab.variants = append(ab.variants, &abVariant{ABVariant: v, requests: new(int64)})
+		ab.totalWeight += uint64(v.Weight)
+	}
+	return ab
+}
+
+// setABTest sets the abTest of a route, getting the services of its
+// variants. The caller must hold s.mtx.
+func (s *HTTPListener) setABTest(r *httpRoute) error {
+	ab := newABTest(r.ABTest)
+	for i, v := range ab.variants {
+		service, err := s.getService(v.Service, r.DrainBackends)
+		if err != nil {
+			for _, v := range ab.variants[:i] {
+				s.releaseService(v.service)
+			}
+			return err
+		}
+		v.service = service
+		v.rp = s.newRouteProxy(r, v.Service, service)
+	}
+	r.abTest = ab
+	return nil
+}
+
+// keepRequestCounts continues counting the requests of variants which were
+// also in prev, the A/B test of the route being replaced.
+func (ab *abTest) keepRequestCounts(prev *abTest) {
+	for _, v := range ab.variants {
+		if p := prev.variant(v.Name); p != nil {
+			v.requests = p.requests
+		}
+	}
+}
+
+// variant returns the variant with the given name, or nil if there isn't
+// one.
+func (ab *abTest) variant(name string) *abVariant {
+	for _, v := range ab.variants {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// pickVariant deterministically picks the variant of a new user identified
+// by nonce, with each variant being picked for a share of nonces
+// proportional to its weight.
+func (ab *abTest) pickVariant(nonce []byte) *abVariant {
+	h := fnv.New64a()
+	h.Write(nonce)
+	n := h.Sum64() % ab.totalWeight
+	for _, v := range ab.variants {
+		if n < uint64(v.Weight) {
+			return v
+		}
+		n -= uint64(v.Weight)
+	}
+	return ab.variants[len(ab.variants)-1]
+}
+
+// serveHTTP proxies req to the variant assigned to its user, assigning one
+// and setting the bucket cookie if it has none (or the variant it names no
+// longer exists).
+func (ab *abTest) serveHTTP(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var v *abVariant
+	if cookie, err := req.Cookie(ab.cookie); err == nil {
+		v = ab.variant(cookie.Value)
+	}
+	if v == nil {
+		v = ab.pickVariant(random.Bytes(16))
+		cookie := &http.Cookie{
+			Name:   ab.cookie,
+			Value:  v.Name,
+			Path:   "/",
+			MaxAge: abBucketCookieMaxAge,
+		}
+		w.Header().Add("Set-Cookie", cookie.String())
+	}
+	atomic.AddInt64(v.requests, 1)
+	v.rp.ServeHTTP(ctx, w, req)
+}
+
+// stats returns the request counts of the A/B test's variants.
+func (ab *abTest) stats() []router.ABVariantStats {
+	stats := make([]router.ABVariantStats, len(ab.variants))
+	for i, v := range ab.variants {
+		stats[i] = router.ABVariantStats{
+			Name:     v.Name,
+			Service:  v.Service,
+			Requests: atomic.LoadInt64(v.requests),
+		}
+	}
+	return stats
+}
+
+// ABTestStats returns the request counts of the A/B tests of the routes of a
+// domain.
+func (s *HTTPListener) ABTestStats(domain string) []*router.ABTestStats {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var stats []*router.ABTestStats
+	for _, r := range s.routes {
+		if r.abTest == nil || canonicalDomain(r.Domain) != canonicalDomain(domain) {
+			continue
+		}
+		stats = append(stats, &router.ABTestStats{
+			RouteID:  r.ID,
+			Path:     r.Path,
+			Variants: r.abTest.stats(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Path < stats[j].Path })
+	return stats
+}
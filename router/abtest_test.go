@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestABTestVariantAssignment(c *C) {
+	ab := newABTest(&router.ABTest{Variants: []router.ABVariant{
+		{Name: "a", Weight: 1, Service: "a"},
+		{Name: "b", Weight: 3, Service: "b"},
+	}})
+	c.Assert(ab.cookie, Equals, defaultABBucketCookie)
+
+	// a nonce always picks the same variant, and variants are picked in
+	// proportion to their weights
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		nonce := []byte(fmt.Sprintf("nonce-%d", i))
+		v := ab.pickVariant(nonce)
+		c.Assert(ab.pickVariant(nonce), Equals, v)
+		counts[v.Name]++
+	}
+	c.Assert(counts["a"] > 800 && counts["a"] < 1200, Equals, true, Commentf("counts = %v", counts))
+	c.Assert(counts["a"]+counts["b"], Equals, 4000)
+
+	for _, t := range []struct {
+		route *router.Route
+		msg   string
+	}{
+		{
+			route: &router.Route{ABTest: &router.ABTest{}},
+			msg:   "variants must be set",
+		},
+		{
+			route: &router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a b", Weight: 1, Service: "a"}}}},
+			msg:   "variant name \"a b\" must only contain letters, digits and !#$%&'*+.^_`|~-",
+		},
+		{
+			route: &router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Service: "a"}}}},
+			msg:   `variant "a" must have a positive weight`,
+		},
+		{
+			route: &router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Weight: 1}}}},
+			msg:   `variant "a" must have a service`,
+		},
+		{
+			route: &router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Weight: 1, Service: "a"}, {Name: "a", Weight: 1, Service: "b"}}}},
+			msg:   `variant name "a" is not unique`,
+		},
+		{
+			route: &router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Weight: 1, Service: "a"}}, BucketCookie: "a;b"}},
+			msg:   `bucket_cookie "a;b" is not a valid cookie name`,
+		},
+		{
+			route: &router.Route{RequestCollapsingEnabled: true, ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Weight: 1, Service: "a"}}}},
+			msg:   "responses can't be shared between users with request collapsing, deduplication or push paths",
+		},
+	} {
+		c.Assert(validateABTest(t.route), DeepEquals, httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "A/B test invalid: " + t.msg,
+		})
+	}
+	c.Assert(validateABTest(&router.Route{ABTest: &router.ABTest{Variants: []router.ABVariant{{Name: "a", Weight: 1, Service: "a"}}}}), IsNil)
+}
+
+func (s *S) TestABTestRouting(c *C) {
+	srvA := httptest.NewServer(httpTestHandler("a"))
+	defer srvA.Close()
+	srvB := httptest.NewServer(httpTestHandler("b"))
+	defer srvB.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		ABTest: &router.ABTest{
+			Variants: []router.ABVariant{
+				{Name: "a", Weight: 1, Service: "test-a"},
+				{Name: "b", Weight: 1, Service: "test-b"},
+			},
+			BucketCookie: "bucket",
+		},
+	}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test-a", srvA.Listener.Addr().String())()
+	defer registerFakeBackend(c, l, d, "test-b", srvB.Listener.Addr().String())()
+
+	get := func(cookie string) (string, *http.Response) {
+		req := newReq("http://"+l.Addr, "example.com")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "bucket", Value: cookie})
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(body), res
+	}
+
+	// new users are assigned a variant and served by its service
+	variant, res := get("")
+	cookies := res.Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Assert(cookies[0].Name, Equals, "bucket")
+	c.Assert(cookies[0].Value, Equals, variant)
+
+	// users keep being served by their variant's service
+	for i := 0; i < 5; i++ {
+		body, res := get(variant)
+		c.Assert(body, Equals, variant)
+		c.Assert(res.Cookies(), HasLen, 0)
+	}
+	body, _ := get("b")
+	c.Assert(body, Equals, "b")
+
+	// users assigned a variant which no longer exists get a new one
+	body, res = get("c")
+	c.Assert(res.Cookies(), HasLen, 1)
+	c.Assert(res.Cookies()[0].Value, Equals, body)
+
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/abtests/example.com/stats")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	var stats []*router.ABTestStats
+	c.Assert(json.NewDecoder(res.Body).Decode(&stats), IsNil)
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Path, Equals, "/")
+	c.Assert(stats[0].Variants, HasLen, 2)
+	var total int64
+	for _, v := range stats[0].Variants {
+		total += v.Requests
+	}
+	c.Assert(total, Equals, int64(8))
+
+	res, err = http.Get(srv.URL + "/abtests/missing.example.com/stats")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
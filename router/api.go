@@ -4,13 +4,16 @@ import (
 	"encoding/json"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/pkg/ctxhelper"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/pprof"
 	"github.com/flynn/flynn/pkg/sse"
 	"github.com/flynn/flynn/pkg/status"
+	"github.com/flynn/flynn/router/metrics"
 	"github.com/flynn/flynn/router/types"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/net/context"
@@ -36,13 +39,59 @@ func apiHandler(rtr *Router) http.Handler {
 	r.GET("/certificates/:id/routes", httphelper.WrapHandler(api.GetCertRoutes))
 	r.DELETE("/certificates/:id", httphelper.WrapHandler(api.DeleteCert))
 	r.GET("/certificates", httphelper.WrapHandler(api.GetCerts))
+	r.GET("/domains/:domain/certificate", httphelper.WrapHandler(api.GetDomainCertStatus))
+	r.GET("/domains/:domain/latency", httphelper.WrapHandler(api.GetDomainLatency))
+	r.GET("/abtests/:domain/stats", httphelper.WrapHandler(api.GetABTestStats))
 	r.GET("/events", httphelper.WrapHandler(api.StreamEvents))
-
-	r.HandlerFunc("GET", "/debug/*path", pprof.Handler.ServeHTTP)
+	r.GET("/services/:service/domains", httphelper.WrapHandler(api.GetServiceDomains))
+	r.DELETE("/services/:service/routes", httphelper.WrapHandler(api.DeleteServiceRoutes))
+	r.GET("/health/backends", httphelper.WrapHandler(api.GetBackendHealth))
+	r.GET("/health/services/:service", httphelper.WrapHandler(api.GetServiceHealth))
+	r.GET("/health/domains/:domain", httphelper.WrapHandler(api.GetDomainHealth))
+	r.GET("/health/summary", httphelper.WrapHandler(api.GetHealthSummary))
+	r.GET("/health/sync", httphelper.WrapHandler(api.GetSyncStatus))
+	r.GET("/health/stream", httphelper.WrapHandler(api.StreamBackendHealth))
+	r.GET("/sync/routes", httphelper.WrapHandler(api.GetRouteChanges))
+
+	r.Handler("GET", "/metrics", metrics.Handler)
+	r.HandlerFunc("GET", "/debug/*path", api.ServeDebug)
 
 	return httphelper.ContextInjector("router", httphelper.NewRequestLogger(r))
 }
 
+// ServeDebug serves the connection journal at /debug/connections, and
+// otherwise the pprof handlers, which share the /debug prefix.
+func (api *API) ServeDebug(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/debug/connections" {
+		pprof.Handler.ServeHTTP(w, req)
+		return
+	}
+	l := api.router.HTTP.(*HTTPListener)
+	if l.journal == nil {
+		httphelper.ObjectNotFoundError(w, "connection journal is not enabled")
+		return
+	}
+	var n int
+	if s := req.URL.Query().Get("count"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			httphelper.ValidationError(w, "count", "must be a positive integer")
+			return
+		}
+	}
+	httphelper.JSON(w, 200, l.ConnectionJournal(n))
+}
+
+// readOnlyError responds to a request to modify the routes of a read-only
+// router
+func readOnlyError(w http.ResponseWriter) {
+	httphelper.Error(w, httphelper.JSONError{
+		Code:    httphelper.PreconditionFailedErrorCode,
+		Message: "Router is read-only",
+	})
+}
+
 func (api *API) CreateRoute(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	log, _ := ctxhelper.LoggerFromContext(ctx)
 
@@ -75,6 +124,9 @@ func (api *API) CreateRoute(ctx context.Context, w http.ResponseWriter, req *htt
 		case ErrInvalid:
 			jsonError.Code = httphelper.ValidationErrorCode
 			jsonError.Message = "Invalid route"
+		case ErrReadOnly:
+			readOnlyError(w)
+			return
 		default:
 			log.Error(err.Error())
 			httphelper.Error(w, err)
@@ -83,7 +135,7 @@ func (api *API) CreateRoute(ctx context.Context, w http.ResponseWriter, req *htt
 		httphelper.Error(w, jsonError)
 		return
 	}
-	httphelper.JSON(w, 200, route)
+	httphelper.JSON(w, 200, redactRoute(route))
 }
 
 func (api *API) UpdateRoute(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -111,11 +163,111 @@ func (api *API) UpdateRoute(ctx context.Context, w http.ResponseWriter, req *htt
 			w.WriteHeader(404)
 			return
 		}
+		if err == ErrReadOnly {
+			readOnlyError(w)
+			return
+		}
 		log.Error(err.Error())
 		httphelper.Error(w, err)
 		return
 	}
-	httphelper.JSON(w, 200, route)
+	httphelper.JSON(w, 200, redactRoute(route))
+}
+
+// redactRoute returns a copy of the route without its write-only secrets,
+// or the route itself if it has none.
+func redactRoute(r *router.Route) *router.Route {
+	if r == nil || (r.ResponseSigningKey == "" && (r.VaultServiceAuth == nil || r.VaultServiceAuth.SecretID == "") &&
+		(r.BasicAuth == nil || r.BasicAuth.PasswordHash == "")) {
+		return r
+	}
+	redacted := *r
+	if r.ResponseSigningKey != "" {
+		redacted.ResponseSigningKey = router.RedactedSecret
+	}
+	if r.BasicAuth != nil && r.BasicAuth.PasswordHash != "" {
+		auth := *r.BasicAuth
+		auth.PasswordHash = router.RedactedSecret
+		redacted.BasicAuth = &auth
+	}
+	if r.VaultServiceAuth != nil {
+		vault := *r.VaultServiceAuth
+		vault.SecretID = ""
+		redacted.VaultServiceAuth = &vault
+	}
+	return &redacted
+}
+
+// redactPrivateKeys returns a copy of r without the private key of its
+// certificate if it has one, otherwise r is returned.
+func redactPrivateKeys(r *router.Route) *router.Route {
+	if r == nil || (r.LegacyTLSKey == "" && (r.Certificate == nil || r.Certificate.Key == "")) {
+		return r
+	}
+	redacted := *r
+	redacted.LegacyTLSKey = ""
+	if r.Certificate != nil {
+		cert := *r.Certificate
+		cert.Key = ""
+		redacted.Certificate = &cert
+	}
+	return &redacted
+}
+
+// keepPrivateKeys sets the private key of r's certificate, which is redacted
+// by redactPrivateKeys, to that of the existing route if the certificate
+// hasn't changed.
+func keepPrivateKeys(r, existing *router.Route) {
+	if existing == nil {
+		return
+	}
+	if r.LegacyTLSCert != "" && r.LegacyTLSKey == "" && r.LegacyTLSCert == existing.LegacyTLSCert {
+		r.LegacyTLSKey = existing.LegacyTLSKey
+	}
+	if r.Certificate != nil && r.Certificate.Key == "" && existing.Certificate != nil &&
+		r.Certificate.Cert == existing.Certificate.Cert {
+		cert := *r.Certificate
+		cert.Key = existing.Certificate.Key
+		r.Certificate = &cert
+	}
+}
+
+// keepSecrets sets the write-only secrets which r is missing or has
+// redacted to those of the existing route, which is nil if there is none,
+// so that redacted routes returned by the API, pulled from peers or loaded
+// from snapshots can be saved as they are.
+func keepSecrets(r, existing *router.Route) {
+	if r.ResponseSigningKey == router.RedactedSecret {
+		r.ResponseSigningKey = ""
+		if existing != nil {
+			r.ResponseSigningKey = existing.ResponseSigningKey
+		}
+	}
+	if r.BasicAuth != nil && r.BasicAuth.PasswordHash == router.RedactedSecret {
+		auth := *r.BasicAuth
+		auth.PasswordHash = ""
+		if existing != nil && existing.BasicAuth != nil {
+			auth.PasswordHash = existing.BasicAuth.PasswordHash
+		}
+		r.BasicAuth = &auth
+	}
+	if existing == nil {
+		return
+	}
+	if r.VaultServiceAuth != nil && r.VaultServiceAuth.SecretID == "" && existing.VaultServiceAuth != nil &&
+		r.VaultServiceAuth.VaultAddr == existing.VaultServiceAuth.VaultAddr && r.VaultServiceAuth.RoleID == existing.VaultServiceAuth.RoleID {
+		vault := *r.VaultServiceAuth
+		vault.SecretID = existing.VaultServiceAuth.SecretID
+		r.VaultServiceAuth = &vault
+	}
+}
+
+func redactRoutes(routes []*router.Route) []*router.Route {
+	redacted := make([]*router.Route, len(routes))
+	for i, r := range routes {
+		redacted[i] = redactRoute(r)
+	}
+	return redacted
 }
 
 type sortedRoutes []*router.Route
@@ -152,7 +304,7 @@ func (api *API) GetRoutes(ctx context.Context, w http.ResponseWriter, req *http.
 	}
 
 	sort.Sort(sortedRoutes(routes))
-	httphelper.JSON(w, 200, routes)
+	httphelper.JSON(w, 200, redactRoutes(routes))
 }
 
 func (api *API) GetRoute(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -176,7 +328,7 @@ func (api *API) GetRoute(ctx context.Context, w http.ResponseWriter, req *http.R
 		return
 	}
 
-	httphelper.JSON(w, 200, route)
+	httphelper.JSON(w, 200, redactRoute(route))
 }
 
 func (api *API) DeleteRoute(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -201,6 +353,9 @@ func (api *API) DeleteRoute(ctx context.Context, w http.ResponseWriter, req *htt
 				Message: "Route has dependent routes",
 			})
 			return
+		case ErrReadOnly:
+			readOnlyError(w)
+			return
 		default:
 			log.Error(err.Error())
 			httphelper.Error(w, err)
@@ -210,6 +365,41 @@ func (api *API) DeleteRoute(ctx context.Context, w http.ResponseWriter, req *htt
 	w.WriteHeader(200)
 }
 
+func (api *API) GetServiceDomains(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.DomainsForService(params.ByName("service")))
+}
+
+// DeleteServiceRoutes removes all the HTTP routes of a service, responding
+// with a 500 and the domains which were removed if only some of them could
+// be.
+func (api *API) DeleteServiceRoutes(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log, _ := ctxhelper.LoggerFromContext(ctx)
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	service := params.ByName("service")
+	removed, err := l.RemoveService(service)
+	res := &router.RemovedService{Service: service, Domains: removed}
+	if err != nil {
+		switch err {
+		case ErrReadOnly:
+			readOnlyError(w)
+			return
+		case ErrClosed:
+			httphelper.Error(w, err)
+			return
+		}
+		log.Error(err.Error())
+		res.Error = err.Error()
+		httphelper.JSON(w, 500, res)
+		return
+	}
+	httphelper.JSON(w, 200, res)
+}
+
 func (api *API) CreateCert(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var cert *router.Certificate
 	if err := json.NewDecoder(req.Body).Decode(&cert); err != nil {
@@ -228,6 +418,9 @@ func (api *API) CreateCert(ctx context.Context, w http.ResponseWriter, req *http
 		case ErrInvalid:
 			jsonError.Code = httphelper.ValidationErrorCode
 			jsonError.Message = "Invalid cert"
+		case ErrReadOnly:
+			readOnlyError(w)
+			return
 		default:
 			httphelper.Error(w, err)
 			return
@@ -236,6 +429,38 @@ func (api *API) CreateCert(ctx context.Context, w http.ResponseWriter, req *http
 	httphelper.JSON(w, 200, cert)
 }
 
+// defaultLatencyWindow is the window latencies are returned for if not given
+const defaultLatencyWindow = time.Minute
+
+func (api *API) GetDomainLatency(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	window := defaultLatencyWindow
+	if s := req.URL.Query().Get("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil || window <= 0 {
+			httphelper.ValidationError(w, "window", "must be a positive duration")
+			return
+		}
+	}
+
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.LatencyPercentiles(params.ByName("domain"), window))
+}
+
+func (api *API) GetABTestStats(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	stats := l.ABTestStats(params.ByName("domain"))
+	if len(stats) == 0 {
+		httphelper.ObjectNotFoundError(w, "domain has no A/B tests")
+		return
+	}
+	httphelper.JSON(w, 200, stats)
+}
+
 func (api *API) GetCert(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	params, _ := ctxhelper.ParamsFromContext(ctx)
 
@@ -262,7 +487,7 @@ func (api *API) GetCertRoutes(ctx context.Context, w http.ResponseWriter, req *h
 		httphelper.Error(w, err)
 		return
 	}
-	httphelper.JSON(w, 200, routes)
+	httphelper.JSON(w, 200, redactRoutes(routes))
 }
 
 func (api *API) GetCerts(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -285,6 +510,9 @@ func (api *API) DeleteCert(ctx context.Context, w http.ResponseWriter, req *http
 		case ErrNotFound:
 			httphelper.ObjectNotFoundError(w, "certificate not found")
 			return
+		case ErrReadOnly:
+			readOnlyError(w)
+			return
 		default:
 			httphelper.Error(w, err)
 			return
@@ -293,6 +521,12 @@ func (api *API) DeleteCert(ctx context.Context, w http.ResponseWriter, req *http
 	w.WriteHeader(200)
 }
 
+// streamWatchOptions are used to watch the events streamed by the API. They
+// buffer as many events as are kept for replay so that slow clients don't
+// hold up other watchers, dropping the oldest events if the buffer fills,
+// which clients detect by gaps in the events' sequence numbers.
+var streamWatchOptions = WatchOptions{Policy: BackpressureDropOldest, BufferSize: eventBufferSize}
+
 func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	log, _ := ctxhelper.LoggerFromContext(ctx)
 
@@ -302,8 +536,8 @@ func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *ht
 	httpEvents := make(chan *router.Event)
 	tcpEvents := make(chan *router.Event)
 	sseEvents := make(chan *router.StreamEvent)
-	go httpListener.Watch(httpEvents, true)
-	go tcpListener.Watch(tcpEvents, true)
+	go httpListener.WatchWithOptions(httpEvents, true, streamWatchOptions)
+	go tcpListener.WatchWithOptions(tcpEvents, true, streamWatchOptions)
 	defer httpListener.Unwatch(httpEvents)
 	defer tcpListener.Unwatch(tcpEvents)
 
@@ -323,10 +557,13 @@ func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *ht
 				continue
 			}
 			sseEvents <- &router.StreamEvent{
-				Event:   e.Event,
-				Route:   e.Route,
-				Backend: e.Backend,
-				Error:   e.Error,
+				Event:     e.Event,
+				Route:     redactRoute(e.Route),
+				Backend:   e.Backend,
+				Error:     e.Error,
+				Timestamp: e.Timestamp,
+				Sequence:  e.Sequence,
+				Metadata:  e.Metadata,
 			}
 		}
 	}
@@ -334,3 +571,137 @@ func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *ht
 	go sendEvents(tcpEvents)
 	sse.ServeStream(w, sseEvents, log)
 }
+
+func (api *API) GetBackendHealth(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.BackendHealth())
+}
+
+// StreamBackendHealth streams an event each time the health of a backend of
+// an HTTP route changes, as server-sent events.
+func (api *API) StreamBackendHealth(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log, _ := ctxhelper.LoggerFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	events := make(chan *router.Event)
+	l.WatchWithOptions(events, false, streamWatchOptions)
+	defer l.Unwatch(events)
+
+	sseEvents := make(chan *router.StreamEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var e *router.Event
+			select {
+			case e = <-events:
+			case <-done:
+				return
+			}
+			if e == nil {
+				return
+			}
+			if e.Event != router.EventTypeBackendHealthy && e.Event != router.EventTypeBackendUnhealthy {
+				continue
+			}
+			select {
+			case sseEvents <- &router.StreamEvent{
+				Event:     e.Event,
+				Backend:   e.Backend,
+				Timestamp: e.Timestamp,
+				Sequence:  e.Sequence,
+				Metadata:  e.Metadata,
+			}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	sse.ServeStream(w, sseEvents, log)
+}
+
+func (api *API) GetServiceHealth(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	health, err := l.ServiceHealth(params.ByName("service"))
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "service not found")
+		return
+	}
+	httphelper.JSON(w, 200, health)
+}
+
+func (api *API) GetDomainHealth(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	health, err := l.DomainHealth(params.ByName("domain"))
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "domain not found")
+		return
+	}
+	httphelper.JSON(w, 200, health)
+}
+
+func (api *API) GetHealthSummary(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.HealthSummary())
+}
+
+func (api *API) GetSyncStatus(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.SyncStatus())
+}
+
+// GetRouteChanges returns the changes to the HTTP routes since the position
+// in the change log of the listener instance given by the instance and since
+// query parameters, which peers pull while they can't sync with the data
+// store. Pulls must be signed with the listener's PeerDiscovery.SyncKey and
+// give the instance ID of the peer as the peer query parameter. Changes are
+// pulled over cleartext HTTP/2, so the private keys of certificates are
+// redacted.
+func (api *API) GetRouteChanges(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	l := api.router.HTTP.(*HTTPListener)
+	if !verifyPeerRequest(req, l.PeerDiscovery.SyncKey, time.Now()) {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.UnauthorizedErrorCode,
+			Message: "invalid peer sync signature",
+		})
+		return
+	}
+	query := req.URL.Query()
+	peer := query.Get("peer")
+	if peer == "" {
+		httphelper.ValidationError(w, "peer", "must be set")
+		return
+	}
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			httphelper.ValidationError(w, "since", "must be a non-negative integer")
+			return
+		}
+	}
+	changes := l.RouteChanges(peer, query.Get("instance"), since)
+	for i, change := range changes.Changes {
+		redacted := *change
+		redacted.Route = redactPrivateKeys(redactRoute(change.Route))
+		changes.Changes[i] = &redacted
+	}
+	httphelper.JSON(w, 200, changes)
+}
+
+func (api *API) GetDomainCertStatus(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	cert, err := l.CertInfo(params.ByName("domain"))
+	if err == ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "certificate not found")
+		return
+	}
+	httphelper.JSON(w, 200, cert)
+}
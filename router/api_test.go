@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/discoverd/testutil"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
 	. "github.com/flynn/go-check"
@@ -176,6 +177,38 @@ func (s *S) TestAPISetTCPRoute(c *C) {
 	c.Assert(r.Service, Equals, "bar")
 }
 
+func (s *S) TestAPIReadOnly(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	httpRoute := router.HTTPRoute{Domain: "readonly.example.com", Service: "foo"}.ToRoute()
+	c.Assert(srv.CreateRoute(httpRoute), IsNil)
+	tcpRoute := router.TCPRoute{Service: "foo"}.ToRoute()
+	c.Assert(srv.CreateRoute(tcpRoute), IsNil)
+
+	srv.listeners[0].(*HTTPListener).ReadOnly = true
+	srv.listeners[1].(*TCPListener).ReadOnly = true
+
+	// routes can still be read
+	r, err := srv.GetRoute("http", httpRoute.ID)
+	c.Assert(err, IsNil)
+	c.Assert(r.Service, Equals, "foo")
+
+	// but not modified
+	assertReadOnly := func(err error) {
+		c.Assert(err, NotNil)
+		c.Assert(httphelper.IsPreconditionFailedError(err), Equals, true, Commentf("err = %s", err))
+	}
+	assertReadOnly(srv.CreateRoute(router.HTTPRoute{Domain: "readonly.example.net", Service: "foo"}.ToRoute()))
+	assertReadOnly(srv.CreateRoute(router.TCPRoute{Service: "foo"}.ToRoute()))
+	httpRoute.Service = "bar"
+	assertReadOnly(srv.UpdateRoute(httpRoute))
+	assertReadOnly(srv.DeleteRoute("http", httpRoute.ID))
+	assertReadOnly(srv.DeleteRoute("tcp", tcpRoute.ID))
+	cert := tlsConfigForDomain("readonly.example.com")
+	assertReadOnly(srv.CreateCert(&router.Certificate{Cert: cert.Cert, Key: cert.PrivateKey}))
+}
+
 func (s *S) TestAPIListRoutes(c *C) {
 	srv := s.newTestAPIServer(c)
 	defer srv.Close()
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+// basic auth password hashes have the form
+// "pbkdf2-sha256:<iterations>:<salt>:<digest>" where salt and digest are hex
+// encoded. golang.org/x/crypto/bcrypt isn't vendored, so passwords are
+// stretched with PBKDF2 (RFC 8018) using enough iterations that a leaked
+// route table can't be cheaply brute-forced.
+const (
+	passwordHashPrefix     = "pbkdf2-sha256:"
+	passwordHashIterations = 100000
+	// maxPasswordHashIterations stops a route's password_hash making
+	// each request arbitrarily expensive to authenticate
+	maxPasswordHashIterations = 10 * passwordHashIterations
+	passwordSaltSize          = 16
+)
+
+// stretching a password is expensive, so each client can only have its
+// credentials checked basicAuthAttemptsPerSecond times a second (with bursts
+// of basicAuthAttemptBurst), and successful checks are cached for
+// basicAuthCacheTTL so that authenticated clients aren't limited
+const (
+	basicAuthAttemptsPerSecond = 1
+	basicAuthAttemptBurst      = 10
+	basicAuthCacheTTL          = 5 * time.Minute
+	basicAuthCacheSize         = 1000
+)
+
+var basicAuthRateLimitedRequests = metrics.NewCounter(
+	"strowger_basic_auth_rate_limited_requests_total",
+	"Number of requests rejected because the client checked too many basic auth credentials.",
+)
+
+func invalidBasicAuth(msg string) error {
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Basic auth invalid: " + msg,
+	}
+}
+
+// hashBasicAuthPassword validates the given credentials and replaces any
+// plaintext password with a salted hash so that it is never stored.
+func hashBasicAuthPassword(auth *router.BasicAuth) error {
+	if auth == nil {
+		return nil
+	}
+	if auth.Username == "" {
+		return invalidBasicAuth("username must be set")
+	}
+	if strings.Contains(auth.Username, ":") {
+		return invalidBasicAuth("username must not contain a colon")
+	}
+	if auth.Password != "" {
+		var salt [passwordSaltSize]byte
+		if _, err := rand.Read(salt[:]); err != nil {
+			return err
+		}
+		auth.PasswordHash = hashPassword(salt[:], auth.Password)
+		auth.Password = ""
+		return nil
+	}
+	if _, _, _, ok := parsePasswordHash(auth.PasswordHash); !ok {
+		return invalidBasicAuth("either password or a valid password_hash must be set")
+	}
+	return nil
+}
+
+func hashPassword(salt []byte, password string) string {
+	digest := pbkdf2SHA256([]byte(password), salt, passwordHashIterations)
+	return fmt.Sprintf("%s%d:%s:%s", passwordHashPrefix, passwordHashIterations, hex.EncodeToString(salt), hex.EncodeToString(digest))
+}
+
+// pbkdf2SHA256 derives a single block key from password using PBKDF2 with
+// HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func parsePasswordHash(hash string) (iterations int, salt, digest []byte, ok bool) {
+	if !strings.HasPrefix(hash, passwordHashPrefix) {
+		return 0, nil, nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(hash, passwordHashPrefix), ":")
+	if len(parts) != 3 {
+		return 0, nil, nil, false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < passwordHashIterations || iterations > maxPasswordHashIterations {
+		return 0, nil, nil, false
+	}
+	salt, err = hex.DecodeString(parts[1])
+	if err != nil || len(salt) == 0 {
+		return 0, nil, nil, false
+	}
+	digest, err = hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha256.Size {
+		return 0, nil, nil, false
+	}
+	return iterations, salt, digest, true
+}
+
+func basicAuthColumns(auth *router.BasicAuth) (username, passwordHash string) {
+	if auth == nil {
+		return "", ""
+	}
+	return auth.Username, auth.PasswordHash
+}
+
+func basicAuthFromColumns(username, passwordHash string) *router.BasicAuth {
+	if username == "" && passwordHash == "" {
+		return nil
+	}
+	return &router.BasicAuth{Username: username, PasswordHash: passwordHash}
+}
+
+// checkBasicAuth returns whether the request contains credentials matching
+// auth.
+func checkBasicAuth(auth *router.BasicAuth, req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	iterations, salt, digest, ok := parsePasswordHash(auth.PasswordHash)
+	if !ok {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), digest) == 1
+	return usernameOK && passwordOK
+}
+
+// basicAuthChecker checks the basic auth credentials of requests to a route,
+// caching successful checks and limiting the rate at which each client can
+// have credentials checked.
+type basicAuthChecker struct {
+	auth     *router.BasicAuth
+	attempts *clientRateLimiter
+
+	// key is the HMAC key the cache is keyed with, so that the cache
+	// doesn't hold the credentials themselves
+	key [32]byte
+
+	mtx      sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newBasicAuthChecker(auth *router.BasicAuth) (*basicAuthChecker, error) {
+	a := &basicAuthChecker{
+		auth: auth,
+		attempts: &clientRateLimiter{
+			rate:    basicAuthAttemptsPerSecond,
+			burst:   basicAuthAttemptBurst,
+			max:     defaultMaxTrackedClients,
+			clients: make(map[string]*list.Element),
+			lru:     list.New(),
+		},
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	if _, err := rand.Read(a.key[:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// check returns whether req contains credentials matching the route's, or
+// how long until the client with the given IP can have its credentials
+// checked if it has checked too many.
+func (a *basicAuthChecker) check(req *http.Request, ip string, now time.Time) (bool, time.Duration) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false, 0
+	}
+	mac := hmac.New(sha256.New, a.key[:])
+	// usernames can't contain a colon
+	mac.Write([]byte(username + ":" + password))
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+
+	a.mtx.Lock()
+	expires, ok := a.verified[key]
+	a.mtx.Unlock()
+	if ok && now.Before(expires) {
+		return true, 0
+	}
+
+	if ok, wait := a.attempts.allow(ip, now); !ok {
+		return false, wait
+	}
+	if !checkBasicAuth(a.auth, req) {
+		return false, 0
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.verified) >= basicAuthCacheSize {
+		for k, expires := range a.verified {
+			if !now.Before(expires) {
+				delete(a.verified, k)
+			}
+		}
+		if len(a.verified) >= basicAuthCacheSize {
+			a.verified = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	a.verified[key] = now.Add(basicAuthCacheTTL)
+	return true, 0
+}
+
+// equal returns whether a and other check the same credentials.
+func (a *basicAuthChecker) equal(other *basicAuthChecker) bool {
+	return a.auth.Username == other.auth.Username && a.auth.PasswordHash == other.auth.PasswordHash
+}
+
+// requireBasicAuth challenges the client for credentials
+func requireBasicAuth(w http.ResponseWriter, realm string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(realm, `"`, "", -1)+`"`)
+	fail(w, http.StatusUnauthorized)
+}
+
+// checkBasicAuth responds with a 401, or a 429 if the client has checked
+// too many credentials, and returns false unless req has the route's basic
+// auth credentials.
+func (r *httpRoute) checkBasicAuth(w http.ResponseWriter, req *http.Request) bool {
+	ok, wait := r.basicAuth.check(req, r.config().clientIP(req), time.Now())
+	if ok {
+		return true
+	}
+	if wait > 0 {
+		basicAuthRateLimitedRequests.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		fail(w, http.StatusTooManyRequests)
+		return false
+	}
+	requireBasicAuth(w, r.Domain)
+	return false
+}
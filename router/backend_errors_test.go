@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestBackendErrorStatus(c *C) {
+	// a listener which is closed gives an address which fails to dial
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	// a backend which closes the connection without responding
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer broken.Close()
+
+	for _, t := range []struct {
+		name     string
+		backends []string
+		status   int
+	}{
+		{"no backends", nil, http.StatusServiceUnavailable},
+		{"dial failed", []string{closedAddr}, http.StatusServiceUnavailable},
+		{"protocol error", []string{broken.Listener.Addr().String()}, http.StatusBadGateway},
+	} {
+		backends := t.backends
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+		r.rp = proxy.NewReverseProxy(func() []string { return backends }, &[32]byte{}, false, &service{}, logger)
+
+		var handlerStatus int
+		r.rp.ErrorHandler = func(ctx context.Context, w http.ResponseWriter, req *http.Request, status int) {
+			handlerStatus = status
+			fail(w, status)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, t.status, Commentf(t.name))
+		c.Assert(handlerStatus, Equals, t.status, Commentf(t.name))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// backupTimeFormat is the format of the timestamp in backup keys, which
+// sorts lexically in time order
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+var errBackupNotConfigured = errors.New("router: backups are not configured")
+
+// BackupConfig configures periodic backups of the routing table to an
+// S3-compatible object store.
+type BackupConfig struct {
+	// S3Endpoint is the URL of the object store, defaulting to AWS S3 if empty
+	S3Endpoint string
+	S3Region   string
+	S3Bucket   string
+	// S3KeyPrefix is prepended to the key of each backup
+	S3KeyPrefix string
+
+	// S3AccessKeyID and S3SecretAccessKey are the credentials used to access
+	// the bucket, the default AWS credential chain is used if they are empty
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	// BackupInterval is how often backups are taken, backups are only
+	// taken periodically if it is non-zero
+	BackupInterval time.Duration
+}
+
+func (c BackupConfig) enabled() bool {
+	return c.S3Bucket != ""
+}
+
+func (c BackupConfig) client() s3iface.S3API {
+	config := aws.NewConfig()
+	if c.S3Endpoint != "" {
+		// most S3-compatible stores don't support virtual hosted buckets
+		config.WithEndpoint(c.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	region := c.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	config.WithRegion(region)
+	if c.S3AccessKeyID != "" {
+		config.WithCredentials(credentials.NewStaticCredentials(c.S3AccessKeyID, c.S3SecretAccessKey, ""))
+	}
+	return s3.New(session.New(config))
+}
+
+// RouteSnapshot is a point in time copy of the routing table.
+type RouteSnapshot struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Routes    []*router.Route `json:"routes"`
+}
+
+// Snapshot returns a copy of all the routes in the data store, including
+// their certificates but not their write-only secrets.
+func (s *HTTPListener) Snapshot() (*RouteSnapshot, error) {
+	routes, err := s.ds.List()
+	if err != nil {
+		return nil, err
+	}
+	return &RouteSnapshot{CreatedAt: time.Now().UTC(), Routes: redactRoutes(routes)}, nil
+}
+
+// LoadSnapshot updates the routes in the snapshot which still exist and adds
+// those which don't, skipping any that conflict with existing routes.
+func (s *HTTPListener) LoadSnapshot(snapshot *RouteSnapshot) error {
+	for _, r := range snapshot.Routes {
+		_, err := s.ds.Get(r.ID)
+		switch err {
+		case nil:
+			err = s.UpdateRoute(r)
+		case ErrNotFound:
+			err = s.AddRoute(r)
+			if err == ErrConflict {
+				logger.Info("skipping conflicting route from snapshot", "route.id", r.ID, "route.domain", r.Domain, "route.path", r.Path, "route.port", r.Port)
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("router: error loading route %s from snapshot: %s", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *HTTPListener) runBackups(ctx context.Context) {
+	ticker := time.NewTicker(s.BackupConfig.BackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			key, err := s.Backup()
+			if err != nil {
+				logger.Error("error backing up routes", "err", err)
+				continue
+			}
+			logger.Info("backed up routes", "key", key)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Backup uploads a snapshot of the routing table to the configured bucket,
+// returning the key of the backup.
+func (s *HTTPListener) Backup() (string, error) {
+	if s.s3 == nil {
+		return "", errBackupNotConfigured
+	}
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	key := path.Join(s.BackupConfig.S3KeyPrefix, fmt.Sprintf("routes-%s.json", snapshot.CreatedAt.Format(backupTimeFormat)))
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:      &s.BackupConfig.S3Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return key, err
+}
+
+// RestoreFromBackup downloads the backup with the given key and loads it
+// using LoadSnapshot.
+func (s *HTTPListener) RestoreFromBackup(ctx context.Context, key string) error {
+	if s.s3 == nil {
+		return errBackupNotConfigured
+	}
+	req, res := s.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: &s.BackupConfig.S3Bucket,
+		Key:    &key,
+	})
+	req.HTTPRequest.Cancel = ctx.Done()
+	if err := req.Send(); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	snapshot := &RouteSnapshot{}
+	if err := json.NewDecoder(res.Body).Decode(snapshot); err != nil {
+		return fmt.Errorf("router: error decoding backup %s: %s", key, err)
+	}
+	return s.LoadSnapshot(snapshot)
+}
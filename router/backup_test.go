@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// fakeS3 is a minimal S3-compatible object store which supports putting and
+// getting objects using path style requests.
+type fakeS3 struct {
+	mtx     sync.Mutex
+	objects map[string][]byte
+	puts    chan string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		puts:    make(chan string, 10),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch req.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		f.objects[req.URL.Path] = data
+		select {
+		case f.puts <- req.URL.Path:
+		default:
+		}
+	case "GET":
+		data, ok := f.objects[req.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(404)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			return
+		}
+		w.Write(data)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *S) newBackupHTTPListener(c *C, interval time.Duration) (*HTTPListener, *fakeS3, func()) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+
+	l := s.buildHTTPListener(c)
+	l.BackupConfig = BackupConfig{
+		S3Endpoint:        srv.URL,
+		S3Bucket:          "backups",
+		S3KeyPrefix:       "router",
+		S3AccessKeyID:     "id",
+		S3SecretAccessKey: "secret",
+		BackupInterval:    interval,
+	}
+	if err := l.Start(); err != nil {
+		srv.Close()
+		c.Fatal(err)
+	}
+	return l, fake, func() {
+		l.Close()
+		srv.Close()
+	}
+}
+
+func (s *S) TestBackupAndRestore(c *C) {
+	l, fake, cleanup := s.newBackupHTTPListener(c, 0)
+	defer cleanup()
+
+	r := addRoute(c, l, router.HTTPRoute{
+		Domain:  "backup.example.com",
+		Service: "test",
+	}.ToRoute())
+
+	key, err := l.Backup()
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(key, "router/routes-"), Equals, true)
+	c.Assert(strings.HasSuffix(key, ".json"), Equals, true)
+	c.Assert(<-fake.puts, Equals, "/backups/"+key)
+
+	removeRoute(c, l, r.ID)
+	routes, err := l.ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 0)
+
+	c.Assert(l.RestoreFromBackup(context.Background(), key), IsNil)
+	routes, err = l.ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Domain, Equals, "backup.example.com")
+	c.Assert(routes[0].Service, Equals, "test")
+
+	// restoring again should not duplicate the route
+	c.Assert(l.RestoreFromBackup(context.Background(), key), IsNil)
+	routes, err = l.ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+
+	// restoring a missing backup is an error
+	c.Assert(l.RestoreFromBackup(context.Background(), "router/missing.json"), NotNil)
+}
+
+func (s *S) TestPeriodicBackup(c *C) {
+	l, fake, cleanup := s.newBackupHTTPListener(c, 10*time.Millisecond)
+	defer cleanup()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "backup.example.com",
+		Service: "test",
+	}.ToRoute())
+
+	select {
+	case key := <-fake.puts:
+		c.Assert(strings.HasPrefix(key, "/backups/router/routes-"), Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for backup")
+	}
+}
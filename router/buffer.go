@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultMaxBufferedRequestBytes is the maximum size of buffered request
+// bodies if the listener config doesn't specify one
+const defaultMaxBufferedRequestBytes = 10 << 20
+
+// validateRequestBuffering checks that the route doesn't both buffer request
+// bodies and forward trailers, which are only sent with chunked bodies.
+func validateRequestBuffering(r *router.Route) error {
+	if r.BufferFullRequestBody && r.ForwardTrailers {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Request buffering invalid: trailers can't be forwarded with buffered request bodies",
+		}
+	}
+	return nil
+}
+
+// maxBufferedRequestBytes returns the maximum size of request bodies which
+// the route buffers.
+func (r *httpRoute) maxBufferedRequestBytes() int64 {
+	if r.config != nil {
+		if max := r.config().MaxBufferedRequestBytes; max > 0 {
+			return max
+		}
+	}
+	return defaultMaxBufferedRequestBytes
+}
+
+// bufferRequestBody reads the whole body of req into memory so that it can be
+// sent to the backend with a Content-Length header rather than chunked. It
+// writes an error response and returns false if the body is too large or
+// can't be read.
+func (r *httpRoute) bufferRequestBody(w http.ResponseWriter, req *http.Request) bool {
+	return bufferBody(w, req, r.maxBufferedRequestBytes())
+}
+
+// bufferBody replaces the body of req with one read into memory which can be
+// replayed using req.GetBody, writing an error response and returning false
+// if it is larger than max or can't be read.
+func bufferBody(w http.ResponseWriter, req *http.Request, max int64) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.ContentLength > max {
+		fail(w, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	var buf bytes.Buffer
+	if req.ContentLength > 0 {
+		buf.Grow(int(req.ContentLength))
+	}
+	n, err := io.Copy(&buf, io.LimitReader(req.Body, max+1))
+	req.Body.Close()
+	if err != nil {
+		fail(w, http.StatusBadRequest)
+		return false
+	}
+	if n > max {
+		fail(w, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	// an outgoing request with a body and zero ContentLength is sent
+	// chunked, so use NoBody for empty bodies
+	req.Body = http.NoBody
+	req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+	if n > 0 {
+		body := buf.Bytes()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		// allow the body to be replayed when retrying the request
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	req.ContentLength = n
+	req.TransferEncoding = nil
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestBufferFullRequestBody(c *C) {
+	type backendRequest struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+	requests := make(chan *backendRequest, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- &backendRequest{req.ContentLength, req.TransferEncoding, string(body)}
+	}))
+	defer backend.Close()
+
+	config := &ListenerConfig{MaxBufferedRequestBytes: 1 << 20}
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{
+			Domain:                "example.com",
+			Service:               "test",
+			BufferFullRequestBody: true,
+		},
+		config: func() *ListenerConfig { return config },
+	}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	// newChunkedRequest returns a request whose body has an unknown length,
+	// as if it were sent chunked by the client
+	newChunkedRequest := func(size int) *http.Request {
+		body := strings.Repeat("a", size)
+		req := httptest.NewRequest("POST", "http://example.com/upload", ioutil.NopCloser(strings.NewReader(body)))
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		return req
+	}
+
+	size := 512 << 10
+	w := newCloseNotifyRecorder()
+	r.ServeHTTP(context.Background(), w, newChunkedRequest(size))
+	c.Assert(w.Code, Equals, 200)
+	got := <-requests
+	c.Assert(got.contentLength, Equals, int64(size))
+	c.Assert(got.transferEncoding, HasLen, 0)
+	c.Assert(got.body, HasLen, size)
+
+	// bodies larger than the limit are rejected without reaching the backend
+	w = newCloseNotifyRecorder()
+	r.ServeHTTP(context.Background(), w, newChunkedRequest(2<<20))
+	c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge)
+	req := httptest.NewRequest("POST", "http://example.com/upload", io.LimitReader(zeroReader{}, 2<<20))
+	req.ContentLength = 2 << 20
+	w = newCloseNotifyRecorder()
+	r.ServeHTTP(context.Background(), w, req)
+	c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(requests, HasLen, 0)
+
+	// empty bodies are sent with a zero Content-Length
+	w = newCloseNotifyRecorder()
+	r.ServeHTTP(context.Background(), w, newChunkedRequest(0))
+	c.Assert(w.Code, Equals, 200)
+	got = <-requests
+	c.Assert(got.contentLength, Equals, int64(0))
+	c.Assert(got.transferEncoding, HasLen, 0)
+}
+
+func (s *S) TestValidateRequestBuffering(c *C) {
+	c.Assert(validateRequestBuffering(&router.Route{BufferFullRequestBody: true}), IsNil)
+	c.Assert(validateRequestBuffering(&router.Route{ForwardTrailers: true}), IsNil)
+	c.Assert(validateRequestBuffering(&router.Route{BufferFullRequestBody: true, ForwardTrailers: true}), NotNil)
+}
+
+// closeNotifyRecorder is a ResponseRecorder which implements
+// http.CloseNotifier, as required by the proxy for non-GET requests
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func newCloseNotifyRecorder() *closeNotifyRecorder {
+	return &closeNotifyRecorder{httptest.NewRecorder()}
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
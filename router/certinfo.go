@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+var invalidCertificatesAdded = metrics.NewCounter(
+	"strowger_invalid_certificates_added_total",
+	"Number of certificates added which were expired or not yet valid.",
+)
+
+// parseKeyPair parses a PEM encoded certificate and private key, including
+// the certificate's leaf.
+func parseKeyPair(cert, key string) (tls.Certificate, error) {
+	kp, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return kp, err
+	}
+	if kp.Leaf == nil {
+		kp.Leaf, err = x509.ParseCertificate(kp.Certificate[0])
+	}
+	return kp, err
+}
+
+// checkCertValidity returns an error if now is outside the validity period of
+// the given certificate.
+func checkCertValidity(leaf *x509.Certificate, now time.Time) error {
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CertInfo returns the status of the certificate served for TLS connections
+// to the given domain, or ErrNotFound if the domain has no route with a
+// certificate.
+func (s *HTTPListener) CertInfo(domain string) (*router.CertStatus, error) {
+	r := s.findRoute(domain, "/")
+	if r == nil || r.keypair == nil || r.keypair.Leaf == nil {
+		return nil, ErrNotFound
+	}
+	return certStatus(domain, r.ID, r.keypair.Leaf, time.Now()), nil
+}
+
+func certStatus(domain, routeID string, leaf *x509.Certificate, now time.Time) *router.CertStatus {
+	return &router.CertStatus{
+		Domain:    domain,
+		RouteID:   routeID,
+		Subject:   leaf.Subject.String(),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		Valid:     !now.Before(leaf.NotBefore) && !now.After(leaf.NotAfter),
+	}
+}
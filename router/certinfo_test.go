@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestCertInfo(c *C) {
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	h := &httpSyncHandler{l: l}
+	cert := tlsConfigForDomain("certinfo.example.org")
+	c.Assert(h.Set(&router.Route{
+		Type:        "http",
+		ID:          "tls",
+		Domain:      "certinfo.example.org",
+		Path:        "/",
+		Service:     "web",
+		Certificate: &router.Certificate{Cert: cert.Cert, Key: cert.PrivateKey},
+	}), IsNil)
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "plain", Domain: "plain.example.org", Path: "/", Service: "web"}), IsNil)
+
+	status, err := l.CertInfo("CertInfo.example.org")
+	c.Assert(err, IsNil)
+	c.Assert(status.RouteID, Equals, "tls")
+	c.Assert(status.DNSNames, DeepEquals, []string{"certinfo.example.org"})
+	c.Assert(status.Valid, Equals, true)
+	c.Assert(status.NotAfter.After(time.Now()), Equals, true)
+
+	_, err = l.CertInfo("plain.example.org")
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = l.CertInfo("missing.example.org")
+	c.Assert(err, Equals, ErrNotFound)
+
+	leaf := &x509.Certificate{NotBefore: time.Unix(100, 0), NotAfter: time.Unix(200, 0)}
+	c.Assert(certStatus("example.org", "id", leaf, time.Unix(150, 0)).Valid, Equals, true)
+	c.Assert(certStatus("example.org", "id", leaf, time.Unix(50, 0)).Valid, Equals, false)
+	c.Assert(certStatus("example.org", "id", leaf, time.Unix(250, 0)).Valid, Equals, false)
+}
+
+// generateCertWithValidity returns a PEM encoded self-signed certificate and
+// key for domain with the given validity period.
+func generateCertWithValidity(c *C, domain string, notBefore, notAfter time.Time) *router.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &router.Certificate{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func (s *S) TestCheckCertValidity(c *C) {
+	now := time.Now()
+	for _, t := range []struct {
+		notBefore, notAfter time.Time
+		err                 string
+	}{
+		{now.Add(-time.Hour), now.Add(time.Hour), ""},
+		{now.Add(-2 * time.Hour), now.Add(-time.Hour), "certificate expired at .*"},
+		{now.Add(time.Hour), now.Add(2 * time.Hour), "certificate is not valid until .*"},
+	} {
+		cert := generateCertWithValidity(c, "validity.example.org", t.notBefore, t.notAfter)
+		kp, err := parseKeyPair(cert.Cert, cert.Key)
+		c.Assert(err, IsNil)
+		err = checkCertValidity(kp.Leaf, now)
+		if t.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, t.err)
+		}
+	}
+}
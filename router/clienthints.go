@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// validateClientHints checks that the route's client hints are valid header
+// names.
+func validateClientHints(r *router.Route) error {
+	for _, hint := range r.ClientHints {
+		if !tokenPattern.MatchString(hint) {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Client hints invalid: %q is not a valid header name", hint),
+			}
+		}
+	}
+	return nil
+}
+
+// setClientHintHeaders asks browsers to send the route's client hints if the
+// request was sent without some of them, and sets the route's
+// Permissions-Policy. Headers which are already set by the backend are left
+// as they are, other than Vary, which the hints are added to as both the
+// response headers and the backend's response depend on them.
+func (r *httpRoute) setClientHintHeaders(res *http.Response) {
+	if len(r.ClientHints) > 0 {
+		addVary(res.Header, r.ClientHints)
+	}
+	if len(r.ClientHints) > 0 && res.Header.Get("Accept-CH") == "" && res.Request != nil && missingClientHints(res.Request, r.ClientHints) {
+		hints := strings.Join(r.ClientHints, ", ")
+		res.Header.Set("Accept-CH", hints)
+		res.Header.Set("Critical-CH", hints)
+	}
+	if r.PermissionsPolicy != "" && res.Header.Get("Permissions-Policy") == "" {
+		res.Header.Set("Permissions-Policy", r.PermissionsPolicy)
+	}
+}
+
+// addVary adds the given request header names to the Vary header unless
+// they are already listed, or it is "*".
+func addVary(header http.Header, names []string) {
+	listed := make(map[string]struct{})
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return
+		}
+		listed[name] = struct{}{}
+	}
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		if _, ok := listed[key]; !ok {
+			header.Add("Vary", name)
+			listed[key] = struct{}{}
+		}
+	}
+}
+
+// missingClientHints returns whether req is missing some of the given client
+// hints, meaning the browser hasn't been asked for them yet.
+func missingClientHints(req *http.Request, hints []string) bool {
+	for _, hint := range hints {
+		if _, ok := req.Header[http.CanonicalHeaderKey(hint)]; !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestClientHints(c *C) {
+	// the backend responds with the mobile hint it received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("Sec-CH-UA-Mobile")))
+	}))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:            "example.com",
+		Service:           "test",
+		ClientHints:       []string{"Sec-CH-UA", "Sec-CH-UA-Mobile"},
+		PermissionsPolicy: "ch-ua-mobile=(self)",
+	}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+
+	get := func(hints map[string]string) *http.Response {
+		req := newReq("http://"+l.Addr, "example.com")
+		for k, v := range hints {
+			req.Header.Set(k, v)
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	// the first response asks the browser for the hints
+	res := get(nil)
+	res.Body.Close()
+	c.Assert(res.Header.Get("Accept-CH"), Equals, "Sec-CH-UA, Sec-CH-UA-Mobile")
+	c.Assert(res.Header.Get("Critical-CH"), Equals, "Sec-CH-UA, Sec-CH-UA-Mobile")
+	c.Assert(res.Header.Get("Permissions-Policy"), Equals, "ch-ua-mobile=(self)")
+	c.Assert(res.Header["Vary"], DeepEquals, []string{"Sec-CH-UA", "Sec-CH-UA-Mobile"})
+
+	// subsequent requests include the hints, which are forwarded to the
+	// backend
+	hints := map[string]string{"Sec-CH-UA": `"Chromium";v="120"`, "Sec-CH-UA-Mobile": "?1"}
+	res = get(hints)
+	defer res.Body.Close()
+	c.Assert(res.Header.Get("Accept-CH"), Equals, "")
+	c.Assert(res.Header.Get("Permissions-Policy"), Equals, "ch-ua-mobile=(self)")
+	c.Assert(res.Header["Vary"], DeepEquals, []string{"Sec-CH-UA", "Sec-CH-UA-Mobile"})
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "?1")
+
+	// requests with only some of the hints are asked for the rest
+	delete(hints, "Sec-CH-UA")
+	res = get(hints)
+	res.Body.Close()
+	c.Assert(res.Header.Get("Accept-CH"), Equals, "Sec-CH-UA, Sec-CH-UA-Mobile")
+
+	// hints already in the backend's Vary header aren't added again
+	header := http.Header{"Vary": {"Accept-Encoding, sec-ch-ua"}}
+	addVary(header, []string{"Sec-CH-UA", "Sec-CH-UA-Mobile"})
+	c.Assert(header["Vary"], DeepEquals, []string{"Accept-Encoding, sec-ch-ua", "Sec-CH-UA-Mobile"})
+	header = http.Header{"Vary": {"*"}}
+	addVary(header, []string{"Sec-CH-UA"})
+	c.Assert(header["Vary"], DeepEquals, []string{"*"})
+
+	c.Assert(validateClientHints(&router.Route{ClientHints: []string{"Sec-CH-UA"}}), IsNil)
+	c.Assert(validateClientHints(&router.Route{ClientHints: []string{"Sec CH"}}), DeepEquals, httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: `Client hints invalid: "Sec CH" is not a valid header name`,
+	})
+}
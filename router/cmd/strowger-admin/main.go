@@ -0,0 +1,74 @@
+// Command strowger-admin provides administrative tools for the router.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/client"
+)
+
+const usage = `usage: strowger-admin routes export-nginx [options]
+
+Commands:
+	routes export-nginx  write an nginx config fragment serving the current
+	                     HTTP routes, as an aid to migrating between nginx
+	                     and the router
+`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "strowger-admin:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 2 || args[0] != "routes" || args[1] != "export-nginx" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return exportNginx(args[2:])
+}
+
+func exportNginx(args []string) error {
+	flags := flag.NewFlagSet("export-nginx", flag.ExitOnError)
+	apiAddr := flags.String("router-api", "", "router API address (defaults to discovering router-api)")
+	certDir := flags.String("cert-dir", "certs", "directory to write route TLS certificates and keys to")
+	output := flags.String("o", "", "file to write the config to (defaults to stdout)")
+	flags.Parse(args)
+
+	c := client.New()
+	if *apiAddr != "" {
+		c = client.NewWithAddr(*apiAddr)
+	}
+	routes, err := c.ListRoutes("")
+	if err != nil {
+		return err
+	}
+
+	config := &nginxConfig{
+		Routes:  routes,
+		CertDir: *certDir,
+		Backends: func(service string) ([]string, error) {
+			return discoverd.NewService(service).Addrs()
+		},
+	}
+	if err := config.writeCerts(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return config.write(w)
+}
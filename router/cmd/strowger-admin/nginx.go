@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// nginxConfig generates an nginx config fragment with a server block for
+// each domain with HTTP routes, proxying each route's path to an upstream of
+// its service's backends.
+type nginxConfig struct {
+	Routes []*router.Route
+
+	// CertDir is the directory the route certificates are written to and
+	// referenced from
+	CertDir string
+
+	// Backends returns the addresses of the backends of a service
+	Backends func(service string) ([]string, error)
+}
+
+// nginxServer is the routes of a single domain
+type nginxServer struct {
+	domain string
+	cert   *router.Certificate
+	routes []*router.Route
+}
+
+// sortedRoutesByPath sorts routes by path
+type sortedRoutesByPath []*router.Route
+
+func (p sortedRoutesByPath) Len() int           { return len(p) }
+func (p sortedRoutesByPath) Less(i, j int) bool { return p[i].Path < p[j].Path }
+func (p sortedRoutesByPath) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// servers groups the HTTP routes by domain, sorted by domain and path.
+func (c *nginxConfig) servers() []*nginxServer {
+	byDomain := make(map[string]*nginxServer)
+	var domains []string
+	for _, r := range c.Routes {
+		if r.Type != "http" {
+			continue
+		}
+		domain := strings.ToLower(r.Domain)
+		s, ok := byDomain[domain]
+		if !ok {
+			s = &nginxServer{domain: domain}
+			byDomain[domain] = s
+			domains = append(domains, domain)
+		}
+		// the router serves the certificate of the domain's default route
+		if r.Certificate != nil && r.Certificate.Cert != "" && (s.cert == nil || r.Path == "/") {
+			s.cert = r.Certificate
+		}
+		s.routes = append(s.routes, r)
+	}
+	sort.Strings(domains)
+	servers := make([]*nginxServer, len(domains))
+	for i, domain := range domains {
+		servers[i] = byDomain[domain]
+		sort.Sort(sortedRoutesByPath(servers[i].routes))
+	}
+	return servers
+}
+
+// certPaths returns the paths of the certificate and key files for cert.
+func (c *nginxConfig) certPaths(cert *router.Certificate) (string, string) {
+	return filepath.Join(c.CertDir, cert.ID+".crt"), filepath.Join(c.CertDir, cert.ID+".key")
+}
+
+// writeCerts writes the certificates and keys referenced by the config to
+// CertDir.
+func (c *nginxConfig) writeCerts() error {
+	for _, s := range c.servers() {
+		if s.cert == nil {
+			continue
+		}
+		if err := os.MkdirAll(c.CertDir, 0700); err != nil {
+			return err
+		}
+		certPath, keyPath := c.certPaths(s.cert)
+		if err := ioutil.WriteFile(certPath, []byte(s.cert.Cert), 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(keyPath, []byte(s.cert.Key), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upstreamName returns the name of the upstream for a service, which may only
+// contain characters valid in an nginx identifier.
+func upstreamName(service string) string {
+	return "flynn_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, service)
+}
+
+func (c *nginxConfig) write(w io.Writer) error {
+	servers := c.servers()
+
+	var services []string
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		for _, r := range s.routes {
+			if !seen[r.Service] {
+				seen[r.Service] = true
+				services = append(services, r.Service)
+			}
+		}
+	}
+	sort.Strings(services)
+
+	fmt.Fprintln(w, "# generated by strowger-admin routes export-nginx")
+	for _, service := range services {
+		backends, err := c.Backends(service)
+		if err != nil {
+			return fmt.Errorf("error getting backends of %s: %s", service, err)
+		}
+		sort.Strings(backends)
+		fmt.Fprintf(w, "\n# service: %s\nupstream %s {\n", service, upstreamName(service))
+		for _, addr := range backends {
+			fmt.Fprintf(w, "\tserver %s;\n", addr)
+		}
+		if len(backends) == 0 {
+			// an upstream must have a server, so add one which is
+			// never used
+			fmt.Fprintln(w, "\t# no backends are currently registered")
+			fmt.Fprintln(w, "\tserver 127.0.0.1:1 down;")
+		}
+		fmt.Fprintln(w, "}")
+	}
+
+	for _, s := range servers {
+		fmt.Fprintf(w, "\n# domain: %s\nserver {\n\tlisten 80;\n", s.domain)
+		if s.cert != nil {
+			certPath, keyPath := c.certPaths(s.cert)
+			fmt.Fprintf(w, "\tlisten 443 ssl;\n\tssl_certificate %s;\n\tssl_certificate_key %s;\n", certPath, keyPath)
+		}
+		fmt.Fprintf(w, "\tserver_name %s;\n", s.domain)
+		for _, r := range s.routes {
+			path := r.Path
+			if path == "" {
+				path = "/"
+			}
+			fmt.Fprintf(w, "\n\t# route: %s, service: %s\n", r.FormattedID(), r.Service)
+			fmt.Fprintf(w, "\tlocation %s {\n", path)
+			fmt.Fprintln(w, "\t\tproxy_set_header Host $host;")
+			fmt.Fprintln(w, "\t\tproxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;")
+			fmt.Fprintln(w, "\t\tproxy_set_header X-Forwarded-Proto $scheme;")
+			fmt.Fprintf(w, "\t\tproxy_pass http://%s;\n", upstreamName(r.Service))
+			fmt.Fprintln(w, "\t}")
+		}
+		fmt.Fprintln(w, "}")
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+// nginxDirective is a directive parsed from an nginx config
+type nginxDirective struct {
+	name  string
+	args  []string
+	block []*nginxDirective
+}
+
+// find returns the directives in the block with the given name.
+func (d *nginxDirective) find(name string) []*nginxDirective {
+	var res []*nginxDirective
+	for _, child := range d.block {
+		if child.name == name {
+			res = append(res, child)
+		}
+	}
+	return res
+}
+
+// parseNginx parses the subset of the nginx config syntax used by the
+// generated config: directives terminated by semicolons, blocks and
+// comments, without quoting.
+func parseNginx(config string) (*nginxDirective, error) {
+	var tokens []string
+	for _, line := range strings.Split(config, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, sep := range []string{";", "{", "}"} {
+			line = strings.Replace(line, sep, " "+sep+" ", -1)
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+
+	root := &nginxDirective{}
+	stack := []*nginxDirective{root}
+	var current []string
+	for _, t := range tokens {
+		parent := stack[len(stack)-1]
+		switch t {
+		case ";":
+			if len(current) == 0 {
+				return nil, fmt.Errorf("empty directive")
+			}
+			parent.block = append(parent.block, &nginxDirective{name: current[0], args: current[1:]})
+			current = nil
+		case "{":
+			if len(current) == 0 {
+				return nil, fmt.Errorf("block without a directive")
+			}
+			d := &nginxDirective{name: current[0], args: current[1:]}
+			parent.block = append(parent.block, d)
+			stack = append(stack, d)
+			current = nil
+		case "}":
+			if len(current) > 0 || len(stack) == 1 {
+				return nil, fmt.Errorf("unexpected }")
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current = append(current, t)
+		}
+	}
+	if len(current) > 0 || len(stack) > 1 {
+		return nil, fmt.Errorf("unexpected end of config")
+	}
+	return root, nil
+}
+
+func (S) TestExportNginx(c *C) {
+	certDir, err := ioutil.TempDir("", "strowger-admin")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(certDir)
+
+	cert := &router.Certificate{ID: "cert1", Cert: "CERT", Key: "KEY"}
+	routes := []*router.Route{
+		{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web", Certificate: cert},
+		{Type: "http", ID: "2", Domain: "example.com", Path: "/api/", Service: "api"},
+		{Type: "http", ID: "3", Domain: "*.example.org", Path: "/", Service: "web"},
+		{Type: "http", ID: "4", Domain: "idle.example.net", Path: "/", Service: "idle-web"},
+		{Type: "tcp", ID: "5", Port: 3000, Service: "db"},
+	}
+	backends := map[string][]string{
+		"web": {"10.0.0.2:8080", "10.0.0.1:8080"},
+		"api": {"10.0.0.3:8080"},
+	}
+	config := &nginxConfig{
+		Routes:  routes,
+		CertDir: certDir,
+		Backends: func(service string) ([]string, error) {
+			return backends[service], nil
+		},
+	}
+	c.Assert(config.writeCerts(), IsNil)
+	var buf bytes.Buffer
+	c.Assert(config.write(&buf), IsNil)
+
+	root, err := parseNginx(buf.String())
+	c.Assert(err, IsNil, Commentf(buf.String()))
+
+	upstreams := make(map[string][]string)
+	for _, u := range root.find("upstream") {
+		c.Assert(u.args, HasLen, 1)
+		var servers []string
+		for _, s := range u.find("server") {
+			servers = append(servers, s.args[0])
+		}
+		upstreams[u.args[0]] = servers
+	}
+	c.Assert(upstreams, DeepEquals, map[string][]string{
+		"flynn_web":      {"10.0.0.1:8080", "10.0.0.2:8080"},
+		"flynn_api":      {"10.0.0.3:8080"},
+		"flynn_idle_web": {"127.0.0.1:1"},
+	})
+
+	servers := make(map[string]map[string]string)
+	for _, s := range root.find("server") {
+		names := s.find("server_name")
+		c.Assert(names, HasLen, 1)
+		locations := make(map[string]string)
+		for _, l := range s.find("location") {
+			passes := l.find("proxy_pass")
+			c.Assert(passes, HasLen, 1)
+			upstream := strings.TrimPrefix(passes[0].args[0], "http://")
+			_, ok := upstreams[upstream]
+			c.Assert(ok, Equals, true, Commentf("undefined upstream %s", upstream))
+			locations[l.args[0]] = upstream
+		}
+		servers[names[0].args[0]] = locations
+
+		if names[0].args[0] == "example.com" {
+			crt := s.find("ssl_certificate")
+			c.Assert(crt, HasLen, 1)
+			data, err := ioutil.ReadFile(crt[0].args[0])
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, "CERT")
+			key := s.find("ssl_certificate_key")
+			c.Assert(key, HasLen, 1)
+			c.Assert(key[0].args[0], Equals, filepath.Join(certDir, "cert1.key"))
+		} else {
+			c.Assert(s.find("ssl_certificate"), HasLen, 0)
+		}
+	}
+	c.Assert(servers, DeepEquals, map[string]map[string]string{
+		"example.com":      {"/": "flynn_web", "/api/": "flynn_api"},
+		"*.example.org":    {"/": "flynn_web"},
+		"idle.example.net": {"/": "flynn_idle_web"},
+	})
+	c.Assert(strings.Contains(buf.String(), "# route: http/2, service: api"), Equals, true)
+}
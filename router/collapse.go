@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/router/metrics"
+	"golang.org/x/net/context"
+)
+
+var collapsedRequests = metrics.NewCounter(
+	"strowger_collapsed_requests_total",
+	"Number of requests served with the response to a concurrent identical request.",
+)
+
+// collapsedResponse is a response shared between collapsed requests
+type collapsedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	// vary is the leader's values of the request headers named in the
+	// response's Vary header
+	vary map[string]string
+}
+
+// shareable returns whether a response with the given header can be served
+// to other clients.
+func shareable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "private", "no-store":
+			return false
+		}
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// varyHeaders returns the request header names in the Vary header.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// varyValues returns the values of the given request headers, which are
+// joined so that they can be compared.
+func varyValues(req *http.Request, names []string) map[string]string {
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		values[name] = strings.Join(req.Header[name], ",")
+	}
+	return values
+}
+
+// matches returns whether req has the same values as the leader for the
+// request headers the response varies by.
+func (res *collapsedResponse) matches(req *http.Request) bool {
+	for name, value := range res.vary {
+		if strings.Join(req.Header[name], ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// collapseKey returns the key used to collapse req with concurrent identical
+// requests, or an empty string if req can't be collapsed because the
+// response may depend on more than the URL. Other request headers named in
+// the response's Vary header are checked once it is known (see
+// collapsedResponse.matches).
+func collapseKey(req *http.Request) string {
+	if req.Method != "GET" {
+		return ""
+	}
+	for _, h := range []string{"Cookie", "Authorization", "Range", "Upgrade"} {
+		if req.Header.Get(h) != "" {
+			return ""
+		}
+	}
+	// the backend may compress the response, so only collapse requests
+	// which accept the same encodings
+	return req.Host + req.URL.RequestURI() + "\x00" + req.Header.Get("Accept-Encoding")
+}
+
+// serveCollapsed proxies req to the backend unless an identical request is
+// already in flight, in which case it waits for that request and serves a
+// copy of its response. Responses which are personalized (they set cookies or
+// are private or no-store) or vary by request headers which differ are not
+// shared.
+func (r *httpRoute) serveCollapsed(ctx context.Context, w http.ResponseWriter, req *http.Request, key string) {
+	var leader bool
+	v, _ := r.collapse.Do(key, func() (interface{}, error) {
+		leader = true
+		rw := &recordingWriter{ResponseWriter: w}
+		r.proxyFor(req).ServeHTTP(ctx, rw, req)
+		// don't share a response which may be incomplete because the
+		// client went away
+		if rw.status == 0 || rw.overflow || rw.err != nil || ctx.Err() != nil || !shareable(w.Header()) {
+			return nil, nil
+		}
+		header := make(http.Header, len(w.Header()))
+		copyHeader(header, w.Header())
+		return &collapsedResponse{
+			status: rw.status,
+			header: header,
+			body:   rw.body.Bytes(),
+			vary:   varyValues(req, varyHeaders(header)),
+		}, nil
+	})
+	if leader {
+		return
+	}
+
+	res, _ := v.(*collapsedResponse)
+	if res == nil || !res.matches(req) {
+		// the response couldn't be shared, so make our own request
+		r.proxyFor(req).ServeHTTP(ctx, w, req)
+		return
+	}
+	collapsedRequests.Inc()
+	copyHeader(w.Header(), res.header)
+	w.WriteHeader(res.status)
+	// the ResponseWriter may retain the body (e.g. when recording it for the
+	// push cache), so give each request its own copy
+	w.Write(append([]byte(nil), res.body...))
+}
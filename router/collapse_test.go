@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestRequestCollapsing(c *C) {
+	var backendRequests int64
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&backendRequests, 1)
+		<-release
+		w.Header().Set("X-Backend", "1")
+		w.Write([]byte("collapsed"))
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{
+		Domain:                   "example.com",
+		Service:                  "test",
+		RequestCollapsingEnabled: true,
+	}}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	const n = 100
+	collapsed := collapsedRequests.Value()
+	var started int64
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "http://example.com/foo?bar=baz", nil)
+			w := httptest.NewRecorder()
+			responses[i] = w
+			atomic.AddInt64(&started, 1)
+			r.ServeHTTP(context.Background(), w, req)
+		}(i)
+	}
+
+	// wait for the requests to reach the backend before responding
+	for atomic.LoadInt64(&started) < n || atomic.LoadInt64(&backendRequests) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	c.Assert(atomic.LoadInt64(&backendRequests), Equals, int64(1))
+	c.Assert(collapsedRequests.Value(), Equals, collapsed+n-1)
+	for _, w := range responses {
+		c.Assert(w.Code, Equals, 200)
+		c.Assert(w.Header().Get("X-Backend"), Equals, "1")
+		c.Assert(w.Body.String(), Equals, "collapsed")
+	}
+
+	// each request gets its own copy of the response header
+	responses[0].Header().Set("X-Backend", "modified")
+	c.Assert(responses[1].Header().Get("X-Backend"), Equals, "1")
+
+	// requests which may get a personalized response are not collapsed
+	for _, h := range []string{"Cookie", "Authorization", "Range"} {
+		req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		req.Header.Set(h, "x")
+		c.Assert(collapseKey(req), Equals, "", Commentf(h))
+	}
+	c.Assert(collapseKey(httptest.NewRequest("POST", "http://example.com/foo", nil)), Equals, "")
+}
+
+func (s *S) TestRequestCollapsingPersonalized(c *C) {
+	var backendRequests int64
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&backendRequests, 1)
+		<-release
+		for k, v := range req.URL.Query() {
+			w.Header()[k] = v
+		}
+		w.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{
+		Domain:                   "example.com",
+		Service:                  "test",
+		RequestCollapsingEnabled: true,
+	}}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	// serve sends a request from a leader and a follower with the given
+	// languages, returning the number of backend requests and the bodies of
+	// the responses
+	serve := func(query, leaderLang, followerLang string) (int64, []string) {
+		atomic.StoreInt64(&backendRequests, 0)
+		release = make(chan struct{})
+		bodies := make([]string, 2)
+		var wg sync.WaitGroup
+		for i, lang := range []string{leaderLang, followerLang} {
+			wg.Add(1)
+			go func(i int, lang string) {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "http://example.com/foo?"+query, nil)
+				req.Header.Set("Accept-Language", lang)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(context.Background(), w, req)
+				bodies[i] = w.Body.String()
+			}(i, lang)
+			// wait for the leader to reach the backend before starting the
+			// follower
+			for i == 0 && atomic.LoadInt64(&backendRequests) == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		return atomic.LoadInt64(&backendRequests), bodies
+	}
+
+	for _, t := range []struct {
+		query        string
+		followerLang string
+		shared       bool
+	}{
+		{"Vary=Accept-Language", "en", true},
+		{"Vary=Accept-Language", "fr", false},
+		{"Vary=Accept-Encoding,%20Accept-Language", "fr", false},
+		{"Vary=*", "en", false},
+		{"Set-Cookie=session=1", "en", false},
+		{"Cache-Control=private,%20max-age=60", "en", false},
+		{"Cache-Control=no-store", "en", false},
+		{"Cache-Control=public,%20max-age=60", "en", true},
+	} {
+		requests, bodies := serve(t.query, "en", t.followerLang)
+		if t.shared {
+			c.Assert(requests, Equals, int64(1), Commentf(t.query))
+		} else {
+			c.Assert(requests, Equals, int64(2), Commentf(t.query))
+		}
+		c.Assert(bodies, DeepEquals, []string{"en", t.followerLang}, Commentf(t.query))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultQueueTimeout is how long requests wait for a slot on routes with
+// MaxQueuedRequests set but no QueueTimeoutMS
+const defaultQueueTimeout = 5 * time.Second
+
+var concurrencyLimitedRequests = metrics.NewCounter(
+	"strowger_concurrency_limited_requests_total",
+	"Number of requests rejected because their route's concurrent request limit was reached.",
+)
+
+// validateConcurrencyLimit checks that the route's concurrency limit options
+// are valid.
+func validateConcurrencyLimit(r *router.Route) error {
+	var msg string
+	switch {
+	case r.MaxConcurrentRequests < 0 || r.MaxQueuedRequests < 0 || r.QueueTimeoutMS < 0:
+		msg = "limits can't be negative"
+	case r.MaxConcurrentRequests == 0 && (r.MaxQueuedRequests > 0 || r.QueueTimeoutMS > 0):
+		msg = "max_concurrent_requests must be set to queue requests"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Concurrency limit invalid: " + msg,
+	}
+}
+
+// concurrencyLimiter limits the number of concurrent requests to a route,
+// queueing a bounded number of requests beyond the limit.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func newConcurrencyLimiter(r *router.HTTPRoute) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		slots:   make(chan struct{}, r.MaxConcurrentRequests),
+		queue:   make(chan struct{}, r.MaxQueuedRequests),
+		timeout: time.Duration(r.QueueTimeoutMS) * time.Millisecond,
+	}
+	if l.timeout == 0 {
+		l.timeout = defaultQueueTimeout
+	}
+	return l
+}
+
+// acquire waits for a slot, returning false if there are no slots or queue
+// slots free, or if the queue timeout expires or the client goes away
+// before a slot is free. Callers must call release once done if true is
+// returned.
+func (l *concurrencyLimiter) acquire(w http.ResponseWriter) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+		defer func() { <-l.queue }()
+	default:
+		return false
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-closed:
+		return false
+	}
+}
+
+// equal returns whether l and other have the same limits.
+func (l *concurrencyLimiter) equal(other *concurrencyLimiter) bool {
+	return cap(l.slots) == cap(other.slots) && cap(l.queue) == cap(other.queue) && l.timeout == other.timeout
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
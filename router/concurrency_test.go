@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestConcurrencyLimit(c *C) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-unblock
+	}))
+	defer backend.Close()
+
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	h := &httpSyncHandler{l: l}
+	route := &router.Route{
+		Type:                  "http",
+		ID:                    "1",
+		Domain:                "example.com",
+		Path:                  "/",
+		Service:               "web",
+		MaxConcurrentRequests: 2,
+		MaxQueuedRequests:     1,
+		QueueTimeoutMS:        100,
+	}
+	c.Assert(h.Set(route), IsNil)
+	r := l.findRoute("example.com", "/")
+	c.Assert(r, NotNil)
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	codes := make(chan int)
+	get := func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		codes <- w.Code
+	}
+	waitQueued := func(n int) {
+		for i := 0; len(r.limiter.queue) != n; i++ {
+			if i > 100 {
+				c.Fatalf("timed out waiting for %d queued requests", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// requests up to the limit are proxied
+	go get()
+	go get()
+	<-started
+	<-started
+
+	// the next request is queued, and requests beyond the queue are
+	// rejected
+	go get()
+	waitQueued(1)
+	limited := concurrencyLimitedRequests.Value()
+	go get()
+	c.Assert(<-codes, Equals, http.StatusServiceUnavailable)
+	c.Assert(concurrencyLimitedRequests.Value()-limited, Equals, uint64(1))
+
+	// the queued request is proxied once a request completes
+	unblock <- struct{}{}
+	c.Assert(<-codes, Equals, 200)
+	<-started
+
+	// queued requests are rejected once the timeout expires
+	go get()
+	c.Assert(<-codes, Equals, http.StatusServiceUnavailable)
+	waitQueued(0)
+
+	// updating the route without changing the limits keeps counting the
+	// requests in flight to the previous route
+	prev := r.limiter
+	route.Sticky = true
+	c.Assert(h.Set(route), IsNil)
+	c.Assert(l.findRoute("example.com", "/").limiter, Equals, prev)
+	route.MaxConcurrentRequests = 3
+	c.Assert(h.Set(route), IsNil)
+	c.Assert(l.findRoute("example.com", "/").limiter, Not(Equals), prev)
+
+	unblock <- struct{}{}
+	unblock <- struct{}{}
+	c.Assert(<-codes, Equals, 200)
+	c.Assert(<-codes, Equals, 200)
+	c.Assert(len(r.limiter.slots), Equals, 0)
+}
+
+func (s *S) TestValidateConcurrencyLimit(c *C) {
+	c.Assert(validateConcurrencyLimit(&router.Route{}), IsNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{MaxConcurrentRequests: 10}), IsNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{MaxConcurrentRequests: 10, MaxQueuedRequests: 100, QueueTimeoutMS: 1000}), IsNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{MaxConcurrentRequests: -1}), NotNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{MaxConcurrentRequests: 10, QueueTimeoutMS: -1}), NotNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{MaxQueuedRequests: 100}), NotNil)
+	c.Assert(validateConcurrencyLimit(&router.Route{QueueTimeoutMS: 1000}), NotNil)
+}
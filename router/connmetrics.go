@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/metrics"
+)
+
+var (
+	clientConnections = metrics.NewCounter(
+		"strowger_client_connections_total",
+		"Number of client connections accepted by the HTTP listeners.",
+	)
+	clientRequests = metrics.NewCounter(
+		"strowger_client_requests_total",
+		"Number of requests read from client connections, divided by strowger_client_connections_total it is the keep-alive reuse factor.",
+	)
+	clientConnectionsClosed = metrics.NewCounterVec(
+		"strowger_client_connections_closed_total",
+		"Number of client connections closed, by reason (client_close, server_close, idle_timeout or error).",
+		"reason",
+	)
+)
+
+// connMetricsListener counts the connections accepted by a listener and the
+// reasons they are closed.
+type connMetricsListener struct {
+	net.Listener
+}
+
+func (l connMetricsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	clientConnections.Inc()
+	return &connMetricsConn{Conn: c}, nil
+}
+
+// connMetricsConn tracks the last read error of a connection so that the
+// reason it is closed can be counted.
+type connMetricsConn struct {
+	net.Conn
+
+	mtx     sync.Mutex
+	readErr error
+	// aborting is set when the read deadline is set in the past, which
+	// net/http does to interrupt reads rather than to time out the
+	// connection
+	aborting bool
+	closed   bool
+}
+
+func (c *connMetricsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mtx.Lock()
+	if err == nil {
+		c.readErr = nil
+	} else if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() || !c.aborting {
+		c.readErr = err
+	}
+	c.mtx.Unlock()
+	return n, err
+}
+
+func (c *connMetricsConn) SetDeadline(t time.Time) error {
+	c.setAborting(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *connMetricsConn) SetReadDeadline(t time.Time) error {
+	c.setAborting(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *connMetricsConn) setAborting(t time.Time) {
+	c.mtx.Lock()
+	c.aborting = !t.IsZero() && !t.After(time.Now())
+	c.mtx.Unlock()
+}
+
+func (c *connMetricsConn) Close() error {
+	c.mtx.Lock()
+	if !c.closed {
+		c.closed = true
+		clientConnectionsClosed.Inc(closeReason(c.readErr))
+	}
+	c.mtx.Unlock()
+	return c.Conn.Close()
+}
+
+// closeReason returns the reason a connection was closed given the last
+// error reading from it.
+func closeReason(readErr error) string {
+	if readErr == nil {
+		return "server_close"
+	}
+	if readErr == io.EOF {
+		return "client_close"
+	}
+	if nerr, ok := readErr.(net.Error); ok && nerr.Timeout() {
+		return "idle_timeout"
+	}
+	return "error"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestClientConnectionMetrics(c *C) {
+	l, _, _ := newFakeHTTPListener(c)
+	defer l.Close()
+	addr := "http://" + l.Addr
+
+	conns := clientConnections.Value()
+	requests := clientRequests.Value()
+	clientClosed := clientConnectionsClosed.Value("client_close")
+	serverClosed := clientConnectionsClosed.Value("server_close")
+	timeouts := clientConnectionsClosed.Value("idle_timeout")
+
+	// requests on a kept-alive connection closed by the client, which
+	// are counted by the listener whether or not they match a route
+	const keptAlive = 3
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < keptAlive; i++ {
+		res, err := client.Get(addr)
+		c.Assert(err, IsNil)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	}
+	transport.CloseIdleConnections()
+	waitForCount(c, func() uint64 { return clientConnectionsClosed.Value("client_close") }, clientClosed+1)
+	c.Assert(clientConnections.Value()-conns, Equals, uint64(1))
+	c.Assert(clientRequests.Value()-requests, Equals, uint64(keptAlive))
+
+	// a request asking the server to close the connection, which isn't
+	// mistaken for a timeout when net/http interrupts its background read
+	req, err := http.NewRequest("POST", addr, nil)
+	c.Assert(err, IsNil)
+	req.Close = true
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	waitForCount(c, func() uint64 { return clientConnectionsClosed.Value("server_close") }, serverClosed+1)
+	c.Assert(clientConnections.Value()-conns, Equals, uint64(2))
+	c.Assert(clientRequests.Value()-requests, Equals, uint64(keptAlive+1))
+	c.Assert(clientConnectionsClosed.Value("idle_timeout"), Equals, timeouts)
+}
+
+// waitForCount waits for the counter read by value to reach n
+func waitForCount(c *C, value func() uint64, n uint64) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if value() == n {
+			return
+		}
+	}
+	c.Fatalf("timed out waiting for count %d, got %d", n, value())
+}
+
+// timeoutError is a net.Error which is a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (s *S) TestConnectionCloseReason(c *C) {
+	for _, t := range []struct {
+		err    error
+		reason string
+	}{
+		{nil, "server_close"},
+		{io.EOF, "client_close"},
+		{timeoutError{}, "idle_timeout"},
+		{errors.New("connection reset by peer"), "error"},
+	} {
+		c.Assert(closeReason(t.err), Equals, t.reason)
+	}
+}
+
+func (s *S) TestBackendConnectionMetrics(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	conns := metricValue(c, "strowger_backend_connections_total")
+	requests := metricValue(c, "strowger_backend_requests_total")
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, 200)
+	}
+	// the backend connection is reused
+	c.Assert(metricValue(c, "strowger_backend_connections_total"), Equals, conns+1)
+	c.Assert(metricValue(c, "strowger_backend_requests_total"), Equals, requests+3)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+// validateConsistentHashKey checks that the route's consistent hash key is
+// valid.
+func validateConsistentHashKey(r *router.Route) error {
+	if r.ConsistentHashKey == "" || consistentHashKeyFunc(r.ConsistentHashKey) != nil {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: fmt.Sprintf(`Consistent hash key invalid: %q must be "path", "header:<name>" or "cookie:<name>"`, r.ConsistentHashKey),
+	}
+}
+
+// consistentHashKeyFunc returns a function which extracts the given
+// consistent hash key from requests, or nil if the key is invalid.
+func consistentHashKeyFunc(key string) func(*http.Request) string {
+	if key == "path" {
+		return func(req *http.Request) string { return req.URL.Path }
+	}
+	i := strings.IndexByte(key, ':')
+	if i < 0 || !tokenPattern.MatchString(key[i+1:]) {
+		return nil
+	}
+	name := key[i+1:]
+	switch key[:i] {
+	case "header":
+		name = http.CanonicalHeaderKey(name)
+		return func(req *http.Request) string { return req.Header.Get(name) }
+	case "cookie":
+		return func(req *http.Request) string {
+			if c, err := req.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}
+	}
+	return nil
+}
+
+// consistentHashSelector returns the BackendSelector of routes with
+// ConsistentHashKey set, or nil if it isn't set.
+func consistentHashSelector(r *router.HTTPRoute) proxy.BackendSelector {
+	if r.ConsistentHashKey == "" {
+		return nil
+	}
+	key := consistentHashKeyFunc(r.ConsistentHashKey)
+	if key == nil {
+		return nil
+	}
+	return &proxy.HashBackendSelector{Key: key}
+}
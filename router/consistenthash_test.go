@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestHashBackendSelectorRebalancing(c *C) {
+	selector := &proxy.HashBackendSelector{Key: func(req *http.Request) string { return req.URL.Path }}
+	pick := func(path string, backends ...string) string {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		return selector.SelectBackends(req, backends)[0]
+	}
+
+	// removing a backend only moves the keys it had, and adding it back
+	// moves them back
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/%d", i)
+		before := pick(path, "a", "b", "c", "d")
+		c.Assert(pick(path, "d", "c", "b", "a"), Equals, before)
+		after := pick(path, "a", "b", "c")
+		if before == "d" {
+			moved++
+		} else {
+			c.Assert(after, Equals, before)
+		}
+		c.Assert(pick(path, "a", "b", "c", "d"), Equals, before)
+	}
+	c.Assert(moved > 150 && moved < 350, Equals, true, Commentf("moved = %d", moved))
+}
+
+func (s *S) TestConsistentHashRouting(c *C) {
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:            "example.com",
+		Service:           "test",
+		ConsistentHashKey: "header:x-cache-key",
+	}.ToRoute())
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewServer(httpTestHandler(fmt.Sprint(i)))
+		defer srv.Close()
+		defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+	}
+
+	get := func(key string) string {
+		req := newReq("http://"+l.Addr, "example.com")
+		req.Header.Set("X-Cache-Key", key)
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	backends := make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		backend := get(key)
+		for j := 0; j < 3; j++ {
+			c.Assert(get(key), Equals, backend)
+		}
+		backends[backend] = struct{}{}
+	}
+	c.Assert(backends, HasLen, 3)
+
+	for _, key := range []string{"path", "header:X-Foo", "cookie:session"} {
+		c.Assert(validateConsistentHashKey(&router.Route{ConsistentHashKey: key}), IsNil)
+	}
+	for _, key := range []string{"query", "header:", "cookie:a b", "body:x"} {
+		c.Assert(validateConsistentHashKey(&router.Route{ConsistentHashKey: key}), DeepEquals, httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: fmt.Sprintf(`Consistent hash key invalid: %q must be "path", "header:<name>" or "cookie:<name>"`, key),
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/singleflight"
+)
+
+// defaultConsulCacheTTL is how long the passing instances of a service are
+// cached for if ConsulCacheTTL is zero
+const defaultConsulCacheTTL = time.Second
+
+// consulRetryInterval is how long Consul isn't queried for a service after a
+// query for it fails
+var consulRetryInterval = 5 * time.Second
+
+// consulHealth looks up the instances of services which are passing their
+// Consul health checks, caching the results to avoid querying Consul for
+// every request. Failed queries are cached for consulRetryInterval so that
+// requests don't wait for Consul to time out while it is unavailable, with
+// the last passing instances served in the meantime if there are any.
+type consulHealth struct {
+	addr   string
+	ttl    time.Duration
+	client *http.Client
+
+	mtx   sync.Mutex
+	cache map[string]*consulHealthEntry
+
+	// lookups ensures there is only one query in flight per service
+	lookups singleflight.Group
+}
+
+type consulHealthEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func newConsulHealth(addr string, ttl time.Duration) *consulHealth {
+	if ttl == 0 {
+		ttl = defaultConsulCacheTTL
+	}
+	return &consulHealth{
+		addr:   addr,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  make(map[string]*consulHealthEntry),
+	}
+}
+
+// consulServiceEntry is an entry in the response to a Consul health service
+// query
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Addrs returns the addresses of the passing instances of service, using
+// the cached result if it hasn't expired. If Consul can't be queried, the
+// previous result is returned if there is one.
+func (c *consulHealth) Addrs(service string) ([]string, error) {
+	c.mtx.Lock()
+	entry, ok := c.cache[service]
+	c.mtx.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	v, _ := c.lookups.Do(service, func() (interface{}, error) {
+		entry := &consulHealthEntry{}
+		entry.addrs, entry.err = c.lookup(service)
+		entry.expires = time.Now().Add(c.ttl)
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if entry.err != nil {
+			entry.expires = time.Now().Add(consulRetryInterval)
+			if prev, ok := c.cache[service]; ok && prev.err == nil {
+				logger.Error("error querying consul, using previous passing instances", "service", service, "err", entry.err)
+				entry.addrs, entry.err = prev.addrs, nil
+			}
+		}
+		c.cache[service] = entry
+		return entry, nil
+	})
+	entry = v.(*consulHealthEntry)
+	return entry.addrs, entry.err
+}
+
+func (c *consulHealth) lookup(service string) ([]string, error) {
+	u := fmt.Sprintf("http://%s/v1/health/service/%s?passing=true", c.addr, url.PathEscape(service))
+	res, err := c.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("router: unexpected status %d from consul", res.StatusCode)
+	}
+	var entries []*consulServiceEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// the service address defaults to the node address
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, nil
+}
+
+// backends returns a proxy.BackendListFunc returning the passing instances of
+// the service, falling back to the given list of discoverd instances if
+// Consul can't be queried.
+func (c *consulHealth) backends(service string, fallback func() []string) func() []string {
+	return func() []string {
+		addrs, err := c.Addrs(service)
+		if err != nil {
+			logger.Error("error getting passing instances from consul, using discoverd instances", "service", service, "err", err)
+			return fallback()
+		}
+		// the proxy shuffles the list it is given, so return a copy
+		return append([]string(nil), addrs...)
+	}
+}
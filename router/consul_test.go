@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestConsulHealthBackends(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+
+	// the mock Consul API returns the passing backends
+	var mtx sync.Mutex
+	var passing []string
+	var queries int
+	var failing bool
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		queries++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		c.Assert(req.URL.Path, Equals, "/v1/health/service/web")
+		c.Assert(req.URL.Query().Get("passing"), Equals, "true")
+		entries := make([]map[string]interface{}, len(passing))
+		for i, addr := range passing {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			entries[i] = map[string]interface{}{
+				"Node":    map[string]interface{}{"Address": host},
+				"Service": map[string]interface{}{"Port": p},
+			}
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	defer consul.Close()
+	setPassing := func(addrs ...string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		passing = addrs
+	}
+
+	const ttl = 50 * time.Millisecond
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+		consul:    newConsulHealth(consul.Listener.Addr().String(), ttl),
+	}
+	h := &httpSyncHandler{l: l}
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web", ConsulHealthBackends: true}), IsNil)
+	r := l.findRoute("example.com", "/")
+	c.Assert(r, NotNil)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, 200)
+		return w.Body.String()
+	}
+
+	setPassing(srv1.Listener.Addr().String())
+	for i := 0; i < 10; i++ {
+		c.Assert(get(), Equals, "1")
+	}
+	// the passing instances are cached
+	mtx.Lock()
+	c.Assert(queries, Equals, 1)
+	mtx.Unlock()
+
+	// the router follows the health checks once the cache expires
+	setPassing(srv2.Listener.Addr().String())
+	time.Sleep(2 * ttl)
+	for i := 0; i < 10; i++ {
+		c.Assert(get(), Equals, "2")
+	}
+
+	// the previous passing instances are used while Consul is unavailable,
+	// which isn't queried again until the retry interval has passed
+	defer func(d time.Duration) { consulRetryInterval = d }(consulRetryInterval)
+	consulRetryInterval = 4 * ttl
+	mtx.Lock()
+	failing = true
+	queries = 0
+	mtx.Unlock()
+	time.Sleep(2 * ttl)
+	for i := 0; i < 10; i++ {
+		c.Assert(get(), Equals, "2")
+	}
+	mtx.Lock()
+	c.Assert(queries, Equals, 1)
+	mtx.Unlock()
+	time.Sleep(2 * consulRetryInterval)
+	c.Assert(get(), Equals, "2")
+	mtx.Lock()
+	c.Assert(queries, Equals, 2)
+	mtx.Unlock()
+
+	// failed queries for services without previous results are cached too
+	for i := 0; i < 10; i++ {
+		_, err := l.consul.Addrs("other")
+		c.Assert(err, NotNil)
+	}
+	mtx.Lock()
+	c.Assert(queries, Equals, 3)
+	mtx.Unlock()
+}
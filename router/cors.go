@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultCORSMethods are the methods allowed in cross-origin requests when a
+// route doesn't configure any
+var defaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+func validateCORS(cors *router.CORS) error {
+	if cors == nil {
+		return nil
+	}
+	if len(cors.AllowedOrigins) == 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "CORS invalid: allowed_origins must be set",
+		}
+	}
+	for _, origin := range cors.AllowedOrigins {
+		if origin != "*" && strings.Count(origin, "*") > 1 {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("CORS invalid: allowed origin %q contains more than one wildcard", origin),
+			}
+		}
+	}
+	if cors.MaxAge < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "CORS invalid: max_age must not be negative",
+		}
+	}
+	return nil
+}
+
+// corsColumns returns the CORS config to store, which is empty if CORS is
+// disabled.
+func corsColumns(cors *router.CORS) router.CORS {
+	if cors == nil {
+		return router.CORS{}
+	}
+	return *cors
+}
+
+func corsFromColumns(cors router.CORS) *router.CORS {
+	if len(cors.AllowedOrigins) == 0 {
+		return nil
+	}
+	return &cors
+}
+
+// serveCORSPreflight responds to CORS preflight requests from allowed
+// origins, returning whether a response was written. Preflight requests
+// which are not allowed by the route's config are passed to the backend.
+func (r *httpRoute) serveCORSPreflight(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "OPTIONS" {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" || !r.corsAllowsOrigin(origin) || !r.corsAllowsMethod(method) {
+		return false
+	}
+	requestHeaders := splitHeaderList(req.Header.Get("Access-Control-Request-Headers"))
+	for _, h := range requestHeaders {
+		if !r.corsAllowsHeader(h) {
+			return false
+		}
+	}
+
+	header := w.Header()
+	r.setCORSOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", method)
+	if len(requestHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+	}
+	if r.CORS.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(r.CORS.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// setCORSHeaders adds CORS headers to a backend response to a request from
+// an allowed origin.
+func (r *httpRoute) setCORSHeaders(res *http.Response) {
+	origin := res.Request.Header.Get("Origin")
+	if origin == "" || !r.corsAllowsOrigin(origin) {
+		return
+	}
+	r.setCORSOrigin(res.Header, origin)
+	if len(r.CORS.ExposedHeaders) > 0 {
+		res.Header.Set("Access-Control-Expose-Headers", strings.Join(r.CORS.ExposedHeaders, ", "))
+	}
+}
+
+func (r *httpRoute) setCORSOrigin(header http.Header, origin string) {
+	// the wildcard can't be used with credentials, so echo the origin back
+	if r.corsAllowsAnyOrigin() && !r.CORS.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+	if r.CORS.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (r *httpRoute) corsAllowsAnyOrigin() bool {
+	for _, o := range r.CORS.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *httpRoute) corsAllowsOrigin(origin string) bool {
+	for _, o := range r.CORS.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) || matchOriginPattern(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOriginPattern returns whether origin matches a pattern containing a
+// wildcard, which matches one or more characters of the host or port.
+func matchOriginPattern(pattern, origin string) bool {
+	i := strings.Index(pattern, "*")
+	if i == -1 {
+		return false
+	}
+	prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	origin = strings.ToLower(origin)
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// don't let the wildcard match the scheme, port or path
+	return !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:")
+}
+
+func (r *httpRoute) corsAllowsMethod(method string) bool {
+	methods := r.CORS.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *httpRoute) corsAllowsHeader(header string) bool {
+	for _, h := range r.CORS.AllowedHeaders {
+		if h == "*" || strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestCORSPreflight(c *C) {
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{CORS: &router.CORS{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Token"},
+		MaxAge:         600,
+	}}}
+
+	preflight := func(method, origin, reqMethod, reqHeaders string) (*httptest.ResponseRecorder, bool) {
+		req, _ := http.NewRequest(method, "http://api.example.com/users", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if reqMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", reqMethod)
+		}
+		if reqHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", reqHeaders)
+		}
+		w := httptest.NewRecorder()
+		return w, r.serveCORSPreflight(w, req)
+	}
+
+	w, ok := preflight("OPTIONS", "https://app.example.com", "PUT", "content-type, x-token")
+	c.Assert(ok, Equals, true)
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(w.Header().Get("Access-Control-Allow-Methods"), Equals, "PUT")
+	c.Assert(w.Header().Get("Access-Control-Allow-Headers"), Equals, "content-type, x-token")
+	c.Assert(w.Header().Get("Access-Control-Max-Age"), Equals, "600")
+	c.Assert(w.Header().Get("Access-Control-Allow-Credentials"), Equals, "")
+	c.Assert(w.Header().Get("Vary"), Equals, "Origin")
+
+	// requests which aren't allowed preflights are passed to the backend
+	for _, t := range [][4]string{
+		{"GET", "https://app.example.com", "PUT", ""},
+		{"OPTIONS", "", "PUT", ""},
+		{"OPTIONS", "https://app.example.com", "", ""},
+		{"OPTIONS", "https://evil.example.com", "PUT", ""},
+		{"OPTIONS", "https://app.example.com", "DELETE", ""},
+		{"OPTIONS", "https://app.example.com", "GET", "X-Other"},
+	} {
+		_, ok := preflight(t[0], t[1], t[2], t[3])
+		c.Assert(ok, Equals, false, Commentf("%v", t))
+	}
+
+	// a wildcard origin responds with a wildcard unless credentials are
+	// allowed
+	r.CORS = &router.CORS{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}}
+	w, ok = preflight("OPTIONS", "https://other.com", "POST", "X-Anything")
+	c.Assert(ok, Equals, true)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(w.Header().Get("Access-Control-Allow-Headers"), Equals, "X-Anything")
+	c.Assert(w.Header().Get("Vary"), Equals, "")
+
+	r.CORS.AllowCredentials = true
+	w, ok = preflight("OPTIONS", "https://other.com", "POST", "")
+	c.Assert(ok, Equals, true)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), Equals, "https://other.com")
+	c.Assert(w.Header().Get("Access-Control-Allow-Credentials"), Equals, "true")
+
+	// the default methods don't include PUT
+	_, ok = preflight("OPTIONS", "https://other.com", "PUT", "")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestCORSHeaders(c *C) {
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{CORS: &router.CORS{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		ExposedHeaders:   []string{"X-Total-Count", "X-Page"},
+		AllowCredentials: true,
+	}}}
+
+	response := func(origin string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://api.example.com/users", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res := &http.Response{Header: make(http.Header), Request: req}
+		r.setCORSHeaders(res)
+		return res
+	}
+
+	res := response("https://app.example.com")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(res.Header.Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(res.Header.Get("Access-Control-Expose-Headers"), Equals, "X-Total-Count, X-Page")
+
+	for _, origin := range []string{"", "https://evil.example.com"} {
+		res := response(origin)
+		c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+		c.Assert(res.Header.Get("Access-Control-Expose-Headers"), Equals, "")
+	}
+
+	c.Assert(validateCORS(nil), IsNil)
+	c.Assert(validateCORS(&router.CORS{AllowedOrigins: []string{"*"}}), IsNil)
+	c.Assert(validateCORS(&router.CORS{}), NotNil)
+	c.Assert(validateCORS(&router.CORS{AllowedOrigins: []string{"*"}, MaxAge: -1}), NotNil)
+	c.Assert(validateCORS(&router.CORS{AllowedOrigins: []string{"https://*.example.com"}}), IsNil)
+	c.Assert(validateCORS(&router.CORS{AllowedOrigins: []string{"https://*.*.example.com"}}), NotNil)
+}
+
+func (s *S) TestCORSWildcardOrigins(c *C) {
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{CORS: &router.CORS{
+		AllowedOrigins:   []string{"https://*.example.com", "http://localhost:*"},
+		AllowCredentials: true,
+	}}}
+
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":       true,
+		"https://a.b.example.com":       true,
+		"https://APP.Example.com":       true,
+		"http://localhost:3000":         true,
+		"https://example.com":           false,
+		"https://.example.com":          false,
+		"http://app.example.com":        false,
+		"https://evil.com/.example.com": false,
+		"https://evil.com:.example.com": false,
+		"https://app.example.com.evil":  false,
+		"http://localhost":              false,
+		"http://localhost:3000/x":       false,
+	} {
+		c.Assert(r.corsAllowsOrigin(origin), Equals, allowed, Commentf(origin))
+	}
+
+	// the matching origin is echoed back for credentialed requests
+	req, _ := http.NewRequest("GET", "http://api.example.com/users", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	res := &http.Response{Header: make(http.Header), Request: req}
+	r.setCORSHeaders(res)
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(res.Header.Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(res.Header.Get("Vary"), Equals, "Origin")
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto/sha256"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"strings"
@@ -51,6 +50,10 @@ type pgDataStore struct {
 
 	routeType string
 	tableName string
+
+	// strictCertValidity is whether or not to reject certificates which are
+	// expired or not yet valid rather than just logging a warning
+	strictCertValidity bool
 }
 
 const (
@@ -105,6 +108,81 @@ func (d *pgDataStore) Add(r *router.Route) (err error) {
 }
 
 func (d *pgDataStore) addHTTP(r *router.Route) error {
+	r.Domain = canonicalDomain(r.Domain)
+	if err := hashBasicAuthPassword(r.BasicAuth); err != nil {
+		return err
+	}
+	if err := validatePathRewrite(r); err != nil {
+		return err
+	}
+	if err := validateCORS(r.CORS); err != nil {
+		return err
+	}
+	if err := validateRequestBuffering(r); err != nil {
+		return err
+	}
+	if err := validateConcurrencyLimit(r); err != nil {
+		return err
+	}
+	if err := validateClientRateLimit(r); err != nil {
+		return err
+	}
+	if err := validateRequestDedup(r); err != nil {
+		return err
+	}
+	if err := validateEnvoyHC(r); err != nil {
+		return err
+	}
+	if err := validateTLSPassthrough(r); err != nil {
+		return err
+	}
+	if err := validateHeaderSizeLimits(r); err != nil {
+		return err
+	}
+	if err := validateBackendTimeout(r); err != nil {
+		return err
+	}
+	if err := validateSlowRequestThreshold(r); err != nil {
+		return err
+	}
+	if err := validateABTest(r); err != nil {
+		return err
+	}
+	if err := validateMethodRoutes(r); err != nil {
+		return err
+	}
+	if err := validateConsistentHashKey(r); err != nil {
+		return err
+	}
+	if err := validateVaultServiceAuth(r.VaultServiceAuth); err != nil {
+		return err
+	}
+	if err := validateClientHints(r); err != nil {
+		return err
+	}
+	if err := validateRetryBudget(r.RetryBudget); err != nil {
+		return err
+	}
+	if err := validateStatusRateLimit(r.StatusRateLimit); err != nil {
+		return err
+	}
+	if err := validateFanout(r); err != nil {
+		return err
+	}
+	if err := validateTLSHandshakeTimeout(r); err != nil {
+		return err
+	}
+	if err := validateReservoirSampleSize(r); err != nil {
+		return err
+	}
+	authUsername, authPasswordHash := basicAuthColumns(r.BasicAuth)
+	cors := corsColumns(r.CORS)
+	ab := abTestColumns(r.ABTest)
+	methodRoutes := methodRouteColumns(r.MethodRoutes)
+	vault := vaultColumns(r.VaultServiceAuth)
+	retryBudget := retryBudgetColumns(r.RetryBudget)
+	statusRateLimit := statusRateLimitColumns(r.StatusRateLimit)
+
 	tx, err := d.pgx.Begin()
 	if err != nil {
 		return err
@@ -118,6 +196,67 @@ func (d *pgDataStore) addHTTP(r *router.Route) error {
 		r.Domain,
 		r.Sticky,
 		r.Path,
+		authUsername,
+		authPasswordHash,
+		r.ErrorHandlerService,
+		r.LogTLSFingerprint,
+		r.BlockedTLSFingerprints,
+		r.RewriteLocationHosts,
+		r.StripPathPrefix,
+		r.AddPathPrefix,
+		r.MulticastMode,
+		cors.AllowedOrigins,
+		cors.AllowedMethods,
+		cors.AllowedHeaders,
+		cors.ExposedHeaders,
+		cors.AllowCredentials,
+		cors.MaxAge,
+		r.PushPaths,
+		r.RequestCollapsingEnabled,
+		r.BufferFullRequestBody,
+		r.ForwardTrailers,
+		r.ConsulHealthBackends,
+		r.MaxConcurrentRequests,
+		r.MaxQueuedRequests,
+		r.QueueTimeoutMS,
+		r.PerClientRateLimit,
+		r.ClientRequestsPerSecond,
+		r.ClientBurst,
+		r.MaxTrackedClients,
+		r.RequestFingerprintDedup,
+		r.FingerprintMaxBytes,
+		r.DedupWindowMS,
+		r.EnvoyHCPath,
+		r.EnvoyHCBackendCheck,
+		r.BackendH2CEnabled,
+		r.TLSPassthrough,
+		r.MaxRequestHeaderBytes,
+		r.MaxResponseHeaderBytes,
+		r.BackendTimeoutMS,
+		r.SlowRequestThresholdMS,
+		ab.Names,
+		ab.Weights,
+		ab.Services,
+		ab.BucketCookie,
+		methodRoutes.Methods,
+		methodRoutes.Services,
+		r.ConsistentHashKey,
+		vault.VaultAddr,
+		vault.RoleID,
+		vault.SecretID,
+		vault.TokenPath,
+		r.ResponseSigningKey,
+		r.ClientHints,
+		r.PermissionsPolicy,
+		retryBudget.BudgetPercent,
+		retryBudget.MinimumRetries,
+		statusRateLimit.StatusCodes,
+		statusRateLimit.Thresholds,
+		statusRateLimit.Actions,
+		r.FanoutServices,
+		r.FanoutMaxBodyBytes,
+		r.TLSHandshakeTimeoutMS,
+		r.ReservoirSampleSize,
 	).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt); err != nil {
 		tx.Rollback()
 		return err
@@ -156,12 +295,25 @@ func (d *pgDataStore) addCertWithTx(tx *pgx.Tx, c *router.Certificate) error {
 	c.Cert = strings.Trim(c.Cert, " \n")
 	c.Key = strings.Trim(c.Key, " \n")
 
-	if _, err := tls.X509KeyPair([]byte(c.Cert), []byte(c.Key)); err != nil {
+	kp, err := parseKeyPair(c.Cert, c.Key)
+	if err != nil {
 		return httphelper.JSONError{
 			Code:    httphelper.ValidationErrorCode,
 			Message: "Certificate invalid: " + err.Error(),
 		}
 	}
+	if err := checkCertValidity(kp.Leaf, time.Now()); err != nil {
+		if d.strictCertValidity {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Certificate invalid: " + err.Error(),
+			}
+		}
+		// allow adding certificates ahead of time or while rotating
+		// expired ones, but make it visible
+		invalidCertificatesAdded.Inc()
+		logger.Warn("adding certificate outside its validity period", "fn", "addCert", "subject", kp.Leaf.Subject.String(), "err", err)
+	}
 
 	tlsCertSHA256 := sha256.Sum256([]byte(c.Cert))
 	if err := tx.QueryRow("insert_certificate", c.Cert, c.Key, tlsCertSHA256[:]).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt); err != nil {
@@ -283,6 +435,80 @@ func (d *pgDataStore) Update(r *router.Route) error {
 }
 
 func (d *pgDataStore) updateHTTP(r *router.Route) error {
+	if err := hashBasicAuthPassword(r.BasicAuth); err != nil {
+		return err
+	}
+	if err := validatePathRewrite(r); err != nil {
+		return err
+	}
+	if err := validateCORS(r.CORS); err != nil {
+		return err
+	}
+	if err := validateRequestBuffering(r); err != nil {
+		return err
+	}
+	if err := validateConcurrencyLimit(r); err != nil {
+		return err
+	}
+	if err := validateClientRateLimit(r); err != nil {
+		return err
+	}
+	if err := validateRequestDedup(r); err != nil {
+		return err
+	}
+	if err := validateEnvoyHC(r); err != nil {
+		return err
+	}
+	if err := validateTLSPassthrough(r); err != nil {
+		return err
+	}
+	if err := validateHeaderSizeLimits(r); err != nil {
+		return err
+	}
+	if err := validateBackendTimeout(r); err != nil {
+		return err
+	}
+	if err := validateSlowRequestThreshold(r); err != nil {
+		return err
+	}
+	if err := validateABTest(r); err != nil {
+		return err
+	}
+	if err := validateMethodRoutes(r); err != nil {
+		return err
+	}
+	if err := validateConsistentHashKey(r); err != nil {
+		return err
+	}
+	if err := validateVaultServiceAuth(r.VaultServiceAuth); err != nil {
+		return err
+	}
+	if err := validateClientHints(r); err != nil {
+		return err
+	}
+	if err := validateRetryBudget(r.RetryBudget); err != nil {
+		return err
+	}
+	if err := validateStatusRateLimit(r.StatusRateLimit); err != nil {
+		return err
+	}
+	if err := validateFanout(r); err != nil {
+		return err
+	}
+	if err := validateTLSHandshakeTimeout(r); err != nil {
+		return err
+	}
+	if err := validateReservoirSampleSize(r); err != nil {
+		return err
+	}
+	authUsername, authPasswordHash := basicAuthColumns(r.BasicAuth)
+	cors := corsColumns(r.CORS)
+	ab := abTestColumns(r.ABTest)
+	methodRoutes := methodRouteColumns(r.MethodRoutes)
+	vault := vaultColumns(r.VaultServiceAuth)
+	retryBudget := retryBudgetColumns(r.RetryBudget)
+	statusRateLimit := statusRateLimitColumns(r.StatusRateLimit)
+
 	tx, err := d.pgx.Begin()
 	if err != nil {
 		return err
@@ -294,6 +520,67 @@ func (d *pgDataStore) updateHTTP(r *router.Route) error {
 		r.Leader,
 		r.Sticky,
 		r.Path,
+		authUsername,
+		authPasswordHash,
+		r.ErrorHandlerService,
+		r.LogTLSFingerprint,
+		r.BlockedTLSFingerprints,
+		r.RewriteLocationHosts,
+		r.StripPathPrefix,
+		r.AddPathPrefix,
+		r.MulticastMode,
+		cors.AllowedOrigins,
+		cors.AllowedMethods,
+		cors.AllowedHeaders,
+		cors.ExposedHeaders,
+		cors.AllowCredentials,
+		cors.MaxAge,
+		r.PushPaths,
+		r.RequestCollapsingEnabled,
+		r.BufferFullRequestBody,
+		r.ForwardTrailers,
+		r.ConsulHealthBackends,
+		r.MaxConcurrentRequests,
+		r.MaxQueuedRequests,
+		r.QueueTimeoutMS,
+		r.PerClientRateLimit,
+		r.ClientRequestsPerSecond,
+		r.ClientBurst,
+		r.MaxTrackedClients,
+		r.RequestFingerprintDedup,
+		r.FingerprintMaxBytes,
+		r.DedupWindowMS,
+		r.EnvoyHCPath,
+		r.EnvoyHCBackendCheck,
+		r.BackendH2CEnabled,
+		r.TLSPassthrough,
+		r.MaxRequestHeaderBytes,
+		r.MaxResponseHeaderBytes,
+		r.BackendTimeoutMS,
+		r.SlowRequestThresholdMS,
+		ab.Names,
+		ab.Weights,
+		ab.Services,
+		ab.BucketCookie,
+		methodRoutes.Methods,
+		methodRoutes.Services,
+		r.ConsistentHashKey,
+		vault.VaultAddr,
+		vault.RoleID,
+		vault.SecretID,
+		vault.TokenPath,
+		r.ResponseSigningKey,
+		r.ClientHints,
+		r.PermissionsPolicy,
+		retryBudget.BudgetPercent,
+		retryBudget.MinimumRetries,
+		statusRateLimit.StatusCodes,
+		statusRateLimit.Thresholds,
+		statusRateLimit.Actions,
+		r.FanoutServices,
+		r.FanoutMaxBodyBytes,
+		r.TLSHandshakeTimeoutMS,
+		r.ReservoirSampleSize,
 		r.ID,
 		r.Domain,
 	)); err != nil {
@@ -407,12 +694,14 @@ func (d *pgDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- str
 			delete(toRemove, route.ID)
 		}
 		if err := h.Set(route); err != nil {
+			cancel()
 			return err
 		}
 	}
 	// send remove for any routes that are no longer in the database
 	for id := range toRemove {
 		if err := h.Remove(id); err != nil {
+			cancel()
 			return err
 		}
 	}
@@ -426,6 +715,7 @@ func (d *pgDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- str
 				return err
 			}
 		case err = <-errc:
+			cancel()
 			return err
 		case <-ctx.Done():
 			// wait for startListener to finish (it will either
@@ -501,7 +791,14 @@ func (d *pgDataStore) scanRouteWithoutCert(route *router.Route, s scannable) err
 	route.Type = d.routeType
 	switch d.tableName {
 	case tableNameHTTP:
-		return s.Scan(
+		var authUsername, authPasswordHash string
+		var cors router.CORS
+		var ab abTestColumnValues
+		var methodRoutes methodRouteColumnValues
+		var vault router.VaultConfig
+		var retryBudget router.RetryBudgetConfig
+		var statusRateLimit statusRateLimitColumnValues
+		if err := s.Scan(
 			&route.ID,
 			&route.ParentRef,
 			&route.Service,
@@ -510,9 +807,80 @@ func (d *pgDataStore) scanRouteWithoutCert(route *router.Route, s scannable) err
 			&route.Domain,
 			&route.Sticky,
 			&route.Path,
+			&authUsername,
+			&authPasswordHash,
+			&route.ErrorHandlerService,
+			&route.LogTLSFingerprint,
+			&route.BlockedTLSFingerprints,
+			&route.RewriteLocationHosts,
+			&route.StripPathPrefix,
+			&route.AddPathPrefix,
+			&route.MulticastMode,
+			&cors.AllowedOrigins,
+			&cors.AllowedMethods,
+			&cors.AllowedHeaders,
+			&cors.ExposedHeaders,
+			&cors.AllowCredentials,
+			&cors.MaxAge,
+			&route.PushPaths,
+			&route.RequestCollapsingEnabled,
+			&route.BufferFullRequestBody,
+			&route.ForwardTrailers,
+			&route.ConsulHealthBackends,
+			&route.MaxConcurrentRequests,
+			&route.MaxQueuedRequests,
+			&route.QueueTimeoutMS,
+			&route.PerClientRateLimit,
+			&route.ClientRequestsPerSecond,
+			&route.ClientBurst,
+			&route.MaxTrackedClients,
+			&route.RequestFingerprintDedup,
+			&route.FingerprintMaxBytes,
+			&route.DedupWindowMS,
+			&route.EnvoyHCPath,
+			&route.EnvoyHCBackendCheck,
+			&route.BackendH2CEnabled,
+			&route.TLSPassthrough,
+			&route.MaxRequestHeaderBytes,
+			&route.MaxResponseHeaderBytes,
+			&route.BackendTimeoutMS,
+			&route.SlowRequestThresholdMS,
+			&ab.Names,
+			&ab.Weights,
+			&ab.Services,
+			&ab.BucketCookie,
+			&methodRoutes.Methods,
+			&methodRoutes.Services,
+			&route.ConsistentHashKey,
+			&vault.VaultAddr,
+			&vault.RoleID,
+			&vault.SecretID,
+			&vault.TokenPath,
+			&route.ResponseSigningKey,
+			&route.ClientHints,
+			&route.PermissionsPolicy,
+			&retryBudget.BudgetPercent,
+			&retryBudget.MinimumRetries,
+			&statusRateLimit.StatusCodes,
+			&statusRateLimit.Thresholds,
+			&statusRateLimit.Actions,
+			&route.FanoutServices,
+			&route.FanoutMaxBodyBytes,
+			&route.TLSHandshakeTimeoutMS,
+			&route.ReservoirSampleSize,
 			&route.CreatedAt,
 			&route.UpdatedAt,
-		)
+		); err != nil {
+			return err
+		}
+		route.BasicAuth = basicAuthFromColumns(authUsername, authPasswordHash)
+		route.CORS = corsFromColumns(cors)
+		route.ABTest = abTestFromColumns(ab)
+		route.MethodRoutes = methodRoutesFromColumns(methodRoutes)
+		route.VaultServiceAuth = vaultFromColumns(vault)
+		route.RetryBudget = retryBudgetFromColumns(retryBudget)
+		route.StatusRateLimit = statusRateLimitFromColumns(statusRateLimit)
+		return nil
 	case tableNameTCP:
 		return s.Scan(
 			&route.ID,
@@ -534,6 +902,13 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 	case tableNameHTTP:
 		var certID, certCert, certKey *string
 		var certCreatedAt, certUpdatedAt *time.Time
+		var authUsername, authPasswordHash string
+		var cors router.CORS
+		var ab abTestColumnValues
+		var methodRoutes methodRouteColumnValues
+		var vault router.VaultConfig
+		var retryBudget router.RetryBudgetConfig
+		var statusRateLimit statusRateLimitColumnValues
 		if err := s.Scan(
 			&route.ID,
 			&route.ParentRef,
@@ -543,6 +918,67 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 			&route.Domain,
 			&route.Sticky,
 			&route.Path,
+			&authUsername,
+			&authPasswordHash,
+			&route.ErrorHandlerService,
+			&route.LogTLSFingerprint,
+			&route.BlockedTLSFingerprints,
+			&route.RewriteLocationHosts,
+			&route.StripPathPrefix,
+			&route.AddPathPrefix,
+			&route.MulticastMode,
+			&cors.AllowedOrigins,
+			&cors.AllowedMethods,
+			&cors.AllowedHeaders,
+			&cors.ExposedHeaders,
+			&cors.AllowCredentials,
+			&cors.MaxAge,
+			&route.PushPaths,
+			&route.RequestCollapsingEnabled,
+			&route.BufferFullRequestBody,
+			&route.ForwardTrailers,
+			&route.ConsulHealthBackends,
+			&route.MaxConcurrentRequests,
+			&route.MaxQueuedRequests,
+			&route.QueueTimeoutMS,
+			&route.PerClientRateLimit,
+			&route.ClientRequestsPerSecond,
+			&route.ClientBurst,
+			&route.MaxTrackedClients,
+			&route.RequestFingerprintDedup,
+			&route.FingerprintMaxBytes,
+			&route.DedupWindowMS,
+			&route.EnvoyHCPath,
+			&route.EnvoyHCBackendCheck,
+			&route.BackendH2CEnabled,
+			&route.TLSPassthrough,
+			&route.MaxRequestHeaderBytes,
+			&route.MaxResponseHeaderBytes,
+			&route.BackendTimeoutMS,
+			&route.SlowRequestThresholdMS,
+			&ab.Names,
+			&ab.Weights,
+			&ab.Services,
+			&ab.BucketCookie,
+			&methodRoutes.Methods,
+			&methodRoutes.Services,
+			&route.ConsistentHashKey,
+			&vault.VaultAddr,
+			&vault.RoleID,
+			&vault.SecretID,
+			&vault.TokenPath,
+			&route.ResponseSigningKey,
+			&route.ClientHints,
+			&route.PermissionsPolicy,
+			&retryBudget.BudgetPercent,
+			&retryBudget.MinimumRetries,
+			&statusRateLimit.StatusCodes,
+			&statusRateLimit.Thresholds,
+			&statusRateLimit.Actions,
+			&route.FanoutServices,
+			&route.FanoutMaxBodyBytes,
+			&route.TLSHandshakeTimeoutMS,
+			&route.ReservoirSampleSize,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 			&certID,
@@ -553,6 +989,13 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 		); err != nil {
 			return err
 		}
+		route.BasicAuth = basicAuthFromColumns(authUsername, authPasswordHash)
+		route.CORS = corsFromColumns(cors)
+		route.ABTest = abTestFromColumns(ab)
+		route.MethodRoutes = methodRoutesFromColumns(methodRoutes)
+		route.VaultServiceAuth = vaultFromColumns(vault)
+		route.RetryBudget = retryBudgetFromColumns(retryBudget)
+		route.StatusRateLimit = statusRateLimitFromColumns(statusRateLimit)
 		if certID != nil {
 			route.Certificate = &router.Certificate{
 				ID:        *certID,
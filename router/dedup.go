@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultFingerprintMaxBytes is the size of the largest request body
+	// which is fingerprinted for routes with RequestFingerprintDedup set
+	// but no FingerprintMaxBytes
+	defaultFingerprintMaxBytes = 64 << 10
+
+	// defaultDedupWindow is how long responses are kept to deduplicate
+	// requests for routes with no DedupWindowMS
+	defaultDedupWindow = 10 * time.Second
+
+	// maxDedupEntries and maxDedupBytes limit the number and total size of
+	// the responses kept for deduplicating the requests to each route, the
+	// least recently stored being forgotten first
+	maxDedupEntries = 1000
+	maxDedupBytes   = 16 << 20
+)
+
+var dedupedRequests = metrics.NewCounter(
+	"strowger_deduplicated_requests_total",
+	"Number of requests answered with the response to an identical earlier request.",
+)
+
+// validateRequestDedup checks that the route's request deduplication options
+// are valid.
+func validateRequestDedup(r *router.Route) error {
+	var msg string
+	switch {
+	case r.FingerprintMaxBytes < 0 || r.DedupWindowMS < 0:
+		msg = "limits can't be negative"
+	case !r.RequestFingerprintDedup && (r.FingerprintMaxBytes > 0 || r.DedupWindowMS > 0):
+		msg = "request_fingerprint_dedup must be set to deduplicate requests"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Request deduplication invalid: " + msg,
+	}
+}
+
+// dedupEntry is the response to a request, kept to be sent in response to
+// identical requests until it expires.
+type dedupEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// size returns the approximate memory used by the entry.
+func (e *dedupEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, vv := range e.header {
+		n += len(k)
+		for _, v := range vv {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+// dedupCache keeps the responses to the most recent requests to a route,
+// keyed by the requests' fingerprints.
+type dedupCache struct {
+	window   time.Duration
+	maxBytes int64
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *dedupEntry of each response, most recent first
+	lru *list.List
+	// size is the total size of the entries
+	size int64
+}
+
+func newDedupCache(r *router.HTTPRoute) *dedupCache {
+	c := &dedupCache{
+		window:   time.Duration(r.DedupWindowMS) * time.Millisecond,
+		maxBytes: int64(r.FingerprintMaxBytes),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if c.window == 0 {
+		c.window = defaultDedupWindow
+	}
+	if c.maxBytes == 0 {
+		c.maxBytes = defaultFingerprintMaxBytes
+	}
+	return c
+}
+
+// get returns the unexpired response stored with the given key, if any.
+func (c *dedupCache) get(key string, now time.Time) *dedupEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*dedupEntry)
+	if now.After(entry.expires) {
+		c.remove(e)
+		return nil
+	}
+	return entry
+}
+
+func (c *dedupCache) set(entry *dedupEntry) {
+	size := entry.size()
+	if size > maxDedupBytes {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	for c.lru.Len() >= maxDedupEntries || c.size+size > maxDedupBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+// remove removes the given element of c.lru. The caller must hold c.mtx.
+func (c *dedupCache) remove(e *list.Element) {
+	entry := e.Value.(*dedupEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// equal returns whether c and other have the same options.
+func (c *dedupCache) equal(other *dedupCache) bool {
+	return c.window == other.window && c.maxBytes == other.maxBytes
+}
+
+// requestFingerprint returns the deduplication key of req, or an empty
+// string if it should not be deduplicated. The body is read up to the
+// route's limit and then restored, with bodies over the limit being passed
+// on without being read any further.
+func (r *httpRoute) requestFingerprint(req *http.Request) string {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ""
+	}
+	// the connections of upgrade requests are taken over by the backend's
+	// protocol, so their responses can't be recorded
+	if req.Header.Get("Upgrade") != "" {
+		return ""
+	}
+	max := r.dedup.maxBytes
+	if req.ContentLength > max {
+		return ""
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+		rest := req.Body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+		if err != nil || int64(len(body)) > max {
+			return ""
+		}
+	}
+
+	h := sha256.New()
+	for _, s := range []string{req.Method, req.Host, req.URL.RequestURI(), req.Header.Get("Authorization"), req.Header.Get("Cookie")} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveDeduplicated responds to req with the stored response to an identical
+// request if there is one, otherwise fanning it out and proxying it to the
+// backend and storing the response.
+func (r *httpRoute) serveDeduplicated(ctx context.Context, w http.ResponseWriter, req *http.Request, key string) {
+	if entry := r.dedup.get(key, time.Now()); entry != nil {
+		dedupedRequests.Inc()
+		copyHeader(w.Header(), entry.header)
+		w.WriteHeader(entry.status)
+		w.Write(entry.body)
+		return
+	}
+
+	if len(r.fanout) > 0 && !r.fanoutRequest(w, req) {
+		return
+	}
+	cw := &recordingWriter{ResponseWriter: w}
+	r.proxyFor(req).ServeHTTP(ctx, cw, req)
+	// errors may be temporary, so only store responses which the backend
+	// completed successfully
+	if cw.status == 0 || cw.status >= 500 || cw.overflow || cw.err != nil {
+		return
+	}
+	header := make(http.Header, len(w.Header()))
+	copyHeader(header, w.Header())
+	r.dedup.set(&dedupEntry{
+		key:     key,
+		status:  cw.status,
+		header:  header,
+		body:    cw.body.Bytes(),
+		expires: time.Now().Add(r.dedup.window),
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestRequestFingerprintDedup(c *C) {
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Request", fmt.Sprint(n))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	route := &router.HTTPRoute{
+		Domain:                  "example.com",
+		Service:                 "test",
+		RequestFingerprintDedup: true,
+		FingerprintMaxBytes:     16,
+	}
+	r := &httpRoute{HTTPRoute: route, dedup: newDedupCache(route)}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	send := func(method, body, auth string) *closeNotifyRecorder {
+		req := httptest.NewRequest(method, "http://example.com/orders", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := newCloseNotifyRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w
+	}
+
+	// the first request is proxied
+	w := send("POST", "order=1", "a")
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(w.Body.String(), Equals, "order=1")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(1))
+
+	// a duplicate gets the same response without being proxied
+	w = send("POST", "order=1", "a")
+	c.Assert(w.Code, Equals, http.StatusCreated)
+	c.Assert(w.Body.String(), Equals, "order=1")
+	c.Assert(w.Header().Get("X-Request"), Equals, "1")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(1))
+
+	// requests with different bodies, credentials or methods are proxied
+	send("POST", "order=2", "a")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(2))
+	send("POST", "order=1", "b")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(3))
+	send("PUT", "order=1", "a")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(4))
+
+	// GET requests and bodies over the limit are not deduplicated, but
+	// are still proxied in full
+	for i := 0; i < 2; i++ {
+		send("GET", "", "a")
+		w = send("POST", strings.Repeat("a", 32), "a")
+		c.Assert(w.Body.String(), Equals, strings.Repeat("a", 32))
+	}
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(8))
+
+	// duplicates are proxied once the window has passed
+	for _, e := range r.dedup.entries {
+		e.Value.(*dedupEntry).expires = time.Now().Add(-time.Second)
+	}
+	w = send("POST", "order=1", "a")
+	c.Assert(w.Header().Get("X-Request"), Equals, "9")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(9))
+}
+
+func (s *S) TestDedupCacheLimits(c *C) {
+	cache := newDedupCache(&router.HTTPRoute{})
+	expires := time.Now().Add(time.Minute)
+	entry := func(key string, size int) *dedupEntry {
+		return &dedupEntry{key: key, status: 200, header: http.Header{}, body: make([]byte, size), expires: expires}
+	}
+
+	// the total size of the responses is limited
+	for i := 0; i < 20; i++ {
+		cache.set(entry(strconv.Itoa(i), 1<<20))
+	}
+	c.Assert(cache.size <= maxDedupBytes, Equals, true)
+	c.Assert(cache.lru.Len(), Equals, 15)
+	c.Assert(cache.get("4", time.Now()), IsNil)
+	c.Assert(cache.get("5", time.Now()), NotNil)
+
+	// replacing an entry doesn't count it twice
+	size := cache.size
+	cache.set(entry("19", 1<<20))
+	c.Assert(cache.size, Equals, size)
+
+	// as is the number of responses
+	for i := 0; i < maxDedupEntries+10; i++ {
+		cache.set(entry("small"+strconv.Itoa(i), 1))
+	}
+	c.Assert(cache.lru.Len(), Equals, maxDedupEntries)
+	c.Assert(cache.entries, HasLen, maxDedupEntries)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/metrics"
+)
+
+// defaultDiscoverdProbeInterval is how often an open circuit checks whether
+// discoverd is reachable again
+const defaultDiscoverdProbeInterval = 5 * time.Second
+
+var discoverdCircuitOpened = metrics.NewCounter(
+	"strowger_discoverd_circuit_opened_total",
+	"Number of times discoverd became unreachable and services were served from the last known instances.",
+)
+
+// DiscoverdCircuitBreaker is a DiscoverdClient which keeps routes working
+// while discoverd is unreachable. It records the instances of the services
+// watched through it, and once watching a service fails the circuit opens,
+// with watches returning the last known instances of their service (or none
+// for services it hasn't seen, so their routes respond with a 503 rather
+// than failing to be added). While open, discoverd is probed every
+// ProbeInterval, and once it is reachable the circuit closes and the
+// watches it served are closed so that their service caches reconnect to
+// discoverd.
+type DiscoverdCircuitBreaker struct {
+	client DiscoverdClient
+
+	// ProbeInterval is how often discoverd is probed while the circuit is
+	// open.
+	ProbeInterval time.Duration
+
+	mtx sync.Mutex
+	// recovered is non-nil while the circuit is open, and is closed when
+	// it closes
+	recovered chan struct{}
+	// instances are the last known instances of each service, keyed by
+	// instance ID
+	instances map[string]map[string]*discoverd.Instance
+}
+
+func NewDiscoverdCircuitBreaker(client DiscoverdClient, probeInterval time.Duration) *DiscoverdCircuitBreaker {
+	return &DiscoverdCircuitBreaker{
+		client:        client,
+		ProbeInterval: probeInterval,
+		instances:     make(map[string]map[string]*discoverd.Instance),
+	}
+}
+
+func (b *DiscoverdCircuitBreaker) Service(name string) discoverd.Service {
+	return &breakerService{Service: b.client.Service(name), b: b, name: name}
+}
+
+func (b *DiscoverdCircuitBreaker) AddService(name string, conf *discoverd.ServiceConfig) error {
+	return b.client.AddService(name, conf)
+}
+
+// Open returns whether discoverd is currently considered unreachable.
+func (b *DiscoverdCircuitBreaker) Open() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.recovered != nil
+}
+
+// trip opens the circuit after watching the given service failed, probing
+// it until discoverd is reachable again. It returns the channel which is
+// closed when the circuit closes.
+func (b *DiscoverdCircuitBreaker) trip(service discoverd.Service, name string, err error) chan struct{} {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.recovered == nil {
+		logger.Error("discoverd unreachable, serving last known service instances", "service", name, "err", err)
+		discoverdCircuitOpened.Inc()
+		b.recovered = make(chan struct{})
+		go b.probe(service)
+	}
+	return b.recovered
+}
+
+// probe watches the given service every ProbeInterval until it succeeds,
+// then closes the circuit.
+func (b *DiscoverdCircuitBreaker) probe(service discoverd.Service) {
+	for {
+		time.Sleep(b.ProbeInterval)
+		events := make(chan *discoverd.Event)
+		s, err := service.Watch(events)
+		if err != nil {
+			continue
+		}
+		go func() {
+			for range events {
+			}
+		}()
+		s.Close()
+		break
+	}
+
+	logger.Info("discoverd reachable again")
+	b.mtx.Lock()
+	close(b.recovered)
+	b.recovered = nil
+	b.mtx.Unlock()
+}
+
+// record updates the last known instances of a service with an event.
+func (b *DiscoverdCircuitBreaker) record(name string, e *discoverd.Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	instances, ok := b.instances[name]
+	if !ok {
+		instances = make(map[string]*discoverd.Instance)
+		b.instances[name] = instances
+	}
+	switch e.Kind {
+	case discoverd.EventKindUp, discoverd.EventKindUpdate:
+		instances[e.Instance.ID] = e.Instance
+	case discoverd.EventKindDown:
+		delete(instances, e.Instance.ID)
+	}
+}
+
+// lastKnown returns the last known instances of a service.
+func (b *DiscoverdCircuitBreaker) lastKnown(name string) []*discoverd.Instance {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	instances := make([]*discoverd.Instance, 0, len(b.instances[name]))
+	for _, inst := range b.instances[name] {
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// breakerService is a discoverd.Service whose watches go through a
+// DiscoverdCircuitBreaker.
+type breakerService struct {
+	discoverd.Service
+
+	b    *DiscoverdCircuitBreaker
+	name string
+}
+
+func (s *breakerService) Watch(events chan *discoverd.Event) (stream.Stream, error) {
+	s.b.mtx.Lock()
+	recovered := s.b.recovered
+	s.b.mtx.Unlock()
+	if recovered != nil {
+		return s.watchLastKnown(events, recovered), nil
+	}
+
+	inner := make(chan *discoverd.Event)
+	innerStream, err := s.Service.Watch(inner)
+	if err != nil {
+		return s.watchLastKnown(events, s.b.trip(s.Service, s.name, err)), nil
+	}
+	st := &breakerStream{Stream: innerStream, stop: make(chan struct{})}
+	go func() {
+		defer close(events)
+		for e := range inner {
+			s.b.record(s.name, e)
+			select {
+			case events <- e:
+			case <-st.stop:
+				// let the inner stream finish closing
+				for range inner {
+				}
+				return
+			}
+		}
+	}()
+	return st, nil
+}
+
+// watchLastKnown sends the last known instances of the service followed by
+// a current event, then closes events once the circuit closes so that the
+// watcher reconnects to discoverd.
+func (s *breakerService) watchLastKnown(events chan *discoverd.Event, recovered chan struct{}) stream.Stream {
+	st := stream.New()
+	instances := s.b.lastKnown(s.name)
+	go func() {
+		for _, inst := range instances {
+			select {
+			case events <- &discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst}:
+			case <-st.StopCh:
+				return
+			}
+		}
+		select {
+		case events <- &discoverd.Event{Kind: discoverd.EventKindCurrent}:
+		case <-st.StopCh:
+			return
+		}
+		select {
+		case <-recovered:
+			close(events)
+		case <-st.StopCh:
+		}
+	}()
+	return st
+}
+
+// breakerStream stops relaying events from a watch of discoverd when closed
+type breakerStream struct {
+	stream.Stream
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *breakerStream) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.Stream.Close()
+}
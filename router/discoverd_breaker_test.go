@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// flakyDiscoverd is a memDiscoverd which can be made unreachable, failing
+// new watches and closing the existing ones
+type flakyDiscoverd struct {
+	*memDiscoverd
+
+	mtx     sync.Mutex
+	down    bool
+	dropped chan struct{}
+}
+
+func newFlakyDiscoverd() *flakyDiscoverd {
+	return &flakyDiscoverd{memDiscoverd: newMemDiscoverd(), dropped: make(chan struct{})}
+}
+
+func (d *flakyDiscoverd) Service(name string) discoverd.Service {
+	return &flakyDiscoverdService{Service: d.memDiscoverd.Service(name), d: d}
+}
+
+func (d *flakyDiscoverd) setDown(down bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if down && !d.down {
+		close(d.dropped)
+	} else if !down && d.down {
+		d.dropped = make(chan struct{})
+	}
+	d.down = down
+}
+
+type flakyDiscoverdService struct {
+	discoverd.Service
+	d *flakyDiscoverd
+}
+
+func (s *flakyDiscoverdService) Watch(events chan *discoverd.Event) (stream.Stream, error) {
+	s.d.mtx.Lock()
+	down, dropped := s.d.down, s.d.dropped
+	s.d.mtx.Unlock()
+	if down {
+		return nil, errors.New("discoverd unreachable")
+	}
+
+	inner := make(chan *discoverd.Event)
+	innerStream, _ := s.Service.Watch(inner)
+	st := stream.New()
+	go func() {
+		defer innerStream.Close()
+		for {
+			select {
+			case e := <-inner:
+				select {
+				case events <- e:
+				case <-dropped:
+					close(events)
+					return
+				case <-st.StopCh:
+					return
+				}
+			case <-dropped:
+				close(events)
+				return
+			case <-st.StopCh:
+				return
+			}
+		}
+	}()
+	return st, nil
+}
+
+func (s *S) TestDiscoverdCircuitBreaker(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+
+	d := newFlakyDiscoverd()
+	b := NewDiscoverdCircuitBreaker(d, 10*time.Millisecond)
+	l := startFakeHTTPListener(c, newMemDataStore("http"), b)
+	defer l.Close()
+
+	get := func(host string) (int, string) {
+		res, err := httpClient.Do(newReq("http://"+l.Addr, host))
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res.StatusCode, string(body)
+	}
+	waitForBackend := func(host, expected string) {
+		timeout := time.After(waitTimeout)
+		for {
+			if status, body := get(host); status == http.StatusOK && body == expected {
+				return
+			}
+			select {
+			case <-timeout:
+				c.Fatalf("timed out waiting for %s to be served by backend %s", host, expected)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	addRoute(c, l, router.HTTPRoute{Domain: "1.example.com", Service: "web"}.ToRoute())
+	registerFakeBackend(c, l, d.memDiscoverd, "web", srv1.Listener.Addr().String())
+	waitForBackend("1.example.com", "1")
+	c.Assert(b.Open(), Equals, false)
+
+	// routes keep using the last known backends while discoverd is down,
+	// and routes to services it hasn't seen can still be added
+	d.setDown(true)
+	addRoute(c, l, router.HTTPRoute{Domain: "2.example.com", Service: "api"}.ToRoute())
+	c.Assert(b.Open(), Equals, true)
+	status, _ := get("2.example.com")
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	for i := 0; i < 5; i++ {
+		status, body := get("1.example.com")
+		c.Assert(status, Equals, http.StatusOK)
+		c.Assert(body, Equals, "1")
+	}
+
+	// the services are watched again once discoverd is back
+	d.memDiscoverd.Register("api", srv2.Listener.Addr().String())
+	d.setDown(false)
+	waitForBackend("2.example.com", "2")
+	c.Assert(b.Open(), Equals, false)
+	waitForBackend("1.example.com", "1")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DrainTimeoutError is returned by CloseGraceful when connections are still
+// active once the timeout has passed.
+type DrainTimeoutError struct {
+	// Active is the number of connections which were forcibly closed.
+	Active int
+}
+
+func (e DrainTimeoutError) Error() string {
+	return fmt.Sprintf("router: timed out draining connections, %d still active", e.Active)
+}
+
+// connStateHook returns an http.Server ConnState hook which counts the open
+// connections to a listener serving the given protocol, and records them
+// to the connection journal if it is enabled.
+func (s *HTTPListener) connStateHook(proto string) func(net.Conn, http.ConnState) {
+	var journal func(net.Conn, http.ConnState)
+	if s.journal != nil {
+		journal = s.journal.connState(proto)
+	}
+	return func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&s.openConns, 1)
+		case http.StateHijacked, http.StateClosed:
+			atomic.AddInt64(&s.openConns, -1)
+		}
+		if journal != nil {
+			journal(c, state)
+		}
+	}
+}
+
+// CloseGraceful stops accepting connections and waits up to timeout for the
+// active requests to complete before closing the listener, forcibly closing
+// any connections which are still active and returning a DrainTimeoutError.
+// Hijacked connections (e.g. WebSockets) are not waited for.
+func (s *HTTPListener) CloseGraceful(timeout time.Duration) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	// mark the listener closed so that routes can't be changed while
+	// draining, but keep the services open until the requests to them
+	// have completed
+	s.closed = true
+	servers := s.servers
+	s.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var timedOut int32
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				atomic.StoreInt32(&timedOut, 1)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	var err error
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = DrainTimeoutError{Active: int(atomic.LoadInt64(&s.openConns))}
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopSync()
+	s.closeRequestSamples()
+	for _, service := range s.services {
+		service.Close()
+	}
+	return err
+}
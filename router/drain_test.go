@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestCloseGraceful(c *C) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	newListener := func() *HTTPListener {
+		l := &HTTPListener{
+			Addr:      "127.0.0.1:0",
+			routes:    make(map[string]*httpRoute),
+			domains:   make(map[string]*node),
+			services:  make(map[string]*service),
+			discoverd: newMemDiscoverd(),
+			wm:        NewWatchManager(),
+			cookieKey: &[32]byte{},
+			stopSync:  func() {},
+		}
+		c.Assert((&httpSyncHandler{l: l}).Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web"}), IsNil)
+		backends := func() []string { return []string{backend.Listener.Addr().String()} }
+		l.findRoute("example.com", "/").rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+		c.Assert(l.listenAndServe(), IsNil)
+		return l
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	get := func(l *HTTPListener) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "http://"+l.listener.Addr().String(), nil)
+			req.Host = "example.com"
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			ch <- result{string(body), err}
+		}()
+		return ch
+	}
+
+	// active requests complete before the listener is closed
+	l := newListener()
+	res := get(l)
+	<-started
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	c.Assert(l.CloseGraceful(5*time.Second), IsNil)
+	r := <-res
+	c.Assert(r.err, IsNil)
+	c.Assert(r.body, Equals, "done")
+	c.Assert(l.closed, Equals, true)
+
+	// connections still active after the timeout are forcibly closed
+	l = newListener()
+	res = get(l)
+	<-started
+	err := l.CloseGraceful(100 * time.Millisecond)
+	c.Assert(err, DeepEquals, DrainTimeoutError{Active: 1})
+	c.Assert((<-res).err, NotNil)
+	close(release)
+
+	// closing again is a no-op
+	c.Assert(l.CloseGraceful(time.Second), IsNil)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestEarlyHints(c *C) {
+	const link = "</style.css>; rel=preload; as=style"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", link)
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte(req.Proto))
+	})
+	http1Backend := httptest.NewServer(handler)
+	defer http1Backend.Close()
+	h2cBackend := newH2CBackend(c, handler)
+	defer h2cBackend.Close()
+
+	for _, t := range []struct {
+		backend      string
+		h2c          bool
+		clientHTTP2  bool
+		backendProto string
+	}{
+		{backend: http1Backend.Listener.Addr().String(), clientHTTP2: true, backendProto: "HTTP/1.1"},
+		{backend: h2cBackend.Addr().String(), h2c: true, clientHTTP2: true, backendProto: "HTTP/2.0"},
+		{backend: http1Backend.Listener.Addr().String(), clientHTTP2: false, backendProto: "HTTP/1.1"},
+	} {
+		backend := t.backend
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+		r.rp = proxy.NewReverseProxy(func() []string { return []string{backend} }, &[32]byte{}, false, &service{}, logger)
+		r.rp.SetBackendH2C(t.h2c)
+
+		frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			r.ServeHTTP(context.Background(), w, req)
+		}))
+		frontend.EnableHTTP2 = t.clientHTTP2
+		frontend.StartTLS()
+
+		var hints []textproto.MIMEHeader
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				c.Assert(code, Equals, http.StatusEarlyHints)
+				hints = append(hints, header)
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		res, err := frontend.Client().Do(req)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		frontend.Close()
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, t.backendProto)
+		// the hints aren't repeated in the final response
+		c.Assert(res.Header.Get("Link"), Equals, "")
+
+		// hints are only forwarded to HTTP/2 clients
+		if t.clientHTTP2 {
+			c.Assert(res.ProtoMajor, Equals, 2)
+			c.Assert(hints, HasLen, 1)
+			c.Assert(hints[0].Get("Link"), Equals, link)
+		} else {
+			c.Assert(res.ProtoMajor, Equals, 1)
+			c.Assert(hints, HasLen, 0)
+		}
+	}
+}
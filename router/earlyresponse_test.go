@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// earlyResponseBackend returns the address of a backend which rejects
+// requests with a 413 as soon as it has read their headers, closing the
+// connection without reading the body.
+func earlyResponseBackend(c *C) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func (s *S) TestEarlyBackendResponse(c *C) {
+	addr, cleanup := earlyResponseBackend(c)
+	defer cleanup()
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	r.rp = proxy.NewReverseProxy(func() []string { return []string{addr} }, &[32]byte{}, false, &service{}, logger)
+
+	// the backend closing the connection makes writing the rest of the
+	// body fail, which shouldn't stop its response being relayed
+	for i := 0; i < 10; i++ {
+		body, bodyW := io.Pipe()
+		go func() {
+			chunk := make([]byte, 1<<20)
+			for {
+				if _, err := bodyW.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+		req := httptest.NewRequest("POST", "http://example.com/", body)
+		req.ContentLength = 64 << 20
+		w := newCloseNotifyRecorder()
+		done := make(chan struct{})
+		go func() {
+			r.ServeHTTP(context.Background(), w, req)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for response")
+		}
+		body.Close()
+		c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func (s *S) TestExpectContinueBackendRejection(c *C) {
+	addr, cleanup := earlyResponseBackend(c)
+	defer cleanup()
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	r.rp = proxy.NewReverseProxy(func() []string { return []string{addr} }, &[32]byte{}, false, &service{}, logger)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(context.Background(), w, req)
+	}))
+	defer srv.Close()
+
+	// clients waiting for 100 Continue get the backend's rejection
+	// without being asked to send the body
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", 64<<20)
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(strings.TrimSpace(status), Equals, "HTTP/1.1 413 Request Entity Too Large")
+}
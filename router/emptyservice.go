@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// emptyServiceWait returns how long requests wait for the route's service to
+// have instances if it has none, which is zero if they fail immediately.
+func (r *httpRoute) emptyServiceWait() time.Duration {
+	if r.config == nil {
+		return 0
+	}
+	return time.Duration(r.config().EmptyServiceWaitMS) * time.Millisecond
+}
+
+// notifyInstanceUp wakes the requests waiting for the service to have
+// instances.
+func (s *service) notifyInstanceUp() {
+	s.instanceUpMtx.Lock()
+	defer s.instanceUpMtx.Unlock()
+	close(s.instanceUp)
+	s.instanceUp = make(chan struct{})
+}
+
+// waitForInstances waits up to timeout for the service to have an instance,
+// returning whether it has one. It returns early if ctx is done (e.g. the
+// client went away) or the service is closed.
+func (s *service) waitForInstances(ctx context.Context, timeout time.Duration) bool {
+	var timer *time.Timer
+	for {
+		// get the channel before checking the instances so that an
+		// instance coming up in between isn't missed
+		s.instanceUpMtx.Lock()
+		up := s.instanceUp
+		s.instanceUpMtx.Unlock()
+		if len(s.Addrs()) > 0 {
+			return true
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-up:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-s.closed:
+			return false
+		}
+	}
+}
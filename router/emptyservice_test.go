@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestEmptyServiceWait(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+
+	get := func() (int, time.Duration) {
+		start := time.Now()
+		res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.StatusCode, time.Since(start)
+	}
+
+	// requests fail immediately by default
+	status, _ := get()
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+
+	// requests wait for the service to have instances, failing if none
+	// come up in time
+	c.Assert(l.Reload(&ListenerConfig{EmptyServiceWaitMS: 100}), IsNil)
+	status, elapsed := get()
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	c.Assert(elapsed >= 100*time.Millisecond, Equals, true)
+
+	// and are sent to the instance once it comes up
+	c.Assert(l.Reload(&ListenerConfig{EmptyServiceWaitMS: 5000}), IsNil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		d.Register("test", srv.Listener.Addr().String())
+	}()
+	status, elapsed = get()
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(elapsed < 5*time.Second, Equals, true)
+}
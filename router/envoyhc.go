@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// envoyHCHeader is set to "true" on health check requests sent by Envoy
+const envoyHCHeader = "X-Envoy-Health-Check"
+
+// validateEnvoyHC checks that the route's Envoy health check options are
+// valid.
+func validateEnvoyHC(r *router.Route) error {
+	var msg string
+	switch {
+	case r.EnvoyHCPath != "" && !strings.HasPrefix(r.EnvoyHCPath, "/"):
+		msg = "envoy_hc_path must start with a /"
+	case r.EnvoyHCBackendCheck && r.EnvoyHCPath == "":
+		msg = "envoy_hc_path must be set to check the backend"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Envoy health check invalid: " + msg,
+	}
+}
+
+// isEnvoyHealthCheck returns whether req is an Envoy health check of the
+// route, which must be a GET or HEAD request from a trusted proxy.
+func (r *httpRoute) isEnvoyHealthCheck(req *http.Request) bool {
+	if req.URL.Path != r.EnvoyHCPath || !strings.EqualFold(req.Header.Get(envoyHCHeader), "true") {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	return err == nil && r.config().isTrustedProxy(ip)
+}
+
+// handleEnvoyHealthCheck responds to an Envoy health check and returns true
+// unless EnvoyHCBackendCheck is set, in which case the health check is
+// handled like any other request so that it is subject to the route's
+// authentication. The health check header is removed from requests which
+// aren't health checks so that backends can rely on it.
+func (r *httpRoute) handleEnvoyHealthCheck(w http.ResponseWriter, req *http.Request) bool {
+	if !r.isEnvoyHealthCheck(req) {
+		req.Header.Del(envoyHCHeader)
+		return false
+	}
+	if r.EnvoyHCBackendCheck {
+		return false
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+	return true
+}
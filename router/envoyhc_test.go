@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestEnvoyHealthCheck(c *C) {
+	var requests int64
+	var hcHeader atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		hcHeader.Store(req.Header.Get("X-Envoy-Health-Check"))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	l := &HTTPListener{}
+	c.Assert(l.Reload(&ListenerConfig{TrustedProxies: []string{"10.0.0.1"}}), IsNil)
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{
+			Domain:      "example.com",
+			Service:     "test",
+			EnvoyHCPath: "/healthz",
+			BasicAuth:   &router.BasicAuth{Username: "user", PasswordHash: hashPassword([]byte("salt"), "password")},
+		},
+		config: l.getConfig,
+	}
+	var err error
+	r.basicAuth, err = newBasicAuthChecker(r.BasicAuth)
+	c.Assert(err, IsNil)
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	serve := func(method, path, remoteIP string, envoy bool) int {
+		req := httptest.NewRequest(method, "http://example.com"+path, nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		if envoy {
+			req.Header.Set("x-envoy-health-check", "true")
+		}
+		req.SetBasicAuth("user", "password")
+		w := newCloseNotifyRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w.Code
+	}
+
+	// health checks from trusted proxies are answered by the router
+	c.Assert(serve("GET", "/healthz", "10.0.0.1", true), Equals, http.StatusOK)
+	c.Assert(serve("HEAD", "/healthz", "10.0.0.1", true), Equals, http.StatusOK)
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(0))
+
+	// other requests are routed normally, without the header
+	for _, t := range []struct {
+		method   string
+		path     string
+		remoteIP string
+		envoy    bool
+	}{
+		{"GET", "/healthz", "10.0.0.1", false},
+		{"GET", "/other", "10.0.0.1", true},
+		{"POST", "/healthz", "10.0.0.1", true},
+		{"GET", "/healthz", "10.0.0.2", true},
+	} {
+		hcHeader.Store("")
+		c.Assert(serve(t.method, t.path, t.remoteIP, t.envoy), Equals, http.StatusTeapot, Commentf("%+v", t))
+		c.Assert(hcHeader.Load(), Equals, "", Commentf("%+v", t))
+	}
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(4))
+
+	// health checks proxied to the backend are authenticated
+	r.EnvoyHCBackendCheck = true
+	c.Assert(serve("GET", "/healthz", "10.0.0.1", true), Equals, http.StatusTeapot)
+	c.Assert(hcHeader.Load(), Equals, "true")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(5))
+	r.BasicAuth.PasswordHash = hashPassword([]byte("salt"), "other")
+	r.basicAuth, err = newBasicAuthChecker(r.BasicAuth)
+	c.Assert(err, IsNil)
+	c.Assert(serve("GET", "/healthz", "10.0.0.1", true), Equals, http.StatusUnauthorized)
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(5))
+}
+
+func (s *S) TestValidateEnvoyHC(c *C) {
+	for _, t := range []struct {
+		route *router.Route
+		valid bool
+	}{
+		{&router.Route{}, true},
+		{&router.Route{EnvoyHCPath: "/healthz"}, true},
+		{&router.Route{EnvoyHCPath: "/healthz", EnvoyHCBackendCheck: true}, true},
+		{&router.Route{EnvoyHCPath: "healthz"}, false},
+		{&router.Route{EnvoyHCBackendCheck: true}, false},
+	} {
+		err := validateEnvoyHC(t.route)
+		c.Assert(err == nil, Equals, t.valid, Commentf("%+v: %v", t.route, err))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// envRoutePrefix is the prefix of environment variables which define routes
+// loaded by LoadEnvRoutes
+const envRoutePrefix = "STROWGER_ROUTE_"
+
+// LoadEnvRoutes adds HTTP routes defined by STROWGER_ROUTE_* environment
+// variables, so that a domain can be served before any routes are added
+// using the API, for example:
+//
+//	STROWGER_ROUTE_0=domain=example.com,service=myapp,cert=/certs/cert.pem,key=/certs/key.pem
+//
+// The supported options are domain and service (both required), path, and
+// cert and key (which are paths to PEM files). The routes only exist in
+// memory and are replaced by any route in the data store with the same
+// domain and path. It must be called after the listener has been started.
+func (s *HTTPListener) LoadEnvRoutes() error {
+	routes, err := parseEnvRoutes(os.Environ())
+	if err != nil {
+		return err
+	}
+
+	h := &httpSyncHandler{l: s}
+	for _, route := range routes {
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			return ErrClosed
+		}
+		if s.hasRoute(route.Domain, route.Path, "") {
+			s.mtx.Unlock()
+			logger.Info("not loading route from environment, domain and path already routed", "id", route.ID, "domain", route.Domain, "path", route.Path)
+			continue
+		}
+		if s.envRoutes == nil {
+			s.envRoutes = make(map[string]struct{})
+		}
+		s.envRoutes[route.ID] = struct{}{}
+		s.mtx.Unlock()
+
+		if err := h.Set(route); err != nil {
+			s.mtx.Lock()
+			delete(s.envRoutes, route.ID)
+			s.mtx.Unlock()
+			return fmt.Errorf("router: error adding route %s from the environment: %s", route.ID, err)
+		}
+	}
+	return nil
+}
+
+// hasRoute returns whether there is a route other than the one with the
+// given ID for the given domain and path. The caller must hold s.mtx.
+func (s *HTTPListener) hasRoute(domain, path, exceptID string) bool {
+	for id, r := range s.routes {
+		if id != exceptID && strings.EqualFold(r.Domain, domain) && r.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// removeConflictingEnvRoutes removes any routes loaded from the environment
+// with the same domain and path as r, which take precedence. The caller must
+// hold s.mtx.
+func (s *HTTPListener) removeConflictingEnvRoutes(r *httpRoute) {
+	for id := range s.envRoutes {
+		env, ok := s.routes[id]
+		if ok && strings.EqualFold(env.Domain, r.Domain) && env.Path == r.Path {
+			logger.Info("replacing route loaded from environment", "id", id, "domain", r.Domain, "path", r.Path)
+			s.removeRoute(id)
+		}
+	}
+}
+
+// parseEnvRoutes returns the routes defined in the given environment, sorted
+// by variable name.
+func parseEnvRoutes(environ []string) ([]*router.Route, error) {
+	var vars []string
+	for _, env := range environ {
+		if strings.HasPrefix(env, envRoutePrefix) {
+			vars = append(vars, env)
+		}
+	}
+	sort.Strings(vars)
+
+	routes := make([]*router.Route, 0, len(vars))
+	for _, env := range vars {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		route, err := parseEnvRoute(strings.ToLower(strings.TrimPrefix(kv[0], envRoutePrefix)), kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("router: invalid %s: %s", kv[0], err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func parseEnvRoute(name, value string) (*router.Route, error) {
+	route := &router.Route{Type: "http", ID: "env-" + name, Path: "/"}
+	var certFile, keyFile string
+	for _, opt := range strings.Split(value, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", opt)
+		}
+		switch key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); key {
+		case "domain":
+			route.Domain = val
+		case "service":
+			route.Service = val
+		case "path":
+			route.Path = val
+		case "cert":
+			certFile = val
+		case "key":
+			keyFile = val
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if route.Domain == "" || route.Service == "" {
+		return nil, fmt.Errorf("domain and service must be set")
+	}
+	if !strings.HasPrefix(route.Path, "/") || !strings.HasSuffix(route.Path, "/") {
+		return nil, fmt.Errorf("path must start and end with a slash")
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+	if certFile != "" {
+		cert, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		route.Certificate = &router.Certificate{Cert: string(cert), Key: string(key)}
+	}
+	return route, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestLoadEnvRoutes(c *C) {
+	dir, err := ioutil.TempDir("", "router-env-routes")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	cert := tlsConfigForDomain("env.example.org")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(certFile, []byte(cert.Cert), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, []byte(cert.PrivateKey), 0600), IsNil)
+
+	vars := map[string]string{
+		"STROWGER_ROUTE_0": "domain=env.example.org,service=web,cert=" + certFile + ",key=" + keyFile,
+		"STROWGER_ROUTE_1": "domain=env.example.org,service=api,path=/api/",
+	}
+	for k, v := range vars {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	c.Assert(l.LoadEnvRoutes(), IsNil)
+
+	r := l.findRoute("env.example.org", "/")
+	c.Assert(r, NotNil)
+	c.Assert(r.ID, Equals, "env-0")
+	c.Assert(r.Service, Equals, "web")
+	c.Assert(r.keypair, NotNil)
+	r = l.findRoute("env.example.org", "/api/users")
+	c.Assert(r, NotNil)
+	c.Assert(r.Service, Equals, "api")
+
+	// the data store sync doesn't know about routes from the environment
+	h := &httpSyncHandler{l: l}
+	c.Assert(h.Current(), HasLen, 0)
+
+	// routes from the data store replace routes from the environment
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "db-1", Domain: "ENV.example.org", Path: "/", Service: "web2"}), IsNil)
+	r = l.findRoute("env.example.org", "/")
+	c.Assert(r, NotNil)
+	c.Assert(r.ID, Equals, "db-1")
+	c.Assert(l.routes, HasLen, 2)
+	c.Assert(l.envRoutes, HasLen, 1)
+	c.Assert(h.Current(), DeepEquals, map[string]struct{}{"db-1": {}})
+
+	// reloading doesn't replace routes from the data store
+	c.Assert(l.LoadEnvRoutes(), IsNil)
+	c.Assert(l.findRoute("env.example.org", "/").ID, Equals, "db-1")
+
+	for _, value := range []string{
+		"service=web",
+		"domain=example.org",
+		"domain=example.org,service=web,path=api",
+		"domain=example.org,service=web,cert=" + certFile,
+		"domain=example.org,service=web,sticky=true",
+		"domain",
+	} {
+		_, err := parseEnvRoutes([]string{"STROWGER_ROUTE_X=" + value})
+		c.Assert(err, NotNil, Commentf(value))
+	}
+}
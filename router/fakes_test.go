@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// memDataStore is an in-memory DataStore which syncs changes to listeners
+// as they are made, for running listeners without postgres. Unlike the
+// postgres data store it doesn't validate routes.
+type memDataStore struct {
+	routeType string
+
+	mtx    sync.Mutex
+	routes map[string]*router.Route
+	certs  map[string]*router.Certificate
+	// syncs are the channels of the running syncs, which are sent the IDs
+	// of changed routes
+	syncs map[chan string]struct{}
+}
+
+func newMemDataStore(routeType string) *memDataStore {
+	return &memDataStore{
+		routeType: routeType,
+		routes:    make(map[string]*router.Route),
+		certs:     make(map[string]*router.Certificate),
+		syncs:     make(map[chan string]struct{}),
+	}
+}
+
+// notify sends the ID of a changed route to the running syncs. The caller
+// must hold d.mtx.
+func (d *memDataStore) notify(id string) {
+	for ch := range d.syncs {
+		// syncs get the route when they receive its ID, so the order
+		// the IDs are received in doesn't matter
+		go func(ch chan string) { ch <- id }(ch)
+	}
+}
+
+// conflicts returns whether r has the same domain and path, or the same
+// port, as another route. The caller must hold d.mtx.
+func (d *memDataStore) conflicts(r *router.Route) bool {
+	for _, other := range d.routes {
+		if other.ID == r.ID {
+			continue
+		}
+		if d.routeType == "http" && other.Domain == r.Domain && other.Path == r.Path {
+			return true
+		}
+		if d.routeType == "tcp" && other.Port == r.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *memDataStore) Add(r *router.Route) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	r.Type = d.routeType
+	if r.Type == "http" {
+		r.Domain = canonicalDomain(r.Domain)
+		if r.Path == "" {
+			r.Path = "/"
+		}
+	}
+	if d.conflicts(r) {
+		return ErrConflict
+	}
+	r.ID = random.UUID()
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = r.CreatedAt
+	route := *r
+	d.routes[r.ID] = &route
+	d.notify(r.ID)
+	return nil
+}
+
+func (d *memDataStore) Update(r *router.Route) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	existing, ok := d.routes[r.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	r.Type = d.routeType
+	if d.conflicts(r) {
+		return ErrConflict
+	}
+	r.CreatedAt = existing.CreatedAt
+	r.UpdatedAt = time.Now()
+	route := *r
+	d.routes[r.ID] = &route
+	d.notify(r.ID)
+	return nil
+}
+
+func (d *memDataStore) Get(id string) (*router.Route, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	r, ok := d.routes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	route := *r
+	return &route, nil
+}
+
+func (d *memDataStore) List() ([]*router.Route, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	routes := make([]*router.Route, 0, len(d.routes))
+	for _, r := range d.routes {
+		route := *r
+		routes = append(routes, &route)
+	}
+	return routes, nil
+}
+
+func (d *memDataStore) Remove(id string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.routes[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.routes, id)
+	d.notify(id)
+	return nil
+}
+
+func (d *memDataStore) AddCert(c *router.Certificate) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	c.ID = random.UUID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	cert := *c
+	d.certs[c.ID] = &cert
+	return nil
+}
+
+func (d *memDataStore) GetCert(id string) (*router.Certificate, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	c, ok := d.certs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cert := *c
+	return &cert, nil
+}
+
+func (d *memDataStore) ListCerts() ([]*router.Certificate, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	certs := make([]*router.Certificate, 0, len(d.certs))
+	for _, c := range d.certs {
+		cert := *c
+		certs = append(certs, &cert)
+	}
+	return certs, nil
+}
+
+func (d *memDataStore) ListCertRoutes(id string) ([]*router.Route, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var routes []*router.Route
+	for _, r := range d.routes {
+		if r.Certificate != nil && r.Certificate.ID == id {
+			route := *r
+			routes = append(routes, &route)
+		}
+	}
+	return routes, nil
+}
+
+func (d *memDataStore) RemoveCert(id string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if _, ok := d.certs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.certs, id)
+	return nil
+}
+
+func (d *memDataStore) Ping() error {
+	return nil
+}
+
+func (d *memDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+	ids := make(chan string)
+	d.mtx.Lock()
+	d.syncs[ids] = struct{}{}
+	d.mtx.Unlock()
+	defer func() {
+		d.mtx.Lock()
+		delete(d.syncs, ids)
+		d.mtx.Unlock()
+	}()
+
+	routes, _ := d.List()
+	toRemove := h.Current()
+	for _, route := range routes {
+		delete(toRemove, route.ID)
+		if err := h.Set(route); err != nil {
+			return err
+		}
+	}
+	for id := range toRemove {
+		if err := h.Remove(id); err != nil {
+			return err
+		}
+	}
+	close(startc)
+
+	for {
+		select {
+		case id := <-ids:
+			route, err := d.Get(id)
+			if err == ErrNotFound {
+				err = h.Remove(id)
+				if err == ErrNotFound {
+					err = nil
+				}
+			} else if err == nil {
+				err = h.Set(route)
+			}
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// memDiscoverd is an in-memory DiscoverdClient whose service instances are
+// registered with Register.
+type memDiscoverd struct {
+	mtx      sync.Mutex
+	services map[string]*memDiscoverdService
+}
+
+func newMemDiscoverd() *memDiscoverd {
+	return &memDiscoverd{services: make(map[string]*memDiscoverdService)}
+}
+
+func (d *memDiscoverd) Service(name string) discoverd.Service {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	s, ok := d.services[name]
+	if !ok {
+		s = &memDiscoverdService{
+			instances: make(map[string]*discoverd.Instance),
+			watchers:  make(map[chan *discoverd.Event]struct{}),
+		}
+		d.services[name] = s
+	}
+	return s
+}
+
+func (d *memDiscoverd) AddService(string, *discoverd.ServiceConfig) error {
+	return nil
+}
+
+// Register adds an instance of the given service, returning a function
+// which removes it.
+func (d *memDiscoverd) Register(service, addr string) func() {
+	return d.RegisterInstance(service, &discoverd.Instance{ID: random.UUID(), Addr: addr, Proto: "http", Meta: map[string]string{}})
+}
+
+// RegisterInstance adds the given instance of the service, returning a
+// function which removes it.
+func (d *memDiscoverd) RegisterInstance(service string, inst *discoverd.Instance) func() {
+	s := d.Service(service).(*memDiscoverdService)
+	s.update(discoverd.EventKindUp, inst)
+	return func() { s.update(discoverd.EventKindDown, inst) }
+}
+
+// newFakeService returns a service backed by a memDiscoverd service with the
+// given instances
+func newFakeService(c *C, name string, instances ...*discoverd.Instance) *service {
+	d := newMemDiscoverd()
+	for _, inst := range instances {
+		d.RegisterInstance(name, inst)
+	}
+	sc, err := cache.New(d.Service(name))
+	c.Assert(err, IsNil)
+	return newService(name, sc, nil, false)
+}
+
+type memDiscoverdService struct {
+	discoverd.Service
+
+	mtx       sync.Mutex
+	instances map[string]*discoverd.Instance
+	watchers  map[chan *discoverd.Event]struct{}
+}
+
+// update adds or removes an instance, sending the event to the watchers.
+// Events are sent while holding s.mtx so that watchers receive them in
+// order.
+func (s *memDiscoverdService) update(kind discoverd.EventKind, inst *discoverd.Instance) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if kind == discoverd.EventKindUp {
+		s.instances[inst.ID] = inst
+	} else {
+		delete(s.instances, inst.ID)
+	}
+	for ch := range s.watchers {
+		ch <- &discoverd.Event{Kind: kind, Instance: inst}
+	}
+}
+
+func (s *memDiscoverdService) Instances() ([]*discoverd.Instance, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	instances := make([]*discoverd.Instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+func (s *memDiscoverdService) Addrs() ([]string, error) {
+	instances, _ := s.Instances()
+	addrs := make([]string, len(instances))
+	for i, inst := range instances {
+		addrs[i] = inst.Addr
+	}
+	return addrs, nil
+}
+
+// Watch sends an up event for each current instance followed by a current
+// event, and then the events of instances being added and removed until the
+// stream is closed.
+func (s *memDiscoverdService) Watch(events chan *discoverd.Event) (stream.Stream, error) {
+	s.mtx.Lock()
+	current := make([]*discoverd.Event, 0, len(s.instances)+1)
+	for _, inst := range s.instances {
+		current = append(current, &discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst})
+	}
+	current = append(current, &discoverd.Event{Kind: discoverd.EventKindCurrent})
+
+	// updates are buffered so that they aren't held up by the watcher
+	// receiving the current instances
+	updates := make(chan *discoverd.Event, 100)
+	s.watchers[updates] = struct{}{}
+	s.mtx.Unlock()
+
+	st := stream.New()
+	go func() {
+		defer func() {
+			s.mtx.Lock()
+			delete(s.watchers, updates)
+			s.mtx.Unlock()
+		}()
+		for _, event := range current {
+			select {
+			case events <- event:
+			case <-st.StopCh:
+				return
+			}
+		}
+		for {
+			select {
+			case event := <-updates:
+				select {
+				case events <- event:
+				case <-st.StopCh:
+					return
+				}
+			case <-st.StopCh:
+				return
+			}
+		}
+	}()
+	return st, nil
+}
+
+// registerFakeBackend registers an instance of the given service with d,
+// waiting for the listener to route requests to it, and returns a function which
+// unregisters it and waits for the listener to see that too.
+func registerFakeBackend(c *C, l *HTTPListener, d *memDiscoverd, service, addr string) func() {
+	l.mtx.RLock()
+	s, ok := l.services[service]
+	l.mtx.RUnlock()
+	c.Assert(ok, Equals, true)
+
+	// waitFor runs f, waiting for the service's backends to include the
+	// instance or not
+	waitFor := func(up bool, f func()) {
+		f()
+		hasAddr := func() bool {
+			for _, a := range s.Addrs() {
+				if a == addr {
+					return true
+				}
+			}
+			return false
+		}
+		for start := time.Now(); hasAddr() != up; time.Sleep(time.Millisecond) {
+			if time.Since(start) > waitTimeout {
+				c.Fatalf("timed out waiting for backend %s (up=%v)", addr, up)
+			}
+		}
+	}
+	var unregister func()
+	waitFor(true, func() { unregister = d.Register(service, addr) })
+	return func() { waitFor(false, unregister) }
+}
+
+// addFakeRoute adds route to l with a backend serving requests using h
+// registered for its service, returning the listener's route and a function
+// which stops the backend.
+func addFakeRoute(c *C, l *HTTPListener, d *memDiscoverd, route *router.Route, h http.Handler) (*httpRoute, func()) {
+	backend := httptest.NewServer(h)
+	addRoute(c, l, route)
+	unregister := registerFakeBackend(c, l, d, route.Service, backend.Listener.Addr().String())
+	r := l.findRoute(route.Domain, route.Path)
+	c.Assert(r, NotNil)
+	return r, func() {
+		unregister()
+		backend.Close()
+	}
+}
+
+// newFakeHTTPListener starts an HTTPListener on random local ports using an
+// in-memory data store and discoverd client, serving TLS for example.com by
+// default.
+func newFakeHTTPListener(c *C) (*HTTPListener, *memDataStore, *memDiscoverd) {
+	ds := newMemDataStore("http")
+	d := newMemDiscoverd()
+	return startFakeHTTPListener(c, ds, d), ds, d
+}
+
+// startFakeHTTPListener starts an HTTPListener on random local ports using
+// the given data store and discoverd client, configuring it with any given
+// functions first.
+func startFakeHTTPListener(c *C, ds DataStore, d DiscoverdClient, configure ...func(*HTTPListener)) *HTTPListener {
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	l := &HTTPListener{
+		Addr:      "127.0.0.1:0",
+		TLSAddr:   "127.0.0.1:0",
+		keypair:   pair,
+		ds:        ds,
+		discoverd: d,
+	}
+	for _, f := range configure {
+		f(l)
+	}
+	c.Assert(l.Start(), IsNil)
+	return l
+}
+
+func (s *S) TestFakeHTTPListener(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+
+	r := addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	unregister := registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	assertGet(c, "https://"+l.TLSAddr, "example.com", "1")
+
+	unregister()
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	wait := waitForEvent(c, l, "remove", r.ID)
+	c.Assert(l.RemoveRoute(r.ID), IsNil)
+	wait()
+	res, err = httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *S) TestInjectedListeners(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Forwarded-Proto") + ":" + req.Header.Get("X-Forwarded-Port")))
+	}))
+	defer srv.Close()
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	pl, tlsPL := newPipeListener(), newPipeListener()
+	d := newMemDiscoverd()
+	l := &HTTPListener{
+		Listener:    pl,
+		TLSListener: tlsPL,
+		keypair:     pair,
+		ds:          newMemDataStore("http"),
+		discoverd:   d,
+	}
+	c.Assert(l.Start(), IsNil)
+	c.Assert(l.Addr, Equals, "pipe")
+	c.Assert(l.TLSAddr, Equals, "pipe")
+
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	unregister := registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())
+
+	for _, t := range []struct {
+		url string
+		l   *pipeListener
+	}{
+		{"http://example.com", pl},
+		{"https://example.com", tlsPL},
+	} {
+		client := newHTTPClient("example.com")
+		client.Transport.(*http.Transport).Dial = t.l.Dial
+		res, err := client.Get(t.url)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, strings.TrimSuffix(t.url, "://example.com")+":")
+	}
+
+	// closing the listener closes the injected listeners
+	unregister()
+	l.Close()
+	_, err = pl.Accept()
+	c.Assert(err, NotNil)
+	_, err = tlsPL.Accept()
+	c.Assert(err, NotNil)
+}
+
+// pipeListener is an in-memory net.Listener whose connections are created
+// with net.Pipe by Dial.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errors.New("pipe listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// defaultFanoutMaxBodyBytes is the maximum size of request bodies buffered to
+// be fanned out if the route doesn't specify one
+const defaultFanoutMaxBodyBytes = 1 << 20
+
+// fanoutTimeout is how long fan-out requests may take if the route has no
+// backend timeout, so that slow fan-out services can't accumulate requests
+var fanoutTimeout = 30 * time.Second
+
+// fanoutMaxInFlight is the maximum number of requests in flight to each
+// fan-out service of a route, beyond which requests aren't fanned out to it
+// so that a slow service can't accumulate goroutines and buffered bodies
+var fanoutMaxInFlight = 64
+
+var droppedFanoutRequests = metrics.NewCounterVec(
+	"strowger_fanout_requests_dropped_total",
+	"Number of requests not fanned out to a service as too many requests to it were in flight.",
+	"service",
+)
+
+// validateFanout checks that the route's fan-out services are valid.
+func validateFanout(r *router.Route) error {
+	var msg string
+	seen := make(map[string]struct{}, len(r.FanoutServices))
+	for _, name := range r.FanoutServices {
+		if name == "" {
+			msg = "services must not be empty"
+		} else if name == r.Service {
+			msg = fmt.Sprintf("service %s is the route's service", name)
+		} else if _, ok := seen[name]; ok {
+			msg = fmt.Sprintf("service %s is listed more than once", name)
+		}
+		if msg != "" {
+			break
+		}
+		seen[name] = struct{}{}
+	}
+	if msg == "" && r.FanoutMaxBodyBytes < 0 {
+		msg = "max body bytes must not be negative"
+	}
+	if msg == "" && len(r.FanoutServices) > 0 && r.ForwardTrailers {
+		msg = "trailers can't be forwarded with fanned out requests, which have buffered bodies"
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Fan-out invalid: " + msg,
+	}
+}
+
+// fanoutTarget is a service which requests to a route are fanned out to
+type fanoutTarget struct {
+	name    string
+	service *service
+	rp      *proxy.ReverseProxy
+
+	// inflight holds a value for each request in flight to the service
+	inflight chan struct{}
+}
+
+// setFanout sets the fan-out targets of a route, getting their services. The
+// caller must hold s.mtx.
+func (s *HTTPListener) setFanout(r *httpRoute) error {
+	targets := make([]*fanoutTarget, 0, len(r.FanoutServices))
+	for _, name := range r.FanoutServices {
+		service, err := s.getService(name, r.DrainBackends)
+		if err != nil {
+			for _, t := range targets {
+				s.releaseService(t.service)
+			}
+			return err
+		}
+		targets = append(targets, &fanoutTarget{
+			name:    name,
+			service: service,
+			rp:      s.newRouteProxy(r, name, service),
+
+			inflight: make(chan struct{}, fanoutMaxInFlight),
+		})
+	}
+	r.fanout = targets
+	return nil
+}
+
+// fanoutMaxBodyBytes returns the maximum size of request bodies which the
+// route fans out.
+func (r *httpRoute) fanoutMaxBodyBytes() int64 {
+	if r.FanoutMaxBodyBytes > 0 {
+		return r.FanoutMaxBodyBytes
+	}
+	return defaultFanoutMaxBodyBytes
+}
+
+// fanoutRequest buffers the body of req and sends a copy of it to each of the
+// route's fan-out services in the background, discarding their responses.
+// Upgrade requests are not fanned out, and nor are requests to services with
+// fanoutMaxInFlight requests in flight. It writes an error response and
+// returns false if the body is too large or can't be read.
+func (r *httpRoute) fanoutRequest(w http.ResponseWriter, req *http.Request) bool {
+	// upgraded connections can only be proxied to a single backend
+	if req.Header.Get("Upgrade") != "" {
+		return true
+	}
+	if !bufferBody(w, req, r.fanoutMaxBodyBytes()) {
+		return false
+	}
+	timeout := r.backendTimeout()
+	if timeout <= 0 {
+		timeout = fanoutTimeout
+	}
+	for _, t := range r.fanout {
+		select {
+		case t.inflight <- struct{}{}:
+		default:
+			droppedFanoutRequests.Inc(t.name)
+			continue
+		}
+		// the copies are made before the request is sent to the primary
+		// service as the proxy modifies its URL, and they don't share its
+		// context so that they aren't cancelled when it completes
+		outreq := req.Clone(context.Background())
+		outreq.Body = http.NoBody
+		if req.GetBody != nil {
+			outreq.Body, _ = req.GetBody()
+		}
+		go t.serveHTTP(outreq, timeout)
+	}
+	return true
+}
+
+// serveHTTP sends req to the fan-out service, logging the status of the
+// response.
+func (t *fanoutTarget) serveHTTP(req *http.Request, timeout time.Duration) {
+	defer func() { <-t.inflight }()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	w := &discardResponseWriter{header: make(http.Header)}
+	t.rp.ServeHTTP(ctx, w, req)
+	l := logger.New("service", t.name, "request_id", req.Header.Get("X-Request-Id"), "method", req.Method, "path", req.URL.Path, "status", w.status)
+	if w.status >= 500 {
+		l.Warn("fan-out request failed")
+	} else {
+		l.Info("fan-out request completed")
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter which discards the
+// response, recording only its status.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+// CloseNotify never notifies as there is no client to go away.
+func (w *discardResponseWriter) CloseNotify() <-chan bool {
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestFanout(c *C) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(append([]byte("primary:"), body...))
+	}))
+	defer primary.Close()
+
+	// one fan-out service responds quickly, the other slowly with an
+	// error, neither of which should affect the primary response
+	type fanoutReq struct {
+		service string
+		method  string
+		path    string
+		body    string
+	}
+	received := make(chan fanoutReq, 10)
+	release := make(chan struct{})
+	fanoutHandler := func(service string, wait bool) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			received <- fanoutReq{service, req.Method, req.URL.Path, string(body)}
+			if wait {
+				<-release
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			w.Write([]byte("discarded"))
+		})
+	}
+	fast := httptest.NewServer(fanoutHandler("audit", false))
+	defer fast.Close()
+	slow := httptest.NewServer(fanoutHandler("replica", true))
+	defer slow.Close()
+	defer close(release)
+
+	defer func(n int) { fanoutMaxInFlight = n }(fanoutMaxInFlight)
+	fanoutMaxInFlight = 1
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:                  "example.com",
+		Service:                 "test",
+		FanoutServices:          []string{"test-audit", "test-replica"},
+		FanoutMaxBodyBytes:      16,
+		RequestFingerprintDedup: true,
+	}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", primary.Listener.Addr().String())()
+	defer registerFakeBackend(c, l, d, "test-audit", fast.Listener.Addr().String())()
+	defer registerFakeBackend(c, l, d, "test-replica", slow.Listener.Addr().String())()
+
+	post := func(body string) (int, string) {
+		req := newReq("http://"+l.Addr+"/events", "example.com")
+		req.Method = "POST"
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res.StatusCode, string(data)
+	}
+
+	// the primary response is returned without waiting for the slow
+	// fan-out service, which still hasn't responded
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		status, body := post("event")
+		c.Check(status, Equals, http.StatusOK)
+		c.Check(body, Equals, "primary:event")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for primary response")
+	}
+
+	// each fan-out service receives a copy of the request with the body
+	got := make(map[string]fanoutReq)
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			got[r.service] = r
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for fan-out request")
+		}
+	}
+	for _, service := range []string{"audit", "replica"} {
+		c.Assert(got[service], Equals, fanoutReq{service, "POST", "/events", "event"})
+	}
+
+	// wait for the fast service's request to complete, leaving only the
+	// slow service's in flight
+	audit := l.findRoute("example.com", "/events").fanout[0]
+	for start := time.Now(); len(audit.inflight) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			c.Fatal("timed out waiting for fan-out request to complete")
+		}
+	}
+
+	// identical requests answered with the earlier response aren't fanned
+	// out again
+	status, body := post("event")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "primary:event")
+
+	// requests aren't fanned out to services with fanoutMaxInFlight
+	// requests in flight, as the slow service has
+	dropped := droppedFanoutRequests.Value("test-replica")
+	status, body = post("other")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "primary:other")
+	c.Assert(droppedFanoutRequests.Value("test-replica"), Equals, dropped+1)
+	select {
+	case r := <-received:
+		c.Assert(r, Equals, fanoutReq{"audit", "POST", "/events", "other"})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for fan-out request")
+	}
+
+	// bodies larger than the buffer limit are rejected
+	status, _ = post(strings.Repeat("x", 17))
+	c.Assert(status, Equals, http.StatusRequestEntityTooLarge)
+
+	for route, msg := range map[*router.Route]string{
+		{Service: "a", FanoutServices: []string{""}}:                         "services must not be empty",
+		{Service: "a", FanoutServices: []string{"a"}}:                        "service a is the route's service",
+		{Service: "a", FanoutServices: []string{"b", "b"}}:                   "service b is listed more than once",
+		{Service: "a", FanoutMaxBodyBytes: -1}:                               "max body bytes must not be negative",
+		{Service: "a", FanoutServices: []string{"b"}, ForwardTrailers: true}: "trailers can't be forwarded with fanned out requests, which have buffered bodies",
+	} {
+		c.Assert(validateFanout(route), DeepEquals, httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Fan-out invalid: " + msg,
+		})
+	}
+}
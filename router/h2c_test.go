@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+// h2cBackend is a backend which serves HTTP/2 to clients sending the
+// HTTP/2 connection preface, accepting h2c upgrade requests and serving
+// other HTTP/1.1 requests normally
+type h2cBackend struct {
+	net.Listener
+	upgrades int64
+	// h2conns are the connections served using HTTP/2 by h2
+	h2conns *connListener
+}
+
+func newH2CBackend(c *C, handler http.Handler) *h2cBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	b := &h2cBackend{Listener: l, h2conns: newConnListener(l.Addr())}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	h2 := &http.Server{Handler: handler, Protocols: &protocols}
+	go h2.Serve(b.h2conns)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, handler)
+		}
+	}()
+	return b
+}
+
+func (b *h2cBackend) Close() error {
+	b.h2conns.Close()
+	return b.Listener.Close()
+}
+
+func (b *h2cBackend) serve(conn net.Conn, handler http.Handler) {
+	br := bufio.NewReader(conn)
+	preface, err := br.Peek(len(http2.ClientPreface))
+	if err == nil && string(preface) == http2.ClientPreface {
+		b.h2conns.serve(&peekedConn{Conn: conn, r: br})
+		return
+	}
+	defer conn.Close()
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Header.Get("Upgrade") == "h2c" && req.Header.Get("Http2-Settings") != "" {
+		atomic.AddInt64(&b.upgrades, 1)
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		return
+	}
+	w := newCloseNotifyRecorder()
+	handler.ServeHTTP(w, req)
+	res := w.Result()
+	res.Close = true
+	res.Write(conn)
+}
+
+// connListener is a net.Listener which accepts the connections passed to
+// serve
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) serve(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// peekedConn is a net.Conn whose reads start with data already buffered
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (s *S) TestBackendH2C(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Proto)
+	})
+	h2cBackend := newH2CBackend(c, handler)
+	defer h2cBackend.Close()
+	// a backend which only speaks HTTP/1.1 and ignores upgrade requests
+	http1Backend := httptest.NewServer(handler)
+	defer http1Backend.Close()
+
+	for _, t := range []struct {
+		backend string
+		proto   string
+	}{
+		{h2cBackend.Addr().String(), "HTTP/2.0"},
+		{http1Backend.Listener.Addr().String(), "HTTP/1.1"},
+	} {
+		backend := t.backend
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test", BackendH2CEnabled: true}}
+		r.rp = proxy.NewReverseProxy(func() []string { return []string{backend} }, &[32]byte{}, false, &service{}, logger)
+		r.rp.SetBackendH2C(true)
+
+		for i := 0; i < 2; i++ {
+			w := newCloseNotifyRecorder()
+			req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+			r.ServeHTTP(context.Background(), w, req)
+			c.Assert(w.Code, Equals, 200)
+			c.Assert(w.Body.String(), Equals, t.proto)
+		}
+	}
+	// the upgrade is only negotiated once
+	c.Assert(atomic.LoadInt64(&h2cBackend.upgrades), Equals, int64(1))
+
+	// HTTP/1.1 is used unless h2c is enabled
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	r.rp = proxy.NewReverseProxy(func() []string { return []string{h2cBackend.Addr().String()} }, &[32]byte{}, false, &service{}, logger)
+	w := newCloseNotifyRecorder()
+	r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+	c.Assert(w.Body.String(), Equals, "HTTP/1.1")
+}
@@ -44,3 +44,17 @@ func (h fwdProtoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	h.Handler.ServeHTTP(w, r)
 }
+
+// stripHeadersHandler is an http.Handler that removes Headers from inbound
+// requests so that backends can trust that they were only set by the router.
+type stripHeadersHandler struct {
+	http.Handler
+	Headers []string
+}
+
+func (h stripHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, name := range h.Headers {
+		r.Header.Del(name)
+	}
+	h.Handler.ServeHTTP(w, r)
+}
@@ -32,3 +32,30 @@ func (s *S) TestFwdProtoHandler(c *C) {
 	c.Assert(request.Header.Get("X-Forwarded-Proto"), Equals, prevForwardedProto+", https")
 	c.Assert(request.Header.Get("X-Forwarded-Port"), Equals, prevForwardedPort+", 443")
 }
+
+func (s *S) TestStripHeadersHandler(c *C) {
+	var got http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	})
+	h := stripHeadersHandler{
+		Handler: fwdProtoHandler{Handler: handler, Proto: "https", Port: "443"},
+		Headers: []string{"X-Real-IP", "X-Forwarded-Proto", "x-internal-user"},
+	}
+
+	rec := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://test.com", nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	request.Header.Set("X-Real-Ip", "5.6.7.8")
+	request.Header.Set("X-Forwarded-Proto", "http")
+	request.Header.Set("X-Internal-User", "admin")
+	request.Header.Set("X-Other", "foo")
+	h.ServeHTTP(rec, request)
+
+	c.Assert(got.Get("X-Real-Ip"), Equals, "")
+	c.Assert(got.Get("X-Internal-User"), Equals, "")
+	c.Assert(got.Get("X-Other"), Equals, "foo")
+	// stripped headers set by the router should only contain the router's value
+	c.Assert(got.Get("X-Forwarded-Proto"), Equals, "https")
+	c.Assert(got.Get("X-Forwarded-For"), Equals, "1.2.3.4")
+}
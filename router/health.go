@@ -0,0 +1,249 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// unhealthyFailureThreshold is the number of consecutive failed requests
+// after which a backend is reported as unhealthy
+const unhealthyFailureThreshold = 3
+
+// healthEventInterval is the minimum time between health events for the same
+// backend, so that flapping backends don't flood watchers and evict other
+// events from their replay buffers
+var healthEventInterval = time.Second
+
+// backendHealth is the passively tracked health of a backend
+type backendHealth struct {
+	lastError           string
+	consecutiveFailures int
+}
+
+// sentHealthEvent is the type and time of the last health event sent for a
+// backend
+type sentHealthEvent struct {
+	typ router.EventType
+	at  time.Time
+}
+
+// TrackBackendSuccess implements the proxy.HealthTracker interface.
+func (s *service) TrackBackendSuccess(backend string) {
+	s.healthMtx.Lock()
+	defer s.healthMtx.Unlock()
+	if h, ok := s.health[backend]; ok {
+		if h.consecutiveFailures >= unhealthyFailureThreshold {
+			s.sendHealthEvent(router.EventTypeBackendHealthy, backend, h.lastError, 0)
+		}
+		h.consecutiveFailures = 0
+	}
+}
+
+// TrackBackendFailure implements the proxy.HealthTracker interface.
+func (s *service) TrackBackendFailure(backend string, err error) {
+	s.healthMtx.Lock()
+	defer s.healthMtx.Unlock()
+	if s.health == nil {
+		s.health = make(map[string]*backendHealth)
+	}
+	h, ok := s.health[backend]
+	if !ok {
+		h = &backendHealth{}
+		s.health[backend] = h
+	}
+	h.lastError = err.Error()
+	h.consecutiveFailures++
+	if h.consecutiveFailures == unhealthyFailureThreshold {
+		s.sendHealthEvent(router.EventTypeBackendUnhealthy, backend, h.lastError, h.consecutiveFailures)
+	}
+}
+
+// sendHealthEvent queues an event notifying watchers that the health of a
+// backend has changed, which is sent by sendHealthEvents so that requests
+// aren't blocked by slow watchers. It must be called with healthMtx held.
+func (s *service) sendHealthEvent(typ router.EventType, backend, lastError string, failures int) {
+	if s.wm == nil {
+		return
+	}
+	if s.healthEvents == nil {
+		s.healthEvents = make(map[string]*router.Event)
+		s.healthSent = make(map[string]sentHealthEvent)
+	}
+	s.healthEvents[backend] = &router.Event{
+		Event:     typ,
+		Backend:   &router.Backend{Service: s.name, Addr: backend},
+		Timestamp: time.Now(),
+		Metadata: map[string]string{
+			"last_error":           lastError,
+			"consecutive_failures": strconv.Itoa(failures),
+		},
+	}
+	if !s.healthSending {
+		s.healthSending = true
+		go s.sendHealthEvents()
+	}
+}
+
+// sendHealthEvents sends the queued health events in the order they happened
+// until there are none left. Events for a backend are sent at most once
+// every healthEventInterval, with only the latest sent if it has changed
+// since the last one.
+func (s *service) sendHealthEvents() {
+	for {
+		s.healthMtx.Lock()
+		now := time.Now()
+		var ready []*router.Event
+		var next time.Time
+		for backend, event := range s.healthEvents {
+			sent, ok := s.healthSent[backend]
+			if ok && sent.typ == event.Event {
+				// the backend is back in the state last sent
+				delete(s.healthEvents, backend)
+				continue
+			}
+			if at := sent.at.Add(healthEventInterval); ok && at.After(now) {
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+				continue
+			}
+			delete(s.healthEvents, backend)
+			s.healthSent[backend] = sentHealthEvent{typ: event.Event, at: now}
+			ready = append(ready, event)
+		}
+		if len(ready) == 0 && next.IsZero() {
+			s.healthSending = false
+			s.healthMtx.Unlock()
+			return
+		}
+		s.healthMtx.Unlock()
+
+		sort.Slice(ready, func(i, j int) bool {
+			return ready[i].Timestamp.Before(ready[j].Timestamp)
+		})
+		for _, event := range ready {
+			s.wm.Send(event)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+		select {
+		case <-time.After(next.Sub(now)):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// forgetBackendHealth removes the tracked health of a backend which has gone
+// away.
+func (s *service) forgetBackendHealth(backend string) {
+	s.healthMtx.Lock()
+	defer s.healthMtx.Unlock()
+	delete(s.health, backend)
+	delete(s.healthSent, backend)
+}
+
+// backendHealth returns the health of all of the service's backends, sorted
+// by address.
+func (s *service) backendHealth() []*router.BackendHealth {
+	addrs := s.Addrs()
+	sort.Strings(addrs)
+
+	s.healthMtx.Lock()
+	defer s.healthMtx.Unlock()
+	res := make([]*router.BackendHealth, len(addrs))
+	for i, addr := range addrs {
+		res[i] = &router.BackendHealth{Addr: addr, Healthy: true}
+		if h, ok := s.health[addr]; ok {
+			res[i].LastError = h.lastError
+			res[i].ConsecutiveFailures = h.consecutiveFailures
+			res[i].Healthy = h.consecutiveFailures < unhealthyFailureThreshold
+		}
+	}
+	return res
+}
+
+// BackendHealth returns the health of the backends of all services with HTTP
+// routes, keyed by service name.
+func (s *HTTPListener) BackendHealth() map[string][]*router.BackendHealth {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	res := make(map[string][]*router.BackendHealth, len(s.services))
+	for name, service := range s.services {
+		res[name] = service.backendHealth()
+	}
+	return res
+}
+
+// ServiceHealth returns the health of the backends of the given service, or
+// ErrNotFound if it has no HTTP routes.
+func (s *HTTPListener) ServiceHealth(name string) ([]*router.BackendHealth, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	service, ok := s.services[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return service.backendHealth(), nil
+}
+
+// DomainHealth returns the health of the backends of the services of all
+// routes for the given domain, keyed by service name, or ErrNotFound if there
+// are no routes for the domain.
+func (s *HTTPListener) DomainHealth(domain string) (map[string][]*router.BackendHealth, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var res map[string][]*router.BackendHealth
+	for _, r := range s.routes {
+		if !strings.EqualFold(r.Domain, domain) {
+			continue
+		}
+		if res == nil {
+			res = make(map[string][]*router.BackendHealth)
+		}
+		if _, ok := res[r.Service]; !ok {
+			res[r.Service] = r.service.backendHealth()
+		}
+	}
+	if res == nil {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// HealthSummary returns a summary of the health of all HTTP routes.
+func (s *HTTPListener) HealthSummary() *router.HealthSummary {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	summary := &router.HealthSummary{}
+	healthyServices := make(map[string]bool, len(s.services))
+	for name, service := range s.services {
+		for _, b := range service.backendHealth() {
+			summary.TotalBackends++
+			if b.Healthy {
+				summary.HealthyBackends++
+				healthyServices[name] = true
+			}
+		}
+	}
+
+	domains := make(map[string]bool)
+	for _, r := range s.routes {
+		domain := strings.ToLower(r.Domain)
+		healthy, ok := domains[domain]
+		domains[domain] = (healthy || !ok) && healthyServices[r.Service]
+	}
+	summary.TotalDomains = len(domains)
+	for _, healthy := range domains {
+		if healthy {
+			summary.HealthyDomains++
+		}
+	}
+	return summary
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func instancesForAddrs(addrs ...string) []*discoverd.Instance {
+	instances := make([]*discoverd.Instance, len(addrs))
+	for i, addr := range addrs {
+		instances[i] = &discoverd.Instance{ID: addr, Addr: addr}
+	}
+	return instances
+}
+
+func (s *S) TestBackendHealth(c *C) {
+	// a backend which refuses connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	down := ln.Addr().String()
+	ln.Close()
+
+	web := newFakeService(c, "web", instancesForAddrs(down, "127.0.0.1:1001")...)
+	defer web.Close()
+	api := newFakeService(c, "api", instancesForAddrs("127.0.0.1:2001")...)
+	defer api.Close()
+
+	l := &HTTPListener{
+		services: map[string]*service{"web": web, "api": api},
+		routes: map[string]*httpRoute{
+			"1": {HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "web"}, service: web},
+			"2": {HTTPRoute: &router.HTTPRoute{Domain: "example.com", Path: "/api/", Service: "api"}, service: api},
+			"3": {HTTPRoute: &router.HTTPRoute{Domain: "api.example.com", Service: "api"}, service: api},
+		},
+	}
+
+	// failed requests are tracked passively by the proxy
+	rp := proxy.NewReverseProxy(func() []string { return []string{down} }, &[32]byte{}, false, web, logger)
+	for i := 0; i < unhealthyFailureThreshold; i++ {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	}
+	health, err := l.ServiceHealth("web")
+	c.Assert(err, IsNil)
+	c.Assert(health, HasLen, 2)
+	c.Assert(health[0].Addr, Equals, "127.0.0.1:1001")
+	c.Assert(health[0].Healthy, Equals, true)
+	c.Assert(health[1].Addr, Equals, down)
+	c.Assert(health[1].Healthy, Equals, false)
+	c.Assert(health[1].ConsecutiveFailures, Equals, unhealthyFailureThreshold)
+	c.Assert(health[1].LastError, Not(Equals), "")
+
+	_, err = l.ServiceHealth("missing")
+	c.Assert(err, Equals, ErrNotFound)
+
+	// a domain is unhealthy if any of its routes have no healthy backends
+	api.TrackBackendFailure("127.0.0.1:2001", errors.New("connection refused"))
+	c.Assert(l.HealthSummary(), DeepEquals, &router.HealthSummary{
+		TotalDomains:    2,
+		HealthyDomains:  2,
+		TotalBackends:   3,
+		HealthyBackends: 2,
+	})
+	for i := 1; i < unhealthyFailureThreshold; i++ {
+		api.TrackBackendFailure("127.0.0.1:2001", errors.New("connection refused"))
+	}
+	c.Assert(l.HealthSummary(), DeepEquals, &router.HealthSummary{
+		TotalDomains:    2,
+		HealthyDomains:  0,
+		TotalBackends:   3,
+		HealthyBackends: 1,
+	})
+
+	// a successful request resets the failure count but keeps the error
+	api.TrackBackendSuccess("127.0.0.1:2001")
+	domain, err := l.DomainHealth("API.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(domain, DeepEquals, map[string][]*router.BackendHealth{
+		"api": {{Addr: "127.0.0.1:2001", Healthy: true, LastError: "connection refused"}},
+	})
+	_, err = l.DomainHealth("missing.example.com")
+	c.Assert(err, Equals, ErrNotFound)
+
+	// check the API returns the health of all services
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/health/backends")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	var backends map[string][]*router.BackendHealth
+	c.Assert(json.NewDecoder(res.Body).Decode(&backends), IsNil)
+	c.Assert(backends, HasLen, 2)
+	c.Assert(backends["web"], HasLen, 2)
+	c.Assert(backends["web"][1].ConsecutiveFailures, Equals, unhealthyFailureThreshold)
+
+	res, err = http.Get(srv.URL + "/health/services/missing")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestStreamBackendHealth(c *C) {
+	wm := NewWatchManager()
+	web := newFakeService(c, "web", instancesForAddrs("127.0.0.1:1001")...)
+	web.wm = wm
+	defer web.Close()
+	l := &HTTPListener{Watcher: wm, wm: wm, services: map[string]*service{"web": web}}
+
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/health/stream")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream; charset=utf-8")
+	events := make(chan *router.StreamEvent)
+	go func() {
+		dec := sse.NewDecoder(bufio.NewReader(res.Body))
+		for {
+			e := &router.StreamEvent{}
+			if err := dec.Decode(e); err != nil {
+				close(events)
+				return
+			}
+			events <- e
+		}
+	}()
+	next := func(start time.Time, delay time.Duration) *router.StreamEvent {
+		select {
+		case e := <-events:
+			c.Assert(e, NotNil)
+			c.Assert(time.Since(start) >= delay, Equals, true)
+			c.Assert(time.Since(start) < delay+100*time.Millisecond, Equals, true)
+			return e
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for health event")
+			return nil
+		}
+	}
+	defer func(interval time.Duration) { healthEventInterval = interval }(healthEventInterval)
+	healthEventInterval = 200 * time.Millisecond
+
+	// an event is sent when a backend becomes unhealthy
+	var start time.Time
+	for i := 0; i < unhealthyFailureThreshold; i++ {
+		start = time.Now()
+		web.TrackBackendFailure("127.0.0.1:1001", errors.New("connection refused"))
+	}
+	e := next(start, 0)
+	c.Assert(e.Event, Equals, router.EventTypeBackendUnhealthy)
+	c.Assert(e.Backend, DeepEquals, &router.Backend{Service: "web", Addr: "127.0.0.1:1001"})
+	c.Assert(e.Metadata["last_error"], Equals, "connection refused")
+	c.Assert(e.Metadata["consecutive_failures"], Equals, "3")
+	c.Assert(e.Timestamp.IsZero(), Equals, false)
+
+	// but not for further failures or successes of healthy backends
+	web.TrackBackendFailure("127.0.0.1:1001", errors.New("connection refused"))
+	web.TrackBackendSuccess("127.0.0.1:1002")
+
+	// and another when it recovers, once healthEventInterval has passed
+	web.TrackBackendSuccess("127.0.0.1:1001")
+	e = next(start, healthEventInterval)
+	c.Assert(e.Event, Equals, router.EventTypeBackendHealthy)
+	c.Assert(e.Backend, DeepEquals, &router.Backend{Service: "web", Addr: "127.0.0.1:1001"})
+	c.Assert(e.Metadata["consecutive_failures"], Equals, "0")
+
+	// backends which flap back to the state last sent within
+	// healthEventInterval don't send events
+	for i := 0; i < unhealthyFailureThreshold; i++ {
+		web.TrackBackendFailure("127.0.0.1:1001", errors.New("connection refused"))
+	}
+	web.TrackBackendSuccess("127.0.0.1:1001")
+	start = time.Now()
+	for i := 0; i < unhealthyFailureThreshold; i++ {
+		web.TrackBackendFailure("127.0.0.1:1002", errors.New("connection refused"))
+	}
+	e = next(start, 0)
+	c.Assert(e.Backend.Addr, Equals, "127.0.0.1:1002")
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected health event %+v", e)
+	case <-time.After(2 * healthEventInterval):
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// HealthCheckConfig configures the health check requests (e.g. from load
+// balancers in front of the router) which the router answers itself rather
+// than routing them to a backend.
+type HealthCheckConfig struct {
+	// Path, if set, is the path health check requests are sent to.
+	Path string `json:"path,omitempty"`
+
+	// Host, if set, is the host health check requests are sent to, with
+	// any port ignored.
+	Host string `json:"host,omitempty"`
+
+	// Status is the status code of the response, defaulting to 200.
+	Status int `json:"status,omitempty"`
+
+	// Body is the body of the response, defaulting to "OK\n".
+	Body string `json:"body,omitempty"`
+}
+
+func (h *HealthCheckConfig) validate() error {
+	if h.Path == "" && h.Host == "" {
+		return errors.New("router: health check must match a path or host")
+	}
+	if h.Status != 0 && (h.Status < 200 || h.Status > 599) {
+		return errors.New("router: invalid health check status " + strconv.Itoa(h.Status))
+	}
+	return nil
+}
+
+// matches returns whether req is a health check request, which must match
+// both the path and host if they are set.
+func (h *HealthCheckConfig) matches(req *http.Request) bool {
+	if h == nil {
+		return false
+	}
+	if h.Path != "" && req.URL.Path != h.Path {
+		return false
+	}
+	if h.Host != "" {
+		if host, _ := parseHost(req.Host); host != canonicalDomain(h.Host) {
+			return false
+		}
+	}
+	return true
+}
+
+// serve responds to a health check request.
+func (h *HealthCheckConfig) serve(w http.ResponseWriter, req *http.Request) {
+	status := h.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := h.Body
+	if body == "" {
+		body = "OK\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if req.Method != "HEAD" {
+		w.Write([]byte(body))
+	}
+}
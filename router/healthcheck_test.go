@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestHealthCheck(c *C) {
+	l := &HTTPListener{}
+	for _, config := range []*HealthCheckConfig{
+		{},
+		{Path: "/health", Status: 99},
+		{Path: "/health", Status: 600},
+	} {
+		c.Assert(l.Reload(&ListenerConfig{HealthCheck: config}), NotNil)
+	}
+
+	serve := func(method, host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, req)
+		return w
+	}
+
+	// matching requests are answered without looking up a route or
+	// counting them as client requests
+	c.Assert(l.Reload(&ListenerConfig{HealthCheck: &HealthCheckConfig{Path: "/lb-health"}}), IsNil)
+	requests := clientRequests.Value()
+	w := serve("GET", "anything.example.com", "/lb-health")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "OK\n")
+	c.Assert(w.Header().Get("Cache-Control"), Equals, "no-store")
+	c.Assert(clientRequests.Value(), Equals, requests)
+	c.Assert(serve("GET", "example.com", "/lb-health/other").Code, Equals, http.StatusNotFound)
+	w = serve("HEAD", "example.com", "/lb-health")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.Len(), Equals, 0)
+
+	// both the host and path must match if set, with the response
+	// configurable
+	c.Assert(l.Reload(&ListenerConfig{HealthCheck: &HealthCheckConfig{
+		Path:   "/health",
+		Host:   "LB.example.com",
+		Status: http.StatusNoContent,
+		Body:   "healthy",
+	}}), IsNil)
+	w = serve("GET", "lb.example.com:8080", "/health")
+	c.Assert(w.Code, Equals, http.StatusNoContent)
+	c.Assert(serve("GET", "other.example.com", "/health").Code, Equals, http.StatusNotFound)
+	c.Assert(serve("GET", "lb.example.com", "/").Code, Equals, http.StatusNotFound)
+
+	c.Assert(l.Reload(&ListenerConfig{HealthCheck: &HealthCheckConfig{Host: "lb.example.com", Body: "healthy"}}), IsNil)
+	w = serve("GET", "lb.example.com", "/any/path")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "healthy")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// hopsHeader is the request header counting the number of times a request
+// has passed through a router, which is incremented before forwarding it to
+// a backend so that routing loops (e.g. a backend proxying back to the router
+// for the same domain) can be detected
+const hopsHeader = "X-Strowger-Hops"
+
+// requestHops returns the hop count of req, treating a missing or invalid
+// header as no hops.
+func requestHops(req *http.Request) int {
+	hops, err := strconv.Atoi(req.Header.Get(hopsHeader))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// checkHops increments the hop count of req, returning false if it has
+// already passed through the maximum number of routers from the listener
+// config. A zero MaxHops disables loop detection without touching the header.
+func checkHops(req *http.Request, config *ListenerConfig) bool {
+	if config.MaxHops <= 0 {
+		return true
+	}
+	hops := requestHops(req)
+	if hops >= config.MaxHops {
+		return false
+	}
+	req.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+	return true
+}
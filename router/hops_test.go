@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestRoutingLoopDetection(c *C) {
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	c.Assert(l.Reload(&ListenerConfig{MaxHops: -1}), NotNil)
+
+	// the backend is misconfigured to proxy requests back to the router
+	// for the same domain
+	routerURL, _ := url.Parse("http://" + l.Addr)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		httputil.NewSingleHostReverseProxy(routerURL).ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+
+	c.Assert(l.Reload(&ListenerConfig{MaxHops: 3}), IsNil)
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusLoopDetected)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(3))
+
+	// requests which have passed through fewer routers are forwarded with
+	// the hop count incremented
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(hopsHeader, "1")
+	c.Assert(checkHops(req, &ListenerConfig{MaxHops: 3}), Equals, true)
+	c.Assert(req.Header.Get(hopsHeader), Equals, "2")
+	c.Assert(checkHops(req, &ListenerConfig{}), Equals, true)
+	c.Assert(req.Header.Get(hopsHeader), Equals, "2")
+	req.Header.Set(hopsHeader, "invalid")
+	c.Assert(checkHops(req, &ListenerConfig{MaxHops: 1}), Equals, true)
+	c.Assert(req.Header.Get(hopsHeader), Equals, "1")
+	c.Assert(checkHops(req, &ListenerConfig{MaxHops: 1}), Equals, false)
+}
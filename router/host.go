@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// parseHost splits the given Host header into its hostname and port. The
+// hostname is normalized by canonicalDomain, so IPv6 literals lose their
+// brackets (e.g. "[::1]:8080" is split into "::1" and "8080"), and an
+// unbracketed IPv6 literal is treated as a hostname without a port.
+func parseHost(host string) (hostname, port string) {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.IndexByte(host, ']'); i > 0 {
+			hostname = host[1:i]
+			port = strings.TrimPrefix(host[i+1:], ":")
+			return canonicalDomain(hostname), port
+		}
+	}
+	if strings.Count(host, ":") == 1 {
+		i := strings.IndexByte(host, ':')
+		host, port = host[:i], host[i+1:]
+	}
+	return canonicalDomain(host), port
+}
+
+// canonicalDomain returns the form of the given route domain or hostname
+// which routes are looked up by: lowercased, with IPv6 literals unbracketed
+// and in their canonical form.
+func canonicalDomain(domain string) string {
+	domain = strings.ToLower(domain)
+	unbracketed := strings.TrimSuffix(strings.TrimPrefix(domain, "["), "]")
+	if strings.Contains(unbracketed, ":") {
+		if ip := net.ParseIP(unbracketed); ip != nil {
+			return ip.String()
+		}
+	}
+	return domain
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestParseHost(c *C) {
+	for _, t := range []struct {
+		host     string
+		hostname string
+		port     string
+	}{
+		{"example.com", "example.com", ""},
+		{"Example.com:8080", "example.com", "8080"},
+		{"127.0.0.1", "127.0.0.1", ""},
+		{"127.0.0.1:80", "127.0.0.1", "80"},
+		{"[::1]", "::1", ""},
+		{"[::1]:8080", "::1", "8080"},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"2001:DB8:0:0::1", "2001:db8::1", ""},
+		{"[2001:db8::1]:443", "2001:db8::1", "443"},
+	} {
+		hostname, port := parseHost(t.host)
+		c.Assert(hostname, Equals, t.hostname, Commentf(t.host))
+		c.Assert(port, Equals, t.port, Commentf(t.host))
+	}
+}
+
+func (s *S) TestFindRouteIPv6Host(c *C) {
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	h := &httpSyncHandler{l: l}
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "1", Domain: "[::1]", Path: "/", Service: "web"}), IsNil)
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "2", Domain: "2001:db8::1", Path: "/", Service: "web"}), IsNil)
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "3", Domain: "127.0.0.1", Path: "/", Service: "web"}), IsNil)
+
+	for host, id := range map[string]string{
+		"[::1]":             "1",
+		"[::1]:8080":        "1",
+		"::1":               "1",
+		"[2001:db8::1]":     "2",
+		"[2001:db8::1]:443": "2",
+		"2001:db8::1":       "2",
+		"127.0.0.1":         "3",
+		"127.0.0.1:8080":    "3",
+	} {
+		r := l.findRoute(host, "/")
+		c.Assert(r, NotNil, Commentf(host))
+		c.Assert(r.ID, Equals, id, Commentf(host))
+	}
+	c.Assert(l.findRoute("[::2]:8080", "/"), IsNil)
+
+	c.Assert(h.Remove("1"), IsNil)
+	c.Assert(l.findRoute("[::1]", "/"), IsNil)
+}
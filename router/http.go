@@ -3,17 +3,21 @@ package main
 import (
 	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/flynn/flynn/discoverd/cache"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/ctxhelper"
@@ -23,6 +27,7 @@ import (
 	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/proxyproto"
 	"github.com/flynn/flynn/router/types"
+	"github.com/golang/groupcache/singleflight"
 	"golang.org/x/net/context"
 	"golang.org/x/net/http2"
 )
@@ -31,26 +36,184 @@ type HTTPListener struct {
 	Watcher
 	DataStoreReader
 
+	// Addr and TLSAddr are the addresses to serve HTTP and HTTPS on, either
+	// of which is disabled if it is empty (and Listener or TLSListener
+	// respectively isn't set)
 	Addr    string
 	TLSAddr string
 
+	// SmuggleProtection, if set, rejects requests to Addr whose framing is
+	// ambiguous, having both a Content-Length and a Transfer-Encoding or
+	// differing Content-Lengths, with a 400 (see smuggleListener)
+	SmuggleProtection bool
+
+	// SocketOptions are set on the sockets of Addr and TLSAddr
+	SocketOptions SocketOpts
+
+	// TLSHandshakeTimeout is how long clients have to complete the TLS
+	// handshake before their connection is closed, unless the route their
+	// ClientHello is for has its own timeout (defaults to 10s if zero)
+	TLSHandshakeTimeout time.Duration
+
+	// Listener and TLSListener, if set, are served instead of listening on
+	// Addr and TLSAddr respectively (e.g. to serve an inherited socket or an
+	// in-memory listener), and are closed when the listener is closed
+	Listener    net.Listener
+	TLSListener net.Listener
+
+	// AdditionalAddrs and AdditionalTLSAddrs are served in the same way as
+	// Addr and TLSAddr respectively, sharing the listener's routes (e.g. to
+	// serve ports in different network zones). Like Addr and TLSAddr, they
+	// are updated to the addresses listened on once started.
+	AdditionalAddrs    []string
+	AdditionalTLSAddrs []string
+
+	// ReadOnly, if set, prevents routes and certificates being modified
+	// through the listener (e.g. on a standby router sharing the data store),
+	// while routes are still synced from the data store and served
+	ReadOnly bool
+
+	// OutboundInterface, if set, is the IP address of a local interface
+	// which connections to backends are made from (e.g. so that they are
+	// allowed through firewalls of backend networks)
+	OutboundInterface string
+	outboundIP        net.IP
+
+	// Sidecar, if set, stops routes being synced from the data store so
+	// that only routes set in memory are served (see
+	// NewSidecarHTTPListener)
+	Sidecar bool
+
+	// BackupConfig configures periodic backups of the routing table
+	BackupConfig BackupConfig
+
+	// SnapshotPath, if set, is the file a snapshot of the routing table is
+	// written to every SnapshotInterval, which is served if the initial sync
+	// with the data store fails
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	// RequestSamplePath, if set, is the file the request reservoirs of
+	// routes with ReservoirSampleSize set are written to every hour, which
+	// are restored when the listener is started
+	RequestSamplePath string
+
+	// ConsulAddr, if set, is the address of the Consul HTTP API used to
+	// find the passing instances of services for routes with
+	// ConsulHealthBackends set, which are cached for ConsulCacheTTL
+	ConsulAddr     string
+	ConsulCacheTTL time.Duration
+
+	// BackendSelector, if set, orders the backends requests to routes are
+	// sent to instead of the default random (or weighted) order, and
+	// RouteBackendSelector, if set, returns the BackendSelector of a
+	// particular route, with nil meaning the route's consistent hash
+	// selector if it has a ConsistentHashKey, or else BackendSelector. Both
+	// must be set before the listener is started.
+	BackendSelector      proxy.BackendSelector
+	RouteBackendSelector func(*router.HTTPRoute) proxy.BackendSelector
+
+	// SessionTicketKeyFile, if set, is a file containing the keys used to
+	// encrypt TLS session tickets (see readSessionTicketKeys), so that they
+	// can be shared by a fleet of routers. If SessionTicketKeyRotation is
+	// set the file is reloaded at that interval, otherwise keys are
+	// generated and rotated at that interval, with tickets encrypted with
+	// the previous keys still accepted.
+	SessionTicketKeyFile     string
+	SessionTicketKeyRotation time.Duration
+
+	// PeerDiscovery configures pulling route changes from other router
+	// instances while syncing with the data store is failing (see
+	// runPeerSync)
+	PeerDiscovery PeerConfig
+
 	mtx      sync.RWMutex
 	domains  map[string]*node
 	routes   map[string]*httpRoute
 	services map[string]*service
 
+	// envRoutes are the IDs of routes loaded from the environment by
+	// LoadEnvRoutes or from Kubernetes Ingresses by SyncKubernetesIngresses,
+	// which are not in the data store
+	envRoutes map[string]struct{}
+
 	discoverd DiscoverdClient
 	ds        DataStore
 	wm        *WatchManager
 	stopSync  func()
 
+	// syncCtx is cancelled by stopSync, and stops syncing routes from
+	// sources other than the data store
+	syncCtx context.Context
+
+	// routeChanges records the changes to routes synced from the data store
+	// or peers, which peers pull while they can't sync (see RouteChanges)
+	routeChanges routeChangeLog
+
 	listener      net.Listener
 	tlsListener   net.Listener
+	tlsConfig     *tls.Config
+	fingerprints  []*fingerprintListener
 	closed        bool
 	cookieKey     *[32]byte
 	keypair       tls.Certificate
 	proxyProtocol bool
 
+	// fingerprintRoutes is the number of routes which log or block TLS
+	// fingerprints, ClientHellos are only fingerprinted if it is non-zero
+	fingerprintRoutes int32
+
+	// additionalListeners are the listeners of AdditionalAddrs and
+	// AdditionalTLSAddrs
+	additionalListeners []net.Listener
+
+	// savedReservoirs are the request reservoirs loaded from
+	// RequestSamplePath which are yet to be restored to their routes
+	savedReservoirs map[string]*requestReservoirState
+
+	// clientCAs, if set, enables verification of TLS client certificates
+	// signed by one of the given CAs, the details of which are forwarded to
+	// backends (see setClientCertHeaders)
+	clientCAs *x509.CertPool
+
+	// config is the listener-level config which can be changed using
+	// Reload
+	configMtx sync.RWMutex
+	config    *ListenerConfig
+
+	// consul looks up service instances in Consul, it is set when starting
+	// the listener if ConsulAddr is set
+	consul *consulHealth
+
+	// vaultTokens are the Vault tokens of routes with VaultServiceAuth set
+	vaultTokens *vaultTokens
+
+	// smuggleMarker identifies requests which replaced requests with
+	// ambiguous framing when SmuggleProtection is set (see smuggleListener)
+	smuggleMarker string
+
+	// journal records the lifecycle of connections if enabled by
+	// EnableConnectionJournal
+	journal *connJournal
+
+	// servers are the servers of the HTTP and HTTPS listeners, which are
+	// shut down by CloseGraceful
+	servers []*http.Server
+	// openConns is the number of open, unhijacked client connections
+	openConns int64
+
+	// s3 is the client used to store backups, it is set when starting
+	// the listener if backups are configured
+	s3 s3iface.S3API
+
+	// syncStatus is the status of syncing routes from the data store
+	syncMtx    sync.Mutex
+	syncStatus router.SyncStatus
+
+	// latency tracks the latencies of requests to each domain (see
+	// LatencyPercentiles)
+	latency latencyStore
+
 	preSync  func()
 	postSync func(<-chan struct{})
 }
@@ -67,8 +230,9 @@ func (s *HTTPListener) Close() error {
 		return nil
 	}
 	s.stopSync()
+	s.closeRequestSamples()
 	for _, service := range s.services {
-		service.sc.Close()
+		service.Close()
 	}
 	if s.listener != nil {
 		s.listener.Close()
@@ -76,6 +240,9 @@ func (s *HTTPListener) Close() error {
 	if s.tlsListener != nil {
 		s.tlsListener.Close()
 	}
+	for _, l := range s.additionalListeners {
+		l.Close()
+	}
 	s.closed = true
 	return nil
 }
@@ -83,6 +250,7 @@ func (s *HTTPListener) Close() error {
 func (s *HTTPListener) Start() error {
 	ctx := context.Background() // TODO(benburkert): make this an argument
 	ctx, s.stopSync = context.WithCancel(ctx)
+	s.syncCtx = ctx
 
 	if s.Watcher != nil {
 		return errors.New("router: http listener already started")
@@ -105,7 +273,28 @@ func (s *HTTPListener) Start() error {
 		s.cookieKey = &[32]byte{}
 	}
 
-	if err := s.startSync(ctx); err != nil {
+	if s.ConsulAddr != "" {
+		s.consul = newConsulHealth(s.ConsulAddr, s.ConsulCacheTTL)
+	}
+	s.vaultTokens = newVaultTokens()
+
+	if s.OutboundInterface != "" {
+		ip, err := parseOutboundIP(s.OutboundInterface)
+		if err != nil {
+			return err
+		}
+		s.outboundIP = ip
+	}
+
+	if s.RequestSamplePath != "" {
+		if err := s.loadRequestSamples(); err != nil {
+			logger.Error("error loading request samples", "path", s.RequestSamplePath, "err", err)
+		}
+	}
+
+	if s.Sidecar {
+		s.synced()
+	} else if err := s.startSync(ctx); err != nil {
 		s.Close()
 		return err
 	}
@@ -115,6 +304,32 @@ func (s *HTTPListener) Start() error {
 		return err
 	}
 
+	if err := s.startSessionTicketKeys(ctx); err != nil {
+		s.Close()
+		return err
+	}
+
+	if s.SnapshotPath != "" {
+		go s.runLocalSnapshots(ctx)
+	}
+
+	if s.RequestSamplePath != "" {
+		go s.runRequestSamples(ctx)
+	}
+
+	if s.PeerDiscovery.enabled() && !s.Sidecar {
+		go s.runPeerSync(ctx)
+	}
+
+	if s.BackupConfig.enabled() {
+		if s.s3 == nil {
+			s.s3 = s.BackupConfig.client()
+		}
+		if s.BackupConfig.BackupInterval > 0 {
+			go s.runBackups(ctx)
+		}
+	}
+
 	return nil
 }
 
@@ -124,42 +339,63 @@ func (s *HTTPListener) startSync(ctx context.Context) error {
 
 	select {
 	case err := <-errc:
-		return err
+		if s.SnapshotPath == "" {
+			return err
+		}
+		// serve the last known routes until syncing succeeds
+		if lerr := s.loadLocalSnapshot(); lerr != nil {
+			logger.Error("error loading local route snapshot", "path", s.SnapshotPath, "err", lerr)
+			return err
+		}
+		s.syncFailed(err)
+		go func() { s.runSync(ctx, errc, s.resync(ctx, errc)) }()
+		return nil
 	case <-startc:
-		go s.runSync(ctx, errc)
+		s.synced()
+		go func() { s.runSync(ctx, errc, <-errc) }()
 		return nil
 	}
 }
 
-func (s *HTTPListener) runSync(ctx context.Context, errc chan error) {
-	err := <-errc
-
-	for {
-		if err == nil {
-			return
-		}
-		log.Printf("router: sync error: %s", err)
+// runSync restarts syncing with the data store whenever it fails, starting
+// with the given result of the current sync. The routes from the last
+// successful sync keep being served in the meantime, with the listener's sync
+// status reporting that it is degraded.
+func (s *HTTPListener) runSync(ctx context.Context, errc chan error, err error) {
+	for err != nil {
+		s.syncFailed(err)
+		err = s.resync(ctx, errc)
+	}
+}
 
-		time.Sleep(2 * time.Second)
+// resync restarts syncing after a failure, returning the result of the new
+// sync once it finishes.
+func (s *HTTPListener) resync(ctx context.Context, errc chan error) error {
+	time.Sleep(syncRetryInterval)
 
-		if s.preSync != nil {
-			s.preSync()
-		}
+	if s.preSync != nil {
+		s.preSync()
+	}
 
-		startc := s.doSync(ctx, errc)
+	startc := s.doSync(ctx, errc)
 
-		if s.postSync != nil {
-			s.postSync(startc)
-		}
+	if s.postSync != nil {
+		s.postSync(startc)
+	}
 
-		err = <-errc
+	select {
+	case <-startc:
+		s.synced()
+		return <-errc
+	case err := <-errc:
+		return err
 	}
 }
 
 func (s *HTTPListener) doSync(ctx context.Context, errc chan<- error) <-chan struct{} {
 	startc := make(chan struct{})
 
-	go func() { errc <- s.ds.Sync(ctx, &httpSyncHandler{l: s}, startc) }()
+	go func() { errc <- s.ds.Sync(ctx, dataStoreSyncHandler{&httpSyncHandler{l: s}}, startc) }()
 
 	return startc
 }
@@ -168,26 +404,44 @@ func (s *HTTPListener) startListen() error {
 	if err := s.listenAndServe(); err != nil {
 		return err
 	}
-	s.Addr = s.listener.Addr().String()
+	if s.listener != nil {
+		s.Addr = s.listener.Addr().String()
+	}
 
 	if err := s.listenAndServeTLS(); err != nil {
-		s.listener.Close()
+		if s.listener != nil {
+			s.listener.Close()
+		}
 		return err
 	}
-	s.TLSAddr = s.tlsListener.Addr().String()
+	if s.tlsListener != nil {
+		s.TLSAddr = s.tlsListener.Addr().String()
+	}
 
 	return nil
 }
 
 var ErrClosed = errors.New("router: listener has been closed")
 
+// ErrReadOnly is returned when trying to modify the routes of a read-only
+// listener
+var ErrReadOnly = errors.New("router: listener is read-only")
+
 func (s *HTTPListener) AddRoute(r *router.Route) error {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	if s.closed {
 		return ErrClosed
 	}
-	return s.ds.Add(r)
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	keepSecrets(r, nil)
+	if err := s.ds.Add(r); err != nil {
+		return err
+	}
+	go checkServiceInstances(s.discoverd, r)
+	return nil
 }
 
 func (s *HTTPListener) UpdateRoute(r *router.Route) error {
@@ -196,6 +450,14 @@ func (s *HTTPListener) UpdateRoute(r *router.Route) error {
 	if s.closed {
 		return ErrClosed
 	}
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	existing, err := s.ds.Get(r.ID)
+	if err != nil {
+		existing = nil
+	}
+	keepSecrets(r, existing)
 	return s.ds.Update(r)
 }
 
@@ -210,6 +472,9 @@ func (s *HTTPListener) RemoveRoute(id string) error {
 	if s.closed {
 		return ErrClosed
 	}
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
 	return s.ds.Remove(id)
 }
 
@@ -219,6 +484,9 @@ func (s *HTTPListener) AddCert(cert *router.Certificate) error {
 	if s.closed {
 		return ErrClosed
 	}
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
 	return s.ds.AddCert(cert)
 }
 
@@ -255,6 +523,9 @@ func (s *HTTPListener) RemoveCert(id string) error {
 	if s.closed {
 		return ErrClosed
 	}
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
 	return s.ds.RemoveCert(id)
 }
 
@@ -267,6 +538,11 @@ func (h *httpSyncHandler) Current() map[string]struct{} {
 	defer h.l.mtx.RUnlock()
 	ids := make(map[string]struct{}, len(h.l.routes))
 	for id := range h.l.routes {
+		// routes loaded from the environment are not in the data
+		// store, so don't let the sync remove them
+		if _, ok := h.l.envRoutes[id]; ok {
+			continue
+		}
 		ids[id] = struct{}{}
 	}
 	return ids
@@ -278,7 +554,7 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 	cert := r.Certificate
 
 	if cert != nil && cert.Cert != "" && cert.Key != "" {
-		kp, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.Key))
+		kp, err := parseKeyPair(cert.Cert, cert.Key)
 		if err != nil {
 			return err
 		}
@@ -286,109 +562,356 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		r.Certificate = nil
 	}
 
+	if len(r.BlockedTLSFingerprints) > 0 {
+		r.blockedFingerprints = make(map[string]struct{}, len(r.BlockedTLSFingerprints))
+		for _, ja3 := range r.BlockedTLSFingerprints {
+			r.blockedFingerprints[strings.ToLower(ja3)] = struct{}{}
+		}
+	}
+
 	h.l.mtx.Lock()
 	defer h.l.mtx.Unlock()
 	if h.l.closed {
 		return nil
 	}
 
-	service := h.l.services[r.Service]
-	if service != nil && service.name != r.Service {
-		service.refs--
-		if service.refs <= 0 {
-			service.Close()
-			delete(h.l.services, service.name)
+	service, err := h.l.getService(r.Service, r.DrainBackends)
+	if err != nil {
+		return err
+	}
+	r.rp = h.l.newRouteProxy(r, r.Service, service)
+	r.config = h.l.getConfig
+	if len(r.PushPaths) > 0 {
+		r.pushCache = newPushCache()
+	}
+	if r.MaxConcurrentRequests > 0 {
+		r.limiter = newConcurrencyLimiter(route)
+	}
+	if r.PerClientRateLimit {
+		r.clientLimiter = newClientRateLimiter(route)
+	}
+	if r.RequestFingerprintDedup {
+		r.dedup = newDedupCache(route)
+	}
+	if r.RetryBudget != nil {
+		r.retryBudget = newRetryBudget(r.RetryBudget)
+	}
+	if len(r.StatusRateLimit) > 0 {
+		r.statusLimiter = newStatusRateLimiter(r.StatusRateLimit)
+	}
+	if r.ReservoirSampleSize > 0 {
+		h.l.setReservoir(r)
+	}
+	r.service = service
+	if r.BasicAuth != nil {
+		if r.basicAuth, err = newBasicAuthChecker(r.BasicAuth); err != nil {
+			h.l.releaseRouteServices(r)
+			return err
 		}
-		service = nil
 	}
-	if service == nil {
-		sc, err := cache.New(h.l.discoverd.Service(r.Service))
+	if r.VaultServiceAuth != nil {
+		r.vaultToken = h.l.vaultTokens.get(r.Service, r.VaultServiceAuth)
+	}
+	if r.ABTest != nil {
+		if err := h.l.setABTest(r); err != nil {
+			h.l.releaseRouteServices(r)
+			return err
+		}
+	}
+	if len(r.MethodRoutes) > 0 {
+		if err := h.l.setMethodRoutes(r); err != nil {
+			h.l.releaseRouteServices(r)
+			return err
+		}
+	}
+	if len(r.FanoutServices) > 0 {
+		if err := h.l.setFanout(r); err != nil {
+			h.l.releaseRouteServices(r)
+			return err
+		}
+	}
+	if r.ErrorHandlerService != "" {
+		errorService, err := h.l.getService(r.ErrorHandlerService, false)
 		if err != nil {
+			h.l.releaseRouteServices(r)
 			return err
 		}
-
-		service = newService(r.Service, sc, h.l.wm, r.DrainBackends)
-		h.l.services[r.Service] = service
+		r.errorService = errorService
+		r.errorRP = proxy.NewReverseProxy(errorService.Addrs, h.l.cookieKey, false, errorService, logger)
+		r.errorRP.SetLocalIP(h.l.outboundIP)
+		// the error handler does not itself get an error handler, if it
+		// fails then the original error is returned
+		r.errorRP.ErrorHandler = failWithRouterError
+		r.rp.ErrorHandler = r.serveError
+		if r.abTest != nil {
+			for _, v := range r.abTest.variants {
+				v.rp.ErrorHandler = r.serveError
+			}
+		}
+		for _, m := range r.methodRoutes {
+			m.rp.ErrorHandler = r.serveError
+		}
 	}
-	service.refs++
-	var bf proxy.BackendListFunc
-	if r.Leader {
-		bf = service.sc.LeaderAddr
-	} else {
-		bf = service.sc.Addrs
+	if _, ok := h.l.envRoutes[data.ID]; !ok {
+		h.l.removeConflictingEnvRoutes(r)
+	}
+	if prev, ok := h.l.routes[data.ID]; ok {
+		// release the services of the route being replaced now that the
+		// new route holds a reference to its own services
+		h.l.releaseRouteServices(prev)
+		// keep counting the requests in flight to the previous route
+		// against the limit if it hasn't changed
+		if r.limiter != nil && prev.limiter != nil && r.limiter.equal(prev.limiter) {
+			r.limiter = prev.limiter
+		}
+		if r.clientLimiter != nil && prev.clientLimiter != nil && r.clientLimiter.equal(prev.clientLimiter) {
+			r.clientLimiter = prev.clientLimiter
+		}
+		if r.basicAuth != nil && prev.basicAuth != nil && r.basicAuth.equal(prev.basicAuth) {
+			r.basicAuth = prev.basicAuth
+		}
+		if r.dedup != nil && prev.dedup != nil && r.dedup.equal(prev.dedup) {
+			r.dedup = prev.dedup
+		}
+		if r.retryBudget != nil && prev.retryBudget != nil && r.retryBudget.equal(prev.retryBudget) {
+			r.retryBudget = prev.retryBudget
+		}
+		if r.reservoir != nil && prev.reservoir != nil && r.reservoir.equal(prev.reservoir) {
+			r.reservoir = prev.reservoir
+		}
+		if r.statusLimiter != nil && prev.statusLimiter != nil && r.statusLimiter.equal(prev.statusLimiter) {
+			r.statusLimiter = prev.statusLimiter
+		}
+		if r.abTest != nil && prev.abTest != nil {
+			r.abTest.keepRequestCounts(prev.abTest)
+		}
+		if prev.usesTLSFingerprint() {
+			atomic.AddInt32(&h.l.fingerprintRoutes, -1)
+		}
 	}
-	r.rp = proxy.NewReverseProxy(bf, h.l.cookieKey, r.Sticky, service, logger)
-	r.service = service
 	h.l.routes[data.ID] = r
+	if r.usesTLSFingerprint() {
+		atomic.AddInt32(&h.l.fingerprintRoutes, 1)
+	}
+	if _, ok := h.l.envRoutes[data.ID]; !ok {
+		h.l.routeChanges.set(data)
+	}
 	if data.Path == "/" {
-		if tree, ok := h.l.domains[strings.ToLower(r.Domain)]; ok {
+		if tree, ok := h.l.domains[canonicalDomain(r.Domain)]; ok {
 			tree.backend = r
 		} else {
-			h.l.domains[strings.ToLower(r.Domain)] = NewTree(r)
+			h.l.domains[canonicalDomain(r.Domain)] = NewTree(r)
 		}
 	} else {
-		if tree, ok := h.l.domains[strings.ToLower(r.Domain)]; ok {
+		if tree, ok := h.l.domains[canonicalDomain(r.Domain)]; ok {
 			tree.Insert(r.Path, r)
 		} else {
 			logger.Error("Failed insert of path based route, consistency violation.")
 		}
 	}
 
-	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: r.Domain, Route: r.ToRoute()})
+	h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: r.Domain, Route: r.ToRoute()})
 	return nil
 }
 
+// newRouteProxy returns a reverse proxy sending requests to the route to the
+// given service. The caller must hold s.mtx.
+func (s *HTTPListener) newRouteProxy(r *httpRoute, serviceName string, service *service) *proxy.ReverseProxy {
+	var bf proxy.BackendListFunc
+	if r.Leader {
+		bf = service.LeaderAddr
+	} else {
+		bf = service.Addrs
+	}
+	if r.ConsulHealthBackends {
+		if s.consul != nil {
+			bf = s.consul.backends(serviceName, bf)
+		} else {
+			logger.Warn("consul is not configured, using discoverd instances", "route.id", r.ID, "service", serviceName)
+		}
+	}
+	rp := proxy.NewReverseProxy(bf, s.cookieKey, r.Sticky, service, logger)
+	if !r.Leader {
+		rp.SetBackendPicker(service.pickBackend)
+	}
+	if selector := s.backendSelector(r.HTTPRoute); selector != nil {
+		rp.SetBackendSelector(selector)
+	}
+	rp.ModifyResponse = r.modifyResponse
+	rp.Multicast = r.MulticastMode
+	rp.ForwardTrailers = r.ForwardTrailers
+	rp.SetBackendH2C(r.BackendH2CEnabled)
+	rp.SetLocalIP(s.outboundIP)
+	rp.SetMaxResponseHeaderBytes(int64(maxHeaderBytes(r.MaxResponseHeaderBytes)))
+	return rp
+}
+
+// releaseRouteServices releases the services held by a route. The caller
+// must hold s.mtx.
+func (s *HTTPListener) releaseRouteServices(r *httpRoute) {
+	s.releaseService(r.service)
+	if r.errorService != nil {
+		s.releaseService(r.errorService)
+	}
+	if r.abTest != nil {
+		for _, v := range r.abTest.variants {
+			s.releaseService(v.service)
+		}
+	}
+	for _, m := range r.methodRoutes {
+		s.releaseService(m.service)
+	}
+	for _, t := range r.fanout {
+		s.releaseService(t.service)
+	}
+	if r.vaultToken != nil {
+		s.vaultTokens.release(r.vaultToken)
+	}
+}
+
+// backendSelector returns the BackendSelector of the given route, or nil to
+// use the default.
+func (s *HTTPListener) backendSelector(r *router.HTTPRoute) proxy.BackendSelector {
+	if s.RouteBackendSelector != nil {
+		if selector := s.RouteBackendSelector(r); selector != nil {
+			return selector
+		}
+	}
+	if selector := consistentHashSelector(r); selector != nil {
+		return selector
+	}
+	return s.BackendSelector
+}
+
 func (h *httpSyncHandler) Remove(id string) error {
 	h.l.mtx.Lock()
 	defer h.l.mtx.Unlock()
 	if h.l.closed {
 		return nil
 	}
-	r, ok := h.l.routes[id]
+	_, isEnv := h.l.envRoutes[id]
+	if err := h.l.removeRoute(id); err != nil {
+		return err
+	}
+	if !isEnv {
+		h.l.routeChanges.remove(id, time.Now())
+	}
+	return nil
+}
+
+// removeRoute removes the route with the given ID. The caller must hold
+// s.mtx.
+func (s *HTTPListener) removeRoute(id string) error {
+	r, ok := s.routes[id]
 	if !ok {
 		return ErrNotFound
 	}
 
-	r.service.refs--
-	if r.service.refs <= 0 {
-		r.service.sc.Close()
-		delete(h.l.services, r.service.name)
+	s.releaseRouteServices(r)
+	if r.usesTLSFingerprint() {
+		atomic.AddInt32(&s.fingerprintRoutes, -1)
 	}
 
-	delete(h.l.routes, id)
-	if tree, ok := h.l.domains[r.Domain]; ok {
+	delete(s.routes, id)
+	delete(s.envRoutes, id)
+	if tree, ok := s.domains[canonicalDomain(r.Domain)]; ok {
 		if r.Path == "/" && tree.backend == r {
-			delete(h.l.domains, r.Domain)
+			delete(s.domains, canonicalDomain(r.Domain))
+			s.latency.forget(r.Domain)
 		} else if tree.Lookup(r.Path) == r {
 			tree.Remove(r.Path)
 		}
 	}
-	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
+	s.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
 	return nil
 }
 
+// getService returns the service with the given name, creating it if it
+// doesn't exist, and increments its reference count. The caller must hold
+// s.mtx.
+func (s *HTTPListener) getService(name string, drainBackends bool) (*service, error) {
+	service := s.services[name]
+	if service == nil {
+		sc, err := cache.New(s.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
+		service = newService(name, sc, s.wm, drainBackends)
+		go service.replaceStaleCaches(s.discoverd.Service(name))
+		s.services[name] = service
+	}
+	service.refs++
+	return service, nil
+}
+
+// releaseService decrements the reference count of the given service,
+// closing it if it is no longer referenced. The caller must hold s.mtx.
+func (s *HTTPListener) releaseService(service *service) {
+	service.refs--
+	if service.refs <= 0 {
+		service.Close()
+		delete(s.services, service.name)
+	}
+}
+
 func (s *HTTPListener) listenAndServe() error {
-	var err error
-	s.listener, err = listenFunc("tcp4", s.Addr)
-	if err != nil {
-		return listenErr{s.Addr, err}
+	if s.Addr != "" || s.Listener != nil {
+		var err error
+		if s.listener, err = s.serveHTTP(s.Addr, s.Listener); err != nil {
+			return err
+		}
+	}
+	for i, addr := range s.AdditionalAddrs {
+		l, err := s.serveHTTP(addr, nil)
+		if err != nil {
+			return err
+		}
+		s.additionalListeners = append(s.additionalListeners, l)
+		s.AdditionalAddrs[i] = l.Addr().String()
+	}
+	return nil
+}
+
+// serveHTTP serves HTTP on l, or on a new listener on addr if l is nil,
+// returning the listener being served.
+func (s *HTTPListener) serveHTTP(addr string, l net.Listener) (net.Listener, error) {
+	if l == nil {
+		var err error
+		l, err = s.SocketOptions.listen(addr)
+		if err != nil {
+			return nil, listenErr{addr, err}
+		}
 	}
 	if s.proxyProtocol {
-		s.listener = proxyproto.Listener{s.listener}
+		l = proxyproto.Listener{l}
 	}
 
 	server := &http.Server{
-		Addr: s.listener.Addr().String(),
-		Handler: fwdProtoHandler{
+		Addr: l.Addr().String(),
+		Handler: s.stripTrustedHeaders(fwdProtoHandler{
 			Handler: s,
 			Proto:   "http",
-			Port:    mustPortFromAddr(s.listener.Addr().String()),
-		},
+			Port:    portFromAddr(l.Addr().String()),
+		}),
+	}
+
+	if s.journal != nil {
+		server.Handler = s.journal.handler(server.Handler)
+	}
+	server.ConnState = s.connStateHook("http")
+	s.servers = append(s.servers, server)
+
+	var sl net.Listener = connMetricsListener{l}
+	if s.SmuggleProtection {
+		if s.smuggleMarker == "" {
+			s.smuggleMarker = random.Hex(16)
+		}
+		sl = smuggleListener{Listener: sl, marker: s.smuggleMarker}
 	}
 
 	// TODO: log error
-	go server.Serve(s.listener)
-	return nil
+	go server.Serve(sl)
+	return l, nil
 }
 
 var errMissingTLS = errors.New("router: route not found or TLS not configured")
@@ -397,57 +920,128 @@ func (s *HTTPListener) listenAndServeTLS() error {
 	certForHandshake := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		r := s.findRoute(hello.ServerName, "/")
 		if r == nil {
+			if s.getConfig().UnknownSNI == unknownSNIDefaultCert {
+				// use the default certificate in Certificates
+				return nil, nil
+			}
 			return nil, errMissingTLS
 		}
+		// hello.Conn is the connection the tlsHandshakeListener set the
+		// listener's deadline on
+		if r.TLSHandshakeTimeoutMS > 0 {
+			hello.Conn.SetDeadline(time.Now().Add(time.Duration(r.TLSHandshakeTimeoutMS) * time.Millisecond))
+		}
 		return r.keypair, nil
 	}
 	tlsConfig := tlsconfig.SecureCiphers(&tls.Config{
 		GetCertificate: certForHandshake,
 		Certificates:   []tls.Certificate{s.keypair},
-		NextProtos:     []string{http2.NextProtoTLS, "h2-14"},
+		NextProtos:     []string{http2.NextProtoTLS, "http/1.1"},
 	})
+	if s.clientCAs != nil {
+		tlsConfig.ClientCAs = s.clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
-	l, err := listenFunc("tcp4", s.TLSAddr)
-	if err != nil {
-		return listenErr{s.Addr, err}
+	s.tlsConfig = tlsConfig
+
+	if s.TLSAddr != "" || s.TLSListener != nil {
+		var err error
+		if s.tlsListener, err = s.serveTLS(s.TLSAddr, s.TLSListener); err != nil {
+			return err
+		}
+	}
+	for i, addr := range s.AdditionalTLSAddrs {
+		l, err := s.serveTLS(addr, nil)
+		if err != nil {
+			return err
+		}
+		s.additionalListeners = append(s.additionalListeners, l)
+		s.AdditionalTLSAddrs[i] = l.Addr().String()
+	}
+	return nil
+}
+
+// serveTLS serves HTTPS on l, or on a new listener on addr if l is nil,
+// returning the TLS listener being served.
+func (s *HTTPListener) serveTLS(addr string, l net.Listener) (net.Listener, error) {
+	if l == nil {
+		var err error
+		l, err = s.SocketOptions.listen(addr)
+		if err != nil {
+			return nil, listenErr{addr, err}
+		}
 	}
 	if s.proxyProtocol {
 		l = proxyproto.Listener{l}
 	}
-	s.tlsListener = tls.NewListener(l, tlsConfig)
-
-	handler := fwdProtoHandler{
-		Handler: s,
-		Proto:   "https",
-		Port:    mustPortFromAddr(s.tlsListener.Addr().String()),
+	l = connMetricsListener{l}
+	l = newPassthroughListener(l, func(hello *clientHello) *httpRoute {
+		r := s.findRoute(hello.serverName, "/")
+		if r == nil || !r.TLSPassthrough || r.blocksTLSFingerprint(hello.JA3Hash()) {
+			return nil
+		}
+		return r
+	})
+	fingerprints := newFingerprintListener(l, func() bool {
+		return atomic.LoadInt32(&s.fingerprintRoutes) > 0
+	}, func(hello *clientHello) bool {
+		r := s.findRoute(hello.serverName, "/")
+		return r == nil || !r.blocksTLSFingerprint(hello.JA3Hash())
+	})
+	s.mtx.Lock()
+	s.fingerprints = append(s.fingerprints, fingerprints)
+	s.mtx.Unlock()
+	handshakeTimeout := s.TLSHandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = defaultTLSHandshakeTimeout
 	}
-	http2Server := &http2.Server{}
-	http2Handler := func(hs *http.Server, c *tls.Conn, h http.Handler) {
-		http2Server.ServeConn(c, &http2.ServeConnOpts{
-			Handler:    handler,
-			BaseConfig: hs,
-		})
+	var handshakeFailed func(net.Conn, time.Time, error)
+	if s.journal != nil {
+		handshakeFailed = s.journal.handshakeFailed("https")
 	}
+	tlsListener := newTLSHandshakeListener(fingerprints, s.tlsConfig, handshakeTimeout, handshakeFailed)
 
+	handler := s.stripTrustedHeaders(fwdProtoHandler{
+		Handler: s,
+		Proto:   "https",
+		Port:    portFromAddr(tlsListener.Addr().String()),
+	})
+	// HTTP/2 is served by net/http (which is configured automatically when
+	// TLSNextProto is nil) as it supports server push, unlike the vendored
+	// x/net/http2 server. net/http doesn't serve the pre-RFC "h2-14" draft
+	// protocol, which browsers stopped negotiating in 2015, so clients
+	// which only offer it use HTTP/1.1.
 	server := &http.Server{
-		Addr:    s.tlsListener.Addr().String(),
+		Addr:    tlsListener.Addr().String(),
 		Handler: handler,
-		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
-			http2.NextProtoTLS: http2Handler,
-			"h2-14":            http2Handler,
-		},
 	}
+	if s.journal != nil {
+		server.Handler = s.journal.handler(server.Handler)
+	}
+	server.ConnState = s.connStateHook("https")
+	s.servers = append(s.servers, server)
 
 	// TODO: log error
-	go server.Serve(s.tlsListener)
-	return nil
+	go server.Serve(tlsListener)
+	return tlsListener, nil
 }
 
-func (s *HTTPListener) findRoute(host string, path string) *httpRoute {
-	host = strings.ToLower(host)
-	if strings.Contains(host, ":") {
-		host, _, _ = net.SplitHostPort(host)
+// tlsFingerprint returns the JA3 hash of the TLS connection with the given
+// remote address.
+func (s *HTTPListener) tlsFingerprint(remoteAddr string) string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, l := range s.fingerprints {
+		if ja3 := l.Fingerprint(remoteAddr); ja3 != "" {
+			return ja3
+		}
 	}
+	return ""
+}
+
+func (s *HTTPListener) findRoute(host string, path string) *httpRoute {
+	host, _ = parseHost(host)
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	if tree, ok := s.domains[host]; ok {
@@ -475,16 +1069,100 @@ func fail(w http.ResponseWriter, code int) {
 	w.Write(msg)
 }
 
+// proxiedMethods are the methods listed in the Allow header of 405 responses
+// to requests whose method the router rejects, though backends may not
+// support all of them
+var proxiedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// failMethodNotAllowed responds with a 405, listing the allowed methods in
+// the Allow header as required by RFC 7231.
+func failMethodNotAllowed(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	fail(w, http.StatusMethodNotAllowed)
+}
+
 func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	config := s.getConfig()
+	// health checks are answered before anything else so that they don't
+	// count towards the request metrics
+	if config.HealthCheck.matches(req) {
+		config.HealthCheck.serve(w, req)
+		return
+	}
+	start := time.Now()
+	clientRequests.Inc()
 	ctx := context.Background()
-	ctx = ctxhelper.NewContextStartTime(ctx, time.Now())
+	ctx = ctxhelper.NewContextStartTime(ctx, start)
+	if s.smuggleMarker != "" && req.Header.Get(smuggleHeader) == s.smuggleMarker {
+		logger.Info("rejected request with ambiguous framing", "client_addr", req.RemoteAddr)
+		w.Header().Set("Connection", "close")
+		fail(w, http.StatusBadRequest)
+		return
+	}
+	if req.Method == "TRACE" && !config.AllowTrace {
+		failMethodNotAllowed(w, proxiedMethods)
+		return
+	}
+	if req.Method == "OPTIONS" && req.RequestURI == "*" {
+		// server-wide OPTIONS requests are about the router rather
+		// than any route, so answer them rather than forwarding the
+		// "*" target to a backend
+		allowed := proxiedMethods
+		if config.AllowTrace {
+			allowed = append(allowed[:len(allowed):len(allowed)], "TRACE")
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if config.MaxRequestHeaders > 0 && headerFieldCount(req.Header) > config.MaxRequestHeaders {
+		fail(w, http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if len(req.RequestURI) > maxURIBytes(config) {
+		fail(w, http.StatusRequestURITooLong)
+		return
+	}
+	if !checkHops(req, config) {
+		fail(w, http.StatusLoopDetected)
+		return
+	}
+	if !config.ForwardAbsoluteURIs {
+		normalizeRequestURI(req)
+	}
+	if normalizeRequestPath(req) && config.NormalizePathRedirect {
+		w.Header().Set("Location", redirectLocation(req.RequestURI))
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
 	r := s.findRoute(req.Host, req.URL.Path)
 	if r == nil {
 		fail(w, 404)
 		return
 	}
+	if req.TLS != nil && s.findRoute(req.TLS.ServerName, "/") == nil {
+		// the connection was completed with the default certificate
+		// (see unknownSNIDefaultCert), so isn't for the route
+		fail(w, http.StatusMisdirectedRequest)
+		return
+	}
+	if r.TLSPassthrough {
+		// the backends expect TLS connections, so only TLS connections
+		// which aren't terminated by the router can be routed to them
+		fail(w, http.StatusMisdirectedRequest)
+		return
+	}
 
+	if r.LogTLSFingerprint && req.TLS != nil {
+		logger.Info("request", "host", req.Host, "path", req.URL.Path, "client_addr", req.RemoteAddr, "ja3", s.tlsFingerprint(req.RemoteAddr))
+	}
+
+	setClientCertHeaders(req, config.ForwardClientCertPEM)
 	r.ServeHTTP(ctx, w, req)
+
+	now := time.Now()
+	s.latency.record(r.Domain, now.Sub(start), now)
 }
 
 // A domain served by a listener, associated TLS certs,
@@ -495,32 +1173,141 @@ type httpRoute struct {
 	keypair *tls.Certificate
 	service *service
 	rp      *proxy.ReverseProxy
+
+	errorService *service
+	errorRP      *proxy.ReverseProxy
+
+	blockedFingerprints map[string]struct{}
+	basicAuth           *basicAuthChecker
+
+	pushCache *pushCache
+
+	// config returns the listener config
+	config func() *ListenerConfig
+
+	// collapse is used to collapse concurrent identical requests when
+	// RequestCollapsingEnabled is set
+	collapse singleflight.Group
+
+	// limiter limits concurrent requests when MaxConcurrentRequests is set
+	limiter *concurrencyLimiter
+
+	// clientLimiter limits the rate of requests from each client when
+	// PerClientRateLimit is set
+	clientLimiter *clientRateLimiter
+
+	// dedup stores responses to deduplicate requests when
+	// RequestFingerprintDedup is set
+	dedup *dedupCache
+
+	// retryBudget limits the requests which are retried when RetryBudget is
+	// set
+	retryBudget *retryBudget
+
+	// statusLimiter throttles or blocks clients which cause too many
+	// responses with the status codes in StatusRateLimit
+	statusLimiter *statusRateLimiter
+
+	// reservoir samples the requests to the route when
+	// ReservoirSampleSize is set
+	reservoir *requestReservoir
+
+	// abTest routes requests to the variants of the route's ABTest
+	abTest *abTest
+
+	// methodRoutes route requests to the services of their methods in
+	// MethodRoutes
+	methodRoutes map[string]*methodRoute
+
+	// fanout are the targets which requests are also sent to when
+	// FanoutServices is set
+	fanout []*fanoutTarget
+
+	// vaultToken is the token sent to the backends when VaultServiceAuth is
+	// set
+	vaultToken *vaultToken
+}
+
+// usesTLSFingerprint returns whether the route logs or blocks the TLS
+// fingerprints of its clients.
+func (r *httpRoute) usesTLSFingerprint() bool {
+	return r.LogTLSFingerprint || len(r.blockedFingerprints) > 0
+}
+
+func (r *httpRoute) blocksTLSFingerprint(ja3 string) bool {
+	_, ok := r.blockedFingerprints[ja3]
+	return ok
 }
 
 // A service definition: name, and set of backends.
 type service struct {
-	name   string
-	sc     *cache.ServiceCache
-	refs   int
-	wm     *WatchManager
-	stream stream.Stream
-	reqs   map[string]int64
-	cond   *sync.Cond
+	name string
+	refs int
+	wm   *WatchManager
+	reqs map[string]int64
+	cond *sync.Cond
+
+	// cacheMtx guards sc and stream, which are replaced when the cache
+	// becomes stale (see replaceStaleCaches)
+	cacheMtx sync.RWMutex
+	sc       *cache.ServiceCache
+	stream   stream.Stream
+
+	// instances are the instances of the service, which are only accessed
+	// by the watchBackends goroutine (or replaceCache while it is stopped)
+	// as the cache is locked while it sends the current instances
+	instances map[string]*discoverd.Instance
+	// stopWatch stops the watchBackends goroutine, which closes watchDone
+	// when it returns
+	stopWatch chan struct{}
+	watchDone chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// weights holds a *weightTableRef used to pick backends
+	weights atomic.Value
+
+	// addrs holds the []string addresses of the instances returned by
+	// Addrs, which is updated as instances change once the instances in
+	// the cache when it was first watched have been received (see
+	// updateAddrs)
+	addrs        atomic.Value
+	addrsCurrent bool
+
+	// health is the passively tracked health of backends which have had
+	// failed requests
+	healthMtx sync.Mutex
+	health    map[string]*backendHealth
+
+	// healthEvents are the latest health events of each backend waiting
+	// to be sent by sendHealthEvents, which is running if healthSending
+	// is set, and healthSent the last event sent for each backend
+	healthEvents  map[string]*router.Event
+	healthSent    map[string]sentHealthEvent
+	healthSending bool
+
+	// instanceUp is closed and replaced when an instance comes up, waking
+	// requests waiting for the service to have instances (see
+	// waitForInstances)
+	instanceUpMtx sync.Mutex
+	instanceUp    chan struct{}
 }
 
 func newService(name string, sc *cache.ServiceCache, wm *WatchManager, trackBackends bool) *service {
 	s := &service{
-		name: name,
-		sc:   sc,
-		wm:   wm,
+		name:       name,
+		sc:         sc,
+		wm:         wm,
+		instances:  make(map[string]*discoverd.Instance),
+		closed:     make(chan struct{}),
+		instanceUp: make(chan struct{}),
 	}
 	if trackBackends {
-		events := make(chan *discoverd.Event)
-		s.stream = sc.Watch(events, true)
 		s.reqs = make(map[string]int64)
 		s.cond = sync.NewCond(&sync.Mutex{})
-		go s.watchBackends(events)
 	}
+	s.watch(sc)
 	return s
 }
 
@@ -546,14 +1333,72 @@ func (s *service) TrackRequestDone(backend string) {
 }
 
 func (s *service) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
 	if s.stream != nil {
 		s.stream.Close()
 	}
 	s.sc.Close()
 }
 
-func (s *service) watchBackends(events chan *discoverd.Event) {
-	for event := range events {
+// watch starts watching the backends of the service in the given cache. The
+// caller must hold s.cacheMtx or have exclusive access to s.
+func (s *service) watch(sc *cache.ServiceCache) {
+	events := make(chan *discoverd.Event)
+	s.stream = sc.Watch(events, true)
+	s.stopWatch = make(chan struct{})
+	s.watchDone = make(chan struct{})
+	// the cache is locked while it sends the current instances, so Addrs
+	// returns once they have all been received
+	current := make(chan struct{})
+	go func() {
+		sc.Addrs()
+		close(current)
+	}()
+	go s.watchBackends(events, current, s.stopWatch, s.watchDone)
+}
+
+func (s *service) watchBackends(events chan *discoverd.Event, current, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			s.handleInstanceEvent(event)
+		case <-current:
+			current = nil
+			s.addrsCurrent = true
+			s.updateAddrs()
+		case <-stop:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *service) handleInstanceEvent(event *discoverd.Event) {
+	switch event.Kind {
+	case discoverd.EventKindUp, discoverd.EventKindUpdate:
+		if _, ok := s.instances[event.Instance.ID]; ok && event.Kind == discoverd.EventKindUp {
+			// a replacement cache sends the instances which were
+			// already up as up events
+			event = &discoverd.Event{Kind: discoverd.EventKindUpdate, Instance: event.Instance}
+		}
+		s.instances[event.Instance.ID] = event.Instance
+		s.updateWeights(instanceList(s.instances))
+		s.updateAddrs()
+		s.notifyInstanceUp()
+	case discoverd.EventKindDown:
+		delete(s.instances, event.Instance.ID)
+		s.updateWeights(instanceList(s.instances))
+		s.updateAddrs()
+		s.forgetBackendHealth(event.Instance.Addr)
+	}
+	if s.reqs != nil {
 		go s.handleBackendEvent(event)
 	}
 }
@@ -594,18 +1439,213 @@ func (s *service) handleBackendEvent(event *discoverd.Event) {
 }
 
 func (r *httpRoute) ServeHTTP(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if r.reservoir != nil {
+		// the request is sampled as the client sent it, before it is
+		// rewritten
+		start := time.Now()
+		sample := requestSampleFor(req, start)
+		sw := &statusRecordingWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			sample.RequestID = req.Header.Get("X-Request-Id")
+			sample.Status = sw.status
+			sample.Duration = time.Since(start)
+			r.sampleRequest(sample)
+		}()
+	}
+
+	if !r.checkRequestHeaderSize(w, req) {
+		return
+	}
+
+	if r.EnvoyHCPath != "" && r.handleEnvoyHealthCheck(w, req) {
+		return
+	}
+
+	if r.clientLimiter != nil && !r.checkClientRateLimit(w, req) {
+		return
+	}
+
+	if r.statusLimiter != nil {
+		ip := r.config().clientIP(req)
+		if !r.checkStatusRateLimit(ctx, w, ip) {
+			return
+		}
+		sw := &statusRecordingWriter{ResponseWriter: w}
+		w = sw
+		defer func() { r.statusLimiter.record(ip, sw.status, time.Now()) }()
+	}
+
+	// preflight requests never include credentials, so are handled before
+	// checking basic auth
+	if r.CORS != nil && r.serveCORSPreflight(w, req) {
+		return
+	}
+
+	if r.basicAuth != nil {
+		if !r.checkBasicAuth(w, req) {
+			return
+		}
+		// the credentials are for the router, don't leak them to the backend
+		req.Header.Del("Authorization")
+	}
+
+	if r.vaultToken != nil && !r.setVaultToken(w, req) {
+		return
+	}
+
 	start, _ := ctxhelper.StartTimeFromContext(ctx)
-	req.Header.Set("X-Request-Start", strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10))
+	if r.SlowRequestThresholdMS > 0 {
+		var slow *slowRequest
+		req, slow = trackSlowRequest(req, start)
+		defer r.checkSlowRequest(slow)
+	}
+	r.setRequestStart(req, start)
 	setRequestID(req)
+	if span := r.setTraceContext(req); span != nil && r.config().TraceSpans {
+		defer span.Log(req, start)
+	}
+
+	// the push cache is keyed by the client facing path, so check for
+	// pushed requests before rewriting it
+	var pushKey string
+	if len(r.PushPaths) > 0 {
+		pushKey = r.pushCacheKey(req)
+		req.Header.Del(pushHeader)
+	}
+
+	if r.StripPathPrefix != "" || r.AddPathPrefix != "" {
+		r.rewritePath(req)
+	}
+
+	if pushKey != "" {
+		r.servePushed(ctx, w, req, pushKey)
+		return
+	}
+	if pusher, ok := w.(http.Pusher); ok && len(r.PushPaths) > 0 && req.Method == "GET" {
+		w = &pushResponseWriter{ResponseWriter: w, pusher: pusher, paths: r.PushPaths, token: r.pushCache.token}
+	}
+
+	if r.limiter != nil {
+		if !r.limiter.acquire(w) {
+			concurrencyLimitedRequests.Inc()
+			fail(w, http.StatusServiceUnavailable)
+			return
+		}
+		defer r.limiter.release()
+	}
+
+	if r.BufferFullRequestBody && !r.bufferRequestBody(w, req) {
+		return
+	}
+
+	if r.config != nil {
+		if h := r.config().IdempotencyHeader; h != "" && req.Header.Get(h) != "" {
+			ctx = proxy.NewContextRetryable(ctx)
+		}
+	}
+	if r.retryBudget != nil {
+		ctx = proxy.NewContextRetryBudget(ctx, r.retryBudget)
+	}
 
-	r.rp.ServeHTTP(ctx, w, req)
+	if wait := r.emptyServiceWait(); wait > 0 {
+		r.service.waitForInstances(ctx, wait)
+	}
+
+	// the timeout starts once the request is ready to be sent, so that it
+	// doesn't include time spent queued or reading the request body
+	if timeout := r.backendTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if r.dedup != nil {
+		if key := r.requestFingerprint(req); key != "" {
+			r.serveDeduplicated(ctx, w, req, key)
+			return
+		}
+	}
+
+	// duplicate requests aren't fanned out (see serveDeduplicated)
+	if len(r.fanout) > 0 && !r.fanoutRequest(w, req) {
+		return
+	}
+
+	if r.RequestCollapsingEnabled {
+		if key := collapseKey(req); key != "" {
+			r.serveCollapsed(ctx, w, req, key)
+			return
+		}
+	}
+
+	if r.abTest != nil {
+		r.abTest.serveHTTP(ctx, w, req)
+		return
+	}
+
+	r.proxyFor(req).ServeHTTP(ctx, w, req)
 }
 
-func mustPortFromAddr(addr string) string {
-	_, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		panic(err)
+// modifyResponse applies the route's response filters to responses from
+// the backend.
+func (r *httpRoute) modifyResponse(res *http.Response) error {
+	if err := r.checkResponseHeaders(res); err != nil {
+		return err
+	}
+	if r.SlowRequestThresholdMS > 0 {
+		recordSlowRequestResponse(res)
+	}
+	// paths are rewritten before hosts, which the path rewrite matches
+	// the backend's hosts against
+	if r.StripPathPrefix != "" || r.AddPathPrefix != "" {
+		r.rewriteLocationPaths(res)
+	}
+	if len(r.RewriteLocationHosts) > 0 {
+		r.rewriteLocation(res)
+	}
+	if r.CORS != nil {
+		r.setCORSHeaders(res)
 	}
+	if len(r.ClientHints) > 0 || r.PermissionsPolicy != "" {
+		r.setClientHintHeaders(res)
+	}
+	if r.ResponseSigningKey != "" {
+		return r.signResponse(res)
+	}
+	return nil
+}
+
+const routerErrorHeaderName = "X-Router-Error"
+
+// serveError forwards a request which could not be proxied to the route's
+// error handler service, setting the X-Router-Error header to the status code
+// of the error. The header is removed from incoming requests (see
+// stripTrustedHeaders), so if it is already set the request has already been
+// through the error handler and a plain error response is returned instead.
+func (r *httpRoute) serveError(ctx context.Context, w http.ResponseWriter, req *http.Request, status int) {
+	if req.Header.Get(routerErrorHeaderName) != "" {
+		fail(w, status)
+		return
+	}
+	req.Header.Set(routerErrorHeaderName, strconv.Itoa(status))
+	r.errorRP.ServeHTTP(ctx, w, req)
+}
+
+// failWithRouterError is the error handler for requests to error handler
+// services, it responds with the original error stored in the X-Router-Error
+// header.
+func failWithRouterError(ctx context.Context, w http.ResponseWriter, req *http.Request, status int) {
+	if code, err := strconv.Atoi(req.Header.Get(routerErrorHeaderName)); err == nil {
+		status = code
+	}
+	fail(w, status)
+}
+
+// portFromAddr returns the port of addr, or an empty string if it doesn't
+// have one (e.g. the address of an in-memory listener).
+func portFromAddr(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
 	return port
 }
 
@@ -617,3 +1657,48 @@ func setRequestID(req *http.Request) {
 		req.Header.Set("X-Request-Id", random.UUID())
 	}
 }
+
+const (
+	clientCertHeaderName        = "X-Client-Cert"
+	clientCertSubjectHeaderName = "X-Client-Cert-Subject"
+	clientCertSANsHeaderName    = "X-Client-Cert-Sans"
+)
+
+// setClientCertHeaders removes any client cert headers sent by the client and
+// then, if the client presented a verified TLS certificate, sets them to the
+// certificate's subject DN and SANs (and the URL-encoded PEM certificate if
+// includePEM is true).
+func setClientCertHeaders(req *http.Request, includePEM bool) {
+	req.Header.Del(clientCertHeaderName)
+	req.Header.Del(clientCertSubjectHeaderName)
+	req.Header.Del(clientCertSANsHeaderName)
+
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	req.Header.Set(clientCertSubjectHeaderName, cert.Subject.String())
+
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	if len(sans) > 0 {
+		req.Header.Set(clientCertSANsHeaderName, strings.Join(sans, ", "))
+	}
+
+	if includePEM {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		req.Header.Set(clientCertHeaderName, url.QueryEscape(string(data)))
+	}
+}
@@ -2,30 +2,46 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"testing"
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/testutil"
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/tlscert"
+	"github.com/flynn/flynn/pkg/tlsconfig"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/schema"
 	"github.com/flynn/flynn/router/types"
 	. "github.com/flynn/go-check"
 	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/websocket"
 )
@@ -293,6 +309,34 @@ func (s *S) TestAddHTTPRouteWithInvalidCert(c *C) {
 	c.Assert(err, Not(IsNil))
 }
 
+func (s *S) TestAddHTTPRouteWithExpiredCert(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	expired := generateCertWithValidity(c, "expired.example.org", time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	newRoute := func() *router.Route {
+		return router.HTTPRoute{
+			Domain:      "expired.example.org",
+			Service:     "test",
+			Certificate: &router.Certificate{Cert: expired.Cert, Key: expired.Key},
+		}.ToRoute()
+	}
+
+	// expired certificates are rejected in strict mode
+	l.ds.(*pgDataStore).strictCertValidity = true
+	err := l.AddRoute(newRoute())
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Matches, ".*certificate expired at .*")
+
+	// otherwise they are added with a warning
+	l.ds.(*pgDataStore).strictCertValidity = false
+	added := invalidCertificatesAdded.Value()
+	r := newRoute()
+	c.Assert(l.AddRoute(r), IsNil)
+	defer l.RemoveRoute(r.ID)
+	c.Assert(invalidCertificatesAdded.Value(), Equals, added+1)
+}
+
 func (s *S) TestAddHTTPRouteWithExistingCert(c *C) {
 	srv1 := httptest.NewServer(httpTestHandler("1"))
 	srv2 := httptest.NewServer(httpTestHandler("2"))
@@ -848,7 +892,7 @@ func (s *S) TestHTTPHeaders(c *C) {
 
 	addHTTPRoute(c, l)
 
-	port := mustPortFromAddr(l.listener.Addr().String())
+	port := portFromAddr(l.listener.Addr().String())
 	srv := httptest.NewServer(httpHeaderTestHandler(c, "127.0.0.1", port))
 
 	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
@@ -862,7 +906,7 @@ func (s *S) TestHTTPHeadersFromClient(c *C) {
 
 	addHTTPRoute(c, l)
 
-	port := mustPortFromAddr(l.listener.Addr().String())
+	port := portFromAddr(l.listener.Addr().String())
 	srv := httptest.NewServer(httpHeaderTestHandler(c, "192.168.1.1, 127.0.0.1", port))
 
 	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
@@ -1495,10 +1539,10 @@ func (s *S) runTestErrorAfterConnOnlyHitsOneBackend(c *C, upgrade bool) {
 	c.Assert(err, IsNil)
 	defer res.Body.Close()
 
-	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.StatusCode, Equals, 502)
 	data, err := ioutil.ReadAll(res.Body)
 	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "Service Unavailable\n")
+	c.Assert(string(data), Equals, "Bad Gateway\n")
 }
 
 // issue #152
@@ -1827,3 +1871,837 @@ func (s *S) TestHTTPProxyProtocol(c *C) {
 		c.Assert(string(data), Equals, "1.1.1.123")
 	}
 }
+
+func (s *S) TestBasicAuthRoute(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("Authorization")))
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	r := addRoute(c, l, router.HTTPRoute{
+		Domain:    "example.com",
+		Service:   "test",
+		BasicAuth: &router.BasicAuth{Username: "admin", Password: "secret"},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	// the plaintext password should not be stored
+	c.Assert(r.BasicAuth.Password, Equals, "")
+	stored, err := l.Get(r.ID)
+	c.Assert(err, IsNil)
+	c.Assert(stored.BasicAuth, NotNil)
+	c.Assert(stored.BasicAuth.Username, Equals, "admin")
+	c.Assert(stored.BasicAuth.Password, Equals, "")
+	c.Assert(stored.BasicAuth.PasswordHash, Not(Equals), "")
+
+	for _, t := range []struct {
+		username string
+		password string
+		status   int
+	}{
+		{"", "", 401},
+		{"admin", "wrong", 401},
+		{"other", "secret", 401},
+		{"admin", "secret", 200},
+	} {
+		req := newReq("http://"+l.Addr, "example.com")
+		if t.username != "" {
+			req.SetBasicAuth(t.username, t.password)
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, t.status)
+		if t.status == 401 {
+			c.Assert(res.Header.Get("WWW-Authenticate"), Equals, `Basic realm="example.com"`)
+		} else {
+			// the credentials should not be forwarded to the backend
+			c.Assert(string(data), Equals, "")
+		}
+	}
+}
+
+func (s *S) TestBasicAuthRouteInvalid(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute(router.HTTPRoute{
+		Domain:    "example.com",
+		Service:   "test",
+		BasicAuth: &router.BasicAuth{Username: "admin"},
+	}.ToRoute())
+	c.Assert(err, NotNil)
+	c.Assert(httphelper.IsValidationError(err), Equals, true)
+}
+
+func (s *S) TestBasicAuthPasswordHash(c *C) {
+	// test vectors from RFC 7914 section 11
+	for _, t := range []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	} {
+		key := pbkdf2SHA256([]byte(t.password), []byte(t.salt), t.iterations)
+		c.Assert(hex.EncodeToString(key), Equals, t.key)
+	}
+
+	hash := hashPassword([]byte("salt"), "secret")
+	iterations, salt, _, ok := parsePasswordHash(hash)
+	c.Assert(ok, Equals, true)
+	c.Assert(iterations, Equals, passwordHashIterations)
+	c.Assert(string(salt), Equals, "salt")
+
+	// hashes which are too cheap or too expensive to check are rejected
+	for _, iterations := range []int{1, maxPasswordHashIterations + 1} {
+		hash := strings.Replace(hash, strconv.Itoa(passwordHashIterations), strconv.Itoa(iterations), 1)
+		_, _, _, ok := parsePasswordHash(hash)
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *S) TestBasicAuthChecker(c *C) {
+	a, err := newBasicAuthChecker(&router.BasicAuth{Username: "admin", PasswordHash: hashPassword([]byte("salt"), "secret")})
+	c.Assert(err, IsNil)
+	req := func(username, password string) *http.Request {
+		req := newReq("http://example.com", "example.com")
+		req.SetBasicAuth(username, password)
+		return req
+	}
+	now := time.Now()
+
+	// requests without credentials aren't limited
+	for i := 0; i < basicAuthAttemptBurst+1; i++ {
+		ok, wait := a.check(newReq("http://example.com", "example.com"), "1.2.3.4", now)
+		c.Assert(ok, Equals, false)
+		c.Assert(wait, Equals, time.Duration(0))
+	}
+
+	// successful checks are cached, so don't count towards the limit
+	for i := 0; i < basicAuthAttemptBurst+1; i++ {
+		ok, wait := a.check(req("admin", "secret"), "1.2.3.4", now)
+		c.Assert(ok, Equals, true)
+		c.Assert(wait, Equals, time.Duration(0))
+	}
+
+	// failed checks are limited per client before the password is
+	// stretched
+	for i := 1; i < basicAuthAttemptBurst; i++ {
+		ok, wait := a.check(req("admin", "wrong"), "1.2.3.4", now)
+		c.Assert(ok, Equals, false)
+		c.Assert(wait, Equals, time.Duration(0))
+	}
+	ok, wait := a.check(req("admin", "wrong"), "1.2.3.4", now)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait > 0, Equals, true)
+	ok, _ = a.check(req("admin", "secret"), "1.2.3.4", now)
+	c.Assert(ok, Equals, true)
+	ok, _ = a.check(req("admin", "wrong"), "5.6.7.8", now)
+	c.Assert(ok, Equals, false)
+
+	// uncached credentials are only checked once the client is allowed to
+	a.verified = make(map[[sha256.Size]byte]time.Time)
+	ok, wait = a.check(req("admin", "secret"), "1.2.3.4", now)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait > 0, Equals, true)
+	ok, _ = a.check(req("admin", "secret"), "1.2.3.4", now.Add(time.Second))
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestBasicAuthPasswordHashRedacted(c *C) {
+	hash := hashPassword([]byte("salt"), "secret")
+	r := router.HTTPRoute{
+		Domain:    "example.com",
+		Service:   "test",
+		BasicAuth: &router.BasicAuth{Username: "admin", PasswordHash: hash},
+	}.ToRoute()
+
+	redacted := redactRoute(r)
+	c.Assert(redacted.BasicAuth.PasswordHash, Equals, router.RedactedSecret)
+	c.Assert(r.BasicAuth.PasswordHash, Equals, hash)
+
+	// updating a route with the redacted hash keeps the current one
+	keepSecrets(redacted, r)
+	c.Assert(redacted.BasicAuth.PasswordHash, Equals, hash)
+
+	// redacted hashes of routes which don't exist yet are dropped
+	redacted = redactRoute(r)
+	keepSecrets(redacted, nil)
+	c.Assert(redacted.BasicAuth.PasswordHash, Equals, "")
+}
+
+func generateClientCert(c *C) (*x509.CertPool, tls.Certificate) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+	ca, err := x509.ParseCertificate(caDER)
+	c.Assert(err, IsNil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "client", Organization: []string{"Flynn"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"client.example.com"},
+		EmailAddresses: []string{"client@example.com"},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	c.Assert(err, IsNil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (s *S) TestClientCertHeaders(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s",
+			req.Header.Get("X-Client-Cert-Subject"),
+			req.Header.Get("X-Client-Cert-Sans"),
+			req.Header.Get("X-Client-Cert"),
+		)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	pool, clientCert := generateClientCert(c)
+
+	l := s.buildHTTPListener(c)
+	l.clientCAs = pool
+	c.Assert(l.Reload(&ListenerConfig{ForwardClientCertPEM: true}), IsNil)
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	spoofed := func(url string) *http.Request {
+		req := newReq(url, "example.com")
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		req.Header.Set("X-Client-Cert-Sans", "DNS:spoofed")
+		req.Header.Set("X-Client-Cert", "spoofed")
+		return req
+	}
+	get := func(client *http.Client, req *http.Request) string {
+		res, err := client.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// spoofed headers are stripped without a client cert
+	client := newHTTPClient("example.com")
+	c.Assert(get(client, spoofed("http://"+l.Addr)), Equals, "||")
+	c.Assert(get(client, spoofed("https://"+l.TLSAddr)), Equals, "||")
+
+	// the verified client cert details are forwarded
+	client = newHTTPClient("example.com")
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	parts := strings.Split(get(client, spoofed("https://"+l.TLSAddr)), "|")
+	c.Assert(parts, HasLen, 3)
+	c.Assert(parts[0], Equals, "CN=client,O=Flynn")
+	c.Assert(parts[1], Equals, "DNS:client.example.com, email:client@example.com")
+	data, err := url.QueryUnescape(parts[2])
+	c.Assert(err, IsNil)
+	block, _ := pem.Decode([]byte(data))
+	c.Assert(block, NotNil)
+	c.Assert(block.Bytes, DeepEquals, clientCert.Certificate[0])
+}
+
+func (s *S) TestErrorHandlerService(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "error page %s %s", req.Header.Get("X-Router-Error"), req.URL.Path)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:              "example.com",
+		Service:             "test",
+		ErrorHandlerService: "test-errors",
+	}.ToRoute())
+
+	assertStatus := func(req *http.Request, status int, expected string) {
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, status)
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+
+	// the error handler failing should return the original error
+	assertStatus(newReq("http://"+l.Addr+"/foo", "example.com"), 503, "Service Unavailable\n")
+
+	// the error handler should get the failed request
+	unregister := discoverdRegisterHTTPService(c, l, "test-errors", srv.Listener.Addr().String())
+	assertStatus(newReq("http://"+l.Addr+"/foo", "example.com"), 503, "error page 503 /foo")
+
+	// clients can't set the error themselves
+	req := newReq("http://"+l.Addr+"/foo", "example.com")
+	req.Header.Set("X-Router-Error", "404")
+	assertStatus(req, 503, "error page 503 /foo")
+
+	unregister()
+	httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	assertStatus(newReq("http://"+l.Addr+"/foo", "example.com"), 503, "Service Unavailable\n")
+}
+
+// metricValue returns the current value of the given metric as exposed by
+// the metrics handler.
+func metricValue(c *C, name string) uint64 {
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			v, err := strconv.ParseUint(strings.TrimPrefix(line, name+" "), 10, 64)
+			c.Assert(err, IsNil)
+			return v
+		}
+	}
+	c.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func (s *S) TestMulticastRoute(c *C) {
+	fast := httptest.NewServer(httpTestHandler("fast"))
+	defer fast.Close()
+	slowHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-w.(http.CloseNotifier).CloseNotify():
+		}
+		w.Write([]byte("slow"))
+	})
+	slow1 := httptest.NewServer(slowHandler)
+	defer slow1.Close()
+	slow2 := httptest.NewServer(slowHandler)
+	defer slow2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:        "example.com",
+		Service:       "test",
+		MulticastMode: true,
+	}.ToRoute())
+	for _, srv := range []*httptest.Server{fast, slow1, slow2} {
+		discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	}
+
+	wasted := metricValue(c, "strowger_multicast_wasted_requests_total")
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		assertGet(c, "http://"+l.Addr, "example.com", "fast")
+		c.Assert(time.Since(start) < time.Second, Equals, true)
+	}
+	c.Assert(metricValue(c, "strowger_multicast_wasted_requests_total"), Equals, wasted+10)
+}
+
+func (s *S) TestTraceMethod(c *C) {
+	l := &HTTPListener{}
+	var allow string
+	serve := func() int {
+		req := httptest.NewRequest("TRACE", "http://example.com/", nil)
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, req)
+		allow = w.Header().Get("Allow")
+		return w.Code
+	}
+
+	// TRACE is rejected by default, listing the allowed methods
+	c.Assert(serve(), Equals, http.StatusMethodNotAllowed)
+	c.Assert(allow, Equals, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+
+	// when allowed it is routed like any other request
+	c.Assert(l.Reload(&ListenerConfig{AllowTrace: true}), IsNil)
+	c.Assert(serve(), Equals, http.StatusNotFound)
+}
+
+func (s *S) TestServerWideOptions(c *C) {
+	l := &HTTPListener{}
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "*", nil)
+		req.Host = "example.com"
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, req)
+		return w
+	}
+
+	// OPTIONS * is answered by the router even without a matching route
+	w := serve()
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Allow"), Equals, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+	c.Assert(w.Body.Len(), Equals, 0)
+
+	c.Assert(l.Reload(&ListenerConfig{AllowTrace: true}), IsNil)
+	c.Assert(serve().Header().Get("Allow"), Equals, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE")
+}
+
+func (s *S) TestForwardTrailers(c *C) {
+	trailers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		trailers <- req.Trailer
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("response"))
+		w.Header().Set("Grpc-Status", "1")
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(context.Background(), w, req)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// post sends a request with a trailer which is only set once the body
+	// has been written, with a Content-Length if length is set (which
+	// HTTP/1.1 clients can't combine with trailers), returning the trailers
+	// of the request received by the backend and of the response
+	post := func(client *http.Client, length bool) (http.Header, http.Header) {
+		body, bodyWriter := io.Pipe()
+		req, err := http.NewRequest("POST", srv.URL, body)
+		c.Assert(err, IsNil)
+		if length {
+			req.ContentLength = int64(len("request"))
+		}
+		req.Trailer = http.Header{"Grpc-Status": nil}
+		go func() {
+			bodyWriter.Write([]byte("request"))
+			req.Trailer.Set("Grpc-Status", "0")
+			bodyWriter.Close()
+		}()
+		res, err := client.Do(req)
+		c.Assert(err, IsNil)
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		return <-trailers, res.Trailer
+	}
+	requestTrailer := func(client *http.Client, length bool) http.Header {
+		trailer, _ := post(client, length)
+		return trailer
+	}
+	responseTrailer := func(client *http.Client) string {
+		_, trailer := post(client, false)
+		return trailer.Get("Grpc-Status")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	h1Client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	h2Client := &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsConfig}}
+
+	// trailers of chunked requests are forwarded by default, while those of
+	// responses aren't
+	c.Assert(requestTrailer(h1Client, false).Get("Grpc-Status"), Equals, "0")
+	c.Assert(requestTrailer(h2Client, false).Get("Grpc-Status"), Equals, "0")
+	c.Assert(responseTrailer(h1Client), Equals, "")
+	c.Assert(responseTrailer(h2Client), Equals, "")
+
+	// trailers of requests with a known length and of responses are only
+	// forwarded if the route forwards trailers
+	c.Assert(requestTrailer(h2Client, true), HasLen, 0)
+	r.rp.ForwardTrailers = true
+	c.Assert(requestTrailer(h2Client, true).Get("Grpc-Status"), Equals, "0")
+	c.Assert(requestTrailer(h1Client, false).Get("Grpc-Status"), Equals, "0")
+	c.Assert(responseTrailer(h1Client), Equals, "1")
+	c.Assert(responseTrailer(h2Client), Equals, "1")
+}
+
+func (s *S) TestCompressionPassthrough(c *C) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("compressed body"))
+	gz.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(gzipped.Len()))
+			w.Write(gzipped.Bytes())
+			return
+		}
+		w.Write([]byte("identity body"))
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w
+	}
+
+	// a compressed response should be passed through untouched
+	w := get("gzip, deflate")
+	c.Assert(w.Code, Equals, 200)
+	c.Assert(w.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(w.Header().Get("Content-Length"), Equals, strconv.Itoa(gzipped.Len()))
+	c.Assert(w.Body.Bytes(), DeepEquals, gzipped.Bytes())
+
+	// the router should not request compression on behalf of clients which
+	// don't support it
+	w = get("")
+	c.Assert(w.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(w.Body.String(), Equals, "identity body")
+}
+
+func (s *S) TestAdditionalListenAddrs(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Forwarded-Proto") + ":" + req.Header.Get("X-Forwarded-Port")))
+	}))
+	defer srv.Close()
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	d := newMemDiscoverd()
+	l := &HTTPListener{
+		Addr:               "127.0.0.1:0",
+		TLSAddr:            "127.0.0.1:0",
+		AdditionalAddrs:    []string{"127.0.0.1:0"},
+		AdditionalTLSAddrs: []string{"127.0.0.1:0", "127.0.0.1:0"},
+		keypair:            pair,
+		ds:                 newMemDataStore("http"),
+		discoverd:          d,
+	}
+	c.Assert(l.Start(), IsNil)
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	unregister := registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())
+
+	// all the addresses serve the same routes
+	get := func(scheme, addr string) (string, error) {
+		client := newHTTPClient("example.com")
+		client.Transport.(*http.Transport).Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}
+		res, err := client.Get(scheme + "://example.com")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+	addrs := map[string][]string{
+		"http":  append([]string{l.Addr}, l.AdditionalAddrs...),
+		"https": append([]string{l.TLSAddr}, l.AdditionalTLSAddrs...),
+	}
+	for scheme, addrs := range addrs {
+		for _, addr := range addrs {
+			body, err := get(scheme, addr)
+			c.Assert(err, IsNil)
+			c.Assert(body, Equals, scheme+":"+portFromAddr(addr))
+		}
+	}
+
+	// closing the listener stops serving the additional addresses
+	unregister()
+	l.Close()
+	for _, addr := range append(l.AdditionalAddrs, l.AdditionalTLSAddrs...) {
+		_, err := net.Dial("tcp", addr)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *S) TestDisabledListeners(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	for _, t := range []struct {
+		addr, tlsAddr string
+	}{
+		{tlsAddr: "127.0.0.1:0"},
+		{addr: "127.0.0.1:0"},
+		{},
+	} {
+		d := newMemDiscoverd()
+		l := &HTTPListener{
+			Addr:      t.addr,
+			TLSAddr:   t.tlsAddr,
+			keypair:   pair,
+			ds:        newMemDataStore("http"),
+			discoverd: d,
+		}
+		c.Assert(l.Start(), IsNil)
+		addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+		unregister := registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())
+
+		// only the enabled listeners are served
+		c.Assert(l.listener == nil, Equals, t.addr == "")
+		c.Assert(l.tlsListener == nil, Equals, t.tlsAddr == "")
+		if t.addr == "" {
+			c.Assert(l.Addr, Equals, "")
+		} else {
+			assertGet(c, "http://"+l.Addr, "example.com", "1")
+		}
+		if t.tlsAddr == "" {
+			c.Assert(l.TLSAddr, Equals, "")
+		} else {
+			assertGet(c, "https://"+l.TLSAddr, "example.com", "1")
+		}
+
+		unregister()
+		c.Assert(l.Close(), IsNil)
+	}
+}
+
+func (s *S) TestNonWebsocketUpgrade(c *C) {
+	// the backend switches to whichever protocol is requested, then echoes
+	// what it is sent
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer backend.Close()
+	headers := make(chan http.Header, 1)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, req.Body)
+				headers <- req.Header
+				fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", req.Header.Get("Upgrade"))
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:                  "example.com",
+		Service:                 "test",
+		PushPaths:               []string{"/style.css"},
+		RequestFingerprintDedup: true,
+	}.ToRoute())
+	unregister := registerFakeBackend(c, l, d, "test", backend.Addr().String())
+	defer unregister()
+
+	for _, t := range []struct {
+		method     string
+		upgrade    string
+		connection string
+		header     string
+		body       string
+	}{
+		{method: "GET", upgrade: "h2c", connection: "Upgrade, HTTP2-Settings", header: "HTTP2-Settings: AAMAAABkAAQAAP__\r\n"},
+		// POST requests are deduplicated, but not if they are upgrades
+		{method: "POST", upgrade: "h2c", connection: "Upgrade, HTTP2-Settings", header: "HTTP2-Settings: AAMAAABkAAQAAP__\r\nContent-Length: 4\r\n", body: "body"},
+		{method: "GET", upgrade: "custom-proto/1.0", connection: "keep-alive, upgrade"},
+	} {
+		c.Logf("upgrading %s request to %s", t.method, t.upgrade)
+		conn, err := net.Dial("tcp", l.Addr)
+		c.Assert(err, IsNil)
+		_, err = fmt.Fprintf(conn, "%s / HTTP/1.1\r\nHost: example.com\r\nConnection: %s\r\nUpgrade: %s\r\n%s\r\n%s", t.method, t.connection, t.upgrade, t.header, t.body)
+		c.Assert(err, IsNil)
+
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, http.StatusSwitchingProtocols)
+		c.Assert(res.Header.Get("Upgrade"), Equals, t.upgrade)
+
+		// the backend receives the headers of the upgrade
+		h := <-headers
+		c.Assert(h.Get("Upgrade"), Equals, t.upgrade)
+		c.Assert(strings.ToLower(h.Get("Connection")), Matches, ".*upgrade.*")
+		if t.upgrade == "h2c" {
+			c.Assert(h.Get("Http2-Settings"), Not(Equals), "")
+		}
+
+		// the connection is then proxied in both directions
+		_, err = io.WriteString(conn, "ping")
+		c.Assert(err, IsNil)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(br, buf)
+		c.Assert(err, IsNil)
+		c.Assert(string(buf), Equals, "ping")
+		conn.Close()
+	}
+}
+
+func (s *S) TestWebsocketUpgradeHeaders(c *C) {
+	// the websocket handler rejects handshakes without the Upgrade and
+	// Connection headers, so the echo only works if they are forwarded
+	srv := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	unregister := registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())
+	defer unregister()
+
+	dialers := map[string]func() (net.Conn, error){
+		"http": func() (net.Conn, error) { return net.Dial("tcp", l.Addr) },
+		"https": func() (net.Conn, error) {
+			return tls.Dial("tcp", l.TLSAddr, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		},
+	}
+	for scheme, dial := range dialers {
+		// browsers such as Firefox send other connection options along
+		// with upgrade
+		for _, connection := range []string{"Upgrade", "keep-alive, Upgrade"} {
+			c.Logf("upgrading %s connection with Connection: %s", scheme, connection)
+			conn, err := dial()
+			c.Assert(err, IsNil)
+			_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nOrigin: http://example.com\r\nConnection: %s\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", connection)
+			c.Assert(err, IsNil)
+
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			c.Assert(err, IsNil)
+			c.Assert(res.StatusCode, Equals, http.StatusSwitchingProtocols)
+			c.Assert(res.Header.Get("Upgrade"), Equals, "websocket")
+			c.Assert(res.Header.Get("Connection"), Equals, "Upgrade")
+			c.Assert(res.Header.Get("Sec-Websocket-Accept"), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+
+			// send a masked text frame (with a zero mask) and read the
+			// unmasked frame echoed back
+			_, err = conn.Write(append([]byte{0x81, 0x80 | 4, 0, 0, 0, 0}, "ping"...))
+			c.Assert(err, IsNil)
+			frame := make([]byte, 6)
+			_, err = io.ReadFull(br, frame)
+			c.Assert(err, IsNil)
+			c.Assert(frame, DeepEquals, append([]byte{0x81, 4}, "ping"...))
+			conn.Close()
+		}
+	}
+}
+
+// BenchmarkServeTLS measures TLS handshakes using a tls.Config built for each
+// connection and using the listener's shared tlsConfig, whose session ticket
+// keys also let clients resume their sessions.
+func BenchmarkServeTLS(b *testing.B) {
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	if err != nil {
+		b.Fatal(err)
+	}
+	l := &HTTPListener{
+		TLSAddr:   "127.0.0.1:0",
+		keypair:   pair,
+		ds:        newMemDataStore("http"),
+		discoverd: newMemDiscoverd(),
+	}
+	if err := l.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	err = l.AddRoute(router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Certificate: &router.Certificate{Cert: cert.Cert, Key: cert.PrivateKey},
+	}.ToRoute())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for start := time.Now(); l.findRoute("example.com", "/") == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			b.Fatal("timed out waiting for route")
+		}
+	}
+
+	handshake := func(b *testing.B, config, clientConfig *tls.Config) {
+		serverConn, clientConn := net.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			// the client reads the session ticket along with the byte
+			_, err := tls.Server(serverConn, config).Write([]byte{0})
+			serverConn.Close()
+			errs <- err
+		}()
+		// close the pipe rather than the TLS connection, as writing the
+		// close_notify alert blocks until the peer reads it
+		_, err := io.ReadFull(tls.Client(clientConn, clientConfig), make([]byte, 1))
+		clientConn.Close()
+		if err == nil {
+			err = <-errs
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, t := range []struct {
+		name   string
+		config func() *tls.Config
+	}{
+		{"per-connection", func() *tls.Config {
+			return tlsconfig.SecureCiphers(&tls.Config{
+				GetCertificate: l.tlsConfig.GetCertificate,
+				Certificates:   l.tlsConfig.Certificates,
+				NextProtos:     l.tlsConfig.NextProtos,
+			})
+		}},
+		{"shared", func() *tls.Config { return l.tlsConfig }},
+	} {
+		b.Run(t.name, func(b *testing.B) {
+			clientConfig := &tls.Config{
+				ServerName:         "example.com",
+				InsecureSkipVerify: true,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				handshake(b, t.config(), clientConfig)
+			}
+		})
+	}
+}
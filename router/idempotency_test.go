@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestIdempotencyHeaderRetry(c *C) {
+	// the failing backend closes the connection after reading the request
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer failing.Close()
+	bodies := make(chan string, 1)
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer working.Close()
+
+	config := &ListenerConfig{IdempotencyHeader: "Idempotency-Key"}
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{
+			Domain:                "example.com",
+			Service:               "test",
+			BufferFullRequestBody: true,
+		},
+		config: func() *ListenerConfig { return config },
+	}
+	failingAddr := failing.Listener.Addr().String()
+	backends := func() []string { return []string{failingAddr, working.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	r.rp.SetBackendPicker(func() string { return failingAddr })
+
+	send := func(key string) int {
+		req := httptest.NewRequest("POST", "http://example.com/charge", strings.NewReader("amount=1"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := newCloseNotifyRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w.Code
+	}
+
+	// requests with the header are replayed to the next backend
+	c.Assert(send("1"), Equals, 200)
+	c.Assert(<-bodies, Equals, "amount=1")
+
+	// requests without it are not retried
+	c.Assert(send(""), Equals, 502)
+
+	// nor are requests with it when the header isn't configured
+	config = &ListenerConfig{}
+	c.Assert(send("2"), Equals, 502)
+
+	// nor are requests whose body can't be replayed
+	config = &ListenerConfig{IdempotencyHeader: "Idempotency-Key"}
+	r.BufferFullRequestBody = false
+	c.Assert(send("3"), Equals, 502)
+	c.Assert(bodies, HasLen, 0)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+var routesWithoutInstances = metrics.NewCounter(
+	"strowger_routes_without_instances_total",
+	"Number of routes added for services which had no instances.",
+)
+
+// checkServiceInstances logs a warning if the service of a newly added route
+// has no instances, which usually means that the service name is wrong or
+// that its backends failed to deploy. The route is added regardless as
+// instances may register later.
+func checkServiceInstances(d DiscoverdClient, r *router.Route) {
+	addrs, err := d.Service(r.Service).Addrs()
+	if err != nil && !discoverd.IsNotFound(err) {
+		logger.Error("error checking service instances", "route.type", r.Type, "route.id", r.ID, "service", r.Service, "err", err)
+		return
+	}
+	if len(addrs) > 0 {
+		return
+	}
+	routesWithoutInstances.Inc()
+	logger.Warn("route added for a service with no instances", "route.type", r.Type, "route.id", r.ID, "service", r.Service)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestCheckServiceInstances(c *C) {
+	d := newMemDiscoverd()
+	d.Register("web", "10.0.0.1:8080")
+	warned := routesWithoutInstances.Value()
+
+	checkServiceInstances(d, &router.Route{Type: "http", ID: "1", Service: "web"})
+	c.Assert(routesWithoutInstances.Value(), Equals, warned)
+
+	checkServiceInstances(d, &router.Route{Type: "http", ID: "2", Service: "wbe"})
+	c.Assert(routesWithoutInstances.Value(), Equals, warned+1)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// Connection journal event types
+const (
+	connEventAccepted     = "accepted"
+	connEventTLSHandshake = "tls_handshake"
+	connEventRequest      = "request"
+	connEventResponse     = "response"
+	connEventHijacked     = "hijacked"
+	connEventClosed       = "closed"
+)
+
+// connJournal records the lifecycle of the most recent connections to a
+// listener in a ring buffer, to help diagnose dropped connections.
+type connJournal struct {
+	mtx sync.Mutex
+	// entries is a ring of the most recently accepted connections, next
+	// being the index the next connection is stored at
+	entries []*router.ConnectionJournalEntry
+	next    int
+	full    bool
+	// conns are the open connections keyed by their remote address, which
+	// is how requests are matched to their connection
+	conns map[string]*journalConn
+}
+
+type journalConn struct {
+	entry        *router.ConnectionJournalEntry
+	tlsHandshake bool
+}
+
+func newConnJournal(maxEntries int) *connJournal {
+	return &connJournal{
+		entries: make([]*router.ConnectionJournalEntry, maxEntries),
+		conns:   make(map[string]*journalConn),
+	}
+}
+
+// EnableConnectionJournal starts recording the lifecycle of connections to
+// the listener, keeping the last maxEntries connections. It must be called
+// before Start.
+func (s *HTTPListener) EnableConnectionJournal(maxEntries int) {
+	if maxEntries > 0 {
+		s.journal = newConnJournal(maxEntries)
+	}
+}
+
+// ConnectionJournal returns up to n of the most recent connections recorded
+// by the connection journal, oldest first, or nil if it is not enabled.
+func (s *HTTPListener) ConnectionJournal(n int) []*router.ConnectionJournalEntry {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.last(n)
+}
+
+func (c *journalConn) add(typ, err string, now time.Time) {
+	c.entry.Events = append(c.entry.Events, router.ConnectionEvent{Type: typ, Time: now, Error: err})
+}
+
+// connState returns an http.Server ConnState hook which records connections
+// to the journal of a listener serving the given protocol.
+func (j *connJournal) connState(proto string) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		now := time.Now()
+		addr := c.RemoteAddr().String()
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+
+		if state == http.StateNew {
+			entry := &router.ConnectionJournalEntry{
+				RemoteAddr: addr,
+				Proto:      proto,
+				Events:     []router.ConnectionEvent{{Type: connEventAccepted, Time: now}},
+			}
+			j.add(entry)
+			j.conns[addr] = &journalConn{entry: entry}
+			return
+		}
+
+		conn, ok := j.conns[addr]
+		if !ok {
+			return
+		}
+		tlsConn, isTLS := c.(*tls.Conn)
+		if isTLS && !conn.tlsHandshake && state != http.StateIdle {
+			// the handshake completes before the connection first
+			// becomes active, so it failed if the connection is
+			// closed without doing so
+			conn.tlsHandshake = true
+			if tlsConn.ConnectionState().HandshakeComplete {
+				conn.add(connEventTLSHandshake, "", now)
+			} else {
+				conn.add(connEventTLSHandshake, "handshake failed", now)
+			}
+		}
+		switch state {
+		case http.StateHijacked:
+			conn.add(connEventHijacked, "", now)
+			delete(j.conns, addr)
+		case http.StateClosed:
+			conn.add(connEventClosed, "", now)
+			delete(j.conns, addr)
+		}
+	}
+}
+
+// handshakeFailed returns a tlsHandshakeListener hook which records
+// connections to a listener serving the given protocol which were closed
+// without completing the TLS handshake, as they never reach the ConnState
+// hook.
+func (j *connJournal) handshakeFailed(proto string) func(net.Conn, time.Time, error) {
+	return func(c net.Conn, accepted time.Time, err error) {
+		now := time.Now()
+		j.mtx.Lock()
+		defer j.mtx.Unlock()
+		j.add(&router.ConnectionJournalEntry{
+			RemoteAddr: c.RemoteAddr().String(),
+			Proto:      proto,
+			Events: []router.ConnectionEvent{
+				{Type: connEventAccepted, Time: accepted},
+				{Type: connEventTLSHandshake, Time: now, Error: err.Error()},
+				{Type: connEventClosed, Time: now},
+			},
+		})
+	}
+}
+
+// add stores entry in the ring, replacing the oldest entry if it is full.
+// The caller must hold j.mtx.
+func (j *connJournal) add(entry *router.ConnectionJournalEntry) {
+	j.entries[j.next] = entry
+	j.next = (j.next + 1) % len(j.entries)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// handler wraps h to record the first request of each connection and the
+// response to it.
+func (j *connJournal) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		j.mtx.Lock()
+		conn, ok := j.conns[req.RemoteAddr]
+		if ok {
+			conn.entry.Requests++
+			if conn.entry.Requests == 1 {
+				conn.add(connEventRequest, "", time.Now())
+			}
+		}
+		j.mtx.Unlock()
+
+		h.ServeHTTP(w, req)
+		if !ok {
+			return
+		}
+
+		j.mtx.Lock()
+		// the connection is no longer tracked once hijacked or closed
+		if conn, ok := j.conns[req.RemoteAddr]; ok && !conn.entry.Responded {
+			conn.entry.Responded = true
+			conn.add(connEventResponse, "", time.Now())
+		}
+		j.mtx.Unlock()
+	})
+}
+
+// last returns copies of up to n of the most recent entries, oldest first.
+func (j *connJournal) last(n int) []*router.ConnectionJournalEntry {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	count := j.next
+	if j.full {
+		count = len(j.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	res := make([]*router.ConnectionJournalEntry, n)
+	for i := range res {
+		entry := *j.entries[(j.next-n+i+len(j.entries))%len(j.entries)]
+		entry.Events = append([]router.ConnectionEvent(nil), entry.Events...)
+		res[i] = &entry
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// journalEventTypes returns the types of the events of the given entry
+func journalEventTypes(entry *router.ConnectionJournalEntry) []string {
+	types := make([]string, len(entry.Events))
+	for i, e := range entry.Events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+// waitForJournalClose waits for the nth connection in the journal to be
+// closed, returning its entry
+func waitForJournalClose(c *C, j *connJournal, n int) *router.ConnectionJournalEntry {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		entries := j.last(0)
+		if len(entries) == n {
+			events := entries[n-1].Events
+			if events[len(events)-1].Type == connEventClosed {
+				return entries[n-1]
+			}
+		}
+	}
+	c.Fatal("timed out waiting for connection to close")
+	return nil
+}
+
+func (s *S) TestConnectionJournal(c *C) {
+	for _, useTLS := range []bool{false, true} {
+		j := newConnJournal(10)
+		srv := httptest.NewUnstartedServer(j.handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+		proto := "http"
+		if useTLS {
+			proto = "https"
+		}
+		srv.Config.ConnState = j.connState(proto)
+		if useTLS {
+			srv.StartTLS()
+		} else {
+			srv.Start()
+		}
+
+		client := &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		}}
+		res, err := client.Get(srv.URL)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+
+		entry := waitForJournalClose(c, j, 1)
+		c.Assert(entry.Proto, Equals, proto)
+		c.Assert(entry.Requests, Equals, 1)
+		c.Assert(entry.Responded, Equals, true)
+		expected := []string{connEventAccepted, connEventRequest, connEventResponse, connEventClosed}
+		if useTLS {
+			expected = []string{connEventAccepted, connEventTLSHandshake, connEventRequest, connEventResponse, connEventClosed}
+		}
+		c.Assert(journalEventTypes(entry), DeepEquals, expected)
+		for i := 1; i < len(entry.Events); i++ {
+			c.Assert(entry.Events[i].Time.Before(entry.Events[i-1].Time), Equals, false)
+		}
+
+		if useTLS {
+			// failed handshakes are recorded
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			c.Assert(err, IsNil)
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+			conn.Close()
+			entry := waitForJournalClose(c, j, 2)
+			c.Assert(journalEventTypes(entry), DeepEquals, []string{connEventAccepted, connEventTLSHandshake, connEventClosed})
+			c.Assert(entry.Events[1].Error, Equals, "handshake failed")
+		}
+		srv.Close()
+	}
+}
+
+func (s *S) TestConnectionJournalWraps(c *C) {
+	j := newConnJournal(3)
+	hook := j.connState("http")
+	addrs := make([]string, 5)
+	for i := range addrs {
+		conn := &fakeAddrConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i}}
+		addrs[i] = conn.addr.String()
+		hook(conn, http.StateNew)
+		hook(conn, http.StateClosed)
+	}
+
+	entries := j.last(0)
+	c.Assert(entries, HasLen, 3)
+	for i, entry := range entries {
+		c.Assert(entry.RemoteAddr, Equals, addrs[i+2])
+		c.Assert(journalEventTypes(entry), DeepEquals, []string{connEventAccepted, connEventClosed})
+	}
+	entries = j.last(2)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[1].RemoteAddr, Equals, addrs[4])
+
+	// connections which aren't closed aren't leaked
+	c.Assert(j.conns, HasLen, 0)
+
+	// a disabled journal returns nothing
+	c.Assert((&HTTPListener{}).ConnectionJournal(0), IsNil)
+}
+
+// fakeAddrConn is a net.Conn with a fixed remote address
+type fakeAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kubernetesRetryInterval is how long to wait before listing Ingresses
+// again after watching them fails
+var kubernetesRetryInterval = 5 * time.Second
+
+// errKubernetesGone is returned when watching from a resource version which
+// is too old, meaning the Ingresses must be listed again
+var errKubernetesGone = errors.New("router: kubernetes resource version expired")
+
+// KubernetesConfig is the config used to connect to the Kubernetes API.
+type KubernetesConfig struct {
+	// Host is the URL of the API server (e.g. https://10.0.0.1:443)
+	Host string
+
+	// BearerToken, if set, authenticates requests to the API server
+	BearerToken string
+
+	// TLSClientConfig, if set, is used to connect to the API server
+	TLSClientConfig *tls.Config
+}
+
+// KubernetesInClusterConfig returns the config to connect to the Kubernetes
+// API from a pod using its service account.
+func KubernetesInClusterConfig() (*KubernetesConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("router: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	token, err := ioutil.ReadFile(kubernetesTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubernetesCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("router: no certificates found in %s", kubernetesCAFile)
+	}
+	return &KubernetesConfig{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		BearerToken:     strings.TrimSpace(string(token)),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}, nil
+}
+
+// kubernetesIngress is a networking.k8s.io/v1 Ingress, with only the fields
+// used to create routes
+type kubernetesIngress struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		TLS []struct {
+			Hosts      []string `json:"hosts"`
+			SecretName string   `json:"secretName"`
+		} `json:"tls"`
+		Rules []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path    string `json:"path"`
+					Backend struct {
+						Service *struct {
+							Name string `json:"name"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+func (i *kubernetesIngress) key() string {
+	return i.Metadata.Namespace + "/" + i.Metadata.Name
+}
+
+type kubernetesIngressList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*kubernetesIngress `json:"items"`
+}
+
+// kubernetesWatchEvent is an event streamed by a watch request, with Object
+// being a Status if Type is ERROR
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type kubernetesSecret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+// KubernetesIngressSync adds routes for the rules of Kubernetes Ingresses,
+// keeping them up to date by watching the Ingresses for changes.
+type KubernetesIngressSync struct {
+	l         *HTTPListener
+	config    *KubernetesConfig
+	namespace string
+	client    *http.Client
+
+	// routes are the IDs of the routes added for each Ingress, keyed by
+	// namespace/name
+	routes map[string][]string
+}
+
+// SyncKubernetesIngresses adds HTTP routes for the Ingresses in the given
+// namespace (or all namespaces if it is empty), mapping each host and path
+// of their rules to a route for the backend service, with the certificate
+// from the Secret of any TLS entry for the host. Paths are matched as
+// prefixes. The routes only exist in memory, are replaced by any route in
+// the data store with the same domain and path, and are updated as the
+// Ingresses change until the listener is closed. Changes to Secrets are
+// picked up when their Ingress changes or the Ingresses are listed again
+// after an error. It must be called after the listener has been started,
+// and returns an error if the Ingresses can't be listed.
+func (s *HTTPListener) SyncKubernetesIngresses(config *KubernetesConfig, namespace string) error {
+	s.mtx.RLock()
+	closed, ctx := s.closed, s.syncCtx
+	s.mtx.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	k := &KubernetesIngressSync{
+		l:         s,
+		config:    config,
+		namespace: namespace,
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: config.TLSClientConfig}},
+		routes:    make(map[string][]string),
+	}
+	version, err := k.list(ctx)
+	if err != nil {
+		return err
+	}
+	go k.watch(ctx, version)
+	return nil
+}
+
+// ingressesPath returns the API path of the Ingresses being synced.
+func (k *KubernetesIngressSync) ingressesPath() string {
+	if k.namespace == "" {
+		return "/apis/networking.k8s.io/v1/ingresses"
+	}
+	return fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/ingresses", url.PathEscape(k.namespace))
+}
+
+// get makes a GET request for the given API path, returning the response if
+// it has a 200 status.
+func (k *KubernetesIngressSync) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(k.config.Host, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if k.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+k.config.BearerToken)
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("router: unexpected status %d from kubernetes GET %s", res.StatusCode, path)
+	}
+	return res, nil
+}
+
+// list sets the routes of all the Ingresses, removing the routes of those
+// which no longer exist, and returns the resource version to watch from.
+func (k *KubernetesIngressSync) list(ctx context.Context) (string, error) {
+	res, err := k.get(ctx, k.ingressesPath())
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var list kubernetesIngressList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	current := make(map[string]struct{}, len(list.Items))
+	for _, ing := range list.Items {
+		current[ing.key()] = struct{}{}
+		k.set(ctx, ing)
+	}
+	for key := range k.routes {
+		if _, ok := current[key]; !ok {
+			k.remove(key)
+		}
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch keeps the routes up to date until ctx is cancelled, listing the
+// Ingresses again whenever watching them fails.
+func (k *KubernetesIngressSync) watch(ctx context.Context, version string) {
+	for {
+		var err error
+		version, err = k.watchFrom(ctx, version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// the API server ends watches after a timeout
+			continue
+		}
+		if err != errKubernetesGone {
+			logger.Error("error watching kubernetes ingresses", "err", err)
+		}
+		for {
+			if err != errKubernetesGone {
+				select {
+				case <-time.After(kubernetesRetryInterval):
+				case <-ctx.Done():
+					return
+				}
+			}
+			version, err = k.list(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("error listing kubernetes ingresses", "err", err)
+		}
+	}
+}
+
+// watchFrom applies changes to the Ingresses after the given resource
+// version until the watch ends, returning the last version seen.
+func (k *KubernetesIngressSync) watchFrom(ctx context.Context, version string) (string, error) {
+	res, err := k.get(ctx, k.ingressesPath()+"?watch=1&resourceVersion="+url.QueryEscape(version))
+	if err != nil {
+		return version, err
+	}
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+	for {
+		var event kubernetesWatchEvent
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				return version, nil
+			}
+			return version, err
+		}
+		if event.Type == "ERROR" {
+			var status kubernetesStatus
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return version, err
+			}
+			if status.Code == http.StatusGone {
+				return version, errKubernetesGone
+			}
+			return version, fmt.Errorf("router: kubernetes watch error %d: %s", status.Code, status.Message)
+		}
+		var ing kubernetesIngress
+		if err := json.Unmarshal(event.Object, &ing); err != nil {
+			return version, err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.set(ctx, &ing)
+		case "DELETED":
+			k.remove(ing.key())
+		}
+		if ing.Metadata.ResourceVersion != "" {
+			version = ing.Metadata.ResourceVersion
+		}
+	}
+}
+
+// set sets the routes of the given Ingress, removing any of its previous
+// routes which it no longer has. The previous routes are kept if the
+// Ingress' TLS Secrets can't be read.
+func (k *KubernetesIngressSync) set(ctx context.Context, ing *kubernetesIngress) {
+	routes, err := k.ingressRoutes(ctx, ing)
+	if err != nil {
+		logger.Error("error getting routes of kubernetes ingress", "ingress", ing.key(), "err", err)
+		return
+	}
+	ids := make([]string, 0, len(routes))
+	current := make(map[string]struct{}, len(routes))
+	for _, route := range routes {
+		current[route.ID] = struct{}{}
+		if err := k.setRoute(route); err != nil {
+			logger.Error("error adding route for kubernetes ingress", "ingress", ing.key(), "id", route.ID, "err", err)
+			continue
+		}
+		ids = append(ids, route.ID)
+	}
+	for _, id := range k.routes[ing.key()] {
+		if _, ok := current[id]; !ok {
+			k.removeRoute(id)
+		}
+	}
+	k.routes[ing.key()] = ids
+}
+
+// remove removes the routes of the Ingress with the given key.
+func (k *KubernetesIngressSync) remove(key string) {
+	for _, id := range k.routes[key] {
+		k.removeRoute(id)
+	}
+	delete(k.routes, key)
+}
+
+// setRoute adds or updates the given route unless another route has the
+// same domain and path.
+func (k *KubernetesIngressSync) setRoute(route *router.Route) error {
+	s := k.l
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return ErrClosed
+	}
+	if s.hasRoute(route.Domain, route.Path, route.ID) {
+		s.mtx.Unlock()
+		logger.Info("not adding route for kubernetes ingress, domain and path already routed", "id", route.ID, "domain", route.Domain, "path", route.Path)
+		return nil
+	}
+	if s.envRoutes == nil {
+		s.envRoutes = make(map[string]struct{})
+	}
+	s.envRoutes[route.ID] = struct{}{}
+	s.mtx.Unlock()
+
+	if err := (&httpSyncHandler{l: s}).Set(route); err != nil {
+		s.mtx.Lock()
+		if _, ok := s.routes[route.ID]; !ok {
+			delete(s.envRoutes, route.ID)
+		}
+		s.mtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+// removeRoute removes the route with the given ID unless it has been
+// replaced by a route from the data store.
+func (k *KubernetesIngressSync) removeRoute(id string) {
+	s := k.l
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.envRoutes[id]; ok && !s.closed {
+		s.removeRoute(id)
+	}
+}
+
+// ingressRoutes returns the routes for the rules of the given Ingress.
+// Rules without a host and backends which aren't services are skipped.
+func (k *KubernetesIngressSync) ingressRoutes(ctx context.Context, ing *kubernetesIngress) ([]*router.Route, error) {
+	// certs are the certificates of the Ingress keyed by host, with
+	// defaultCert being used by hosts without one
+	certs := make(map[string]*router.Certificate)
+	var defaultCert *router.Certificate
+	for _, t := range ing.Spec.TLS {
+		if t.SecretName == "" {
+			continue
+		}
+		cert, err := k.secretCertificate(ctx, ing.Metadata.Namespace, t.SecretName)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.Hosts) == 0 {
+			defaultCert = cert
+		}
+		for _, host := range t.Hosts {
+			certs[strings.ToLower(host)] = cert
+		}
+	}
+
+	var routes []*router.Route
+	for i, rule := range ing.Spec.Rules {
+		if rule.Host == "" || rule.HTTP == nil {
+			continue
+		}
+		cert, ok := certs[strings.ToLower(rule.Host)]
+		if !ok {
+			cert = defaultCert
+		}
+		for j, p := range rule.HTTP.Paths {
+			if p.Backend.Service == nil || p.Backend.Service.Name == "" {
+				continue
+			}
+			routes = append(routes, &router.Route{
+				Type: "http",
+				// namespaces can't contain dots, so IDs are unique
+				ID:          fmt.Sprintf("k8s-%s.%s-%d-%d", ing.Metadata.Namespace, ing.Metadata.Name, i, j),
+				Domain:      rule.Host,
+				Path:        ingressRoutePath(p.Path),
+				Service:     p.Backend.Service.Name,
+				Certificate: cert,
+			})
+		}
+	}
+	return routes, nil
+}
+
+// ingressRoutePath returns the route path matching requests with the given
+// Ingress path as a prefix.
+func ingressRoutePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+// secretCertificate returns the certificate in the given kubernetes.io/tls
+// Secret.
+func (k *KubernetesIngressSync) secretCertificate(ctx context.Context, namespace, name string) (*router.Certificate, error) {
+	res, err := k.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(namespace), url.PathEscape(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var secret kubernetesSecret
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	cert, key := secret.Data["tls.crt"], secret.Data["tls.key"]
+	if len(cert) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("router: secret %s/%s has no tls.crt or tls.key", namespace, name)
+	}
+	return &router.Certificate{Cert: string(cert), Key: string(key)}, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// fakeKubernetesAPI serves the Ingresses of the default namespace, streaming
+// the events sent on events to watch requests.
+type fakeKubernetesAPI struct {
+	mtx       sync.Mutex
+	ingresses []interface{}
+	secrets   map[string]map[string][]byte
+	events    chan interface{}
+}
+
+func (f *fakeKubernetesAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch {
+	case req.URL.Path == "/apis/networking.k8s.io/v1/namespaces/default/ingresses" && req.URL.Query().Get("watch") == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": "1"},
+			"items":    f.ingresses,
+		})
+	case req.URL.Path == "/apis/networking.k8s.io/v1/namespaces/default/ingresses":
+		f.mtx.Unlock()
+		defer f.mtx.Lock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case event := <-f.events:
+				enc.Encode(event)
+				w.(http.Flusher).Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	case strings.HasPrefix(req.URL.Path, "/api/v1/namespaces/default/secrets/"):
+		data, ok := f.secrets[strings.TrimPrefix(req.URL.Path, "/api/v1/namespaces/default/secrets/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeKubernetesAPI) setIngresses(ingresses ...interface{}) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.ingresses = ingresses
+}
+
+// testIngress returns an Ingress with a rule for host routing the given
+// paths to services, using the given TLS secret if set.
+func testIngress(name, host, secret string, paths ...string) map[string]interface{} {
+	var httpPaths []interface{}
+	for i := 0; i < len(paths); i += 2 {
+		httpPaths = append(httpPaths, map[string]interface{}{
+			"path":    paths[i],
+			"backend": map[string]interface{}{"service": map[string]string{"name": paths[i+1]}},
+		})
+	}
+	ing := map[string]interface{}{
+		"metadata": map[string]string{"name": name, "namespace": "default", "resourceVersion": "2"},
+		"spec": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{"host": host, "http": map[string]interface{}{"paths": httpPaths}},
+			},
+		},
+	}
+	if secret != "" {
+		ing["spec"].(map[string]interface{})["tls"] = []interface{}{
+			map[string]interface{}{"hosts": []string{host}, "secretName": secret},
+		}
+	}
+	return ing
+}
+
+// waitForRouteSet is like waitForEvent for the set event of the route with
+// the given ID, since HTTP set events have the route's domain as their ID.
+func waitForRouteSet(c *C, w Watcher, id string) func() *router.Event {
+	ch := make(chan *router.Event)
+	w.Watch(ch, false)
+	return func() *router.Event {
+		defer w.Unwatch(ch)
+		timeout := time.After(waitTimeout)
+		for {
+			select {
+			case e := <-ch:
+				if e.Event == router.EventTypeRouteSet && e.Route.ID == id {
+					return e
+				}
+			case <-timeout:
+				c.Fatalf("timeout exceeded waiting for set %s", id)
+				return nil
+			}
+		}
+	}
+}
+
+func (s *S) TestSyncKubernetesIngresses(c *C) {
+	cert := tlsConfigForDomain("k8s.example.com")
+	api := &fakeKubernetesAPI{
+		secrets: map[string]map[string][]byte{
+			"k8s-tls": {"tls.crt": []byte(cert.Cert), "tls.key": []byte(cert.PrivateKey)},
+		},
+		events: make(chan interface{}),
+	}
+	api.setIngresses(testIngress("web", "k8s.example.com", "k8s-tls", "/", "web"))
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	defer srv.CloseClientConnections()
+
+	l, _, _ := newFakeHTTPListener(c)
+	defer l.Close()
+
+	// requests to the API must be authenticated
+	c.Assert(l.SyncKubernetesIngresses(&KubernetesConfig{Host: srv.URL}, "default"), NotNil)
+
+	// the routes of the listed Ingresses are added before returning
+	c.Assert(l.SyncKubernetesIngresses(&KubernetesConfig{Host: srv.URL, BearerToken: "token"}, "default"), IsNil)
+	r := l.findRoute("k8s.example.com", "/")
+	c.Assert(r, NotNil)
+	c.Assert(r.ID, Equals, "k8s-default.web-0-0")
+	c.Assert(r.Service, Equals, "web")
+	c.Assert(r.keypair, NotNil)
+	c.Assert((&httpSyncHandler{l: l}).Current(), HasLen, 0)
+
+	// modified Ingresses update their routes
+	wait := waitForRouteSet(c, l, "k8s-default.web-0-1")
+	api.events <- map[string]interface{}{
+		"type":   "MODIFIED",
+		"object": testIngress("web", "k8s.example.com", "", "/", "web", "/api", "api"),
+	}
+	wait()
+	r = l.findRoute("k8s.example.com", "/api/users")
+	root := l.findRoute("k8s.example.com", "/")
+	c.Assert(r, NotNil)
+	c.Assert(r.Service, Equals, "api")
+	c.Assert(root.keypair, IsNil)
+
+	// deleted Ingresses remove their routes
+	wait = waitForEvent(c, l, "remove", "k8s-default.web-0-1")
+	api.events <- map[string]interface{}{
+		"type":   "DELETED",
+		"object": testIngress("web", "k8s.example.com", "", "/", "web", "/api", "api"),
+	}
+	wait()
+	l.mtx.RLock()
+	routes := len(l.routes)
+	l.mtx.RUnlock()
+	c.Assert(routes, Equals, 0)
+
+	// the Ingresses are listed again if the watched version expires
+	api.setIngresses(testIngress("other", "other.example.com", "", "/", "other"))
+	wait = waitForRouteSet(c, l, "k8s-default.other-0-0")
+	api.events <- map[string]interface{}{
+		"type":   "ERROR",
+		"object": map[string]interface{}{"kind": "Status", "code": 410, "message": "too old resource version"},
+	}
+	wait()
+}
+
+func (s *S) TestIngressRoutePath(c *C) {
+	for path, expected := range map[string]string{
+		"":     "/",
+		"/":    "/",
+		"/api": "/api/",
+		"api/": "/api/",
+	} {
+		c.Assert(ingressRoutePath(path), Equals, expected)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+const (
+	// latencySlotDuration is the period of time the latencies of each
+	// domain are aggregated over, windows are rounded up to a multiple of it
+	latencySlotDuration = 10 * time.Second
+
+	// latencyRetention is the maximum window latencies can be queried over
+	latencyRetention = time.Hour
+
+	latencySlots = int(latencyRetention / latencySlotDuration)
+
+	// latencySubBucketBits is the number of bits of precision kept for
+	// recorded latencies, values are bucketed to within 1/128 (~0.8%) of
+	// their magnitude
+	latencySubBucketBits = 7
+	latencySubBuckets    = 1 << latencySubBucketBits
+)
+
+// latencyHistogram is a sparse, log-linear histogram of latencies in
+// microseconds in the style of an HDR histogram: values below
+// latencySubBuckets are counted exactly, and larger values are counted in
+// latencySubBuckets linear buckets per power of two.
+type latencyHistogram struct {
+	counts map[int]uint64
+	count  uint64
+	max    uint64
+}
+
+func latencyBucket(v uint64) int {
+	if v < latencySubBuckets {
+		return int(v)
+	}
+	var exp uint
+	for (v >> exp) >= latencySubBuckets*2 {
+		exp++
+	}
+	return latencySubBuckets + int(exp)*latencySubBuckets + int(v>>exp) - latencySubBuckets
+}
+
+// latencyBucketValue returns the midpoint of the values counted in the given
+// bucket.
+func latencyBucketValue(i int) uint64 {
+	if i < latencySubBuckets {
+		return uint64(i)
+	}
+	exp := uint((i - latencySubBuckets) / latencySubBuckets)
+	sub := uint64((i-latencySubBuckets)%latencySubBuckets + latencySubBuckets)
+	return sub<<exp + (uint64(1)<<exp)/2
+}
+
+func (h *latencyHistogram) record(v uint64) {
+	if h.counts == nil {
+		h.counts = make(map[int]uint64)
+	}
+	h.counts[latencyBucket(v)]++
+	h.count++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	if h.counts == nil {
+		h.counts = make(map[int]uint64, len(other.counts))
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.count += other.count
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// percentiles returns the values at each of the given quantiles, which must
+// be in ascending order.
+func (h *latencyHistogram) percentiles(quantiles ...float64) []uint64 {
+	res := make([]uint64, len(quantiles))
+	if h.count == 0 {
+		return res
+	}
+	buckets := make([]int, 0, len(h.counts))
+	for i := range h.counts {
+		buckets = append(buckets, i)
+	}
+	sort.Ints(buckets)
+
+	var seen uint64
+	q := 0
+	for _, i := range buckets {
+		seen += h.counts[i]
+		for q < len(quantiles) && float64(seen) >= quantiles[q]*float64(h.count) {
+			res[q] = latencyBucketValue(i)
+			if res[q] > h.max {
+				res[q] = h.max
+			}
+			q++
+		}
+	}
+	for ; q < len(quantiles); q++ {
+		res[q] = h.max
+	}
+	return res
+}
+
+// latencySlot is the histogram of latencies recorded during a single
+// latencySlotDuration period.
+type latencySlot struct {
+	period int64
+	hist   latencyHistogram
+}
+
+// latencyStore keeps a ring of per-slot latency histograms for each domain
+// covering the last latencyRetention. The zero value is ready to use.
+type latencyStore struct {
+	mtx     sync.Mutex
+	domains map[string]*[latencySlots]latencySlot
+}
+
+func latencyPeriod(t time.Time) int64 {
+	return t.UnixNano() / int64(latencySlotDuration)
+}
+
+func (l *latencyStore) record(domain string, d time.Duration, now time.Time) {
+	domain = strings.ToLower(domain)
+	period := latencyPeriod(now)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.domains == nil {
+		l.domains = make(map[string]*[latencySlots]latencySlot)
+	}
+	ring, ok := l.domains[domain]
+	if !ok {
+		ring = &[latencySlots]latencySlot{}
+		l.domains[domain] = ring
+	}
+	slot := &ring[period%int64(latencySlots)]
+	if slot.period != period {
+		*slot = latencySlot{period: period}
+	}
+	if d < 0 {
+		d = 0
+	}
+	slot.hist.record(uint64(d / time.Microsecond))
+}
+
+// forget removes the latencies recorded for the given domain.
+func (l *latencyStore) forget(domain string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	delete(l.domains, strings.ToLower(domain))
+}
+
+// stats returns the latency stats of the given domain over the window ending
+// at now.
+func (l *latencyStore) stats(domain string, window time.Duration, now time.Time) router.LatencyStats {
+	if window > latencyRetention {
+		window = latencyRetention
+	}
+	slots := int64((window + latencySlotDuration - 1) / latencySlotDuration)
+	if slots < 1 {
+		slots = 1
+	}
+	period := latencyPeriod(now)
+
+	var hist latencyHistogram
+	l.mtx.Lock()
+	if ring, ok := l.domains[strings.ToLower(domain)]; ok {
+		for i := range ring {
+			slot := &ring[i]
+			if slot.period > period-slots && slot.period <= period {
+				hist.merge(&slot.hist)
+			}
+		}
+	}
+	l.mtx.Unlock()
+
+	p := hist.percentiles(0.5, 0.9, 0.99, 0.999)
+	ms := func(v uint64) float64 { return float64(v) / 1000 }
+	return router.LatencyStats{
+		Count: hist.count,
+		P50:   ms(p[0]),
+		P90:   ms(p[1]),
+		P99:   ms(p[2]),
+		P999:  ms(p[3]),
+		Max:   ms(hist.max),
+	}
+}
+
+// LatencyPercentiles returns the percentiles of the latencies of requests
+// to the given domain over the given window, which is capped at
+// latencyRetention.
+func (s *HTTPListener) LatencyPercentiles(domain string, window time.Duration) router.LatencyStats {
+	return s.latency.stats(domain, window, time.Now())
+}
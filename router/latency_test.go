@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestLatencyPercentiles(c *C) {
+	var l latencyStore
+	now := time.Now()
+
+	// record latencies of 1ms to 1000ms in a random order
+	for _, i := range rand.Perm(1000) {
+		l.record("example.com", time.Duration(i+1)*time.Millisecond, now)
+	}
+	// latencies of other domains and outside of the window are ignored
+	l.record("example.org", time.Hour, now)
+	l.record("example.com", time.Hour, now.Add(-2*time.Minute))
+
+	stats := l.stats("Example.com", time.Minute, now)
+	c.Assert(stats.Count, Equals, uint64(1000))
+	for _, t := range []struct {
+		name     string
+		actual   float64
+		expected float64
+	}{
+		{"p50", stats.P50, 500},
+		{"p90", stats.P90, 900},
+		{"p99", stats.P99, 990},
+		{"p999", stats.P999, 999},
+		{"max", stats.Max, 1000},
+	} {
+		c.Assert(t.actual >= t.expected*0.95 && t.actual <= t.expected*1.05, Equals, true,
+			Commentf("%s: expected ~%v, got %v", t.name, t.expected, t.actual))
+	}
+
+	// the latencies outside of the window are included in a larger one
+	stats = l.stats("example.com", 5*time.Minute, now)
+	c.Assert(stats.Count, Equals, uint64(1001))
+	c.Assert(stats.Max, Equals, float64(time.Hour/time.Millisecond))
+
+	// latencies are forgotten once the retention has passed
+	c.Assert(l.stats("example.com", 2*latencyRetention, now.Add(latencyRetention+latencySlotDuration)).Count, Equals, uint64(0))
+
+	// domains without requests have empty stats
+	c.Assert(l.stats("example.net", time.Minute, now), DeepEquals, router.LatencyStats{})
+
+	l.forget("example.com")
+	c.Assert(l.stats("example.com", time.Minute, now).Count, Equals, uint64(0))
+}
+
+func (s *S) TestLatencyPercentilesServeHTTP(c *C) {
+	const delay = 20 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+	}))
+	defer backend.Close()
+
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	h := &httpSyncHandler{l: l}
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web"}), IsNil)
+	r := l.findRoute("example.com", "/")
+	c.Assert(r, NotNil)
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, 200)
+	}
+	stats := l.LatencyPercentiles("example.com", time.Minute)
+	c.Assert(stats.Count, Equals, uint64(5))
+	c.Assert(stats.P50 >= float64(delay/time.Millisecond), Equals, true, Commentf("p50 = %v", stats.P50))
+
+	// the latencies are forgotten when the domain is removed
+	c.Assert(h.Remove("1"), IsNil)
+	c.Assert(l.LatencyPercentiles("example.com", time.Minute).Count, Equals, uint64(0))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultMaxHeaderBytes is the header size limit of requests and responses
+// for routes with no MaxRequestHeaderBytes or MaxResponseHeaderBytes
+const defaultMaxHeaderBytes = 1 << 20
+
+// defaultMaxURIBytes is the maximum length of request URIs if the listener
+// config has no MaxURIBytes
+const defaultMaxURIBytes = 8 << 10
+
+var (
+	errTooManyResponseHeaders  = errors.New("router: too many response header fields")
+	errResponseHeadersTooLarge = errors.New("router: response header fields too large")
+)
+
+// headerFieldCount returns the number of fields in h, counting each value of
+// a repeated field separately.
+func headerFieldCount(h http.Header) int {
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	return n
+}
+
+// maxURIBytes returns the maximum length of request URIs from the listener
+// config.
+func maxURIBytes(config *ListenerConfig) int {
+	if config.MaxURIBytes > 0 {
+		return config.MaxURIBytes
+	}
+	return defaultMaxURIBytes
+}
+
+// headerSize returns the number of bytes h takes up on the wire in an
+// HTTP/1.1 message, with each field on its own "Name: value\r\n" line.
+func headerSize(h http.Header) int {
+	n := 0
+	for name, values := range h {
+		for _, v := range values {
+			n += len(name) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// validateHeaderSizeLimits checks that the route's header size limits are
+// valid.
+func validateHeaderSizeLimits(r *router.Route) error {
+	if r.MaxRequestHeaderBytes >= 0 && r.MaxResponseHeaderBytes >= 0 {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Header size limits invalid: limits can't be negative",
+	}
+}
+
+// maxHeaderBytes returns limit, or the default header size limit if it is
+// zero.
+func maxHeaderBytes(limit int) int {
+	if limit == 0 {
+		return defaultMaxHeaderBytes
+	}
+	return limit
+}
+
+// checkRequestHeaderSize responds with a 431 and returns false if the header
+// fields of req are larger than the route allows.
+func (r *httpRoute) checkRequestHeaderSize(w http.ResponseWriter, req *http.Request) bool {
+	if headerSize(req.Header) <= maxHeaderBytes(r.MaxRequestHeaderBytes) {
+		return true
+	}
+	fail(w, http.StatusRequestHeaderFieldsTooLarge)
+	return false
+}
+
+// checkResponseHeaders returns an error if a backend response has more
+// header fields than allowed by the listener config, or if they are larger
+// than the route allows. The size limit is enforced by the route's
+// transport as the header is read, and checked again here as the transport
+// counts the header differently. Oversized responses fail as protocol
+// errors, so are replaced with a 502 and their connection is closed without
+// reading the body.
+func (r *httpRoute) checkResponseHeaders(res *http.Response) error {
+	if headerSize(res.Header) > maxHeaderBytes(r.MaxResponseHeaderBytes) {
+		return &proxy.BackendError{Kind: proxy.ProtocolError, Backend: res.Request.URL.Host, Err: errResponseHeadersTooLarge}
+	}
+	if r.config == nil {
+		return nil
+	}
+	if max := r.config().MaxResponseHeaders; max > 0 && headerFieldCount(res.Header) > max {
+		return errTooManyResponseHeaders
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestHeaderCountLimits(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Header().Add("X-Backend", "1")
+		}
+	}))
+	defer backend.Close()
+
+	l := &HTTPListener{}
+	c.Assert(l.Reload(&ListenerConfig{MaxRequestHeaders: 10, MaxResponseHeaders: 4}), IsNil)
+	c.Assert(l.Reload(&ListenerConfig{MaxRequestHeaders: -1}), NotNil)
+
+	// requests with too many header fields are rejected before routing
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	for i := 0; i < 11; i++ {
+		req.Header.Add(fmt.Sprintf("X-Field-%d", i%2), "1")
+	}
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusRequestHeaderFieldsTooLarge)
+
+	req.Header.Del("X-Field-0")
+	w = httptest.NewRecorder()
+	l.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+
+	// responses with too many header fields are treated as failures
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"}, config: l.getConfig}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	r.rp.ModifyResponse = r.modifyResponse
+	serve := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		return w.Code
+	}
+	c.Assert(serve(), Equals, http.StatusServiceUnavailable)
+
+	c.Assert(l.Reload(&ListenerConfig{MaxResponseHeaders: 10}), IsNil)
+	c.Assert(serve(), Equals, http.StatusOK)
+}
+
+func (s *S) TestHeaderSizeLimits(c *C) {
+	// headerOfSize returns a header with a single field of n bytes
+	headerOfSize := func(n int) http.Header {
+		return http.Header{"X-Field": {strings.Repeat("a", n-len("X-Field: \r\n"))}}
+	}
+	c.Assert(headerSize(headerOfSize(100)), Equals, 100)
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test", MaxRequestHeaderBytes: 100, MaxResponseHeaderBytes: 200}}
+	for _, t := range []struct {
+		size int
+		ok   bool
+	}{
+		{99, true},
+		{100, true},
+		{101, false},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header = headerOfSize(t.size)
+		w := httptest.NewRecorder()
+		c.Assert(r.checkRequestHeaderSize(w, req), Equals, t.ok)
+		if !t.ok {
+			c.Assert(w.Code, Equals, http.StatusRequestHeaderFieldsTooLarge)
+		}
+	}
+
+	for _, t := range []struct {
+		size int
+		ok   bool
+	}{
+		{199, true},
+		{200, true},
+		{201, false},
+	} {
+		res := &http.Response{Header: headerOfSize(t.size), Request: httptest.NewRequest("GET", "http://127.0.0.1:1234/", nil)}
+		err := r.checkResponseHeaders(res)
+		if t.ok {
+			c.Assert(err, IsNil)
+			continue
+		}
+		c.Assert(err, FitsTypeOf, &proxy.BackendError{})
+		c.Assert(err.(*proxy.BackendError).Kind, Equals, proxy.ProtocolError)
+		c.Assert(err.(*proxy.BackendError).Backend, Equals, "127.0.0.1:1234")
+	}
+
+	// the default limits apply to routes without their own
+	r.MaxRequestHeaderBytes = 0
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header = headerOfSize(defaultMaxHeaderBytes)
+	c.Assert(r.checkRequestHeaderSize(httptest.NewRecorder(), req), Equals, true)
+	req.Header = headerOfSize(defaultMaxHeaderBytes + 1)
+	c.Assert(r.checkRequestHeaderSize(httptest.NewRecorder(), req), Equals, false)
+
+	// oversized backend responses are replaced with a 502
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Big", strings.Repeat("a", 300))
+	}))
+	defer backend.Close()
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	r.rp.ModifyResponse = r.modifyResponse
+	serve := func() int {
+		w := newCloseNotifyRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		return w.Code
+	}
+	c.Assert(serve(), Equals, http.StatusBadGateway)
+	r.MaxResponseHeaderBytes = 0
+	c.Assert(serve(), Equals, http.StatusOK)
+
+	// the transport fails oversized headers before they are read in full
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	r.rp.SetMaxResponseHeaderBytes(200)
+	c.Assert(serve(), Equals, http.StatusBadGateway)
+
+	c.Assert(validateHeaderSizeLimits(&router.Route{MaxResponseHeaderBytes: -1}), NotNil)
+	c.Assert(validateHeaderSizeLimits(&router.Route{MaxRequestHeaderBytes: 1}), IsNil)
+}
+
+func (s *S) TestURILengthLimit(c *C) {
+	l := &HTTPListener{}
+	c.Assert(l.Reload(&ListenerConfig{MaxURIBytes: -1}), NotNil)
+
+	serve := func(uri string) int {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+		return w.Code
+	}
+	path := "/" + strings.Repeat("a", defaultMaxURIBytes-1)
+	c.Assert(serve(path), Equals, http.StatusNotFound)
+	c.Assert(serve(path+"a"), Equals, http.StatusRequestURITooLong)
+
+	c.Assert(l.Reload(&ListenerConfig{MaxURIBytes: 100}), IsNil)
+	c.Assert(serve("/"+strings.Repeat("a", 99)), Equals, http.StatusNotFound)
+	c.Assert(serve("/?q="+strings.Repeat("a", 97)), Equals, http.StatusRequestURITooLong)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+// validateMethodRoutes checks that the route's method routes are valid.
+func validateMethodRoutes(r *router.Route) error {
+	if len(r.MethodRoutes) == 0 {
+		return nil
+	}
+	var msg string
+	if r.ABTest != nil {
+		msg = "requests can't be routed by both method and A/B test variant"
+	}
+	for _, method := range sortedMethods(r.MethodRoutes) {
+		if msg != "" {
+			break
+		}
+		if !tokenPattern.MatchString(method) {
+			msg = fmt.Sprintf("%q is not a valid method", method)
+		} else if r.MethodRoutes[method] == "" {
+			msg = fmt.Sprintf("method %s must have a service", method)
+		}
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Method routes invalid: " + msg,
+	}
+}
+
+func sortedMethods(methodRoutes map[string]string) []string {
+	methods := make([]string, 0, len(methodRoutes))
+	for method := range methodRoutes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// methodRouteColumnValues are the values of a route's method route columns,
+// stored as parallel arrays ordered by method
+type methodRouteColumnValues struct {
+	Methods  []string
+	Services []string
+}
+
+func methodRouteColumns(methodRoutes map[string]string) methodRouteColumnValues {
+	var cols methodRouteColumnValues
+	for _, method := range sortedMethods(methodRoutes) {
+		cols.Methods = append(cols.Methods, method)
+		cols.Services = append(cols.Services, methodRoutes[method])
+	}
+	return cols
+}
+
+func methodRoutesFromColumns(cols methodRouteColumnValues) map[string]string {
+	if len(cols.Methods) == 0 {
+		return nil
+	}
+	methodRoutes := make(map[string]string, len(cols.Methods))
+	for i, method := range cols.Methods {
+		if i < len(cols.Services) {
+			methodRoutes[method] = cols.Services[i]
+		}
+	}
+	return methodRoutes
+}
+
+// methodRoute sends requests with a method in a route's MethodRoutes to its
+// service
+type methodRoute struct {
+	service *service
+	rp      *proxy.ReverseProxy
+}
+
+// setMethodRoutes sets the method routes of a route, getting their
+// services. The caller must hold s.mtx.
+func (s *HTTPListener) setMethodRoutes(r *httpRoute) error {
+	methodRoutes := make(map[string]*methodRoute, len(r.MethodRoutes))
+	for method, name := range r.MethodRoutes {
+		service, err := s.getService(name, r.DrainBackends)
+		if err != nil {
+			for _, m := range methodRoutes {
+				s.releaseService(m.service)
+			}
+			return err
+		}
+		methodRoutes[method] = &methodRoute{
+			service: service,
+			rp:      s.newRouteProxy(r, name, service),
+		}
+	}
+	r.methodRoutes = methodRoutes
+	return nil
+}
+
+// proxyFor returns the reverse proxy which sends req to the service of its
+// method in MethodRoutes, or to Service if it has none.
+func (r *httpRoute) proxyFor(req *http.Request) *proxy.ReverseProxy {
+	if m, ok := r.methodRoutes[req.Method]; ok {
+		return m.rp
+	}
+	return r.rp
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestMethodRoutes(c *C) {
+	write := httptest.NewServer(httpTestHandler("write"))
+	defer write.Close()
+	read := httptest.NewServer(httpTestHandler("read"))
+	defer read.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	r := addRoute(c, l, router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		MethodRoutes: map[string]string{"GET": "test-read", "HEAD": "test-read"},
+	}.ToRoute())
+	unregisterWrite := registerFakeBackend(c, l, d, "test", write.Listener.Addr().String())
+	unregisterRead := registerFakeBackend(c, l, d, "test-read", read.Listener.Addr().String())
+
+	// the method route services are referenced once per method
+	l.mtx.RLock()
+	refs := l.services["test-read"].refs
+	l.mtx.RUnlock()
+	c.Assert(refs, Equals, 2)
+
+	do := func(method string) string {
+		req := newReq("http://"+l.Addr, "example.com")
+		req.Method = method
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	c.Assert(do("GET"), Equals, "read")
+	c.Assert(do("POST"), Equals, "write")
+	c.Assert(do("DELETE"), Equals, "write")
+	// methods without a method route use the route's service
+	c.Assert(do("PATCH"), Equals, "write")
+
+	// removing the route releases the method route services
+	unregisterWrite()
+	unregisterRead()
+	wait := waitForEvent(c, l, "remove", r.ID)
+	c.Assert(l.RemoveRoute(r.ID), IsNil)
+	wait()
+	l.mtx.RLock()
+	_, ok := l.services["test-read"]
+	l.mtx.RUnlock()
+	c.Assert(ok, Equals, false)
+
+	for route, msg := range map[*router.Route]string{
+		{MethodRoutes: map[string]string{"GET ": "read"}}:                          `"GET " is not a valid method`,
+		{MethodRoutes: map[string]string{"GET": ""}}:                               "method GET must have a service",
+		{MethodRoutes: map[string]string{"GET": "read"}, ABTest: &router.ABTest{}}: "requests can't be routed by both method and A/B test variant",
+	} {
+		c.Assert(validateMethodRoutes(route), DeepEquals, httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Method routes invalid: " + msg,
+		})
+	}
+}
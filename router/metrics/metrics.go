@@ -0,0 +1,161 @@
+// Package metrics implements counters which are exposed in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMtx sync.Mutex
+	registry    = make(map[string]metric)
+)
+
+func register(m metric) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := registry[m.name()]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", m.name()))
+	}
+	registry[m.name()] = m
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value uint64
+
+	metricName string
+	help       string
+}
+
+// NewCounter returns a registered counter with the given name and help text.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	register(c)
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.Value())
+}
+
+// CounterVec is a set of counters which share a name and are distinguished
+// by the value of a single label.
+type CounterVec struct {
+	metricName string
+	help       string
+	label      string
+
+	mtx      sync.Mutex
+	counters map[string]*uint64
+}
+
+// NewCounterVec returns a registered counter vector with the given name, help
+// text and label name.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{metricName: name, help: help, label: label, counters: make(map[string]*uint64)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) counter(value string) *uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	n, ok := c.counters[value]
+	if !ok {
+		n = new(uint64)
+		c.counters[value] = n
+	}
+	return n
+}
+
+// Inc increments the counter with the given label value by one.
+func (c *CounterVec) Inc(value string) {
+	atomic.AddUint64(c.counter(value), 1)
+}
+
+// Value returns the current value of the counter with the given label value.
+func (c *CounterVec) Value(value string) uint64 {
+	return atomic.LoadUint64(c.counter(value))
+}
+
+func (c *CounterVec) name() string {
+	return c.metricName
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	values := make([]string, 0, len(c.counters))
+	for v := range c.counters {
+		values = append(values, v)
+	}
+	c.mtx.Unlock()
+	sort.Strings(values)
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.metricName, c.label, v, c.Value(v))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// WriteTo writes all registered metrics to w, sorted by name.
+func WriteTo(w io.Writer) {
+	registryMtx.Lock()
+	metrics := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		metrics = append(metrics, m)
+	}
+	registryMtx.Unlock()
+
+	sort.Sort(byName(metrics))
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type byName []metric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Less(i, j int) bool { return m[i].name() < m[j].name() }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// Handler serves all registered metrics.
+var Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteTo(w)
+})
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	b := NewCounter("test_b_total", "The b counter.")
+	a := NewCounter("test_a_total", "The a counter.")
+	a.Inc()
+	b.Add(5)
+	b.Inc()
+	if v := b.Value(); v != 6 {
+		t.Fatalf("expected b to be 6, got %d", v)
+	}
+
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	expected := strings.Join([]string{
+		"# HELP test_a_total The a counter.",
+		"# TYPE test_a_total counter",
+		"test_a_total 1",
+		"# HELP test_b_total The b counter.",
+		"# TYPE test_b_total counter",
+		"test_b_total 6",
+	}, "\n") + "\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_vec_total", "The vec counter.", "kind")
+	v.Inc("b")
+	v.Inc("a")
+	v.Inc("b")
+	if n := v.Value("b"); n != 2 {
+		t.Fatalf("expected b to be 2, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	expected := strings.Join([]string{
+		"# HELP test_vec_total The vec counter.",
+		"# TYPE test_vec_total counter",
+		`test_vec_total{kind="a"} 1`,
+		`test_vec_total{kind="b"} 2`,
+	}, "\n") + "\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestDuplicateCounter(t *testing.T) {
+	NewCounter("test_duplicate_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected duplicate counter to panic")
+		}
+	}()
+	NewCounter("test_duplicate_total", "")
+}
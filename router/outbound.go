@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// parseOutboundIP returns the local IP backend connections are made from,
+// checking that it is assigned to a local interface by binding to it.
+func parseOutboundIP(addr string) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("router: invalid outbound interface IP %q", addr)
+	}
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("router: outbound interface IP %s is not assigned to a local interface: %s", ip, err)
+	}
+	l.Close()
+	return ip, nil
+}
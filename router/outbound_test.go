@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestOutboundInterface(c *C) {
+	// the backend responds with the IP the request came from
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		w.Write([]byte(host))
+	}))
+	defer srv.Close()
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	newListener := func(outbound string) (*HTTPListener, *memDiscoverd) {
+		d := newMemDiscoverd()
+		return &HTTPListener{
+			Addr:              "127.0.0.1:0",
+			TLSAddr:           "127.0.0.1:0",
+			keypair:           pair,
+			ds:                newMemDataStore("http"),
+			discoverd:         d,
+			OutboundInterface: outbound,
+		}, d
+	}
+
+	l, d := newListener("127.0.0.2")
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+	assertGet(c, "http://"+l.Addr, "example.com", "127.0.0.2")
+
+	// the IP must be valid and assigned to a local interface
+	for _, addr := range []string{"example.com", "192.0.2.1"} {
+		l, _ := newListener(addr)
+		c.Assert(l.Start(), NotNil, Commentf("addr = %s", addr))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/connutil"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// clientHelloTimeout is how long clients have to send their ClientHello
+// before it is passed on to the TLS handshake unread
+const clientHelloTimeout = 10 * time.Second
+
+var errListenerClosed = errors.New("router: listener closed")
+
+// validateTLSPassthrough checks that the route's TLS passthrough option is
+// valid.
+func validateTLSPassthrough(r *router.Route) error {
+	if !r.TLSPassthrough {
+		return nil
+	}
+	var msg string
+	switch {
+	case r.Path != "" && r.Path != "/":
+		msg = "routes are only matched by host name, so the path must be /"
+	case r.Certificate != nil || r.LegacyTLSCert != "":
+		msg = "backends terminate TLS, so a certificate can't be set"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "TLS passthrough invalid: " + msg,
+	}
+}
+
+// passthroughListener reads the ClientHello of accepted connections and
+// tunnels those whose SNI host name matches a route with TLSPassthrough set
+// to the route's backends, returning the rest from Accept to have TLS
+// terminated by the router.
+type passthroughListener struct {
+	net.Listener
+
+	// route returns the TLSPassthrough route to tunnel the connection
+	// which sent hello to, or nil if TLS should be terminated
+	route func(hello *clientHello) *httpRoute
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPassthroughListener(l net.Listener, route func(*clientHello) *httpRoute) *passthroughListener {
+	pl := &passthroughListener{
+		Listener: l,
+		route:    route,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+// acceptLoop accepts connections, reading their ClientHello in a goroutine
+// per connection so that slow clients don't hold up Accept.
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.sniff(conn)
+	}
+}
+
+func (l *passthroughListener) sniff(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, raw, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	conn = &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(raw), conn)}
+
+	if err == nil {
+		if r := l.route(hello); r != nil {
+			r.rp.ServeConn(context.Background(), connutil.CloseNotifyConn(conn))
+			return
+		}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *passthroughListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// replayConn is a net.Conn whose reads start with data which was already
+// read from it
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestPassthroughListener(c *C) {
+	// the backend terminates TLS for passthrough.example.org itself
+	backend := httptest.NewUnstartedServer(httpTestHandler("backend"))
+	backendCert := tlsConfigForDomain("passthrough.example.org")
+	backendPair, err := tls.X509KeyPair([]byte(backendCert.Cert), []byte(backendCert.PrivateKey))
+	c.Assert(err, IsNil)
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{backendPair}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "passthrough.example.org", Service: "test", TLSPassthrough: true}}
+	r.rp = proxy.NewReverseProxy(func() []string { return []string{backend.Listener.Addr().String()} }, &[32]byte{}, false, &service{}, logger)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	pl := newPassthroughListener(l, func(hello *clientHello) *httpRoute {
+		if hello.serverName == r.Domain {
+			return r
+		}
+		return nil
+	})
+	defer pl.Close()
+
+	// other connections are terminated by the router
+	routerCert := tlsConfigForDomain("example.org")
+	routerPair, err := tls.X509KeyPair([]byte(routerCert.Cert), []byte(routerCert.PrivateKey))
+	c.Assert(err, IsNil)
+	srv := &http.Server{Handler: httpTestHandler("router")}
+	go srv.Serve(tls.NewListener(pl, &tls.Config{Certificates: []tls.Certificate{routerPair}}))
+
+	get := func(serverName string) string {
+		client := newHTTPClient(serverName)
+		defer client.Transport.(*http.Transport).CloseIdleConnections()
+		res, err := client.Get("https://" + l.Addr().String())
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	c.Assert(get("passthrough.example.org"), Equals, "backend")
+	c.Assert(get("example.org"), Equals, "router")
+}
+
+func (s *S) TestTLSPassthroughValidation(c *C) {
+	for _, t := range []struct {
+		route *router.Route
+		err   string
+	}{
+		{route: &router.Route{Path: "/", TLSPassthrough: true}},
+		{route: &router.Route{Path: "/", Certificate: &router.Certificate{}}},
+		{
+			route: &router.Route{Path: "/foo/", TLSPassthrough: true},
+			err:   "TLS passthrough invalid: routes are only matched by host name, so the path must be /",
+		},
+		{
+			route: &router.Route{Path: "/", TLSPassthrough: true, LegacyTLSCert: "cert"},
+			err:   "TLS passthrough invalid: backends terminate TLS, so a certificate can't be set",
+		},
+	} {
+		err := validateTLSPassthrough(t.route)
+		if t.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, NotNil)
+			c.Assert(err, DeepEquals, httphelper.JSONError{Code: httphelper.ValidationErrorCode, Message: t.err})
+		}
+	}
+}
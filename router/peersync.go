@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// defaultPeerPollInterval is how often route changes are pulled from peers
+// if PeerConfig.PollInterval is zero
+const defaultPeerPollInterval = 5 * time.Second
+
+// peerCursorTTL is how long the position a peer last pulled from is kept
+// for compacting the change log. Peers which haven't pulled for longer are
+// syncing with the data store themselves.
+const peerCursorTTL = 10 * time.Minute
+
+// peerSignatureMaxAge is how far the time a pull from a peer was signed at
+// may be from the current time
+const peerSignatureMaxAge = time.Minute
+
+// peerSyncTimeHeader and peerSyncSignatureHeader are the headers containing
+// the time pulls from peers were signed at and their signature
+const (
+	peerSyncTimeHeader      = "Peer-Sync-Time"
+	peerSyncSignatureHeader = "Peer-Sync-Signature"
+)
+
+// PeerConfig configures pulling route changes from other router instances
+// while syncing with the data store is failing, so that routes changed
+// through routers which can still reach the data store keep propagating.
+type PeerConfig struct {
+	// PeerService is the discoverd service the APIs of the other router
+	// instances are registered in, pulling from peers is disabled if it is
+	// empty
+	PeerService string
+
+	// Addr is the address this router's API is registered with in
+	// PeerService, which is skipped when pulling changes
+	Addr string
+
+	// PollInterval is how often changes are pulled from each peer while
+	// syncing is degraded
+	PollInterval time.Duration
+
+	// SyncKey is the secret shared by the router instances which pulls are
+	// signed with, so that it isn't sent to peers over cleartext HTTP/2.
+	// Changes aren't served if it is empty.
+	SyncKey string
+}
+
+func (c PeerConfig) enabled() bool {
+	return c.PeerService != ""
+}
+
+// routeChangeLog records the latest change to each route synced from the
+// data store or pulled from peers, so that peers can pull the changes made
+// since the last one they saw.
+type routeChangeLog struct {
+	mtx sync.Mutex
+
+	// instance is the random ID of the router instance, so that positions
+	// in the log of a previous instance at the same address aren't used
+	instance string
+
+	seq     uint64
+	changes map[string]*router.RouteChange
+
+	// tombstones are the changes which removed routes, which are compacted
+	// once every peer has pulled them
+	tombstones map[string]*router.RouteChange
+
+	// cursors are the positions peers last pulled from, keyed by the
+	// instance IDs of the peers
+	cursors map[string]peerCursor
+}
+
+type peerCursor struct {
+	seq  uint64
+	seen time.Time
+}
+
+func (l *routeChangeLog) record(change *router.RouteChange) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.changes == nil {
+		l.changes = make(map[string]*router.RouteChange)
+		l.tombstones = make(map[string]*router.RouteChange)
+	}
+	l.seq++
+	change.Seq = l.seq
+	l.changes[change.ID] = change
+	if change.Route == nil {
+		l.tombstones[change.ID] = change
+	} else {
+		delete(l.tombstones, change.ID)
+	}
+	l.compact()
+}
+
+// id returns the instance ID of the log.
+func (l *routeChangeLog) id() string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.instanceID()
+}
+
+func (l *routeChangeLog) instanceID() string {
+	if l.instance == "" {
+		l.instance = random.UUID()
+	}
+	return l.instance
+}
+
+func (l *routeChangeLog) set(r *router.Route) {
+	l.record(&router.RouteChange{ID: r.ID, Route: r})
+}
+
+func (l *routeChangeLog) remove(id string, removedAt time.Time) {
+	l.record(&router.RouteChange{ID: id, RemovedAt: removedAt})
+}
+
+// since returns the changes after seq in the log of the given instance in the
+// order they were made, recording seq as the position the given peer has
+// pulled up to. All changes are returned if seq is from the log of another
+// instance or is ahead of the log, which happens when a peer pulls from a
+// router which has restarted.
+func (l *routeChangeLog) since(peer, instance string, seq uint64) *router.RouteChanges {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if instance != l.instanceID() || seq > l.seq {
+		seq = 0
+	}
+	if l.cursors == nil {
+		l.cursors = make(map[string]peerCursor)
+	}
+	l.cursors[peer] = peerCursor{seq: seq, seen: time.Now()}
+	l.compact()
+	changes := &router.RouteChanges{Instance: l.instance, Seq: l.seq, Changes: []*router.RouteChange{}}
+	for _, change := range l.changes {
+		if change.Seq > seq {
+			changes.Changes = append(changes.Changes, change)
+		}
+	}
+	sort.Slice(changes.Changes, func(i, j int) bool {
+		return changes.Changes[i].Seq < changes.Changes[j].Seq
+	})
+	return changes
+}
+
+// compact removes the tombstones which are older than peerCursorTTL and
+// which every peer that has pulled within peerCursorTTL has pulled past.
+func (l *routeChangeLog) compact() {
+	if len(l.tombstones) == 0 {
+		return
+	}
+	now := time.Now()
+	oldest := l.seq
+	for peer, cursor := range l.cursors {
+		if now.Sub(cursor.seen) > peerCursorTTL {
+			delete(l.cursors, peer)
+		} else if cursor.seq < oldest {
+			oldest = cursor.seq
+		}
+	}
+	for id, change := range l.tombstones {
+		if change.Seq <= oldest && now.Sub(change.RemovedAt) > peerCursorTTL {
+			delete(l.tombstones, id)
+			delete(l.changes, id)
+		}
+	}
+}
+
+// newer returns whether change is more recent than the latest change to the
+// same route in the log, comparing the times the routes were updated or
+// removed, so that changes pulled back from peers aren't applied again.
+func (l *routeChangeLog) newer(change *router.RouteChange) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	prev, ok := l.changes[change.ID]
+	return !ok || routeChangeTime(change).After(routeChangeTime(prev))
+}
+
+// route returns the route set by the latest change to the route with the
+// given ID, or nil if it was removed or hasn't changed.
+func (l *routeChangeLog) route(id string) *router.Route {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if change, ok := l.changes[id]; ok {
+		return change.Route
+	}
+	return nil
+}
+
+func routeChangeTime(change *router.RouteChange) time.Time {
+	if change.Route != nil {
+		return change.Route.UpdatedAt
+	}
+	return change.RemovedAt
+}
+
+// RouteChanges returns the changes to the listener's routes since the given
+// position in the change log of the given instance, which the peer with the
+// given instance ID has pulled up to.
+func (s *HTTPListener) RouteChanges(peer, instance string, since uint64) *router.RouteChanges {
+	return s.routeChanges.since(peer, instance, since)
+}
+
+// signPeerRequest signs a pull from a peer with key at the given time.
+func signPeerRequest(req *http.Request, key string, now time.Time) {
+	t := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(peerSyncTimeHeader, t)
+	req.Header.Set(peerSyncSignatureHeader, peerRequestSignature(req, key, t))
+}
+
+// verifyPeerRequest returns whether a pull from a peer is signed with key
+// within peerSignatureMaxAge of the given time.
+func verifyPeerRequest(req *http.Request, key string, now time.Time) bool {
+	if key == "" {
+		return false
+	}
+	t := req.Header.Get(peerSyncTimeHeader)
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > peerSignatureMaxAge || age < -peerSignatureMaxAge {
+		return false
+	}
+	signature, err := hex.DecodeString(req.Header.Get(peerSyncSignatureHeader))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(peerRequestSignature(req, key, t))
+	return hmac.Equal(signature, expected)
+}
+
+func peerRequestSignature(req *http.Request, key, t string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", req.Method, req.URL.RequestURI(), t)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newPeerClient returns a client which connects to peers using HTTP/2 over
+// cleartext TCP, multiplexing the pulls from each peer over one connection.
+func newPeerClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{Protocols: &protocols},
+		Timeout:   10 * time.Second,
+	}
+}
+
+// runPeerSync pulls route changes from the peers registered in
+// PeerDiscovery.PeerService every PollInterval while syncing with the data
+// store is degraded, until ctx is done.
+func (s *HTTPListener) runPeerSync(ctx context.Context) {
+	interval := s.PeerDiscovery.PollInterval
+	if interval == 0 {
+		interval = defaultPeerPollInterval
+	}
+	client := newPeerClient()
+
+	// positions are the positions in the change log of each peer pulled
+	// from so far, keyed by the peers' addresses
+	positions := make(map[string]peerPosition)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !s.SyncStatus().Degraded {
+			continue
+		}
+		addrs, err := s.discoverd.Service(s.PeerDiscovery.PeerService).Addrs()
+		if err != nil {
+			logger.Error("error looking up router peers", "service", s.PeerDiscovery.PeerService, "err", err)
+			continue
+		}
+		current := make(map[string]peerPosition, len(addrs))
+		for _, addr := range addrs {
+			if addr == s.PeerDiscovery.Addr {
+				continue
+			}
+			pos, err := s.pullPeerChanges(client, addr, positions[addr])
+			if err != nil {
+				logger.Error("error pulling route changes from peer", "peer", addr, "err", err)
+			}
+			current[addr] = pos
+		}
+		positions = current
+	}
+}
+
+// peerPosition is a position in the change log of a peer instance.
+type peerPosition struct {
+	instance string
+	seq      uint64
+}
+
+// pullPeerChanges applies the route changes made by the peer at addr since
+// the given position in its change log which are newer than the listener's
+// own, returning the position to pull from next. Changes which fail to apply
+// are logged and skipped rather than pulled again.
+func (s *HTTPListener) pullPeerChanges(client *http.Client, addr string, since peerPosition) (peerPosition, error) {
+	query := url.Values{
+		"peer":     {s.routeChanges.id()},
+		"instance": {since.instance},
+		"since":    {strconv.FormatUint(since.seq, 10)},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/sync/routes?%s", addr, query.Encode()), nil)
+	if err != nil {
+		return since, err
+	}
+	signPeerRequest(req, s.PeerDiscovery.SyncKey, time.Now())
+	res, err := client.Do(req)
+	if err != nil {
+		return since, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return since, fmt.Errorf("router: unexpected status %d from peer", res.StatusCode)
+	}
+	var changes router.RouteChanges
+	if err := json.NewDecoder(res.Body).Decode(&changes); err != nil {
+		return since, err
+	}
+	for _, change := range changes.Changes {
+		if err := s.applyPeerChange(change); err != nil {
+			logger.Error("error applying route change from peer", "peer", addr, "route.id", change.ID, "err", err)
+		}
+	}
+	return peerPosition{instance: changes.Instance, seq: changes.Seq}, nil
+}
+
+// applyPeerChange applies a route change pulled from a peer if it is newer
+// than the listener's latest change to the route. Routes loaded from the
+// environment are left as they are. Peers don't serve the private keys of
+// certificates, so routes keep the key of their certificate if it hasn't
+// changed, and otherwise use the listener's default certificate until they
+// are synced from the data store.
+func (s *HTTPListener) applyPeerChange(change *router.RouteChange) error {
+	if !s.routeChanges.newer(change) {
+		return nil
+	}
+	s.mtx.RLock()
+	_, isEnv := s.envRoutes[change.ID]
+	existing, ok := s.routes[change.ID]
+	s.mtx.RUnlock()
+	if isEnv {
+		return nil
+	}
+	if change.Route != nil {
+		// peers don't serve write-only secrets
+		var current *router.Route
+		if ok {
+			current = existing.ToRoute()
+		}
+		keepSecrets(change.Route, current)
+		keepPrivateKeys(change.Route, s.routeChanges.route(change.ID))
+		return (&httpSyncHandler{l: s}).Set(change.Route)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return nil
+	}
+	if err := s.removeRoute(change.ID); err != nil && err != ErrNotFound {
+		return err
+	}
+	s.routeChanges.remove(change.ID, change.RemovedAt)
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// disconnectableDataStore is a memDataStore whose syncs fail once it is
+// disconnected
+type disconnectableDataStore struct {
+	*memDataStore
+	disconnected chan struct{}
+}
+
+var errDataStoreUnreachable = errors.New("data store unreachable")
+
+func (d *disconnectableDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+	select {
+	case <-d.disconnected:
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errDataStoreUnreachable
+	default:
+	}
+	syncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.disconnected:
+			cancel()
+		case <-syncCtx.Done():
+		}
+	}()
+	d.memDataStore.Sync(syncCtx, h, startc)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errDataStoreUnreachable
+}
+
+func (s *S) TestPeerSync(c *C) {
+	ds := newMemDataStore("http")
+	d := newMemDiscoverd()
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+
+	// peers serve their APIs using HTTP/2 over cleartext TCP, recording
+	// the number of HTTP/2 requests
+	var h2Requests int64
+	startPeer := func(ds DataStore) *HTTPListener {
+		srv := httptest.NewUnstartedServer(nil)
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Config.Protocols = &protocols
+		srv.Start()
+		l := &HTTPListener{
+			Addr:      "127.0.0.1:0",
+			TLSAddr:   "127.0.0.1:0",
+			keypair:   pair,
+			ds:        ds,
+			discoverd: d,
+			PeerDiscovery: PeerConfig{
+				PeerService:  "router-api",
+				Addr:         srv.Listener.Addr().String(),
+				PollInterval: 10 * time.Millisecond,
+				SyncKey:      "key",
+			},
+		}
+		api := apiHandler(&Router{HTTP: l})
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.ProtoMajor == 2 {
+				atomic.AddInt64(&h2Requests, 1)
+			}
+			api.ServeHTTP(w, req)
+		})
+		c.Assert(l.Start(), IsNil)
+		unregister := d.Register("router-api", srv.Listener.Addr().String())
+		go func() {
+			<-l.syncCtx.Done()
+			unregister()
+			srv.Close()
+		}()
+		return l
+	}
+	l1 := startPeer(ds)
+	defer l1.Close()
+	disconnected := make(chan struct{})
+	l2 := startPeer(&disconnectableDataStore{memDataStore: ds, disconnected: disconnected})
+	defer l2.Close()
+
+	// routes are synced from the data store while it is reachable
+	wait := waitForEvent(c, l2, "set", "example.com")
+	r := addRoute(c, l1, router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Certificate: &router.Certificate{Cert: cert.Cert, Key: cert.PrivateKey},
+	}.ToRoute())
+	wait()
+
+	// once l2 is disconnected from the data store, route changes made
+	// through l1 are pulled from it
+	close(disconnected)
+	for start := time.Now(); !l2.SyncStatus().Degraded; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			c.Fatal("timeout waiting for sync to be degraded")
+		}
+	}
+	wait = waitForEvent(c, l2, "set", "foo.example.com")
+	addRoute(c, l1, router.HTTPRoute{Domain: "foo.example.com", Service: "foo"}.ToRoute())
+	wait()
+
+	wait = waitForEvent(c, l2, "set", "example.com")
+	r.Service = "updated"
+	c.Assert(l1.UpdateRoute(r), IsNil)
+	e := wait()
+	c.Assert(e.Route.Service, Equals, "updated")
+
+	// peers don't serve the private keys of certificates, but the route
+	// keeps the key of its unchanged certificate
+	req, err := http.NewRequest("GET", "http://"+l1.PeerDiscovery.Addr+"/sync/routes?peer=test", nil)
+	c.Assert(err, IsNil)
+	signPeerRequest(req, "key", time.Now())
+	res, err := newPeerClient().Do(req)
+	c.Assert(err, IsNil)
+	var changes router.RouteChanges
+	err = json.NewDecoder(res.Body).Decode(&changes)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	for _, change := range changes.Changes {
+		if change.Route != nil && change.Route.Certificate != nil {
+			c.Assert(change.Route.Certificate.Key, Equals, "")
+		}
+	}
+	l2.mtx.RLock()
+	c.Assert(l2.routes[r.ID].keypair, NotNil)
+	l2.mtx.RUnlock()
+
+	wait = waitForEvent(c, l2, "remove", r.ID)
+	c.Assert(l1.RemoveRoute(r.ID), IsNil)
+	wait()
+
+	l2.mtx.RLock()
+	ids := make([]string, 0, len(l2.routes))
+	for _, route := range l2.routes {
+		ids = append(ids, route.Domain)
+	}
+	l2.mtx.RUnlock()
+	c.Assert(ids, DeepEquals, []string{"foo.example.com"})
+	c.Assert(atomic.LoadInt64(&h2Requests) > 0, Equals, true)
+
+	// l1 is healthy, so doesn't pull the changes back from l2
+	c.Assert(l1.RouteChanges("test", "", 0).Seq, Equals, uint64(4))
+}
+
+func (s *S) TestRouteChangeLog(c *C) {
+	var log routeChangeLog
+	now := time.Now()
+	log.set(&router.Route{ID: "1", UpdatedAt: now})
+	log.set(&router.Route{ID: "2", UpdatedAt: now})
+	log.remove("1", now.Add(time.Second))
+
+	changes := log.since("peer", "", 0)
+	id := changes.Instance
+	c.Assert(id, Not(Equals), "")
+	c.Assert(changes.Seq, Equals, uint64(3))
+	c.Assert(changes.Changes, HasLen, 2)
+	c.Assert(changes.Changes[0].ID, Equals, "2")
+	c.Assert(changes.Changes[1].ID, Equals, "1")
+	c.Assert(changes.Changes[1].Route, IsNil)
+	c.Assert(log.since("peer", id, 2).Changes, HasLen, 1)
+	c.Assert(log.since("peer", id, 3).Changes, HasLen, 0)
+
+	// peers which are ahead of the log (e.g. because the router restarted)
+	// get all the changes
+	c.Assert(log.since("peer", id, 10).Changes, HasLen, 2)
+
+	// as do peers pulling from a position in the log of another instance
+	c.Assert(log.since("peer", "other", 3).Changes, HasLen, 2)
+
+	// only changes more recent than the latest are newer
+	c.Assert(log.newer(&router.RouteChange{ID: "1", Route: &router.Route{UpdatedAt: now}}), Equals, false)
+	c.Assert(log.newer(&router.RouteChange{ID: "1", Route: &router.Route{UpdatedAt: now.Add(2 * time.Second)}}), Equals, true)
+	c.Assert(log.newer(&router.RouteChange{ID: "2", RemovedAt: now}), Equals, false)
+	c.Assert(log.newer(&router.RouteChange{ID: "3", RemovedAt: now}), Equals, true)
+
+	// tombstones are kept until every peer has pulled them
+	log.remove("2", now.Add(-2*peerCursorTTL))
+	log.since("other", id, 3)
+	c.Assert(log.since("peer", id, 0).Changes, HasLen, 2)
+	log.since("other", id, 4)
+	c.Assert(log.since("peer", id, 4).Changes, HasLen, 0)
+	c.Assert(log.since("peer", id, 0).Changes, HasLen, 1)
+	c.Assert(log.newer(&router.RouteChange{ID: "2", Route: &router.Route{UpdatedAt: now}}), Equals, true)
+
+	// peers which haven't pulled recently are forgotten
+	log.remove("3", now.Add(-2*peerCursorTTL))
+	log.mtx.Lock()
+	log.cursors["other"] = peerCursor{seq: 0, seen: now.Add(-2 * peerCursorTTL)}
+	log.mtx.Unlock()
+	c.Assert(log.since("peer", id, 5).Changes, HasLen, 0)
+
+	// recent tombstones are kept even once every peer has pulled them
+	changes = log.since("peer", id, 0)
+	c.Assert(changes.Changes, HasLen, 1)
+	c.Assert(changes.Changes[0].ID, Equals, "1")
+}
+
+func (s *S) TestPeerRequestSignature(c *C) {
+	now := time.Now()
+	newReq := func(key string, signedAt time.Time) *http.Request {
+		req, err := http.NewRequest("GET", "http://127.0.0.1/sync/routes?peer=a&since=1", nil)
+		c.Assert(err, IsNil)
+		signPeerRequest(req, key, signedAt)
+		return req
+	}
+	c.Assert(verifyPeerRequest(newReq("key", now), "key", now), Equals, true)
+	c.Assert(verifyPeerRequest(newReq("key", now.Add(-30*time.Second)), "key", now), Equals, true)
+
+	// the key isn't sent with the request
+	req := newReq("key", now)
+	for _, v := range req.Header {
+		c.Assert(v, Not(DeepEquals), []string{"key"})
+	}
+	_, password, ok := req.BasicAuth()
+	c.Assert(ok || password != "", Equals, false)
+
+	c.Assert(verifyPeerRequest(newReq("other", now), "key", now), Equals, false)
+	c.Assert(verifyPeerRequest(newReq("", now), "", now), Equals, false)
+	c.Assert(verifyPeerRequest(newReq("key", now.Add(-2*peerSignatureMaxAge)), "key", now), Equals, false)
+	c.Assert(verifyPeerRequest(newReq("key", now.Add(2*peerSignatureMaxAge)), "key", now), Equals, false)
+
+	// the signature covers the query
+	req = newReq("key", now)
+	req.URL.RawQuery = "peer=b&since=1"
+	c.Assert(verifyPeerRequest(req, "key", now), Equals, false)
+	req = newReq("key", now)
+	req.Header.Del(peerSyncTimeHeader)
+	c.Assert(verifyPeerRequest(req, "key", now), Equals, false)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// withEarlyHints returns a copy of req which forwards 103 Early Hints
+// responses from the backend to rw as they are received, so that clients
+// can start preloading the linked resources before the final response.
+// It is only used for HTTP/2 clients, as HTTP/1.1 clients may not expect
+// informational responses other than 100 Continue, which are otherwise
+// discarded by the transport.
+func withEarlyHints(req *http.Request, rw http.ResponseWriter) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code != http.StatusEarlyHints {
+				return nil
+			}
+			h := rw.Header()
+			for k, vv := range header {
+				for _, v := range vv {
+					h.Add(k, v)
+				}
+			}
+			rw.WriteHeader(code)
+			// the hints must not be included in the final response
+			for k := range header {
+				delete(h, k)
+			}
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
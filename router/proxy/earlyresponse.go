@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// earlyResponseDial dials HTTP/1 backend connections which let responses
+// sent before the request body has been written in full be read.
+func earlyResponseDial(network, addr string) (net.Conn, error) {
+	conn, err := customDial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &earlyResponseConn{Conn: conn}, nil
+}
+
+// earlyResponseConn is a backend connection which hides write errors until
+// reading from it fails too.
+//
+// Backends may respond to a request before reading all of its body (e.g.
+// to reject a large upload), closing the connection once the response has
+// been written, which makes writing the rest of the body fail. http.Transport
+// fails requests whose write fails even if the response has already been
+// read, so the write error is hidden to give it the chance to read the
+// response, with the body being discarded. If reading fails as well there is
+// no response to relay, so the write error is returned by further writes.
+type earlyResponseConn struct {
+	net.Conn
+
+	mtx        sync.Mutex
+	writeErr   error
+	readFailed bool
+}
+
+func (c *earlyResponseConn) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	writeErr, readFailed := c.writeErr, c.readFailed
+	c.mtx.Unlock()
+	if writeErr != nil {
+		if readFailed {
+			return 0, writeErr
+		}
+		return len(b), nil
+	}
+
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.mtx.Lock()
+		c.writeErr = err
+		readFailed = c.readFailed
+		c.mtx.Unlock()
+		if !readFailed {
+			return len(b), nil
+		}
+	}
+	return n, err
+}
+
+func (c *earlyResponseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.mtx.Lock()
+		c.readFailed = true
+		c.mtx.Unlock()
+	}
+	return n, err
+}
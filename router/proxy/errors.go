@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/flynn/flynn/router/metrics"
+	"golang.org/x/net/context"
+)
+
+// BackendErrorKind is the cause of a failure to proxy a request to a backend.
+type BackendErrorKind int
+
+const (
+	// NoBackends means there were no backends registered for the service.
+	NoBackends BackendErrorKind = iota
+
+	// DialFailed means that dialing every backend failed.
+	DialFailed
+
+	// BackendTimeout means that a backend did not respond in time.
+	BackendTimeout
+
+	// ProtocolError means that a backend closed the connection or sent an
+	// invalid response after the request was sent.
+	ProtocolError
+
+	// RetryBudgetExhausted means that a request failed and was not retried
+	// with another backend because its route's retry budget was exhausted.
+	RetryBudgetExhausted
+)
+
+func (k BackendErrorKind) String() string {
+	switch k {
+	case NoBackends:
+		return "no_backends"
+	case DialFailed:
+		return "dial_failed"
+	case BackendTimeout:
+		return "timeout"
+	case ProtocolError:
+		return "protocol_error"
+	case RetryBudgetExhausted:
+		return "retry_budget_exhausted"
+	default:
+		return "unknown"
+	}
+}
+
+// StatusCode returns the status code of the response sent to clients whose
+// requests fail with this kind of error.
+func (k BackendErrorKind) StatusCode() int {
+	switch k {
+	case BackendTimeout:
+		return http.StatusGatewayTimeout
+	case ProtocolError:
+		return http.StatusBadGateway
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// BackendError is returned when a request could not be proxied to a backend.
+type BackendError struct {
+	Kind BackendErrorKind
+
+	// Backend is the address of the backend which caused the error, it is
+	// empty for NoBackends, DialFailed and RetryBudgetExhausted errors.
+	Backend string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	msg := "router: " + e.Kind.String()
+	if e.Backend != "" {
+		msg += fmt.Sprintf(" (backend %s)", e.Backend)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+var backendErrors = metrics.NewCounterVec(
+	"strowger_backend_errors_total",
+	"Number of requests which could not be proxied to a backend, by cause.",
+	"kind",
+)
+
+// newBackendError classifies an error returned when sending a request to
+// the given backend.
+func newBackendError(backend string, err error) *BackendError {
+	if _, ok := err.(dialErr); ok {
+		return &BackendError{Kind: DialFailed, Err: err}
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return &BackendError{Kind: BackendTimeout, Backend: backend, Err: err}
+	}
+	return &BackendError{Kind: ProtocolError, Backend: backend, Err: err}
+}
+
+// contextError returns the error a request fails with when ctx is done
+// while it is being sent to the given backend, which is a BackendTimeout if
+// its deadline passed and otherwise errCanceled as the client went away.
+func contextError(ctx context.Context, backend string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &BackendError{Kind: BackendTimeout, Backend: backend, Err: ctx.Err()}
+	}
+	return errCanceled
+}
+
+// errorStatus returns the status code to respond with for the given error
+// from a transport, counting it if it is a BackendError.
+func errorStatus(err error) int {
+	berr, ok := err.(*BackendError)
+	if !ok {
+		return http.StatusServiceUnavailable
+	}
+	backendErrors.Inc(berr.Kind.String())
+	return berr.Kind.StatusCode()
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/flynn/flynn/pkg/random"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ExplainSampleRate is the fraction of requests (between 0 and 1) for which
+// the backend selection is logged, to help diagnose uneven load distribution.
+// It is zero (disabled) by default and must be set before proxying requests.
+// Multicast requests are not logged as they are sent to every backend.
+var ExplainSampleRate float64
+
+// Reasons for the order of the backends returned by getOrderedBackends
+const (
+	selectRandom   = "random"
+	selectWeighted = "weighted"
+	selectSticky   = "sticky"
+	selectCustom   = "selector"
+)
+
+// shouldExplain returns whether the backend selection of the current request
+// should be logged.
+func shouldExplain() bool {
+	return ExplainSampleRate > 0 && random.Math.Float64() < ExplainSampleRate
+}
+
+// explainSelection logs the order the backends were tried in and why,
+// along with the backend which was used (or an empty string if none were
+// available).
+func explainSelection(l log15.Logger, backends []string, reason, stickyBackend, backend string) {
+	l.Info(
+		"backend selection",
+		"candidates", strings.Join(backends, ","),
+		"reason", reason,
+		"sticky_backend", stickyBackend,
+		"backend", backend,
+	)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/singleflight"
+)
+
+const (
+	// h2cProbeInterval is how long the result of probing a backend for
+	// h2c support is cached for
+	h2cProbeInterval = time.Minute
+
+	// h2cProbeRetryInterval is how long a backend which couldn't be probed
+	// is treated as not supporting h2c before it is probed again
+	h2cProbeRetryInterval = 5 * time.Second
+
+	// h2cProbeTimeout is how long to wait for a backend to respond to an
+	// h2c upgrade request
+	h2cProbeTimeout = 5 * time.Second
+
+	// h2cSettings is the base64url encoded SETTINGS payload sent in the
+	// HTTP2-Settings header of upgrade requests, disabling server push
+	h2cSettings = "AAIAAAAA"
+)
+
+// h2cTransport sends requests to backends which support HTTP/2 over
+// cleartext TCP (h2c). It uses net/http's HTTP/2 support rather than the
+// vendored x/net/http2 client as the latter treats informational (1xx)
+// responses other than 100 Continue as final responses.
+var h2cTransport = newH2CTransport()
+
+func newH2CTransport() *http.Transport {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Transport{
+		Dial:                  customDial,
+		Protocols:             &protocols,
+		ResponseHeaderTimeout: httpTransport.ResponseHeaderTimeout,
+		DisableCompression:    true,
+	}
+}
+
+// h2cSupport caches whether backends support h2c.
+type h2cSupport struct {
+	mtx      sync.Mutex
+	backends map[string]h2cProbe
+
+	// probes ensures there is only one probe in flight per backend
+	probes singleflight.Group
+}
+
+type h2cProbe struct {
+	supported bool
+	expires   time.Time
+}
+
+var backendH2C = &h2cSupport{backends: make(map[string]h2cProbe)}
+
+// supported returns whether the given backend supports h2c, probing it with
+// an h2c upgrade request if it has not been recently. Once a backend has
+// been probed, expired results continue to be returned while the backend is
+// probed again in the background so that requests don't wait for probes.
+func (s *h2cSupport) supported(d backendDialer, backend string) bool {
+	s.mtx.Lock()
+	probe, ok := s.backends[backend]
+	if ok && time.Now().After(probe.expires) {
+		// extend the expiry while the backend is probed so only one
+		// request starts a probe
+		probe.expires = time.Now().Add(h2cProbeTimeout)
+		s.backends[backend] = probe
+		go s.probe(d, backend)
+	}
+	s.mtx.Unlock()
+	if ok {
+		return probe.supported
+	}
+	return s.probe(d, backend)
+}
+
+// probe probes the given backend for h2c support and caches the result. If
+// the backend can't be reached, it is cached as not supporting h2c for
+// h2cProbeRetryInterval so that requests fail over to another backend using
+// HTTP/1.1 without each waiting for a probe.
+func (s *h2cSupport) probe(d backendDialer, backend string) bool {
+	v, _ := s.probes.Do(backend, func() (interface{}, error) {
+		now := time.Now()
+		supported, err := probeH2C(d, backend)
+		probe := h2cProbe{supported: supported, expires: now.Add(h2cProbeInterval)}
+		if err != nil {
+			probe = h2cProbe{expires: now.Add(h2cProbeRetryInterval)}
+		}
+		s.mtx.Lock()
+		s.backends[backend] = probe
+		s.mtx.Unlock()
+		return probe.supported, nil
+	})
+	return v.(bool)
+}
+
+// probeH2C sends an HTTP/1.1 request asking to upgrade to h2c (RFC 7540
+// section 3.2) to the given backend, returning whether it switched
+// protocols. The connection is closed once the backend responds, with
+// requests being sent over new connections with prior knowledge of h2c
+// support, as the HTTP/2 client can't take over upgraded connections.
+func probeH2C(d backendDialer, backend string) (bool, error) {
+	conn, err := d.Dial("tcp", backend)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h2cProbeTimeout))
+
+	_, err = fmt.Fprintf(conn, "OPTIONS / HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n", backend, h2cSettings)
+	if err != nil {
+		return false, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(res.Header.Get("Upgrade"), "h2c"), nil
+}
+
+// roundTripper returns the transport to send requests to the given backend
+// with.
+func (t *transport) roundTripper(backend string) http.RoundTripper {
+	if t.bound != nil {
+		if t.useH2C && backendH2C.supported(t.bound.dialer, backend) {
+			return t.bound.h2c
+		}
+		return t.bound.http
+	}
+	if t.useH2C && backendH2C.supported(dialer, backend) {
+		return h2cTransport
+	}
+	return httpTransport
+}
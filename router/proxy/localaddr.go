@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// boundTransports dial backend connections from a particular local IP
+// and limit the size of backend response headers.
+type boundTransports struct {
+	dialer *net.Dialer
+	http   *http.Transport
+	h2c    *http.Transport
+}
+
+// boundKey identifies the transports used by proxies with the same local IP
+// and response header size limit.
+type boundKey struct {
+	ip                     string
+	maxResponseHeaderBytes int64
+}
+
+var (
+	boundMtx sync.Mutex
+	bound    = make(map[boundKey]*boundTransports)
+)
+
+// transportsFor returns the transports which dial backends from the given
+// local IP (or the default if it is nil) and fail responses with headers
+// larger than maxResponseHeaderBytes, which are shared by proxies with the
+// same settings so that their connections are reused.
+func transportsFor(ip net.IP, maxResponseHeaderBytes int64) *boundTransports {
+	key := boundKey{maxResponseHeaderBytes: maxResponseHeaderBytes}
+	if ip != nil {
+		key.ip = ip.String()
+	}
+	boundMtx.Lock()
+	defer boundMtx.Unlock()
+	if t, ok := bound[key]; ok {
+		return t
+	}
+	d := &net.Dialer{
+		Timeout:   1 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	dial := func(network, addr string) (net.Conn, error) {
+		return dialBackend(d, network, addr)
+	}
+	t := &boundTransports{
+		dialer: d,
+		http:   httpTransport.Clone(),
+		h2c:    newH2CTransport(),
+	}
+	t.http.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &earlyResponseConn{Conn: conn}, nil
+	}
+	t.h2c.Dial = dial
+	t.http.MaxResponseHeaderBytes = maxResponseHeaderBytes
+	t.h2c.MaxResponseHeaderBytes = maxResponseHeaderBytes
+	bound[key] = t
+	return t
+}
+
+// bind sets the transports used to connect to backends from the proxy's
+// local IP and response header size limit, using the default transports if
+// neither is set.
+func (t *transport) bind() {
+	if t.localIP == nil && t.maxResponseHeaderBytes == 0 {
+		t.bound = nil
+		return
+	}
+	t.bound = transportsFor(t.localIP, t.maxResponseHeaderBytes)
+}
+
+// SetLocalIP sets the local IP which connections to backends are made from,
+// for example so that firewalls which only allow certain source IPs to reach
+// backends let them through. A nil IP uses the default.
+func (p *ReverseProxy) SetLocalIP(ip net.IP) {
+	p.transport.localIP = ip
+	p.transport.bind()
+}
+
+// SetMaxResponseHeaderBytes sets the maximum size of the header of backend
+// responses, which are read by the transport so that oversized headers fail
+// before they are buffered in full. Zero uses net/http's default limit.
+func (p *ReverseProxy) SetMaxResponseHeaderBytes(n int64) {
+	p.transport.maxResponseHeaderBytes = n
+	p.transport.bind()
+}
+
+// dialer returns the dialer used to connect to backends.
+func (t *transport) dialer() backendDialer {
+	if t.bound != nil {
+		return t.bound.dialer
+	}
+	return dialer
+}
@@ -21,6 +21,8 @@ import (
 const (
 	stickyCookie         = "_backend"
 	ctxKeyRequestTracker = "_request_tracker"
+	ctxKeyRetryable      = "_retryable"
+	ctxKeyRetryBudget    = "_retry_budget"
 )
 
 // onExitFlushLoop is a callback set by tests to detect the state of the
@@ -54,15 +56,49 @@ type ReverseProxy struct {
 
 	RequestTracker RequestTracker
 
+	// ErrorHandler, if set, is called to write the response when a request
+	// cannot be proxied to a backend, instead of writing a plain error
+	// response with the given status code.
+	ErrorHandler ErrorHandlerFunc
+
+	// ModifyResponse, if set, is called to modify the response from the
+	// backend before it is written to the client. res.Request is the
+	// request sent to the backend. If it returns an error, the request
+	// fails as if the backend were unavailable.
+	ModifyResponse func(res *http.Response) error
+
+	// Multicast, if set, sends GET, HEAD and OPTIONS requests without a body
+	// to all backends concurrently, using the first successful response.
+	Multicast bool
+
+	// ForwardTrailers, if set, forwards the trailer fields of requests whose
+	// bodies have a known length, which are otherwise only forwarded from
+	// requests with chunked bodies, by sending the body chunked. It also
+	// forwards the trailer fields of backend responses, which are otherwise
+	// dropped.
+	ForwardTrailers bool
+
 	// Logger is the logger for the proxy.
 	Logger log15.Logger
 }
 
+// ErrorHandlerFunc writes a response for req when proxying it failed with
+// the given HTTP status code.
+type ErrorHandlerFunc func(ctx context.Context, rw http.ResponseWriter, req *http.Request, status int)
+
 type RequestTracker interface {
 	TrackRequestStart(backend string)
 	TrackRequestDone(backend string)
 }
 
+// HealthTracker may be implemented by a RequestTracker to be notified of
+// whether requests to backends succeed, so that their health can be tracked
+// passively. Requests which are canceled are not tracked.
+type HealthTracker interface {
+	TrackBackendSuccess(backend string)
+	TrackBackendFailure(backend string, err error)
+}
+
 // NewReverseProxy initializes a new ReverseProxy with a callback to get
 // backends, a stickyKey for encrypting sticky session cookies, and a flag
 // sticky to enable sticky sessions.
@@ -79,6 +115,26 @@ func NewReverseProxy(bf BackendListFunc, stickyKey *[32]byte, sticky bool, rt Re
 	}
 }
 
+// SetBackendPicker sets a function used to pick the backend which is tried
+// first, before falling back to the remaining backends in a random order.
+func (p *ReverseProxy) SetBackendPicker(f BackendPickerFunc) {
+	p.transport.pickBackend = f
+}
+
+// SetBackendSelector sets the BackendSelector used to order the backends
+// instead of RandomBackendSelector. The backend picker is not used while a
+// selector is set, though sticky sessions still take precedence over it.
+func (p *ReverseProxy) SetBackendSelector(s BackendSelector) {
+	p.transport.selector = s
+}
+
+// SetBackendH2C sets whether requests are sent to backends which support
+// HTTP/2 over cleartext TCP (h2c) using HTTP/2, which is detected using an
+// h2c upgrade request.
+func (p *ReverseProxy) SetBackendH2C(enabled bool) {
+	p.transport.useH2C = enabled
+}
+
 // ServeHTTP implements http.Handler.
 func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
 	transport := p.transport
@@ -87,10 +143,16 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, re
 	}
 
 	outreq := prepareRequest(req)
+	// trailers can only be sent to HTTP/1.1 backends after a chunked body,
+	// which is only used when the length of the body is unknown, so send
+	// bodies whose length is known (e.g. from HTTP/2 clients) chunked too
+	if p.ForwardTrailers && len(outreq.Trailer) > 0 && outreq.ContentLength > 0 {
+		outreq.ContentLength = -1
+	}
 
 	l := p.Logger.New("request_id", req.Header.Get("X-Request-Id"), "client_addr", req.RemoteAddr, "host", req.Host, "path", req.URL.Path, "method", req.Method)
 
-	if isConnectionUpgrade(req.Header) {
+	if isUpgrade(req.Header) {
 		p.serveUpgrade(rw, l, outreq)
 		return
 	}
@@ -127,19 +189,64 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, re
 		}()
 	}
 
-	res, backend, err := transport.RoundTrip(ctx, outreq, l)
+	var res *http.Response
+	var backend string
+	var err error
+	if p.Multicast && canMulticast(outreq) {
+		res, backend, err = transport.multicastRoundTrip(ctx, outreq, l)
+	} else {
+		if req.ProtoMajor == 2 {
+			outreq = withEarlyHints(outreq, rw)
+		}
+		res, backend, err = transport.RoundTrip(ctx, outreq, l)
+	}
 	if err != nil {
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		rw.Write(serviceUnavailable)
+		p.fail(ctx, rw, req, errorStatus(err))
 		return
 	}
 	defer res.Body.Close()
 	defer p.RequestTracker.TrackRequestDone(backend)
 
 	prepareResponseHeaders(res)
+	p.prepareResponseTrailer(res)
+	if p.ModifyResponse != nil {
+		if err := p.ModifyResponse(res); err != nil {
+			status := errorStatus(err)
+			l.Error("error modifying response", "err", err, "status", status)
+			p.fail(ctx, rw, req, status)
+			return
+		}
+	}
 	p.writeResponse(rw, res)
 }
 
+// canMulticast returns whether req can be sent to multiple backends, which is
+// only the case for idempotent requests without a body.
+func canMulticast(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return req.ContentLength == 0
+	default:
+		return false
+	}
+}
+
+// fail writes the response with the given status code for a request which
+// could not be proxied.
+func (p *ReverseProxy) fail(ctx context.Context, rw http.ResponseWriter, req *http.Request, status int) {
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(ctx, rw, req, status)
+		return
+	}
+	writeError(rw, status)
+}
+
+// writeError writes a plain error response with the given status code.
+func writeError(rw http.ResponseWriter, status int) {
+	rw.WriteHeader(status)
+	rw.Write([]byte(http.StatusText(status) + "\n"))
+}
+
 // ServeConn takes an inbound conn and proxies it to a backend.
 func (p *ReverseProxy) ServeConn(ctx context.Context, dconn net.Conn) {
 	transport := p.transport
@@ -179,20 +286,36 @@ func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, l log15.Logger, req
 
 	res, uconn, err := transport.UpgradeHTTP(req, l)
 	if err != nil {
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		rw.Write(serviceUnavailable)
+		writeError(rw, errorStatus(err))
 		return
 	}
 	defer uconn.Close()
 
 	prepareResponseHeaders(res)
+	p.prepareResponseTrailer(res)
 	if res.StatusCode != 101 {
+		if p.ModifyResponse != nil {
+			if err := p.ModifyResponse(res); err != nil {
+				status := errorStatus(err)
+				l.Error("error modifying response", "err", err, "status", status)
+				writeError(rw, status)
+				return
+			}
+		}
 		res.Header.Set("Connection", "close")
 		p.writeResponse(rw, res)
 		return
 	}
 
-	dconn, bufrw, err := rw.(http.Hijacker).Hijack()
+	// the connection can't be taken over if the request wasn't made using
+	// HTTP/1.x, or if it is being recorded (e.g. to cache the response)
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		l.Error("error hijacking request", "err", "response writer can't be hijacked", "status", "502")
+		writeError(rw, http.StatusBadGateway)
+		return
+	}
+	dconn, bufrw, err := hijacker.Hijack()
 	if err != nil {
 		l.Error("error hijacking request", "err", err, "status", "503")
 		rw.WriteHeader(http.StatusServiceUnavailable)
@@ -200,6 +323,9 @@ func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, l log15.Logger, req
 		return
 	}
 	defer dconn.Close()
+	if s, ok := dconn.(protocolSwitcher); ok {
+		s.SwitchProtocols()
+	}
 
 	if err := res.Write(dconn); err != nil {
 		l.Error("error proxying response to client", "err", err)
@@ -234,11 +360,54 @@ func prepareResponseHeaders(res *http.Response) {
 	}
 }
 
+// prepareResponseTrailer drops the trailer fields of backend responses
+// unless ForwardTrailers is set, leaving only those added by ModifyResponse
+// to be sent to the client.
+func (p *ReverseProxy) prepareResponseTrailer(res *http.Response) {
+	if !p.ForwardTrailers {
+		res.Trailer = nil
+	}
+}
+
 func (p *ReverseProxy) writeResponse(rw http.ResponseWriter, res *http.Response) {
 	copyHeader(rw.Header(), res.Header)
 
+	// announce the trailer so that the body is sent chunked rather than
+	// with a Content-Length, which would leave no way to send it
+	trailerKeys := make([]string, 0, len(res.Trailer))
+	for k := range res.Trailer {
+		trailerKeys = append(trailerKeys, k)
+	}
+	if len(trailerKeys) > 0 {
+		rw.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
+
 	rw.WriteHeader(res.StatusCode)
 	p.copyResponse(rw, res.Body)
+
+	// the trailer is only complete once the body has been read. Only the
+	// announced fields are sent, as the transport sets res.Trailer to the
+	// backend's trailer once it reads it even if it was dropped by
+	// prepareResponseTrailer.
+	for _, k := range trailerKeys {
+		for _, v := range res.Trailer[k] {
+			rw.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// protocolSwitcher is implemented by client connections which need to know
+// when they have switched to another protocol after a 101 response (e.g. to
+// stop checking them for HTTP/1.x request smuggling).
+type protocolSwitcher interface {
+	SwitchProtocols()
+}
+
+// isUpgrade returns whether the request headers h ask to switch the
+// connection to another protocol (e.g. "websocket", "h2c" or a custom one),
+// which requires both an Upgrade header and an "upgrade" Connection option.
+func isUpgrade(h http.Header) bool {
+	return h.Get("Upgrade") != "" && isConnectionUpgrade(h)
 }
 
 func isConnectionUpgrade(h http.Header) bool {
@@ -336,7 +505,7 @@ func prepareRequest(req *http.Request) *http.Request {
 	// remove the Upgrade header and headers referenced in the Connection
 	// header if HTTP < 1.1 or if Connection header didn't contain "upgrade":
 	// https://tools.ietf.org/html/rfc7230#section-6.7
-	if !req.ProtoAtLeast(1, 1) || !isConnectionUpgrade(req.Header) {
+	if !req.ProtoAtLeast(1, 1) || !isUpgrade(req.Header) {
 		outreq.Header.Del("Upgrade")
 
 		// Especially important is "Connection" because we want a persistent
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// BackendSelector orders the backends of a service for a request, to
+// implement policies such as consistent hashing.
+type BackendSelector interface {
+	// SelectBackends returns the backends in the order they should be
+	// tried, with the first being used unless connecting to it fails. It
+	// may reorder and return the given slice. req is nil when selecting
+	// the backend of a TCP connection.
+	SelectBackends(req *http.Request, backends []string) []string
+}
+
+// BackendSelectorFunc is a function which implements BackendSelector.
+type BackendSelectorFunc func(req *http.Request, backends []string) []string
+
+func (f BackendSelectorFunc) SelectBackends(req *http.Request, backends []string) []string {
+	return f(req, backends)
+}
+
+// RandomBackendSelector is the default BackendSelector, which tries the
+// backends in a random order.
+var RandomBackendSelector BackendSelector = BackendSelectorFunc(func(req *http.Request, backends []string) []string {
+	shuffle(backends)
+	return backends
+})
+
+// HashBackendSelector sends requests with the same key to the same backend
+// using rendezvous (highest random weight) hashing, so that changing the
+// backends only moves the keys of the added or removed backends. Requests
+// with an empty key, and TCP connections, use RandomBackendSelector.
+type HashBackendSelector struct {
+	// Key returns the key of the given request.
+	Key func(req *http.Request) string
+}
+
+func (s *HashBackendSelector) SelectBackends(req *http.Request, backends []string) []string {
+	var key string
+	if req != nil {
+		key = s.Key(req)
+	}
+	if key == "" {
+		return RandomBackendSelector.SelectBackends(req, backends)
+	}
+	weights := make(map[string]uint64, len(backends))
+	for _, b := range backends {
+		weights[b] = rendezvousWeight(key, b)
+	}
+	// backends after the first are ordered by weight too so that failing
+	// over from a backend is also consistent
+	sort.Slice(backends, func(i, j int) bool {
+		wi, wj := weights[backends[i]], weights[backends[j]]
+		if wi != wj {
+			return wi > wj
+		}
+		return backends[i] < backends[j]
+	})
+	return backends
+}
+
+// rendezvousWeight returns the weight of the given backend for the given key.
+func rendezvousWeight(key, backend string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	h.Write([]byte{0})
+	io.WriteString(h, backend)
+	// FNV's output is poorly mixed for inputs sharing a prefix, so finish it
+	// with the splitmix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -8,9 +8,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/metrics"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/net/context"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -21,18 +24,41 @@ type backendDialer interface {
 }
 
 var (
-	errNoBackends = errors.New("router: no backends available")
-	errCanceled   = errors.New("router: backend connection canceled")
+	errCanceled = errors.New("router: backend connection canceled")
 
 	httpTransport = &http.Transport{
-		Dial: customDial,
+		Dial: earlyResponseDial,
 		// The response header timeout is currently set pretty high because
 		// gitreceive doesn't send headers until it is done unpacking the repo,
 		// it should be lowered after this is fixed.
 		ResponseHeaderTimeout: 10 * time.Minute,
+		// Wait for backends to respond to requests sent with
+		// "Expect: 100-continue" before sending the body, so that those
+		// which reject them early don't have the client upload it in
+		// vain.
+		ExpectContinueTimeout: 1 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second, // unused, but safer to leave default in place
+		// Compression is negotiated between the client and the backend,
+		// so don't add an Accept-Encoding header to requests and
+		// transparently decompress the response, which would remove the
+		// Content-Encoding and Content-Length headers.
+		DisableCompression: true,
 	}
 
+	backendConnections = metrics.NewCounter(
+		"strowger_backend_connections_total",
+		"Number of HTTP connections opened to backends.",
+	)
+	backendRequests = metrics.NewCounter(
+		"strowger_backend_requests_total",
+		"Number of HTTP requests sent to backends, divided by strowger_backend_connections_total it is the keep-alive reuse factor.",
+	)
+
+	multicastWastedRequests = metrics.NewCounter(
+		"strowger_multicast_wasted_requests_total",
+		"Number of multicast backend requests whose responses were discarded.",
+	)
+
 	dialer backendDialer = &net.Dialer{
 		Timeout:   1 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -42,21 +68,65 @@ var (
 // BackendListFunc returns a slice of backend hosts (hostname:port).
 type BackendListFunc func() []string
 
+// BackendPickerFunc returns the backend which should be tried first, or an
+// empty string if backends should be tried in a random order.
+type BackendPickerFunc func() string
+
 type transport struct {
 	getBackends BackendListFunc
+	pickBackend BackendPickerFunc
+
+	// selector, if set, orders the backends instead of
+	// RandomBackendSelector and pickBackend
+	selector BackendSelector
 
 	stickyCookieKey   *[32]byte
 	useStickySessions bool
+
+	// useH2C is whether to send requests to backends which support it
+	// using h2c
+	useH2C bool
+
+	// localIP and maxResponseHeaderBytes are the settings of bound
+	localIP                net.IP
+	maxResponseHeaderBytes int64
+
+	// bound, if set, are the transports used to connect to backends from
+	// a particular local IP or with a response header size limit
+	bound *boundTransports
 }
 
-func (t *transport) getOrderedBackends(stickyBackend string) []string {
+// getOrderedBackends returns the backends in the order they should be tried
+// for req, along with the reason the first backend was chosen.
+func (t *transport) getOrderedBackends(req *http.Request, stickyBackend string) ([]string, string) {
 	backends := t.getBackends()
-	shuffle(backends)
+	if t.selector != nil {
+		backends = t.selector.SelectBackends(req, backends)
+	} else {
+		backends = RandomBackendSelector.SelectBackends(req, backends)
+	}
+	if len(backends) == 0 {
+		return backends, selectRandom
+	}
 
+	reason := selectRandom
+	if t.selector != nil {
+		reason = selectCustom
+	} else if t.pickBackend != nil {
+		if backend := t.pickBackend(); backend != "" {
+			swapToFront(backends, backend)
+			if backends[0] == backend {
+				reason = selectWeighted
+			}
+		}
+	}
 	if stickyBackend != "" {
 		swapToFront(backends, stickyBackend)
+		if backends[0] == stickyBackend {
+			reason = selectSticky
+		}
 	}
-	return backends
+	return backends, reason
 }
 
 func (t *transport) getStickyBackend(req *http.Request) string {
@@ -76,38 +146,245 @@ func (t *transport) setStickyBackend(res *http.Response, originalStickyBackend s
 }
 
 func (t *transport) RoundTrip(ctx context.Context, req *http.Request, l log15.Logger) (*http.Response, string, error) {
-	// http.Transport closes the request body on a failed dial, issue #875
-	req.Body = &fakeCloseReadCloser{req.Body}
-	defer req.Body.(*fakeCloseReadCloser).RealClose()
+	// http.Transport closes the request body on a failed dial, issue #875.
+	// Requests without a body are left alone so that they are sent with a
+	// zero Content-Length rather than an empty chunked body.
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &fakeCloseReadCloser{req.Body}
+		// the body may be replaced by rewindBody, so close the current one
+		defer func() { req.Body.(*fakeCloseReadCloser).RealClose() }()
+	}
 
 	// hook up CloseNotify to cancel the request
 	req.Cancel = ctx.Done()
 
 	rt := ctx.Value(ctxKeyRequestTracker).(RequestTracker)
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
+	backends, reason := t.getOrderedBackends(req, stickyBackend)
+	explain := shouldExplain()
+	// berr is the error the request fails with if no backend succeeds
+	berr := &BackendError{Kind: NoBackends}
+	budget := getRetryBudget(ctx)
+	if budget != nil {
+		budget.TrackRequest()
+	}
 	for i, backend := range backends {
+		if i > 0 && budget != nil && !budget.AllowRetry() {
+			l.Error("not retrying request, retry budget exhausted", "attempt", i)
+			berr = &BackendError{Kind: RetryBudgetExhausted, Err: berr}
+			break
+		}
 		req.URL.Host = backend
 		rt.TrackRequestStart(backend)
-		res, err := httpTransport.RoundTrip(req)
+		backendRequests.Inc()
+		res, err := t.roundTripper(backend).RoundTrip(req)
+		trackBackendHealth(ctx, rt, backend, err)
 		if err == nil {
+			if explain {
+				explainSelection(l, backends, reason, stickyBackend, backend)
+			}
 			t.setStickyBackend(res, stickyBackend)
 			return res, backend, nil
 		}
 		rt.TrackRequestDone(backend)
+		if ctx.Err() != nil {
+			return nil, "", contextError(ctx, backend)
+		}
 		if _, ok := err.(dialErr); !ok {
-			l.Error("unretriable request error", "backend", backend, "err", err, "attempt", i)
-			return nil, "", err
+			berr = newBackendError(backend, err)
+			if isRetryable(ctx) && i < len(backends)-1 && rewindBody(req) {
+				l.Error("retriable request error", "backend", backend, "err", err, "attempt", i)
+				continue
+			}
+			if explain {
+				explainSelection(l, backends, reason, stickyBackend, backend)
+			}
+			l.Error("unretriable request error", "backend", backend, "err", err, "attempt", i, "kind", berr.Kind)
+			return nil, "", berr
+		}
+		if berr.Kind == NoBackends {
+			berr = newBackendError(backend, err)
 		}
 		l.Error("retriable dial error", "backend", backend, "err", err, "attempt", i)
 	}
-	l.Error("request failed", "status", "503", "num_backends", len(backends))
-	return nil, "", errNoBackends
+	if explain {
+		explainSelection(l, backends, reason, stickyBackend, "")
+	}
+	l.Error("request failed", "status", berr.Kind.StatusCode(), "kind", berr.Kind, "num_backends", len(backends))
+	return nil, "", berr
+}
+
+// NewContextRetryable returns a context which marks the request it is used
+// to proxy as idempotent, so that it is retried with the next backend if it
+// fails after being sent rather than only if the dial fails.
+func NewContextRetryable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyRetryable, true)
+}
+
+func isRetryable(ctx context.Context) bool {
+	retryable, _ := ctx.Value(ctxKeyRetryable).(bool)
+	return retryable
+}
+
+// RetryBudget limits the proportion of requests which are retried with
+// another backend after failing, so that retries don't multiply the load on
+// failing backends.
+type RetryBudget interface {
+	// TrackRequest records a request being proxied.
+	TrackRequest()
+	// AllowRetry returns whether a failed request may be retried,
+	// recording the retry if so.
+	AllowRetry() bool
+}
+
+// NewContextRetryBudget returns a context which limits the retries of the
+// request it is used to proxy using the given budget, with the request
+// failing with a RetryBudgetExhausted error rather than being retried once
+// the budget is exhausted.
+func NewContextRetryBudget(ctx context.Context, budget RetryBudget) context.Context {
+	return context.WithValue(ctx, ctxKeyRetryBudget, budget)
+}
+
+func getRetryBudget(ctx context.Context) RetryBudget {
+	budget, _ := ctx.Value(ctxKeyRetryBudget).(RetryBudget)
+	return budget
+}
+
+// rewindBody resets the body of req so that it can be sent again, returning
+// false if it can't be replayed.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body.(*fakeCloseReadCloser).RealClose()
+	req.Body = &fakeCloseReadCloser{body}
+	return true
+}
+
+// multicastRoundTrip sends req to all backends concurrently, returning the
+// first successful response and canceling the other requests. Any request
+// body is not sent as it cannot be replayed to each backend (see
+// canMulticast).
+func (t *transport) multicastRoundTrip(ctx context.Context, req *http.Request, l log15.Logger) (*http.Response, string, error) {
+	rt := ctx.Value(ctxKeyRequestTracker).(RequestTracker)
+	backends := t.getBackends()
+	if len(backends) == 0 {
+		l.Error("request failed", "status", "503", "kind", NoBackends, "num_backends", 0)
+		return nil, "", &BackendError{Kind: NoBackends}
+	}
+
+	type result struct {
+		res     *http.Response
+		backend string
+		err     error
+		index   int
+	}
+	results := make(chan *result, len(backends))
+	cancels := make([]func(), len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		breq := new(http.Request)
+		*breq = *req
+		breq.URL = new(url.URL)
+		*breq.URL = *req.URL
+		breq.URL.Host = backend
+		breq.Header = make(http.Header, len(req.Header))
+		copyHeader(breq.Header, req.Header)
+		breq.Body = nil
+		breq.ContentLength = 0
+
+		bctx, cancel := context.WithCancel(ctx)
+		breq.Cancel = bctx.Done()
+		cancels[i] = cancel
+
+		wg.Add(1)
+		go func(i int, backend string) {
+			defer wg.Done()
+			rt.TrackRequestStart(backend)
+			backendRequests.Inc()
+			res, err := t.roundTripper(backend).RoundTrip(breq)
+			trackBackendHealth(bctx, rt, backend, err)
+			if err != nil {
+				rt.TrackRequestDone(backend)
+			}
+			results <- &result{res: res, backend: backend, err: err, index: i}
+		}(i, backend)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var winner *result
+	var berr *BackendError
+	for r := range results {
+		if r.err != nil {
+			l.Error("multicast request error", "backend", r.backend, "err", r.err)
+			// prefer errors from backends which were reached
+			if err := newBackendError(r.backend, r.err); berr == nil || berr.Kind == DialFailed {
+				berr = err
+			}
+			continue
+		}
+		winner = r
+		break
+	}
+	if winner == nil {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		if ctx.Err() != nil {
+			return nil, "", contextError(ctx, "")
+		}
+		l.Error("request failed", "status", berr.Kind.StatusCode(), "kind", berr.Kind, "num_backends", len(backends))
+		return nil, "", berr
+	}
+
+	// cancel the remaining requests, discarding any responses
+	for i, cancel := range cancels {
+		if i != winner.index {
+			cancel()
+		}
+	}
+	go func() {
+		for r := range results {
+			if r.err == nil {
+				r.res.Body.Close()
+				rt.TrackRequestDone(r.backend)
+			}
+		}
+	}()
+	multicastWastedRequests.Add(uint64(len(backends) - 1))
+
+	res := winner.res
+	res.Body = &cancelReadCloser{ReadCloser: res.Body, cancel: cancels[winner.index]}
+	return res, winner.backend, nil
+}
+
+// trackBackendHealth reports the result of a request to backend if rt is a
+// HealthTracker.
+func trackBackendHealth(ctx context.Context, rt RequestTracker, backend string, err error) {
+	ht, ok := rt.(HealthTracker)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		ht.TrackBackendFailure(backend, err)
+	} else {
+		ht.TrackBackendSuccess(backend)
+	}
 }
 
 func (t *transport) Connect(ctx context.Context, l log15.Logger) (net.Conn, error) {
-	backends := t.getOrderedBackends("")
-	conn, _, err := dialTCP(ctx, l, backends)
+	backends, _ := t.getOrderedBackends(nil, "")
+	conn, _, err := dialTCP(ctx, l, t.dialer(), backends)
 	if err != nil {
 		l.Error("connection failed", "num_backends", len(backends))
 	}
@@ -116,8 +393,11 @@ func (t *transport) Connect(ctx context.Context, l log15.Logger) (net.Conn, erro
 
 func (t *transport) UpgradeHTTP(req *http.Request, l log15.Logger) (*http.Response, net.Conn, error) {
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
-	upconn, addr, err := dialTCP(context.Background(), l, backends)
+	backends, reason := t.getOrderedBackends(req, stickyBackend)
+	upconn, addr, err := dialTCP(context.Background(), l, t.dialer(), backends)
+	if shouldExplain() {
+		explainSelection(l, backends, reason, stickyBackend, addr)
+	}
 	if err != nil {
 		l.Error("dial failed", "status", "503", "num_backends", len(backends))
 		return nil, nil, err
@@ -128,40 +408,49 @@ func (t *transport) UpgradeHTTP(req *http.Request, l log15.Logger) (*http.Respon
 	if err := req.Write(conn); err != nil {
 		conn.Close()
 		l.Error("error writing request", "err", err, "backend", addr)
-		return nil, nil, err
+		return nil, nil, newBackendError(addr, err)
 	}
 	res, err := http.ReadResponse(conn.Reader, req)
 	if err != nil {
 		conn.Close()
 		l.Error("error reading response", "err", err, "backend", addr)
-		return nil, nil, err
+		return nil, nil, newBackendError(addr, err)
 	}
 	t.setStickyBackend(res, stickyBackend)
 	return res, conn, nil
 }
 
-func dialTCP(ctx context.Context, l log15.Logger, addrs []string) (net.Conn, string, error) {
+func dialTCP(ctx context.Context, l log15.Logger, d backendDialer, addrs []string) (net.Conn, string, error) {
 	donec := ctx.Done()
 	for i, addr := range addrs {
 		select {
 		case <-donec:
-			return nil, "", errCanceled
+			return nil, "", contextError(ctx, "")
 		default:
 		}
-		conn, err := dialer.Dial("tcp", addr)
+		conn, err := d.Dial("tcp", addr)
 		if err == nil {
 			return conn, addr, nil
 		}
 		l.Error("retriable dial error", "backend", addr, "err", err, "attempt", i)
+		if i == len(addrs)-1 {
+			return nil, "", &BackendError{Kind: DialFailed, Err: err}
+		}
 	}
-	return nil, "", errNoBackends
+	return nil, "", &BackendError{Kind: NoBackends}
 }
 
 func customDial(network, addr string) (net.Conn, error) {
-	conn, err := dialer.Dial(network, addr)
+	return dialBackend(dialer, network, addr)
+}
+
+// dialBackend dials a backend connection using the given dialer.
+func dialBackend(d backendDialer, network, addr string) (net.Conn, error) {
+	conn, err := d.Dial(network, addr)
 	if err != nil {
 		return nil, dialErr{err}
 	}
+	backendConnections.Inc()
 	return conn, nil
 }
 
@@ -184,6 +473,19 @@ func (w *fakeCloseReadCloser) RealClose() error {
 	return w.ReadCloser.Close()
 }
 
+// cancelReadCloser calls cancel when closed, used to release the context of a
+// request once its response body has been read.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
 func shuffle(s []string) {
 	for i := len(s) - 1; i > 0; i-- {
 		j := random.Math.Intn(i + 1)
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"golang.org/x/net/context"
+)
+
+const (
+	// pushHeader is set to the route's push token on requests promised by
+	// HTTP/2 server pushes so that they can be served from the push cache
+	pushHeader = "X-Router-Push"
+
+	// maxRecordedBodySize is the largest response body which is recorded
+	// to be cached for pushed requests or shared with collapsed requests
+	maxRecordedBodySize = 1 << 20
+)
+
+// pushCache caches responses to requests promised by HTTP/2 server pushes so
+// that they don't hit the backend on every page load. Responses are cached
+// for the max-age given in their Cache-Control header, and conditional
+// requests are answered from the cached ETag and Last-Modified headers.
+type pushCache struct {
+	// token is generated by the router and set in the pushHeader of
+	// promised requests, so that clients can't read or fill the cache by
+	// setting the header themselves
+	token string
+
+	mtx     sync.RWMutex
+	entries map[string]*pushCacheEntry
+}
+
+type pushCacheEntry struct {
+	status       int
+	header       http.Header
+	body         []byte
+	expires      time.Time
+	etag         string
+	lastModified time.Time
+}
+
+// notModified returns whether the conditional headers of req match the
+// entry, in which case a 304 should be sent rather than the entry.
+func (e *pushCacheEntry) notModified(req *http.Request) bool {
+	// If-Modified-Since is ignored if If-None-Match is present (RFC 7232
+	// section 3.3)
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return e.etag != "" && etagMatches(inm, e.etag)
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !e.lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !e.lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagMatches returns whether any of the entity tags in the given
+// If-None-Match header match etag using the weak comparison function.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified writes a 304 response for the entry, which has the
+// entry's headers other than those describing the omitted body.
+func (e *pushCacheEntry) writeNotModified(w http.ResponseWriter) {
+	copyHeader(w.Header(), e.header)
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func newPushCache() *pushCache {
+	return &pushCache{token: random.Hex(16), entries: make(map[string]*pushCacheEntry)}
+}
+
+func (c *pushCache) get(key string) *pushCacheEntry {
+	c.mtx.RLock()
+	entry, ok := c.entries[key]
+	c.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		c.mtx.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.mtx.Unlock()
+		return nil
+	}
+	return entry
+}
+
+func (c *pushCache) set(key string, entry *pushCacheEntry) {
+	c.mtx.Lock()
+	c.entries[key] = entry
+	c.mtx.Unlock()
+}
+
+// pushCacheExpiry returns when a response with the given header expires from
+// the push cache, or false if it should not be cached.
+func pushCacheExpiry(header http.Header) (time.Time, bool) {
+	if header.Get("Set-Cookie") != "" {
+		return time.Time{}, false
+	}
+	var maxAge int
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private":
+			return time.Time{}, false
+		case strings.HasPrefix(directive, "max-age="):
+			if n, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				maxAge = n
+			}
+		}
+	}
+	if maxAge <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(maxAge) * time.Second), true
+}
+
+// pushCacheKey returns the push cache key for req, or an empty string if req
+// was not promised by a push of one of the route's PushPaths or may return a
+// personalized response. The key is the route's push path rather than
+// anything from the request, as only the token identifies pushed requests.
+func (r *httpRoute) pushCacheKey(req *http.Request) string {
+	token := req.Header.Get(pushHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.pushCache.token)) != 1 {
+		return ""
+	}
+	if req.Method != "GET" || req.Header.Get("Cookie") != "" || req.Header.Get("Authorization") != "" {
+		return ""
+	}
+	for _, path := range r.PushPaths {
+		if req.URL.RequestURI() == path {
+			return path
+		}
+	}
+	return ""
+}
+
+// servePushed serves a request promised by a push from the push cache,
+// proxying it to the backend and caching the response on a miss.
+func (r *httpRoute) servePushed(ctx context.Context, w http.ResponseWriter, req *http.Request, key string) {
+	if entry := r.pushCache.get(key); entry != nil {
+		if entry.notModified(req) {
+			entry.writeNotModified(w)
+			return
+		}
+		copyHeader(w.Header(), entry.header)
+		w.WriteHeader(entry.status)
+		w.Write(entry.body)
+		return
+	}
+
+	cw := &recordingWriter{ResponseWriter: w}
+	r.proxyFor(req).ServeHTTP(ctx, cw, req)
+	if cw.status != http.StatusOK || cw.overflow || cw.err != nil {
+		return
+	}
+	if expires, ok := pushCacheExpiry(w.Header()); ok {
+		header := make(http.Header, len(w.Header()))
+		copyHeader(header, w.Header())
+		lastModified, _ := http.ParseTime(header.Get("Last-Modified"))
+		r.pushCache.set(key, &pushCacheEntry{
+			status:       cw.status,
+			header:       header,
+			body:         cw.body.Bytes(),
+			expires:      expires,
+			etag:         header.Get("ETag"),
+			lastModified: lastModified,
+		})
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// recordingWriter records the response written through it so that it can be
+// cached or shared. Bodies larger than maxRecordedBodySize are not recorded.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	// err is the first error writing to the underlying ResponseWriter, in
+	// which case the recorded body may be incomplete
+	err error
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	// informational responses (e.g. 103 Early Hints) precede the response
+	// rather than being part of it
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > maxRecordedBodySize {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// pushResponseWriter pushes the route's PushPaths before writing a
+// successful HTML response.
+type pushResponseWriter struct {
+	http.ResponseWriter
+	pusher      http.Pusher
+	paths       []string
+	token       string
+	wroteHeader bool
+}
+
+func (w *pushResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		if status == http.StatusOK && isHTML(w.Header().Get("Content-Type")) {
+			w.push()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pushResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *pushResponseWriter) push() {
+	opts := &http.PushOptions{Header: http.Header{pushHeader: {w.token}}}
+	for _, path := range w.paths {
+		if err := w.pusher.Push(path, opts); err != nil {
+			// pushes are either disabled by the client or the
+			// connection is going away, so stop pushing
+			return
+		}
+	}
+}
+
+func (w *pushResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *pushResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func isHTML(contentType string) bool {
+	typ, _, err := mime.ParseMediaType(contentType)
+	return err == nil && typ == "text/html"
+}
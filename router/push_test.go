@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// h2Response is a response read by h2Get along with any pushed responses
+type h2Response struct {
+	body   string
+	pushes map[string]string
+}
+
+// h2Get makes a GET request using a raw HTTP/2 connection with server push
+// enabled (which net/http clients do not support), returning the response
+// body and the bodies of any pushed responses keyed by path.
+func h2Get(c *C, addr, path string) *h2Response {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	c.Assert(err, IsNil)
+	fr := http2.NewFramer(conn, conn)
+	c.Assert(fr.WriteSettings(), IsNil)
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for _, f := range [][2]string{{":method", "GET"}, {":scheme", "https"}, {":authority", "example.com"}, {":path", path}} {
+		enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	c.Assert(fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}), IsNil)
+
+	dec := hpack.NewDecoder(4096, nil)
+	promised := make(map[uint32]string)
+	bodies := make(map[uint32]*bytes.Buffer)
+	open := map[uint32]bool{1: true}
+	for len(open) > 0 {
+		f, err := fr.ReadFrame()
+		c.Assert(err, IsNil)
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				c.Assert(fr.WriteSettingsAck(), IsNil)
+			}
+		case *http2.PushPromiseFrame:
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			c.Assert(err, IsNil)
+			for _, field := range fields {
+				if field.Name == ":path" {
+					promised[f.PromiseID] = field.Value
+				}
+			}
+			open[f.PromiseID] = true
+		case *http2.HeadersFrame:
+			_, err := dec.DecodeFull(f.HeaderBlockFragment())
+			c.Assert(err, IsNil)
+			if f.StreamEnded() {
+				delete(open, f.StreamID)
+			}
+		case *http2.DataFrame:
+			if bodies[f.StreamID] == nil {
+				bodies[f.StreamID] = &bytes.Buffer{}
+			}
+			bodies[f.StreamID].Write(f.Data())
+			if f.StreamEnded() {
+				delete(open, f.StreamID)
+			}
+		case *http2.RSTStreamFrame:
+			delete(open, f.StreamID)
+		case *http2.GoAwayFrame:
+			c.Fatalf("unexpected GOAWAY: %s", f.ErrCode)
+		}
+	}
+
+	res := &h2Response{pushes: make(map[string]string)}
+	if b, ok := bodies[1]; ok {
+		res.body = b.String()
+	}
+	for id, path := range promised {
+		if b, ok := bodies[id]; ok {
+			res.pushes[path] = b.String()
+		} else {
+			res.pushes[path] = ""
+		}
+	}
+	return res
+}
+
+func (s *S) TestHTTP2Push(c *C) {
+	var cssRequests, jsRequests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html></html>"))
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		case "/app.css":
+			atomic.AddInt64(&cssRequests, 1)
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte("body {}"))
+		case "/app.js":
+			atomic.AddInt64(&jsRequests, 1)
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write([]byte("main()"))
+		}
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{
+			Domain:    "example.com",
+			Service:   "test",
+			PushPaths: []string{"/app.css", "/app.js"},
+		},
+		pushCache: newPushCache(),
+	}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(context.Background(), w, req)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	expected := map[string]string{"/app.css": "body {}", "/app.js": "main()"}
+	res := h2Get(c, addr, "/")
+	c.Assert(res.body, Equals, "<html></html>")
+	c.Assert(res.pushes, DeepEquals, expected)
+	c.Assert(atomic.LoadInt64(&cssRequests), Equals, int64(1))
+	c.Assert(atomic.LoadInt64(&jsRequests), Equals, int64(1))
+
+	// the CSS should be served from the cache, but the JS is not cacheable
+	res = h2Get(c, addr, "/")
+	c.Assert(res.pushes, DeepEquals, expected)
+	c.Assert(atomic.LoadInt64(&cssRequests), Equals, int64(1))
+	c.Assert(atomic.LoadInt64(&jsRequests), Equals, int64(2))
+
+	// non-HTML responses don't trigger pushes
+	res = h2Get(c, addr, "/data.json")
+	c.Assert(res.body, Equals, "{}")
+	c.Assert(res.pushes, HasLen, 0)
+
+	// the cache should be invalidated once the max-age has passed
+	r.pushCache.entries["/app.css"].expires = time.Now().Add(-time.Second)
+	h2Get(c, addr, "/")
+	c.Assert(atomic.LoadInt64(&cssRequests), Equals, int64(2))
+
+	// responses whose status is recorded (e.g. for sampling) still push
+	r.reservoir = newRequestReservoir(5)
+	res = h2Get(c, addr, "/")
+	c.Assert(res.pushes, DeepEquals, expected)
+}
+
+func (s *S) TestPushCacheExpiry(c *C) {
+	for _, t := range []struct {
+		header    http.Header
+		cacheable bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{http.Header{"Cache-Control": {"public, MAX-AGE=60"}}, true},
+		{http.Header{"Cache-Control": {"max-age=0"}}, false},
+		{http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false},
+	} {
+		expires, ok := pushCacheExpiry(t.header)
+		c.Assert(ok, Equals, t.cacheable, Commentf("%v", t.header))
+		if ok {
+			c.Assert(expires.After(time.Now().Add(59*time.Second)), Equals, true)
+		}
+	}
+}
+
+func (s *S) TestPushCacheConditionalRequests(c *C) {
+	lastModified := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/css")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte("body {}"))
+	}))
+	defer backend.Close()
+
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{
+			Domain:    "example.com",
+			Service:   "test",
+			PushPaths: []string{"/app.css"},
+		},
+		pushCache: newPushCache(),
+	}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/app.css", nil)
+		req.Header.Set(pushHeader, r.pushCache.token)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w
+	}
+
+	// without a cached entry the request is proxied
+	w := get("If-None-Match", `"abc"`)
+	c.Assert(w.Code, Equals, 200)
+	c.Assert(w.Body.String(), Equals, "body {}")
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(1))
+
+	for _, t := range []struct {
+		header string
+		value  string
+		status int
+	}{
+		{"If-None-Match", `"abc"`, 304},
+		{"If-None-Match", `W/"abc"`, 304},
+		{"If-None-Match", `"xyz", "abc"`, 304},
+		{"If-None-Match", "*", 304},
+		{"If-None-Match", `"xyz"`, 200},
+		{"If-Modified-Since", lastModified.Format(http.TimeFormat), 304},
+		{"If-Modified-Since", lastModified.Add(time.Hour).Format(http.TimeFormat), 304},
+		{"If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat), 200},
+		{"If-Modified-Since", "invalid", 200},
+		{"", "", 200},
+	} {
+		w := get(t.header, t.value)
+		c.Assert(w.Code, Equals, t.status, Commentf("%s: %s", t.header, t.value))
+		if t.status == 304 {
+			c.Assert(w.Body.Len(), Equals, 0)
+			c.Assert(w.Header().Get("ETag"), Equals, `"abc"`)
+			c.Assert(w.Header().Get("Content-Type"), Equals, "")
+		} else {
+			c.Assert(w.Body.String(), Equals, "body {}")
+		}
+	}
+	// all of the requests were served from the cache
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(1))
+
+	// clients can't read the cache by setting the push header themselves
+	req := httptest.NewRequest("GET", "http://example.com/app.css", nil)
+	req.Header.Set(pushHeader, "1")
+	r.ServeHTTP(context.Background(), httptest.NewRecorder(), req)
+	c.Assert(atomic.LoadInt64(&requests), Equals, int64(2))
+}
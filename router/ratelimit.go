@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultMaxTrackedClients is the number of clients whose rate limits are
+// tracked for routes with PerClientRateLimit set but no MaxTrackedClients
+const defaultMaxTrackedClients = 10000
+
+var clientRateLimitedRequests = metrics.NewCounter(
+	"strowger_client_rate_limited_requests_total",
+	"Number of requests rejected because the client exceeded its route's per-client rate limit.",
+)
+
+// validateClientRateLimit checks that the route's per-client rate limit
+// options are valid.
+func validateClientRateLimit(r *router.Route) error {
+	var msg string
+	switch {
+	case r.PerClientRateLimit && r.ClientRequestsPerSecond <= 0:
+		msg = "client_requests_per_second must be positive"
+	case r.ClientRequestsPerSecond < 0 || r.ClientBurst < 0 || r.MaxTrackedClients < 0:
+		msg = "limits can't be negative"
+	case !r.PerClientRateLimit && (r.ClientRequestsPerSecond > 0 || r.ClientBurst > 0 || r.MaxTrackedClients > 0):
+		msg = "per_client_rate_limit must be set to limit client requests"
+	default:
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Client rate limit invalid: " + msg,
+	}
+}
+
+// clientIP returns the IP address of the client which sent req. This is the
+// address the request was received from, unless that is one of the config's
+// TrustedProxies, in which case it is the right-most address in the
+// X-Forwarded-For header which isn't a trusted proxy, as addresses to the
+// left of it may have been set by the client.
+func (c *ListenerConfig) clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !c.isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header[fwdForHeaderName], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !c.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientBucket is the token bucket of a single client
+type clientBucket struct {
+	ip      string
+	tokens  float64
+	updated time.Time
+}
+
+// clientRateLimiter limits the rate of requests from each client using a
+// token bucket per client IP, keeping the buckets of the most recently seen
+// clients in an LRU list.
+type clientRateLimiter struct {
+	rate  float64
+	burst float64
+	max   int
+
+	mtx     sync.Mutex
+	clients map[string]*list.Element
+	// lru holds the *clientBucket of each client, most recently seen first
+	lru *list.List
+}
+
+func newClientRateLimiter(r *router.HTTPRoute) *clientRateLimiter {
+	l := &clientRateLimiter{
+		rate:    r.ClientRequestsPerSecond,
+		burst:   float64(r.ClientBurst),
+		max:     r.MaxTrackedClients,
+		clients: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if l.burst == 0 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+	if l.max == 0 {
+		l.max = defaultMaxTrackedClients
+	}
+	return l
+}
+
+// allow takes a token from the client's bucket, returning false along with
+// how long until a token is available if it is empty.
+func (l *clientRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var b *clientBucket
+	if e, ok := l.clients[ip]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*clientBucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+	} else {
+		if l.lru.Len() >= l.max {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.clients, oldest.Value.(*clientBucket).ip)
+		}
+		b = &clientBucket{ip: ip, tokens: l.burst, updated: now}
+		l.clients[ip] = l.lru.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// equal returns whether l and other have the same limits.
+func (l *clientRateLimiter) equal(other *clientRateLimiter) bool {
+	return l.rate == other.rate && l.burst == other.burst && l.max == other.max
+}
+
+// checkClientRateLimit responds with a 429 and returns false if the client
+// which sent req has exceeded its rate limit.
+func (r *httpRoute) checkClientRateLimit(w http.ResponseWriter, req *http.Request) bool {
+	ok, wait := r.clientLimiter.allow(r.config().clientIP(req), time.Now())
+	if ok {
+		return true
+	}
+	clientRateLimitedRequests.Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	fail(w, http.StatusTooManyRequests)
+	return false
+}
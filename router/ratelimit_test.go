@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestClientRateLimiter(c *C) {
+	l := newClientRateLimiter(&router.HTTPRoute{ClientRequestsPerSecond: 1, ClientBurst: 2, MaxTrackedClients: 2})
+	now := time.Now()
+
+	// clients can make a burst of requests
+	for i := 0; i < 2; i++ {
+		ok, _ := l.allow("10.0.0.1", now)
+		c.Assert(ok, Equals, true)
+	}
+	ok, wait := l.allow("10.0.0.1", now)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, time.Second)
+
+	// other clients are unaffected
+	ok, _ = l.allow("10.0.0.2", now)
+	c.Assert(ok, Equals, true)
+
+	// the bucket refills at the rate
+	ok, _ = l.allow("10.0.0.1", now.Add(500*time.Millisecond))
+	c.Assert(ok, Equals, false)
+	ok, _ = l.allow("10.0.0.1", now.Add(time.Second))
+	c.Assert(ok, Equals, true)
+	ok, _ = l.allow("10.0.0.1", now.Add(time.Second))
+	c.Assert(ok, Equals, false)
+
+	// the least recently seen client is forgotten when a new one is seen
+	ok, _ = l.allow("10.0.0.3", now.Add(time.Second))
+	c.Assert(ok, Equals, true)
+	c.Assert(l.lru.Len(), Equals, 2)
+	_, ok = l.clients["10.0.0.2"]
+	c.Assert(ok, Equals, false)
+	_, ok = l.clients["10.0.0.1"]
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestPerClientRateLimit(c *C) {
+	backend := httptest.NewServer(httpTestHandler("1"))
+	defer backend.Close()
+
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	c.Assert((&httpSyncHandler{l: l}).Set(&router.Route{
+		Type:                    "http",
+		ID:                      "1",
+		Domain:                  "example.com",
+		Path:                    "/",
+		Service:                 "web",
+		PerClientRateLimit:      true,
+		ClientRequestsPerSecond: 0.1,
+		ClientBurst:             5,
+	}), IsNil)
+	r := l.findRoute("example.com", "/")
+	c.Assert(r, NotNil)
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	get := func(remoteIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w
+	}
+
+	// an abusive client is limited after its burst
+	limited := clientRateLimitedRequests.Value()
+	for i := 0; i < 20; i++ {
+		w := get("10.0.0.1")
+		if i < 5 {
+			c.Assert(w.Code, Equals, 200)
+		} else {
+			c.Assert(w.Code, Equals, http.StatusTooManyRequests)
+			c.Assert(w.Header().Get("Retry-After"), Equals, "10")
+		}
+	}
+	c.Assert(clientRateLimitedRequests.Value()-limited, Equals, uint64(15))
+
+	// other clients are unaffected
+	c.Assert(get("10.0.0.2").Code, Equals, 200)
+}
+
+func (s *S) TestClientIP(c *C) {
+	config := &ListenerConfig{TrustedProxies: []string{"10.0.0.0/8", "192.168.0.1", "fd00::/8"}}
+	l := &HTTPListener{}
+	c.Assert(l.Reload(config), IsNil)
+	config = l.getConfig()
+
+	for _, t := range []struct {
+		remoteAddr   string
+		forwardedFor []string
+		ip           string
+	}{
+		// X-Forwarded-For from untrusted addresses is ignored
+		{"1.2.3.4:1234", nil, "1.2.3.4"},
+		{"1.2.3.4:1234", []string{"5.6.7.8, 1.2.3.4"}, "1.2.3.4"},
+
+		// the right-most untrusted hop is used for trusted proxies, so a
+		// client can't choose the address by prepending to the header
+		{"10.0.0.1:1234", []string{"1.2.3.4, 10.0.0.1"}, "1.2.3.4"},
+		{"10.0.0.1:1234", []string{"5.6.7.8, 1.2.3.4, 192.168.0.1, 10.0.0.1"}, "1.2.3.4"},
+		{"10.0.0.1:1234", []string{"5.6.7.8", "1.2.3.4, 10.0.0.1"}, "1.2.3.4"},
+		{"[fd00::1]:1234", []string{"2001:db8::1, fd00::1"}, "2001:db8::1"},
+		{"192.168.0.1:1234", []string{"192.168.0.2, 192.168.0.1"}, "192.168.0.2"},
+
+		// if every hop is trusted the left-most one is used
+		{"10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.1"}, "10.0.0.2"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = t.remoteAddr
+		req.Header["X-Forwarded-For"] = t.forwardedFor
+		c.Assert(config.clientIP(req), Equals, t.ip, Commentf("%s %v", t.remoteAddr, t.forwardedFor))
+	}
+
+	c.Assert(l.Reload(&ListenerConfig{TrustedProxies: []string{"10.0.0.0/33"}}), NotNil)
+	c.Assert(l.Reload(&ListenerConfig{TrustedProxies: []string{"example.com"}}), NotNil)
+}
+
+func (s *S) TestValidateClientRateLimit(c *C) {
+	c.Assert(validateClientRateLimit(&router.Route{}), IsNil)
+	c.Assert(validateClientRateLimit(&router.Route{PerClientRateLimit: true, ClientRequestsPerSecond: 10}), IsNil)
+	c.Assert(validateClientRateLimit(&router.Route{PerClientRateLimit: true, ClientRequestsPerSecond: 0.5, ClientBurst: 10, MaxTrackedClients: 100}), IsNil)
+	c.Assert(validateClientRateLimit(&router.Route{PerClientRateLimit: true}), NotNil)
+	c.Assert(validateClientRateLimit(&router.Route{PerClientRateLimit: true, ClientRequestsPerSecond: 10, ClientBurst: -1}), NotNil)
+	c.Assert(validateClientRateLimit(&router.Route{ClientRequestsPerSecond: 10}), NotNil)
+}
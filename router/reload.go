@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ListenerConfig is the listener-level config of an HTTPListener which can be
+// changed while it is running using Reload, without restarting the listeners
+// or dropping connections.
+//
+// The remaining config is only read when the listener is started, so changing
+// the listen addresses, the default TLS keypair, the client certificate CAs,
+// PROXY protocol support, the sticky session cookie key or the backup config
+// requires a restart.
+type ListenerConfig struct {
+	// TrustedHeaders are removed from all client requests so that backends
+	// can rely on them only being set by the router
+	TrustedHeaders []string `json:"trusted_headers,omitempty"`
+
+	// TrustedProxies are the IP addresses or CIDR ranges of proxies in front
+	// of the router whose X-Forwarded-For entries are trusted to identify
+	// clients (e.g. for per-client rate limits). Requests from other
+	// addresses are identified by the address they were received from.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// trustedProxyNets are the parsed TrustedProxies, set by Reload
+	trustedProxyNets []*net.IPNet
+
+	// AllowTrace is whether or not to proxy TRACE requests, which are
+	// otherwise rejected to prevent cross-site tracing
+	AllowTrace bool `json:"allow_trace,omitempty"`
+
+	// ForwardClientCertPEM is whether or not to forward verified client
+	// certificates to backends in the X-Client-Cert header
+	ForwardClientCertPEM bool `json:"forward_client_cert_pem,omitempty"`
+
+	// ForwardAbsoluteURIs is whether or not to forward absolute-form request
+	// targets (e.g. "GET http://example.com/ HTTP/1.1") to backends as sent
+	// rather than rewriting them to origin-form (see normalizeRequestURI)
+	ForwardAbsoluteURIs bool `json:"forward_absolute_uris,omitempty"`
+
+	// NormalizePathRedirect redirects requests with dot segments in their
+	// path (e.g. "/a/../b") to the normalized path with a 301 rather than
+	// forwarding them with the normalized path (see normalizeRequestPath).
+	NormalizePathRedirect bool `json:"normalize_path_redirect,omitempty"`
+
+	// MaxRequestHeaders is the maximum number of header fields in client
+	// requests, which are rejected with a 431 if exceeded. Zero means no
+	// limit beyond the total header size enforced by net/http.
+	MaxRequestHeaders int `json:"max_request_headers,omitempty"`
+
+	// MaxURIBytes is the maximum length of request URIs, with longer ones
+	// rejected with a 414, defaulting to defaultMaxURIBytes.
+	MaxURIBytes int `json:"max_uri_bytes,omitempty"`
+
+	// MaxHops is the number of routers a request may have passed through
+	// according to its X-Strowger-Hops header, with requests which have
+	// already reached it assumed to be in a routing loop and rejected with a
+	// 508. Zero disables loop detection.
+	MaxHops int `json:"max_hops,omitempty"`
+
+	// MaxResponseHeaders is the maximum number of header fields in backend
+	// responses, which are treated as failed requests if exceeded. Zero
+	// means no limit.
+	MaxResponseHeaders int `json:"max_response_headers,omitempty"`
+
+	// MaxBufferedRequestBytes is the maximum size of request bodies which are
+	// buffered for routes with BufferFullRequestBody set, defaulting to
+	// defaultMaxBufferedRequestBytes.
+	MaxBufferedRequestBytes int64 `json:"max_buffered_request_bytes,omitempty"`
+
+	// IdempotencyHeader is the name of a request header (e.g.
+	// "Idempotency-Key") which clients set to mark requests as safe to
+	// retry, so that requests with it set are retried with another backend
+	// if they fail after being sent, regardless of their method. Requests
+	// with a body are only retried if it was buffered (see
+	// BufferFullRequestBody). Empty disables retries.
+	IdempotencyHeader string `json:"idempotency_header,omitempty"`
+
+	// BackendTimeoutMS bounds the time in milliseconds from a request being
+	// sent to a backend until its response has been read, after which the
+	// backend connection is aborted and, if nothing has been sent to the
+	// client yet, a 504 is returned. Routes may override it with their own
+	// BackendTimeoutMS. Zero means no limit.
+	BackendTimeoutMS int `json:"backend_timeout_ms,omitempty"`
+
+	// EmptyServiceWaitMS is how long in milliseconds requests to a route
+	// whose service has no instances wait for one to come up before failing
+	// with a 503, so that requests which arrive while a new service is
+	// registering don't fail. Zero fails them immediately.
+	EmptyServiceWaitMS int `json:"empty_service_wait_ms,omitempty"`
+
+	// RequestStartHeader is the name of the header set on requests to the
+	// time they were received, for APM agents to measure queueing time,
+	// defaulting to X-Request-Start.
+	RequestStartHeader string `json:"request_start_header,omitempty"`
+
+	// RequestStartFormat is the format of the request start header, one of
+	// "ms" (milliseconds since the Unix epoch, the default), "us"
+	// (microseconds), or "t=ms" or "t=us" to prefix them with "t=".
+	RequestStartFormat string `json:"request_start_format,omitempty"`
+
+	// TraceFormat enables propagating distributed tracing context to
+	// backends in the given format, either "w3c" (traceparent and
+	// tracestate) or "b3", continuing the trace sent by the client or
+	// starting a new one. Empty disables it.
+	TraceFormat string `json:"trace_format,omitempty"`
+
+	// TraceSpans logs a span for each request's hop through the router when
+	// TraceFormat is set.
+	TraceSpans bool `json:"trace_spans,omitempty"`
+
+	// HealthCheck, if set, configures health check requests (e.g. from
+	// load balancers) which the router answers itself rather than routing.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+
+	// UnknownSNI is what is done with TLS connections whose SNI host name
+	// matches no route, either "drop" (the default) to fail the handshake,
+	// or "default-cert" to complete it with the listener's default
+	// certificate and answer requests with a 404 (or a 421 for hosts with
+	// routes), which is clearer to misconfigured clients of a shared IP
+	// than a reset connection.
+	UnknownSNI string `json:"unknown_sni,omitempty"`
+
+	// LogLevel is the most verbose level which is logged (one of "debug",
+	// "info", "warn", "error" or "crit"), defaulting to "info". It applies to
+	// the whole process rather than just the listener.
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+// defaultListenerConfig is used by listeners which have not been configured
+var defaultListenerConfig = &ListenerConfig{}
+
+// clone returns a deep copy of the config, which shares no slices or
+// pointers with it.
+func (c *ListenerConfig) clone() *ListenerConfig {
+	config := *c
+	config.TrustedHeaders = append([]string(nil), c.TrustedHeaders...)
+	config.TrustedProxies = append([]string(nil), c.TrustedProxies...)
+	if c.HealthCheck != nil {
+		healthCheck := *c.HealthCheck
+		config.HealthCheck = &healthCheck
+	}
+	return &config
+}
+
+// parseTrustedProxies parses the given IP addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("router: invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("router: invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy returns whether ip is one of the TrustedProxies.
+func (c *ListenerConfig) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range c.trustedProxyNets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload atomically replaces the listener's config, affecting all requests
+// which are received afterwards. The config is not modified if it is invalid.
+func (s *HTTPListener) Reload(config *ListenerConfig) error {
+	level := log15.LvlInfo
+	if config.LogLevel != "" {
+		var err error
+		level, err = log15.LvlFromString(config.LogLevel)
+		if err != nil {
+			return fmt.Errorf("router: invalid log level %q", config.LogLevel)
+		}
+	}
+
+	if config.MaxRequestHeaders < 0 || config.MaxResponseHeaders < 0 {
+		return errors.New("router: header limits must not be negative")
+	}
+	if config.MaxURIBytes < 0 {
+		return errors.New("router: max URI bytes must not be negative")
+	}
+	if config.MaxHops < 0 {
+		return errors.New("router: max hops must not be negative")
+	}
+	if config.MaxBufferedRequestBytes < 0 {
+		return errors.New("router: max buffered request bytes must not be negative")
+	}
+	if config.BackendTimeoutMS < 0 {
+		return errors.New("router: backend timeout must not be negative")
+	}
+	if config.EmptyServiceWaitMS < 0 {
+		return errors.New("router: empty service wait must not be negative")
+	}
+	if !validRequestStartFormat(config.RequestStartFormat) {
+		return fmt.Errorf("router: invalid request start format %q", config.RequestStartFormat)
+	}
+	if config.HealthCheck != nil {
+		if err := config.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+	if !validTraceFormat(config.TraceFormat) {
+		return fmt.Errorf("router: invalid trace format %q", config.TraceFormat)
+	}
+	if !validUnknownSNI(config.UnknownSNI) {
+		return fmt.Errorf("router: invalid unknown SNI action %q", config.UnknownSNI)
+	}
+	trustedProxyNets, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	// copy the config so that the caller can't modify it while it is in use
+	c := config.clone()
+	c.trustedProxyNets = trustedProxyNets
+
+	s.configMtx.Lock()
+	defer s.configMtx.Unlock()
+	s.config = c
+	logger.SetHandler(log15.LvlFilterHandler(level, log15.StdoutHandler))
+	return nil
+}
+
+func (s *HTTPListener) getConfig() *ListenerConfig {
+	s.configMtx.RLock()
+	defer s.configMtx.RUnlock()
+	if s.config == nil {
+		return defaultListenerConfig
+	}
+	return s.config
+}
+
+// stripTrustedHeaders wraps h in a stripHeadersHandler which removes the
+// trusted headers in the current config, along with the X-Router-Error header
+// which only the router may set.
+func (s *HTTPListener) stripTrustedHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del(routerErrorHeaderName)
+		stripHeadersHandler{Handler: h, Headers: s.getConfig().TrustedHeaders}.ServeHTTP(w, req)
+	})
+}
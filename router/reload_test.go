@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestListenerReload(c *C) {
+	l := &HTTPListener{}
+	var got http.Header
+	handler := l.stripTrustedHeaders(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}))
+	serve := func() {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("X-Real-Ip", "1.2.3.4")
+		req.Header.Set("X-Internal-User", "admin")
+		req.Header.Set("X-Router-Error", "503")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	headers := []string{"X-Real-IP"}
+	c.Assert(l.Reload(&ListenerConfig{TrustedHeaders: headers}), IsNil)
+	serve()
+	c.Assert(got.Get("X-Real-Ip"), Equals, "")
+	c.Assert(got.Get("X-Internal-User"), Equals, "admin")
+	c.Assert(got.Get("X-Router-Error"), Equals, "")
+
+	// the config is copied so modifying it has no effect until reloaded
+	headers[0] = "X-Internal-User"
+	serve()
+	c.Assert(got.Get("X-Real-Ip"), Equals, "")
+
+	// the existing handler uses the reloaded config
+	c.Assert(l.Reload(&ListenerConfig{TrustedHeaders: headers, AllowTrace: true}), IsNil)
+	serve()
+	c.Assert(got.Get("X-Real-Ip"), Equals, "1.2.3.4")
+	c.Assert(got.Get("X-Internal-User"), Equals, "")
+
+	// an invalid config is rejected and leaves the config unchanged
+	c.Assert(l.Reload(&ListenerConfig{LogLevel: "loud"}), NotNil)
+	c.Assert(l.getConfig().AllowTrace, Equals, true)
+	c.Assert(l.Reload(&ListenerConfig{LogLevel: "debug"}), IsNil)
+	c.Assert(l.getConfig().AllowTrace, Equals, false)
+	c.Assert(l.Reload(&ListenerConfig{}), IsNil)
+}
+
+func (s *S) TestLoadListenerConfig(c *C) {
+	base := ListenerConfig{TrustedHeaders: []string{"X-Real-IP"}, LogLevel: "info"}
+
+	config, err := loadListenerConfig(base, "")
+	c.Assert(err, IsNil)
+	c.Assert(*config, DeepEquals, base)
+
+	f, err := ioutil.TempFile("", "router-config")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"allow_trace": true, "log_level": "debug"}`)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	config, err = loadListenerConfig(base, f.Name())
+	c.Assert(err, IsNil)
+	c.Assert(config.TrustedHeaders, DeepEquals, []string{"X-Real-IP"})
+	c.Assert(config.AllowTrace, Equals, true)
+	c.Assert(config.LogLevel, Equals, "debug")
+
+	// config slices from the file don't overwrite the base config's
+	base.TrustedHeaders = make([]string, 1, 2)
+	base.TrustedHeaders[0] = "X-Real-IP"
+	base.HealthCheck = &HealthCheckConfig{Path: "/health"}
+	c.Assert(ioutil.WriteFile(f.Name(), []byte(`{"trusted_headers": ["X-Internal-User"], "health_check": {"path": "/ping"}}`), 0644), IsNil)
+	config, err = loadListenerConfig(base, f.Name())
+	c.Assert(err, IsNil)
+	c.Assert(config.TrustedHeaders, DeepEquals, []string{"X-Internal-User"})
+	c.Assert(config.HealthCheck.Path, Equals, "/ping")
+	c.Assert(base.TrustedHeaders, DeepEquals, []string{"X-Real-IP"})
+	c.Assert(base.HealthCheck.Path, Equals, "/health")
+
+	_, err = loadListenerConfig(base, f.Name()+".missing")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RemoveService removes all the HTTP routes in the data store for the given
+// service, returning the domains of the removed routes. It keeps removing
+// routes after failing to remove one, returning an error listing the
+// routes which couldn't be removed along with the domains which were.
+// Routes which only use the service for an A/B test variant or method
+// route are not removed.
+func (s *HTTPListener) RemoveService(service string) (removed []string, err error) {
+	s.mtx.RLock()
+	closed, readOnly := s.closed, s.ReadOnly
+	s.mtx.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if readOnly {
+		return nil, ErrReadOnly
+	}
+
+	routes, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	// remove routes with longer paths first so that routes which depend on
+	// a domain's root route are removed before it
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Path) > len(routes[j].Path)
+	})
+
+	domains := make(map[string]struct{})
+	var failed []string
+	for _, r := range routes {
+		if r.Service != service {
+			continue
+		}
+		if err := s.RemoveRoute(r.ID); err != nil && err != ErrNotFound {
+			failed = append(failed, fmt.Sprintf("%s (%s%s): %s", r.ID, r.Domain, r.Path, err))
+			continue
+		}
+		domains[r.Domain] = struct{}{}
+	}
+
+	removed = make([]string, 0, len(domains))
+	for domain := range domains {
+		removed = append(removed, domain)
+	}
+	sort.Strings(removed)
+	if len(failed) > 0 {
+		return removed, fmt.Errorf("router: error removing routes of service %s: %s", service, strings.Join(failed, "; "))
+	}
+	return removed, nil
+}
+
+// DomainsForService returns the sorted domains of the routes currently
+// being served which route to the given service, including routes which
+// aren't in the data store (e.g. those loaded from the environment).
+func (s *HTTPListener) DomainsForService(service string) []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	seen := make(map[string]struct{})
+	domains := make([]string, 0)
+	for _, r := range s.routes {
+		if r.Service != service {
+			continue
+		}
+		if _, ok := seen[r.Domain]; ok {
+			continue
+		}
+		seen[r.Domain] = struct{}{}
+		domains = append(domains, r.Domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
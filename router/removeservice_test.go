@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// failingRemoveDataStore fails to remove the route with the given ID
+type failingRemoveDataStore struct {
+	*memDataStore
+	failID string
+}
+
+func (d *failingRemoveDataStore) Remove(id string) error {
+	if id == d.failID {
+		return errors.New("remove failed")
+	}
+	return d.memDataStore.Remove(id)
+}
+
+func (s *S) TestRemoveService(c *C) {
+	ds := &failingRemoveDataStore{memDataStore: newMemDataStore("http")}
+	l := startFakeHTTPListener(c, ds, newMemDiscoverd())
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{Domain: "a.example.com", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "a.example.com", Path: "/api/", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "b.example.com", Service: "test"}.ToRoute())
+	failing := addRoute(c, l, router.HTTPRoute{Domain: "c.example.com", Service: "test"}.ToRoute())
+	other := addRoute(c, l, router.HTTPRoute{Domain: "other.example.com", Service: "other"}.ToRoute())
+	ds.failID = failing.ID
+
+	// routes are removed despite failing to remove others
+	removed, err := l.RemoveService("test")
+	c.Assert(removed, DeepEquals, []string{"a.example.com", "b.example.com"})
+	c.Assert(err, ErrorMatches, `router: error removing routes of service test: `+failing.ID+` \(c.example.com/\): remove failed`)
+	routes, err := l.List()
+	c.Assert(err, IsNil)
+	ids := make(map[string]struct{}, len(routes))
+	for _, r := range routes {
+		ids[r.ID] = struct{}{}
+	}
+	c.Assert(ids, DeepEquals, map[string]struct{}{failing.ID: {}, other.ID: {}})
+
+	// the remaining route is removed using the API
+	ds.failID = ""
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	req, err := http.NewRequest("DELETE", srv.URL+"/services/test/routes", nil)
+	c.Assert(err, IsNil)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	var result router.RemovedService
+	c.Assert(json.NewDecoder(res.Body).Decode(&result), IsNil)
+	c.Assert(result, DeepEquals, router.RemovedService{Service: "test", Domains: []string{"c.example.com"}})
+
+	// removing a service without routes removes nothing
+	removed, err = l.RemoveService("test")
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+}
+
+func (s *S) TestDomainsForService(c *C) {
+	l, _, _ := newFakeHTTPListener(c)
+	defer l.Close()
+	c.Assert(l.DomainsForService("test"), DeepEquals, []string{})
+
+	addRoute(c, l, router.HTTPRoute{Domain: "b.example.com", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "b.example.com", Path: "/api/", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "a.example.com", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "other.example.com", Service: "other"}.ToRoute())
+	c.Assert(l.DomainsForService("test"), DeepEquals, []string{"a.example.com", "b.example.com"})
+
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/services/other/domains")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	var domains []string
+	c.Assert(json.NewDecoder(res.Body).Decode(&domains), IsNil)
+	c.Assert(domains, DeepEquals, []string{"other.example.com"})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRequestStartHeader is the header set to the time requests were
+// received if the listener config has no RequestStartHeader
+const defaultRequestStartHeader = "X-Request-Start"
+
+// Formats of the request start header, the "t=" formats being those
+// expected by Heroku style APM agents
+const (
+	requestStartMillis         = "ms"
+	requestStartMicros         = "us"
+	requestStartPrefixedMillis = "t=ms"
+	requestStartPrefixedMicros = "t=us"
+	defaultRequestStartFormat  = requestStartMillis
+)
+
+func validRequestStartFormat(format string) bool {
+	switch format {
+	case "", requestStartMillis, requestStartMicros, requestStartPrefixedMillis, requestStartPrefixedMicros:
+		return true
+	default:
+		return false
+	}
+}
+
+// formatRequestStart formats the time a request was received as the value
+// of the request start header.
+func formatRequestStart(start time.Time, format string) string {
+	switch format {
+	case requestStartMicros:
+		return strconv.FormatInt(start.UnixNano()/int64(time.Microsecond), 10)
+	case requestStartPrefixedMillis:
+		return "t=" + strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	case requestStartPrefixedMicros:
+		return "t=" + strconv.FormatInt(start.UnixNano()/int64(time.Microsecond), 10)
+	default:
+		return strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	}
+}
+
+// setRequestStart sets the request start header of req to the time it was
+// received, using the header name and format of the listener config.
+func (r *httpRoute) setRequestStart(req *http.Request, start time.Time) {
+	name, format := defaultRequestStartHeader, defaultRequestStartFormat
+	if r.config != nil {
+		config := r.config()
+		if config.RequestStartHeader != "" {
+			name = config.RequestStartHeader
+		}
+		if config.RequestStartFormat != "" {
+			format = config.RequestStartFormat
+		}
+	}
+	req.Header.Set(name, formatRequestStart(start, format))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestRequestStartHeader(c *C) {
+	start := time.Unix(1500000000, 123456789)
+	for _, t := range []struct {
+		format   string
+		expected string
+	}{
+		{"", "1500000000123"},
+		{"ms", "1500000000123"},
+		{"us", "1500000000123456"},
+		{"t=ms", "t=1500000000123"},
+		{"t=us", "t=1500000000123456"},
+	} {
+		c.Assert(formatRequestStart(start, t.format), Equals, t.expected)
+	}
+
+	l := &HTTPListener{}
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{}, config: l.getConfig}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.setRequestStart(req, start)
+	c.Assert(req.Header.Get("X-Request-Start"), Equals, "1500000000123")
+
+	c.Assert(l.Reload(&ListenerConfig{RequestStartHeader: "X-Queue-Start", RequestStartFormat: "t=us"}), IsNil)
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	r.setRequestStart(req, start)
+	c.Assert(req.Header.Get("X-Queue-Start"), Equals, "t=1500000000123456")
+	c.Assert(req.Header.Get("X-Request-Start"), Equals, "")
+
+	c.Assert(l.Reload(&ListenerConfig{RequestStartFormat: "seconds"}), NotNil)
+}
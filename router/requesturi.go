@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// normalizeRequestURI rewrites a request with an absolute-form request target
+// (e.g. "GET http://example.com/foo?bar HTTP/1.1", as sent by clients which
+// expect to be talking to a proxy) to origin-form ("/foo?bar") so that it is
+// forwarded to backends as if it had been sent to them directly. The Host is
+// taken from the request target if the request has none.
+func normalizeRequestURI(req *http.Request) {
+	if !req.URL.IsAbs() {
+		return
+	}
+	// use the raw request target rather than req.URL so that the path is
+	// forwarded exactly as sent
+	uri := req.RequestURI
+	if i := strings.Index(uri, "://"); i >= 0 {
+		uri = uri[i+len("://"):]
+	}
+	if i := strings.IndexAny(uri, "/?"); i >= 0 {
+		uri = uri[i:]
+	} else {
+		uri = ""
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	req.RequestURI = uri
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.URL.User = nil
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+}
+
+// normalizeRequestPath canonicalizes the path of an origin-form request
+// target before it is routed and forwarded to a backend, so that clients
+// can't use path traversal sequences (e.g. "/public/../admin") or needless
+// percent-encoding (e.g. "/%61dmin") to reach backends or paths other than
+// the ones the path would be routed to. Percent-encoded unreserved
+// characters are decoded, other encodings are kept (with upper case hex
+// digits) so that e.g. "%2F" isn't treated as a separator, and dot segments
+// are then removed as in RFC 3986 section 5.2.4. Unlike path.Clean, empty
+// segments (e.g. "//") are kept as some backends depend on them.
+//
+// It returns whether removing dot segments changed the path, in which case
+// the listener may redirect the client to the normalized path rather than
+// forwarding the request (see ListenerConfig.NormalizePathRedirect).
+func normalizeRequestPath(req *http.Request) bool {
+	if !strings.HasPrefix(req.RequestURI, "/") {
+		return false
+	}
+	escaped, query := req.RequestURI, ""
+	if i := strings.IndexByte(escaped, '?'); i >= 0 {
+		escaped, query = escaped[:i], escaped[i:]
+	}
+	escaped = canonicalPercentEncoding(escaped)
+	cleaned := removeDotSegments(escaped)
+	unescaped, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return false
+	}
+	req.URL.Path = unescaped
+	req.URL.RawPath = cleaned
+	req.RequestURI = cleaned + query
+	return cleaned != escaped
+}
+
+// redirectLocation returns the Location to redirect a request to its
+// normalized request URI with. Leading slashes (and backslashes, which
+// browsers treat as slashes) are collapsed into one, as removing dot
+// segments can leave a path like "//evil.com" (e.g. from "/..//evil.com")
+// which would otherwise redirect to another host.
+func redirectLocation(uri string) string {
+	return "/" + strings.TrimLeft(uri, `/\`)
+}
+
+// canonicalPercentEncoding decodes the percent-encoded unreserved characters
+// (letters, digits, "-", ".", "_" and "~") of an escaped path, which are
+// equivalent to their decoded form, and upper cases the hex digits of the
+// remaining encodings. Invalid encodings are left as they are.
+func canonicalPercentEncoding(escaped string) string {
+	if !strings.Contains(escaped, "%") {
+		return escaped
+	}
+	var buf strings.Builder
+	buf.Grow(len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != '%' || i+2 >= len(escaped) || !isHex(escaped[i+1]) || !isHex(escaped[i+2]) {
+			buf.WriteByte(escaped[i])
+			continue
+		}
+		b := unhex(escaped[i+1])<<4 | unhex(escaped[i+2])
+		if isUnreserved(b) {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteString(strings.ToUpper(escaped[i : i+3]))
+		}
+		i += 2
+	}
+	return buf.String()
+}
+
+// removeDotSegments resolves the "." and ".." segments of an absolute path,
+// keeping a trailing slash if the last segment was one of them.
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	segments := strings.Split(p[1:], "/")
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+			continue
+		}
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func isUnreserved(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		b == '-' || b == '.' || b == '_' || b == '~'
+}
+
+func isHex(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+func unhex(b byte) byte {
+	switch {
+	case '0' <= b && b <= '9':
+		return b - '0'
+	case 'a' <= b && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
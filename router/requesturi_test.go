@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+type backendRequest struct {
+	uri  string
+	host string
+}
+
+// newRequestURITestListener returns a listener with a route for example.com
+// and a function which parses a raw request as the HTTP server would, serves
+// it, and returns the response and the request received by the backend (if
+// any), along with a function to stop the backend.
+func newRequestURITestListener(c *C, config *ListenerConfig) (func(raw string) (*httptest.ResponseRecorder, *backendRequest), func()) {
+	requests := make(chan backendRequest, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- backendRequest{uri: req.RequestURI, host: req.Host}
+	}))
+
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+		config:    config,
+	}
+	c.Assert((&httpSyncHandler{l: l}).Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web"}), IsNil)
+	r := l.findRoute("example.com", "/")
+	c.Assert(r, NotNil)
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+
+	serve := func(raw string) (*httptest.ResponseRecorder, *backendRequest) {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		c.Assert(err, IsNil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, req)
+		select {
+		case r := <-requests:
+			return w, &r
+		default:
+			return w, nil
+		}
+	}
+	return serve, backend.Close
+}
+
+func (s *S) TestAbsoluteRequestURI(c *C) {
+	var config ListenerConfig
+	serve, stop := newRequestURITestListener(c, &config)
+	defer stop()
+
+	// send proxies the raw request, returning the request the backend gets
+	send := func(raw string) backendRequest {
+		w, req := serve(raw)
+		c.Assert(w.Code, Equals, 200)
+		c.Assert(req, NotNil)
+		return *req
+	}
+
+	for _, t := range []struct {
+		raw  string
+		uri  string
+		host string
+	}{
+		{
+			raw:  "GET /foo?bar=baz HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			uri:  "/foo?bar=baz",
+			host: "example.com",
+		},
+		{
+			raw:  "GET http://example.com/foo?bar=baz HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			uri:  "/foo?bar=baz",
+			host: "example.com",
+		},
+		{
+			raw:  "GET http://example.com/foo%2Fbar//baz HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			uri:  "/foo%2Fbar//baz",
+			host: "example.com",
+		},
+		{
+			raw:  "GET http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			uri:  "/",
+			host: "example.com",
+		},
+		{
+			raw:  "GET http://example.com?foo HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			uri:  "/?foo",
+			host: "example.com",
+		},
+		{
+			// the Host is derived from the request target if missing
+			raw:  "GET http://example.com/foo HTTP/1.0\r\n\r\n",
+			uri:  "/foo",
+			host: "example.com",
+		},
+	} {
+		req := send(t.raw)
+		c.Assert(req.uri, Equals, t.uri, Commentf("request: %q", t.raw))
+		c.Assert(req.host, Equals, t.host, Commentf("request: %q", t.raw))
+	}
+
+	// absolute URIs are forwarded as sent if configured
+	config.ForwardAbsoluteURIs = true
+	req := send("GET http://example.com/foo HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	c.Assert(req.uri, Equals, "http://example.com/foo")
+}
+
+func (s *S) TestNormalizeRequestPath(c *C) {
+	var config ListenerConfig
+	serve, stop := newRequestURITestListener(c, &config)
+	defer stop()
+
+	for _, t := range []struct {
+		path     string
+		expected string
+	}{
+		// traversal sequences are resolved
+		{"/../secret", "/secret"},
+		{"/./normal/../secret", "/secret"},
+		{"/a/b/../../../secret", "/secret"},
+		{"/a/./b/./c", "/a/b/c"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/a/..", "/"},
+		{"/..", "/"},
+		{"/a//../b", "/a/b"},
+		{"/a/..b/c.", "/a/..b/c."},
+		{"/a/.../b", "/a/.../b"},
+		{"/a/b/../c?x=/../y", "/a/c?x=/../y"},
+		// encoded dots are equivalent to unencoded ones
+		{"/a/%2e%2E/secret", "/secret"},
+		{"/a/%2e/b", "/a/b"},
+		// unreserved characters are decoded, other encodings are kept
+		// with upper case hex digits
+		{"/%41%7a%30%2D%5F%7E", "/Az0-_~"},
+		{"/a%2fb", "/a%2Fb"},
+		{"/a%2F..%2Fb", "/a%2F..%2Fb"},
+		{"/a%20b%3f", "/a%20b%3F"},
+		{"/a/%25%32%65", "/a/%252e"},
+		// empty segments are kept
+		{"//foo/bar", "//foo/bar"},
+		{"/foo//bar/", "/foo//bar/"},
+		{"/", "/"},
+	} {
+		w, req := serve("GET " + t.path + " HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		c.Assert(w.Code, Equals, 200, Commentf("path: %q", t.path))
+		c.Assert(req.uri, Equals, t.expected, Commentf("path: %q", t.path))
+	}
+
+	// requests with dot segments are redirected if configured, while other
+	// normalization is still done silently
+	config.NormalizePathRedirect = true
+	w, req := serve("GET /a/./b/../c?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	c.Assert(req, IsNil)
+	c.Assert(w.Code, Equals, http.StatusMovedPermanently)
+	c.Assert(w.Header().Get("Location"), Equals, "/a/c?q=1")
+	for _, t := range []struct {
+		path     string
+		location string
+	}{
+		{"/..//evil.com", "/evil.com"},
+		{"/.//evil.com/x", "/evil.com/x"},
+		{"/a/..//evil.com", "/evil.com"},
+		{"/a/../\\evil.com", "/evil.com"},
+	} {
+		w, req = serve("GET " + t.path + " HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		c.Assert(req, IsNil, Commentf("path: %q", t.path))
+		c.Assert(w.Code, Equals, http.StatusMovedPermanently, Commentf("path: %q", t.path))
+		c.Assert(w.Header().Get("Location"), Equals, t.location, Commentf("path: %q", t.path))
+	}
+	w, req = serve("GET /%61 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	c.Assert(w.Code, Equals, 200)
+	c.Assert(req.uri, Equals, "/a")
+}
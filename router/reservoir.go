@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// maxReservoirSampleSize is the maximum number of requests a route's
+// reservoir may hold
+const maxReservoirSampleSize = 10000
+
+// requestSampleInterval is how often the request reservoirs are written to
+// RequestSamplePath
+var requestSampleInterval = time.Hour
+
+// validateReservoirSampleSize checks that the route's reservoir sample size
+// is valid.
+func validateReservoirSampleSize(r *router.Route) error {
+	if r.ReservoirSampleSize >= 0 && r.ReservoirSampleSize <= maxReservoirSampleSize {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: fmt.Sprintf("Reservoir sample size invalid: reservoir_sample_size must be between 0 and %d", maxReservoirSampleSize),
+	}
+}
+
+// requestSample is a request to a route kept in its reservoir
+type requestSample struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id,omitempty"`
+	Method    string        `json:"method"`
+	Host      string        `json:"host"`
+	Path      string        `json:"path"`
+	Status    int           `json:"status"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// requestReservoir is a uniform random sample of the requests to a route
+// maintained using Vitter's Algorithm R, so that routes are sampled
+// representatively however few requests they get.
+type requestReservoir struct {
+	size int
+
+	mtx sync.Mutex
+	// seen is the number of requests the sample was taken from
+	seen    int64
+	samples []*requestSample
+}
+
+// requestReservoirState is the state of a reservoir which is persisted so
+// that sampling continues where it left off after a restart
+type requestReservoirState struct {
+	Seen    int64            `json:"seen"`
+	Samples []*requestSample `json:"samples"`
+}
+
+func newRequestReservoir(size int) *requestReservoir {
+	return &requestReservoir{size: size, samples: make([]*requestSample, 0, size)}
+}
+
+// add offers a request to the reservoir, returning whether it was kept. The
+// first size requests are kept, and after that the nth request replaces a
+// random sample with probability size/n.
+func (r *requestReservoir) add(s *requestSample) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.seen++
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, s)
+		return true
+	}
+	if i := random.Math.Int63n(r.seen); i < int64(r.size) {
+		r.samples[i] = s
+		return true
+	}
+	return false
+}
+
+// equal returns whether r and other sample the same number of requests.
+func (r *requestReservoir) equal(other *requestReservoir) bool {
+	return r.size == other.size
+}
+
+func (r *requestReservoir) state() *requestReservoirState {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return &requestReservoirState{
+		Seen:    r.seen,
+		Samples: append([]*requestSample(nil), r.samples...),
+	}
+}
+
+// restore continues sampling from the given state, dropping samples at
+// random if the reservoir has shrunk.
+func (r *requestReservoir) restore(state *requestReservoirState) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// samples are dropped from a copy as state may still be in use
+	samples := append([]*requestSample(nil), state.Samples...)
+	for len(samples) > r.size {
+		i := random.Math.Intn(len(samples))
+		samples[i] = samples[len(samples)-1]
+		samples = samples[:len(samples)-1]
+	}
+	r.samples = append(r.samples[:0], samples...)
+	r.seen = state.Seen
+	if r.seen < int64(len(r.samples)) {
+		r.seen = int64(len(r.samples))
+	}
+}
+
+// sampleRequest offers a request to the route's reservoir once it has been
+// served, logging it if it is kept.
+func (r *httpRoute) sampleRequest(s *requestSample) {
+	if r.reservoir.add(s) {
+		logger.Info("request", "route.id", r.ID, "request_id", s.RequestID, "method", s.Method, "host", s.Host, "path", s.Path, "status", s.Status, "duration", s.Duration, "sampled", true)
+	}
+}
+
+// runRequestSamples periodically writes the state of the routes' request
+// reservoirs to RequestSamplePath, so that they are restored if the router
+// restarts (see loadRequestSamples). They are also written when the listener
+// is closed.
+func (s *HTTPListener) runRequestSamples(ctx context.Context) {
+	ticker := time.NewTicker(requestSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.writeRequestSamples(); err != nil {
+			logger.Error("error writing request samples", "path", s.RequestSamplePath, "err", err)
+		}
+	}
+}
+
+// writeRequestSamples atomically replaces the request reservoirs at
+// RequestSamplePath, keyed by route ID.
+func (s *HTTPListener) writeRequestSamples() error {
+	s.mtx.RLock()
+	states := s.requestSampleStates()
+	s.mtx.RUnlock()
+	return s.writeRequestSampleStates(states)
+}
+
+// requestSampleStates returns the states of the routes' request reservoirs,
+// keyed by route ID. The caller must hold s.mtx.
+func (s *HTTPListener) requestSampleStates() map[string]*requestReservoirState {
+	states := make(map[string]*requestReservoirState)
+	for id, r := range s.routes {
+		if r.reservoir != nil {
+			states[id] = r.reservoir.state()
+		}
+	}
+	return states
+}
+
+func (s *HTTPListener) writeRequestSampleStates(states map[string]*requestReservoirState) error {
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.RequestSamplePath, data)
+}
+
+// closeRequestSamples writes the request reservoirs to RequestSamplePath, if
+// set, as the listener is closed. The caller must hold s.mtx.
+func (s *HTTPListener) closeRequestSamples() {
+	if s.RequestSamplePath == "" {
+		return
+	}
+	if err := s.writeRequestSampleStates(s.requestSampleStates()); err != nil {
+		logger.Error("error writing request samples", "path", s.RequestSamplePath, "err", err)
+	}
+}
+
+// loadRequestSamples reads the request reservoirs at RequestSamplePath, which
+// are restored as their routes are set.
+func (s *HTTPListener) loadRequestSamples() error {
+	data, err := ioutil.ReadFile(s.RequestSamplePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	states := make(map[string]*requestReservoirState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		return fmt.Errorf("router: error decoding request samples %s: %s", s.RequestSamplePath, err)
+	}
+	s.mtx.Lock()
+	s.savedReservoirs = states
+	s.mtx.Unlock()
+	return nil
+}
+
+// setReservoir sets the request reservoir of a route, restoring its saved
+// state if it has one. The caller must hold s.mtx.
+func (s *HTTPListener) setReservoir(r *httpRoute) {
+	r.reservoir = newRequestReservoir(r.ReservoirSampleSize)
+	if state, ok := s.savedReservoirs[r.ID]; ok {
+		r.reservoir.restore(state)
+		delete(s.savedReservoirs, r.ID)
+	}
+}
+
+// requestSampleFor returns a sample of req, whose response is yet to be
+// recorded.
+func requestSampleFor(req *http.Request, start time.Time) *requestSample {
+	return &requestSample{
+		Time:   start,
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   req.URL.Path,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestRequestReservoir(c *C) {
+	const size, requests, trials = 100, 10000, 100
+
+	// each request is equally likely to be in the reservoir, so the
+	// samples of each tenth of the requests are about a tenth of the total
+	var buckets [10]int
+	var kept int
+	for t := 0; t < trials; t++ {
+		r := newRequestReservoir(size)
+		for i := 0; i < requests; i++ {
+			if r.add(&requestSample{Status: i}) {
+				kept++
+			}
+		}
+		state := r.state()
+		c.Assert(state.Seen, Equals, int64(requests))
+		c.Assert(state.Samples, HasLen, size)
+		seen := make(map[int]struct{}, size)
+		for _, s := range state.Samples {
+			_, dup := seen[s.Status]
+			c.Assert(dup, Equals, false)
+			seen[s.Status] = struct{}{}
+			buckets[s.Status*len(buckets)/requests]++
+		}
+	}
+	expected := float64(size * trials / len(buckets))
+	for i, n := range buckets {
+		// the standard deviation of each bucket is about 30
+		c.Assert(math.Abs(float64(n)-expected) < 200, Equals, true, Commentf("bucket %d has %d samples", i, n))
+	}
+
+	// the nth request is kept with probability size/n, so about
+	// size*(1+ln(requests/size)) requests are logged rather than a
+	// proportion of them
+	keptPerTrial := float64(kept) / trials
+	expectedKept := size * (1 + math.Log(requests/size))
+	c.Assert(math.Abs(keptPerTrial-expectedKept) < 50, Equals, true, Commentf("kept %f requests per trial", keptPerTrial))
+}
+
+func (s *S) TestRequestReservoirPersisted(c *C) {
+	dir, err := ioutil.TempDir("", "router-request-samples")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "samples.json")
+
+	ds := newMemDataStore("http")
+	d := newMemDiscoverd()
+	withSamplePath := func(l *HTTPListener) { l.RequestSamplePath = path }
+	l := startFakeHTTPListener(c, ds, d, withSamplePath)
+	route := &router.Route{
+		Type:                "http",
+		Domain:              "example.com",
+		Path:                "/",
+		Service:             "web",
+		ReservoirSampleSize: 5,
+	}
+	r, stop := addFakeRoute(c, l, d, route, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("POST", "http://example.com/items/"+strconv.Itoa(i), nil)
+		r.ServeHTTP(context.Background(), newCloseNotifyRecorder(), req)
+	}
+	state := r.reservoir.state()
+	c.Assert(state.Seen, Equals, int64(20))
+	c.Assert(state.Samples, HasLen, 5)
+	for _, s := range state.Samples {
+		c.Assert(s.Method, Equals, "POST")
+		c.Assert(s.Host, Equals, "example.com")
+		c.Assert(s.Path, Matches, "/items/[0-9]+")
+		c.Assert(s.Status, Equals, http.StatusCreated)
+		c.Assert(s.RequestID, Not(Equals), "")
+	}
+	stop()
+
+	// the reservoir is written when the listener is closed, and restored
+	// when the route is synced after a restart
+	c.Assert(l.Close(), IsNil)
+	l = startFakeHTTPListener(c, ds, d, withSamplePath)
+	defer l.Close()
+	restored := l.findRoute("example.com", "/").reservoir.state()
+	c.Assert(restored.Seen, Equals, state.Seen)
+	c.Assert(restored.Samples, HasLen, len(state.Samples))
+	for i, s := range restored.Samples {
+		c.Assert(s.Path, Equals, state.Samples[i].Path)
+		c.Assert(s.Time.Equal(state.Samples[i].Time), Equals, true)
+	}
+
+	// samples are dropped if the reservoir has shrunk, leaving the state
+	// restored from as it was
+	samples := append([]*requestSample(nil), state.Samples...)
+	res := newRequestReservoir(2)
+	res.restore(state)
+	c.Assert(res.state().Samples, HasLen, 2)
+	c.Assert(res.state().Seen, Equals, state.Seen)
+	c.Assert(state.Samples, DeepEquals, samples)
+
+	c.Assert(validateReservoirSampleSize(&router.Route{ReservoirSampleSize: -1}), NotNil)
+	c.Assert(validateReservoirSampleSize(&router.Route{ReservoirSampleSize: maxReservoirSampleSize + 1}), NotNil)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// retryBudgetWindow is the time constant of the decaying request and retry
+// counts of retry budgets, so that a request counts for about a third as
+// much after a window has passed
+var retryBudgetWindow = 10 * time.Second
+
+// validateRetryBudget checks that the route's retry budget is valid.
+func validateRetryBudget(budget *router.RetryBudgetConfig) error {
+	if budget == nil {
+		return nil
+	}
+	var msg string
+	if budget.BudgetPercent <= 0 || budget.BudgetPercent > 100 {
+		msg = fmt.Sprintf("budget_percent %v must be greater than 0 and at most 100", budget.BudgetPercent)
+	} else if budget.MinimumRetries < 0 {
+		msg = "minimum_retries can't be negative"
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Retry budget invalid: " + msg,
+	}
+}
+
+func retryBudgetColumns(budget *router.RetryBudgetConfig) router.RetryBudgetConfig {
+	if budget == nil {
+		return router.RetryBudgetConfig{}
+	}
+	return *budget
+}
+
+func retryBudgetFromColumns(budget router.RetryBudgetConfig) *router.RetryBudgetConfig {
+	if budget.BudgetPercent == 0 {
+		return nil
+	}
+	return &budget
+}
+
+// decayCounter is a count which decays exponentially over time, weighting
+// recent events more heavily than a fixed window would without having to
+// store them.
+type decayCounter struct {
+	value   float64
+	updated time.Time
+}
+
+// get returns the value of the counter at now.
+func (c *decayCounter) get(now time.Time) float64 {
+	if c.updated.IsZero() {
+		return 0
+	}
+	return c.value * math.Exp(-float64(now.Sub(c.updated))/float64(retryBudgetWindow))
+}
+
+// inc increments the counter at now.
+func (c *decayCounter) inc(now time.Time) {
+	c.value = c.get(now) + 1
+	c.updated = now
+}
+
+// retryBudget is a proxy.RetryBudget which allows a route's requests to be
+// retried while the recent retries are within a percentage of the recent
+// requests, or there have been no more than a minimum number of them.
+type retryBudget struct {
+	ratio      float64
+	minRetries float64
+
+	// now is the time retries and requests are recorded at, it is
+	// overridden by tests
+	now func() time.Time
+
+	mtx      sync.Mutex
+	requests decayCounter
+	retries  decayCounter
+}
+
+func newRetryBudget(config *router.RetryBudgetConfig) *retryBudget {
+	return &retryBudget{
+		ratio:      config.BudgetPercent / 100,
+		minRetries: float64(config.MinimumRetries),
+		now:        time.Now,
+	}
+}
+
+// equal returns whether b and other have the same config, so that the
+// counts of a route's budget can be kept when it is updated.
+func (b *retryBudget) equal(other *retryBudget) bool {
+	return b.ratio == other.ratio && b.minRetries == other.minRetries
+}
+
+func (b *retryBudget) TrackRequest() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.requests.inc(b.now())
+}
+
+func (b *retryBudget) AllowRetry() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	retries := b.retries.get(now)
+	if retries > b.minRetries && retries > b.ratio*b.requests.get(now) {
+		return false
+	}
+	b.retries.inc(now)
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestRetryBudget(c *C) {
+	now := time.Now()
+	budget := newRetryBudget(&router.RetryBudgetConfig{BudgetPercent: 20, MinimumRetries: 10})
+	budget.now = func() time.Time { return now }
+
+	// send 100 requests a second, which succeed for 10 seconds and then
+	// half of them fail, being retried if the budget allows
+	var retries []int
+	for second := 0; second < 20; second++ {
+		var n int
+		for i := 0; i < 100; i++ {
+			now = now.Add(10 * time.Millisecond)
+			budget.TrackRequest()
+			if second >= 10 && i%2 == 0 && budget.AllowRetry() {
+				n++
+			}
+		}
+		if second >= 10 {
+			retries = append(retries, n)
+		}
+	}
+
+	// the failed requests are all retried at first, with fewer being
+	// retried as the budget is used up until 20% of the requests are
+	c.Assert(retries[0], Equals, 50)
+	for i := 1; i < len(retries); i++ {
+		c.Assert(retries[i] <= retries[i-1], Equals, true, Commentf("retries = %v", retries))
+	}
+	c.Assert(retries[len(retries)-1], Equals, 20)
+
+	// the budget recovers once requests stop failing
+	for i := 0; i < 1000; i++ {
+		now = now.Add(10 * time.Millisecond)
+		budget.TrackRequest()
+	}
+	c.Assert(budget.AllowRetry(), Equals, true)
+}
+
+func (s *S) TestRetryBudgetExhausted(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	// requests sent to the unreachable backend first are retried with the
+	// other one while the budget allows
+	unreachable, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	unreachable.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		RetryBudget: &router.RetryBudgetConfig{BudgetPercent: 20},
+	}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+	defer registerFakeBackend(c, l, d, "test", unreachable.Addr().String())()
+
+	codes := make(map[int]int)
+	for i := 0; i < 200; i++ {
+		res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		codes[res.StatusCode]++
+	}
+	c.Assert(codes[http.StatusServiceUnavailable] > 0, Equals, true, Commentf("codes = %v", codes))
+	c.Assert(codes[http.StatusOK] > 100, Equals, true, Commentf("codes = %v", codes))
+	c.Assert(codes[http.StatusOK]+codes[http.StatusServiceUnavailable], Equals, 200)
+}
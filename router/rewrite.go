@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// validatePathRewrite checks that the route's path rewrite prefixes are
+// absolute paths.
+func validatePathRewrite(r *router.Route) error {
+	for _, prefix := range []string{r.StripPathPrefix, r.AddPathPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Path rewrite invalid: prefix must start with a /",
+			}
+		}
+	}
+	return nil
+}
+
+// rewritePath applies the route's StripPathPrefix and AddPathPrefix to the
+// request path. The escaped form of the path is rewritten so that encoded
+// characters reach the backend untouched, and the query string is preserved.
+func (r *httpRoute) rewritePath(req *http.Request) {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if prefix := escapePathPrefix(r.StripPathPrefix); prefix != "" {
+		if path == prefix {
+			path = "/"
+		} else if strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+		}
+	}
+	if prefix := escapePathPrefix(r.AddPathPrefix); prefix != "" {
+		path = prefix + path
+	}
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return
+	}
+	req.URL.Path = unescaped
+	req.URL.RawPath = path
+	req.RequestURI = path
+	if req.URL.RawQuery != "" || req.URL.ForceQuery {
+		req.RequestURI += "?" + req.URL.RawQuery
+	}
+}
+
+// rewriteLocationPaths applies the inverse of the route's path rewrite to
+// the Location and Content-Location headers of responses, so that paths
+// the backend refers to are mapped back to the paths clients use. Only
+// absolute paths which are relative to the backend, the route's domain or
+// one of its RewriteLocationHosts are rewritten.
+func (r *httpRoute) rewriteLocationPaths(res *http.Response) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		location := res.Header.Get(name)
+		if location == "" {
+			continue
+		}
+		if rewritten, ok := r.clientLocation(location, res.Request); ok {
+			res.Header.Set(name, rewritten)
+		}
+	}
+}
+
+// clientLocation returns the client facing form of a URL the backend sent
+// in response to req, returning false if it doesn't need rewriting.
+func (r *httpRoute) clientLocation(location string, req *http.Request) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(u.EscapedPath(), "/") {
+		return "", false
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, req.Host) && !strings.EqualFold(u.Host, req.URL.Host) && !r.rewritesLocationHost(u) {
+		return "", false
+	}
+
+	path := u.EscapedPath()
+	if prefix := escapePathPrefix(r.AddPathPrefix); prefix != "" {
+		if path == prefix {
+			path = "/"
+		} else if strings.HasPrefix(path, prefix+"/") {
+			path = path[len(prefix):]
+		} else {
+			// the path is outside of the part of the backend
+			// which is routed to
+			return "", false
+		}
+	}
+	if prefix := escapePathPrefix(r.StripPathPrefix); prefix != "" {
+		path = prefix + path
+	}
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return "", false
+	}
+	u.Path = unescaped
+	u.RawPath = path
+	return u.String(), true
+}
+
+// escapePathPrefix returns the escaped form of a path prefix without any
+// trailing slash, so "/" and "" are both treated as an empty prefix.
+func escapePathPrefix(prefix string) string {
+	return strings.TrimSuffix((&url.URL{Path: prefix}).EscapedPath(), "/")
+}
+
+// rewriteLocation rewrites absolute Location headers which point at one of
+// the route's RewriteLocationHosts so that they point at the host and scheme
+// the client used to make the request, for backends which are not aware
+// that they are behind a proxy.
+func (r *httpRoute) rewriteLocation(res *http.Response) {
+	location := res.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || !r.rewritesLocationHost(u) {
+		return
+	}
+	u.Host = res.Request.Host
+	if res.Request.TLS != nil {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	res.Header.Set("Location", u.String())
+}
+
+func (r *httpRoute) rewritesLocationHost(u *url.URL) bool {
+	for _, host := range r.RewriteLocationHosts {
+		if host == "*" || strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
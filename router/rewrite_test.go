@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestRewriteLocation(c *C) {
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{
+		RewriteLocationHosts: []string{"internal", "backend.local:8080"},
+	}}
+	for _, t := range []struct {
+		location string
+		tls      bool
+		expected string
+	}{
+		{"", false, ""},
+		{"/foo", false, "/foo"},
+		{"http://internal/foo?bar=baz", false, "http://example.com/foo?bar=baz"},
+		{"http://INTERNAL:5000/foo", true, "https://example.com/foo"},
+		{"http://backend.local:8080/", true, "https://example.com/"},
+		{"http://backend.local:9090/", true, "http://backend.local:9090/"},
+		{"https://other.com/foo", false, "https://other.com/foo"},
+	} {
+		req, _ := http.NewRequest("GET", "http://internal/", nil)
+		req.Host = "example.com"
+		if t.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		res := &http.Response{Header: make(http.Header), Request: req}
+		if t.location != "" {
+			res.Header.Set("Location", t.location)
+		}
+		r.rewriteLocation(res)
+		c.Assert(res.Header.Get("Location"), Equals, t.expected, Commentf("location = %q", t.location))
+	}
+
+	// a wildcard rewrites any host
+	r.RewriteLocationHosts = []string{"*"}
+	req, _ := http.NewRequest("GET", "http://internal/", nil)
+	req.Host = "example.com:8080"
+	res := &http.Response{Header: http.Header{"Location": {"http://10.0.0.1:5000/foo"}}, Request: req}
+	r.rewriteLocation(res)
+	c.Assert(res.Header.Get("Location"), Equals, "http://example.com:8080/foo")
+}
+
+func (s *S) TestRewritePath(c *C) {
+	for _, t := range []struct {
+		strip, add string
+		uri        string
+		expected   string
+	}{
+		{"/api", "", "/api/users", "/users"},
+		{"/api/", "", "/api/users?page=2", "/users?page=2"},
+		{"/api", "", "/api", "/"},
+		{"/api", "", "/api/", "/"},
+		{"/api", "", "/api?", "/?"},
+		{"/api", "", "/apiv2/users", "/apiv2/users"},
+		{"/api", "", "/other", "/other"},
+		{"/api", "", "/api/a%2Fb?q=%20", "/a%2Fb?q=%20"},
+		{"", "/v1", "/users?x=1", "/v1/users?x=1"},
+		{"", "/v1/", "/", "/v1/"},
+		{"/api", "/internal", "/api/users/", "/internal/users/"},
+		{"/", "/", "/users", "/users"},
+	} {
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{StripPathPrefix: t.strip, AddPathPrefix: t.add}}
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader("GET " + t.uri + " HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+		c.Assert(err, IsNil)
+		r.rewritePath(req)
+		comment := Commentf("strip = %q, add = %q, uri = %q", t.strip, t.add, t.uri)
+		c.Assert(req.RequestURI, Equals, t.expected, comment)
+		c.Assert(req.URL.RequestURI(), Equals, t.expected, comment)
+	}
+
+	c.Assert(validatePathRewrite(&router.Route{StripPathPrefix: "/api", AddPathPrefix: "/v1"}), IsNil)
+	c.Assert(validatePathRewrite(&router.Route{StripPathPrefix: "api"}), NotNil)
+	c.Assert(validatePathRewrite(&router.Route{AddPathPrefix: "v1"}), NotNil)
+}
+
+func (s *S) TestRewriteLocationPaths(c *C) {
+	for _, t := range []struct {
+		strip, add string
+		location   string
+		expected   string
+	}{
+		// strip only
+		{"/api", "", "/users/1", "/api/users/1"},
+		{"/api", "", "/", "/api/"},
+		{"/api", "", "http://example.com/login?next=%2F", "http://example.com/api/login?next=%2F"},
+		// prepend only
+		{"", "/v2", "/v2/users/1", "/users/1"},
+		{"", "/v2", "/v2", "/"},
+		{"", "/v2", "/v1/users", "/v1/users"},
+		// strip and prepend
+		{"/api", "/v2", "/v2/users?page=2", "/api/users?page=2"},
+		{"/api", "/v2", "http://10.0.0.1:8080/v2/a%2Fb", "http://10.0.0.1:8080/api/a%2Fb"},
+		{"/api", "/v2", "/other", "/other"},
+		// no-op
+		{"", "", "/users/1", "/users/1"},
+		// only absolute paths on the backend or the route's domain
+		// are rewritten
+		{"/api", "/v2", "https://other.com/v2/users", "https://other.com/v2/users"},
+		{"/api", "/v2", "users", "users"},
+	} {
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{StripPathPrefix: t.strip, AddPathPrefix: t.add}}
+		req, _ := http.NewRequest("GET", "http://10.0.0.1:8080/", nil)
+		req.Host = "example.com"
+		res := &http.Response{
+			Header:  http.Header{"Location": {t.location}, "Content-Location": {t.location}},
+			Request: req,
+		}
+		if t.strip != "" || t.add != "" {
+			r.rewriteLocationPaths(res)
+		}
+		comment := Commentf("strip = %q, add = %q, location = %q", t.strip, t.add, t.location)
+		c.Assert(res.Header.Get("Location"), Equals, t.expected, comment)
+		c.Assert(res.Header.Get("Content-Location"), Equals, t.expected, comment)
+	}
+
+	// requests are rewritten in the opposite direction to their responses
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", req.URL.Path+"/1")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+	for _, t := range []struct {
+		strip, add string
+		path       string
+		location   string
+	}{
+		{"/api", "", "/api/users", "/api/users/1"},
+		{"", "/v2", "/users", "/users/1"},
+		{"/api", "/v2", "/api/users", "/api/users/1"},
+		{"", "", "/users", "/users/1"},
+	} {
+		r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test", StripPathPrefix: t.strip, AddPathPrefix: t.add}}
+		r.rp = proxy.NewReverseProxy(func() []string { return []string{backend.Listener.Addr().String()} }, &[32]byte{}, false, &service{}, logger)
+		r.rp.ModifyResponse = r.modifyResponse
+		w := newCloseNotifyRecorder()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("POST", "http://example.com"+t.path, nil))
+		c.Assert(w.Code, Equals, http.StatusCreated)
+		c.Assert(w.Header().Get("Location"), Equals, t.location, Commentf("strip = %q, add = %q", t.strip, t.add))
+	}
+}
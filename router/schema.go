@@ -215,6 +215,131 @@ CREATE TRIGGER notify_route_certificates_update
 		`ALTER TABLE http_routes ADD COLUMN drain_backends boolean NOT NULL DEFAULT TRUE`,
 		`UPDATE http_routes SET drain_backends = false WHERE service = 'controller'`,
 	)
+	migrations.Add(7,
+		`ALTER TABLE http_routes ADD COLUMN auth_username text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN auth_password_hash text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(8,
+		`ALTER TABLE http_routes ADD COLUMN error_handler_service text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(9,
+		`ALTER TABLE http_routes ADD COLUMN log_tls_fingerprint bool NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE http_routes ADD COLUMN blocked_tls_fingerprints text[] NOT NULL DEFAULT '{}'`,
+	)
+	migrations.Add(10,
+		`ALTER TABLE http_routes ADD COLUMN rewrite_location_hosts text[] NOT NULL DEFAULT '{}'`,
+	)
+	migrations.Add(11,
+		`ALTER TABLE http_routes ADD COLUMN strip_path_prefix text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN add_path_prefix text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(12,
+		`ALTER TABLE http_routes ADD COLUMN multicast_mode bool NOT NULL DEFAULT FALSE`,
+	)
+	migrations.Add(13,
+		`ALTER TABLE http_routes ADD COLUMN cors_allowed_origins text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN cors_allowed_methods text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN cors_allowed_headers text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN cors_exposed_headers text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN cors_allow_credentials bool NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE http_routes ADD COLUMN cors_max_age integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(14,
+		`ALTER TABLE http_routes ADD COLUMN push_paths text[] NOT NULL DEFAULT '{}'`,
+	)
+	migrations.Add(15,
+		`ALTER TABLE http_routes ADD COLUMN request_collapsing_enabled bool NOT NULL DEFAULT FALSE`,
+	)
+	migrations.Add(16,
+		`ALTER TABLE http_routes ADD COLUMN buffer_full_request_body bool NOT NULL DEFAULT FALSE`,
+	)
+	migrations.Add(17,
+		`ALTER TABLE http_routes ADD COLUMN forward_trailers bool NOT NULL DEFAULT FALSE`,
+	)
+	migrations.Add(18,
+		`ALTER TABLE http_routes ADD COLUMN consul_health_backends bool NOT NULL DEFAULT FALSE`,
+	)
+	migrations.Add(19,
+		`ALTER TABLE http_routes ADD COLUMN max_concurrent_requests integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN max_queued_requests integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN queue_timeout_ms integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(20,
+		`ALTER TABLE http_routes ADD COLUMN per_client_rate_limit bool NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE http_routes ADD COLUMN client_requests_per_second double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN client_burst integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN max_tracked_clients integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(21,
+		`ALTER TABLE http_routes ADD COLUMN request_fingerprint_dedup boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE http_routes ADD COLUMN fingerprint_max_bytes integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN dedup_window_ms integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(22,
+		`ALTER TABLE http_routes ADD COLUMN envoy_hc_path text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN envoy_hc_backend_check boolean NOT NULL DEFAULT false`,
+	)
+	migrations.Add(23,
+		`ALTER TABLE http_routes ADD COLUMN backend_h2c_enabled boolean NOT NULL DEFAULT false`,
+	)
+	migrations.Add(24,
+		`ALTER TABLE http_routes ADD COLUMN tls_passthrough boolean NOT NULL DEFAULT false`,
+	)
+	migrations.Add(25,
+		`ALTER TABLE http_routes ADD COLUMN max_request_header_bytes integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN max_response_header_bytes integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(26,
+		`ALTER TABLE http_routes ADD COLUMN backend_timeout_ms integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(27,
+		`ALTER TABLE http_routes ADD COLUMN slow_request_threshold_ms integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(28,
+		`ALTER TABLE http_routes ADD COLUMN ab_test_variant_names text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN ab_test_variant_weights integer[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN ab_test_variant_services text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN ab_test_bucket_cookie text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(29,
+		`ALTER TABLE http_routes ADD COLUMN method_route_methods text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN method_route_services text[] NOT NULL DEFAULT '{}'`,
+	)
+	migrations.Add(30,
+		`ALTER TABLE http_routes ADD COLUMN consistent_hash_key text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(31,
+		`ALTER TABLE http_routes ADD COLUMN vault_addr text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN vault_role_id text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN vault_secret_id text NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN vault_token_path text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(32,
+		`ALTER TABLE http_routes ADD COLUMN response_signing_key text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(33,
+		`ALTER TABLE http_routes ADD COLUMN client_hints text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN permissions_policy text NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(34,
+		`ALTER TABLE http_routes ADD COLUMN retry_budget_percent double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN retry_budget_minimum_retries integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(35,
+		`ALTER TABLE http_routes ADD COLUMN status_rate_limit_status_codes integer[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN status_rate_limit_thresholds integer[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN status_rate_limit_actions text[] NOT NULL DEFAULT '{}'`,
+	)
+	migrations.Add(36,
+		`ALTER TABLE http_routes ADD COLUMN fanout_services text[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE http_routes ADD COLUMN fanout_max_body_bytes bigint NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(37,
+		`ALTER TABLE http_routes ADD COLUMN tls_handshake_timeout_ms integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(38,
+		`ALTER TABLE http_routes ADD COLUMN reservoir_sample_size integer NOT NULL DEFAULT 0`,
+	)
 }
 
 func migrateDB(db *postgres.DB) error {
@@ -72,26 +72,26 @@ const (
 
 	// http
 	insertHttpRoute = `
-	INSERT INTO http_routes (parent_ref, service, leader, drain_backends, domain, sticky, path)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO http_routes (parent_ref, service, leader, drain_backends, domain, sticky, path, auth_username, auth_password_hash, error_handler_service, log_tls_fingerprint, blocked_tls_fingerprints, rewrite_location_hosts, strip_path_prefix, add_path_prefix, multicast_mode, cors_allowed_origins, cors_allowed_methods, cors_allowed_headers, cors_exposed_headers, cors_allow_credentials, cors_max_age, push_paths, request_collapsing_enabled, buffer_full_request_body, forward_trailers, consul_health_backends, max_concurrent_requests, max_queued_requests, queue_timeout_ms, per_client_rate_limit, client_requests_per_second, client_burst, max_tracked_clients, request_fingerprint_dedup, fingerprint_max_bytes, dedup_window_ms, envoy_hc_path, envoy_hc_backend_check, backend_h2c_enabled, tls_passthrough, max_request_header_bytes, max_response_header_bytes, backend_timeout_ms, slow_request_threshold_ms, ab_test_variant_names, ab_test_variant_weights, ab_test_variant_services, ab_test_bucket_cookie, method_route_methods, method_route_services, consistent_hash_key, vault_addr, vault_role_id, vault_secret_id, vault_token_path, response_signing_key, client_hints, permissions_policy, retry_budget_percent, retry_budget_minimum_retries, status_rate_limit_status_codes, status_rate_limit_thresholds, status_rate_limit_actions, fanout_services, fanout_max_body_bytes, tls_handshake_timeout_ms, reservoir_sample_size)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47, $48, $49, $50, $51, $52, $53, $54, $55, $56, $57, $58, $59, $60, $61, $62, $63, $64, $65, $66, $67, $68)
 	RETURNING id, created_at, updated_at`
 
 	selectHttpRoute = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.auth_username, r.auth_password_hash, r.error_handler_service, r.log_tls_fingerprint, r.blocked_tls_fingerprints, r.rewrite_location_hosts, r.strip_path_prefix, r.add_path_prefix, r.multicast_mode, r.cors_allowed_origins, r.cors_allowed_methods, r.cors_allowed_headers, r.cors_exposed_headers, r.cors_allow_credentials, r.cors_max_age, r.push_paths, r.request_collapsing_enabled, r.buffer_full_request_body, r.forward_trailers, r.consul_health_backends, r.max_concurrent_requests, r.max_queued_requests, r.queue_timeout_ms, r.per_client_rate_limit, r.client_requests_per_second, r.client_burst, r.max_tracked_clients, r.request_fingerprint_dedup, r.fingerprint_max_bytes, r.dedup_window_ms, r.envoy_hc_path, r.envoy_hc_backend_check, r.backend_h2c_enabled, r.tls_passthrough, r.max_request_header_bytes, r.max_response_header_bytes, r.backend_timeout_ms, r.slow_request_threshold_ms, r.ab_test_variant_names, r.ab_test_variant_weights, r.ab_test_variant_services, r.ab_test_bucket_cookie, r.method_route_methods, r.method_route_services, r.consistent_hash_key, r.vault_addr, r.vault_role_id, r.vault_secret_id, r.vault_token_path, r.response_signing_key, r.client_hints, r.permissions_policy, r.retry_budget_percent, r.retry_budget_minimum_retries, r.status_rate_limit_status_codes, r.status_rate_limit_thresholds, r.status_rate_limit_actions, r.fanout_services, r.fanout_max_body_bytes, r.tls_handshake_timeout_ms, r.reservoir_sample_size, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
 	LEFT OUTER JOIN route_certificates AS rc on r.id = rc.http_route_id
 	LEFT OUTER JOIN certificates AS c ON c.id = rc.certificate_id
 	WHERE r.id = $1 AND r.deleted_at IS NULL`
 
 	updateHttpRoute = `
 	UPDATE http_routes as r
-	SET parent_ref = $1, service = $2, leader = $3, sticky = $4, path = $5
-	WHERE id = $6 AND domain = $7 AND deleted_at IS NULL
-	RETURNING r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at`
+	SET parent_ref = $1, service = $2, leader = $3, sticky = $4, path = $5, auth_username = $6, auth_password_hash = $7, error_handler_service = $8, log_tls_fingerprint = $9, blocked_tls_fingerprints = $10, rewrite_location_hosts = $11, strip_path_prefix = $12, add_path_prefix = $13, multicast_mode = $14, cors_allowed_origins = $15, cors_allowed_methods = $16, cors_allowed_headers = $17, cors_exposed_headers = $18, cors_allow_credentials = $19, cors_max_age = $20, push_paths = $21, request_collapsing_enabled = $22, buffer_full_request_body = $23, forward_trailers = $24, consul_health_backends = $25, max_concurrent_requests = $26, max_queued_requests = $27, queue_timeout_ms = $28, per_client_rate_limit = $29, client_requests_per_second = $30, client_burst = $31, max_tracked_clients = $32, request_fingerprint_dedup = $33, fingerprint_max_bytes = $34, dedup_window_ms = $35, envoy_hc_path = $36, envoy_hc_backend_check = $37, backend_h2c_enabled = $38, tls_passthrough = $39, max_request_header_bytes = $40, max_response_header_bytes = $41, backend_timeout_ms = $42, slow_request_threshold_ms = $43, ab_test_variant_names = $44, ab_test_variant_weights = $45, ab_test_variant_services = $46, ab_test_bucket_cookie = $47, method_route_methods = $48, method_route_services = $49, consistent_hash_key = $50, vault_addr = $51, vault_role_id = $52, vault_secret_id = $53, vault_token_path = $54, response_signing_key = $55, client_hints = $56, permissions_policy = $57, retry_budget_percent = $58, retry_budget_minimum_retries = $59, status_rate_limit_status_codes = $60, status_rate_limit_thresholds = $61, status_rate_limit_actions = $62, fanout_services = $63, fanout_max_body_bytes = $64, tls_handshake_timeout_ms = $65, reservoir_sample_size = $66
+	WHERE id = $67 AND domain = $68 AND deleted_at IS NULL
+	RETURNING r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.auth_username, r.auth_password_hash, r.error_handler_service, r.log_tls_fingerprint, r.blocked_tls_fingerprints, r.rewrite_location_hosts, r.strip_path_prefix, r.add_path_prefix, r.multicast_mode, r.cors_allowed_origins, r.cors_allowed_methods, r.cors_allowed_headers, r.cors_exposed_headers, r.cors_allow_credentials, r.cors_max_age, r.push_paths, r.request_collapsing_enabled, r.buffer_full_request_body, r.forward_trailers, r.consul_health_backends, r.max_concurrent_requests, r.max_queued_requests, r.queue_timeout_ms, r.per_client_rate_limit, r.client_requests_per_second, r.client_burst, r.max_tracked_clients, r.request_fingerprint_dedup, r.fingerprint_max_bytes, r.dedup_window_ms, r.envoy_hc_path, r.envoy_hc_backend_check, r.backend_h2c_enabled, r.tls_passthrough, r.max_request_header_bytes, r.max_response_header_bytes, r.backend_timeout_ms, r.slow_request_threshold_ms, r.ab_test_variant_names, r.ab_test_variant_weights, r.ab_test_variant_services, r.ab_test_bucket_cookie, r.method_route_methods, r.method_route_services, r.consistent_hash_key, r.vault_addr, r.vault_role_id, r.vault_secret_id, r.vault_token_path, r.response_signing_key, r.client_hints, r.permissions_policy, r.retry_budget_percent, r.retry_budget_minimum_retries, r.status_rate_limit_status_codes, r.status_rate_limit_thresholds, r.status_rate_limit_actions, r.fanout_services, r.fanout_max_body_bytes, r.tls_handshake_timeout_ms, r.reservoir_sample_size, r.created_at, r.updated_at`
 
 	deleteHttpRoute = `UPDATE http_routes SET deleted_at = now() WHERE id = $1`
 
 	listHttpRoutes = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.auth_username, r.auth_password_hash, r.error_handler_service, r.log_tls_fingerprint, r.blocked_tls_fingerprints, r.rewrite_location_hosts, r.strip_path_prefix, r.add_path_prefix, r.multicast_mode, r.cors_allowed_origins, r.cors_allowed_methods, r.cors_allowed_headers, r.cors_exposed_headers, r.cors_allow_credentials, r.cors_max_age, r.push_paths, r.request_collapsing_enabled, r.buffer_full_request_body, r.forward_trailers, r.consul_health_backends, r.max_concurrent_requests, r.max_queued_requests, r.queue_timeout_ms, r.per_client_rate_limit, r.client_requests_per_second, r.client_burst, r.max_tracked_clients, r.request_fingerprint_dedup, r.fingerprint_max_bytes, r.dedup_window_ms, r.envoy_hc_path, r.envoy_hc_backend_check, r.backend_h2c_enabled, r.tls_passthrough, r.max_request_header_bytes, r.max_response_header_bytes, r.backend_timeout_ms, r.slow_request_threshold_ms, r.ab_test_variant_names, r.ab_test_variant_weights, r.ab_test_variant_services, r.ab_test_bucket_cookie, r.method_route_methods, r.method_route_services, r.consistent_hash_key, r.vault_addr, r.vault_role_id, r.vault_secret_id, r.vault_token_path, r.response_signing_key, r.client_hints, r.permissions_policy, r.retry_budget_percent, r.retry_budget_minimum_retries, r.status_rate_limit_status_codes, r.status_rate_limit_thresholds, r.status_rate_limit_actions, r.fanout_services, r.fanout_max_body_bytes, r.tls_handshake_timeout_ms, r.reservoir_sample_size, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
 	LEFT OUTER JOIN route_certificates AS rc on r.id = rc.http_route_id
 	LEFT OUTER JOIN certificates AS c ON c.id = rc.certificate_id
 	WHERE r.deleted_at IS NULL
@@ -115,7 +115,7 @@ const (
 	) FROM certificates AS c`
 
 	listCertificateRoutes = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at FROM http_routes AS r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.auth_username, r.auth_password_hash, r.error_handler_service, r.log_tls_fingerprint, r.blocked_tls_fingerprints, r.rewrite_location_hosts, r.strip_path_prefix, r.add_path_prefix, r.multicast_mode, r.cors_allowed_origins, r.cors_allowed_methods, r.cors_allowed_headers, r.cors_exposed_headers, r.cors_allow_credentials, r.cors_max_age, r.push_paths, r.request_collapsing_enabled, r.buffer_full_request_body, r.forward_trailers, r.consul_health_backends, r.max_concurrent_requests, r.max_queued_requests, r.queue_timeout_ms, r.per_client_rate_limit, r.client_requests_per_second, r.client_burst, r.max_tracked_clients, r.request_fingerprint_dedup, r.fingerprint_max_bytes, r.dedup_window_ms, r.envoy_hc_path, r.envoy_hc_backend_check, r.backend_h2c_enabled, r.tls_passthrough, r.max_request_header_bytes, r.max_response_header_bytes, r.backend_timeout_ms, r.slow_request_threshold_ms, r.ab_test_variant_names, r.ab_test_variant_weights, r.ab_test_variant_services, r.ab_test_bucket_cookie, r.method_route_methods, r.method_route_services, r.consistent_hash_key, r.vault_addr, r.vault_role_id, r.vault_secret_id, r.vault_token_path, r.response_signing_key, r.client_hints, r.permissions_policy, r.retry_budget_percent, r.retry_budget_minimum_retries, r.status_rate_limit_status_codes, r.status_rate_limit_thresholds, r.status_rate_limit_actions, r.fanout_services, r.fanout_max_body_bytes, r.tls_handshake_timeout_ms, r.reservoir_sample_size, r.created_at, r.updated_at FROM http_routes AS r
 	INNER JOIN route_certificates AS rc ON rc.http_route_id = r.id AND rc.certificate_id = $1`
 
 	insertCertificate = `
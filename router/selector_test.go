@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestBackendSelector(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+	addr1, addr2 := srv1.Listener.Addr().String(), srv2.Listener.Addr().String()
+
+	// byPath sends requests for /1 to the first backend in address order
+	// and the rest to the last, while last always uses the last
+	byPath := proxy.BackendSelectorFunc(func(req *http.Request, backends []string) []string {
+		sort.Strings(backends)
+		if req.URL.Path != "/1" {
+			sort.Sort(sort.Reverse(sort.StringSlice(backends)))
+		}
+		return backends
+	})
+	last := proxy.BackendSelectorFunc(func(req *http.Request, backends []string) []string {
+		sort.Sort(sort.Reverse(sort.StringSlice(backends)))
+		return backends
+	})
+	first, second := "1", "2"
+	if addr2 < addr1 {
+		first, second = second, first
+	}
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	d := newMemDiscoverd()
+	l := &HTTPListener{
+		Addr:            "127.0.0.1:0",
+		TLSAddr:         "127.0.0.1:0",
+		keypair:         pair,
+		ds:              newMemDataStore("http"),
+		discoverd:       d,
+		BackendSelector: byPath,
+		RouteBackendSelector: func(r *router.HTTPRoute) proxy.BackendSelector {
+			if r.Domain == "last.example.com" {
+				return last
+			}
+			return nil
+		},
+	}
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "last.example.com", Service: "test"}.ToRoute())
+	defer registerFakeBackend(c, l, d, "test", addr1)()
+	defer registerFakeBackend(c, l, d, "test", addr2)()
+
+	for i := 0; i < 5; i++ {
+		assertGet(c, "http://"+l.Addr+"/1", "example.com", first)
+		assertGet(c, "http://"+l.Addr+"/2", "example.com", second)
+		assertGet(c, "http://"+l.Addr+"/1", "last.example.com", second)
+	}
+}
@@ -2,18 +2,26 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/keepalive"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/schema"
 	"github.com/flynn/flynn/router/types"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -92,16 +100,83 @@ func main() {
 
 	proxyProtocol := os.Getenv("PROXY_PROTOCOL") == "true"
 
-	httpPort := flag.Int("http-port", 8080, "http listen port")
-	httpsPort := flag.Int("https-port", 4433, "https listen port")
+	httpPort := flag.Int("http-port", 8080, "http listen port (0 to disable)")
+	httpsPort := flag.Int("https-port", 4433, "https listen port (0 to disable)")
+	additionalHTTPPorts := flag.String("additional-http-ports", "", "comma separated list of additional http listen ports")
+	additionalHTTPSPorts := flag.String("additional-https-ports", "", "comma separated list of additional https listen ports")
 	tcpIP := flag.String("tcp-ip", os.Getenv("LISTEN_IP"), "tcp router listen ip")
 	tcpRangeStart := flag.Int("tcp-range-start", 3000, "tcp port range start")
 	tcpRangeEnd := flag.Int("tcp-range-end", 3500, "tcp port range end")
 	certFile := flag.String("tls-cert", "", "TLS (SSL) cert file in pem format")
 	keyFile := flag.String("tls-key", "", "TLS (SSL) key file in pem format")
+	sessionTicketKeyFile := flag.String("tls-session-ticket-keys", "", "file of base64 encoded TLS session ticket keys, one per line with the first used to encrypt new tickets")
+	sessionTicketKeyRotation := flag.Duration("tls-session-ticket-key-rotation", 0, "how often to reload the session ticket key file, or to generate a new key if it isn't set (0 to disable)")
+	clientCAFile := flag.String("tls-client-ca", "", "TLS (SSL) CA cert file in pem format used to verify client certificates")
+	forwardClientCertPEM := flag.Bool("forward-client-cert-pem", false, "forward verified client certificates to backends in the X-Client-Cert header")
 	apiPort := flag.String("api-port", "", "api listen port")
+	trustedHeaders := flag.String("trusted-headers", "X-Real-IP", "comma separated list of headers to remove from client requests")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated list of IP addresses or CIDR ranges of proxies whose X-Forwarded-For headers identify clients")
+	allowTrace := flag.Bool("allow-trace-method", false, "proxy HTTP TRACE requests to backends rather than rejecting them")
+	normalizePathRedirect := flag.Bool("normalize-path-redirect", false, "redirect requests with dot segments in their path to the normalized path rather than forwarding them with it")
+	forwardAbsoluteURIs := flag.Bool("forward-absolute-uris", false, "forward absolute-form request URIs to backends as sent rather than rewriting them to origin-form")
+	maxRequestHeaders := flag.Int("max-request-headers", 0, "maximum number of header fields in client requests (0 for no limit)")
+	maxURIBytes := flag.Int("max-uri-bytes", defaultMaxURIBytes, "maximum length of request URIs")
+	maxHops := flag.Int("max-hops", 0, "maximum number of routers a request may pass through before being rejected as a loop (0 to disable)")
+	maxResponseHeaders := flag.Int("max-response-headers", 0, "maximum number of header fields in backend responses (0 for no limit)")
+	idempotencyHeader := flag.String("idempotency-header", "", "request header marking requests as safe to retry with another backend after a failure (e.g. Idempotency-Key)")
+	maxBufferedRequestBytes := flag.Int64("max-buffered-request-bytes", defaultMaxBufferedRequestBytes, "maximum size of request bodies buffered for routes which require them")
+	backendTimeout := flag.Duration("backend-timeout", 0, "maximum time from sending a request to a backend until its response has been read (0 for no limit)")
+	emptyServiceWait := flag.Duration("empty-service-wait", 0, "how long requests to services with no instances wait for one to come up (0 to fail immediately)")
+	requestStartHeader := flag.String("request-start-header", defaultRequestStartHeader, "header set on requests to the time they were received")
+	requestStartFormat := flag.String("request-start-format", defaultRequestStartFormat, `format of the request start header ("ms", "us", "t=ms" or "t=us")`)
+	traceFormat := flag.String("trace-format", "", `propagate distributed tracing context to backends in the given format ("w3c" or "b3")`)
+	traceSpans := flag.Bool("trace-spans", false, "log a tracing span for each request's hop through the router")
+	unknownSNI := flag.String("unknown-sni", unknownSNIDrop, `what to do with TLS connections for host names with no route ("drop" or "default-cert" to serve a 404)`)
+	logLevel := flag.String("log-level", "info", "log level (debug, info, warn, error or crit)")
+	healthCheckPath := flag.String("health-check-path", "", "path of health check requests which the router answers itself rather than routing")
+	healthCheckHost := flag.String("health-check-host", "", "host of health check requests which the router answers itself rather than routing")
+	healthCheckStatus := flag.Int("health-check-status", http.StatusOK, "status code of health check responses")
+	healthCheckBody := flag.String("health-check-body", "", `body of health check responses (default "OK\n")`)
+	tcpNoDelay := flag.Bool("tcp-nodelay", true, "set TCP_NODELAY on HTTP connections")
+	reusePort := flag.Bool("reuseport", true, "set SO_REUSEPORT on the HTTP listening sockets")
+	tcpKeepAlive := flag.Bool("tcp-keepalive", true, "enable TCP keepalives on HTTP connections")
+	tcpKeepAliveInterval := flag.Duration("tcp-keepalive-interval", defaultKeepAliveInterval, "interval of TCP keepalive probes on HTTP connections")
+	tcpReceiveBuffer := flag.Int("tcp-receive-buffer", 0, "SO_RCVBUF size in bytes of HTTP sockets (Linux doubles the value, defaults to the system default)")
+	tcpSendBuffer := flag.Int("tcp-send-buffer", 0, "SO_SNDBUF size in bytes of HTTP sockets (Linux doubles the value, defaults to the system default)")
+	tlsHandshakeTimeout := flag.Duration("tls-handshake-timeout", defaultTLSHandshakeTimeout, "how long clients have to complete the TLS handshake, unless overridden by the route")
+	configFile := flag.String("config", "", "JSON file of listener config overriding the flags, which is re-read on SIGHUP")
+	strictCertValidity := flag.Bool("strict-cert-validity", false, "reject certificates which are expired or not yet valid rather than logging a warning")
+	snapshotPath := flag.String("snapshot-path", "", "file to periodically write a snapshot of the HTTP routes to, which is served if the initial route sync fails")
+	requestSamplePath := flag.String("request-sample-path", "", "file to write the request samples of routes to every hour, which are restored on restart")
+	snapshotInterval := flag.Duration("snapshot-interval", defaultSnapshotInterval, "how often to write the route snapshot")
+	consulAddr := flag.String("consul-addr", "", "address of the Consul HTTP API used by routes which use Consul health checks")
+	consulCacheTTL := flag.Duration("consul-cache-ttl", defaultConsulCacheTTL, "how long to cache the passing instances of services from Consul")
+	peerService := flag.String("peer-service", "", `discoverd service of the other routers' APIs (e.g. "router-api") to pull route changes from while the database is unreachable`)
+	peerPollInterval := flag.Duration("peer-poll-interval", defaultPeerPollInterval, "how often to pull route changes from peers while the database is unreachable")
+	peerSyncKey := flag.String("peer-sync-key", os.Getenv("PEER_SYNC_KEY"), "secret shared only with the -peer-service routers to sign pulls of route changes with")
+	connectionJournal := flag.Int("connection-journal", 0, "number of recent HTTP connections to record the lifecycle of for debugging (0 to disable)")
+	smuggleProtection := flag.Bool("smuggle-protection", false, "reject HTTP requests with ambiguous Content-Length and Transfer-Encoding headers")
+	readOnly := flag.Bool("read-only", false, "reject changes to routes made through this router's API (e.g. for a standby router)")
+	discoverdProbeInterval := flag.Duration("discoverd-probe-interval", defaultDiscoverdProbeInterval, "how often to check whether discoverd is reachable again after it becomes unreachable")
+	outboundInterface := flag.String("outbound-interface", "", "IP address of the local interface to connect to backends from")
+	sidecarDomain := flag.String("sidecar-domain", os.Getenv("SIDECAR_DOMAIN"), "only serve this domain, routed to -sidecar-service, rather than the routes in the database")
+	sidecarService := flag.String("sidecar-service", os.Getenv("SIDECAR_SERVICE"), "service the -sidecar-domain is routed to")
+	kubernetesIngresses := flag.Bool("kubernetes-ingresses", false, "add routes for Kubernetes Ingresses using the pod's service account")
+	kubernetesNamespace := flag.String("kubernetes-namespace", "", "namespace of the Kubernetes Ingresses to add routes for (defaults to all namespaces)")
+	explainRate := flag.Float64("explain-backend-selection", 0, "fraction of requests (between 0 and 1) for which to log how the backend was selected")
 	flag.Parse()
 
+	if (*sidecarDomain == "") != (*sidecarService == "") {
+		shutdown.Fatal("-sidecar-domain and -sidecar-service must be set together")
+	}
+	if *peerService != "" && *peerSyncKey == "" {
+		shutdown.Fatal("-peer-sync-key (or PEER_SYNC_KEY) must be set with -peer-service")
+	}
+	if *explainRate < 0 || *explainRate > 1 {
+		shutdown.Fatalf("invalid -explain-backend-selection %v, must be between 0 and 1", *explainRate)
+	}
+	proxy.ExplainSampleRate = *explainRate
+
 	if *apiPort == "" {
 		*apiPort = os.Getenv("PORT")
 		if *apiPort == "" {
@@ -124,6 +199,53 @@ func main() {
 		}
 	}
 
+	var clientCAs *x509.CertPool
+	if *clientCAFile != "" {
+		data, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			shutdown.Fatalf("no valid certificates found in %s", *clientCAFile)
+		}
+	}
+
+	baseConfig := ListenerConfig{
+		TrustedHeaders:          splitHeaderList(*trustedHeaders),
+		TrustedProxies:          splitHeaderList(*trustedProxies),
+		AllowTrace:              *allowTrace,
+		ForwardClientCertPEM:    *forwardClientCertPEM,
+		ForwardAbsoluteURIs:     *forwardAbsoluteURIs,
+		NormalizePathRedirect:   *normalizePathRedirect,
+		MaxRequestHeaders:       *maxRequestHeaders,
+		MaxResponseHeaders:      *maxResponseHeaders,
+		MaxURIBytes:             *maxURIBytes,
+		MaxHops:                 *maxHops,
+		MaxBufferedRequestBytes: *maxBufferedRequestBytes,
+		IdempotencyHeader:       *idempotencyHeader,
+		BackendTimeoutMS:        int(*backendTimeout / time.Millisecond),
+		EmptyServiceWaitMS:      int(*emptyServiceWait / time.Millisecond),
+		RequestStartHeader:      *requestStartHeader,
+		RequestStartFormat:      *requestStartFormat,
+		TraceFormat:             *traceFormat,
+		TraceSpans:              *traceSpans,
+		UnknownSNI:              *unknownSNI,
+		LogLevel:                *logLevel,
+	}
+	if *healthCheckPath != "" || *healthCheckHost != "" {
+		baseConfig.HealthCheck = &HealthCheckConfig{
+			Path:   *healthCheckPath,
+			Host:   *healthCheckHost,
+			Status: *healthCheckStatus,
+			Body:   *healthCheckBody,
+		}
+	}
+	listenerConfig, err := loadListenerConfig(baseConfig, *configFile)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
 	log := logger.New("fn", "main")
 
 	log.Info("connecting to postgres")
@@ -140,26 +262,99 @@ func main() {
 
 	shutdown.BeforeExit(func() { db.Close() })
 
-	httpAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpPort))
-	httpsAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpsPort))
+	backupConfig := BackupConfig{
+		S3Endpoint:        os.Getenv("BACKUP_S3_ENDPOINT"),
+		S3Region:          os.Getenv("BACKUP_S3_REGION"),
+		S3Bucket:          os.Getenv("BACKUP_S3_BUCKET"),
+		S3KeyPrefix:       os.Getenv("BACKUP_S3_KEY_PREFIX"),
+		S3AccessKeyID:     os.Getenv("BACKUP_S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("BACKUP_S3_SECRET_ACCESS_KEY"),
+	}
+	if interval := os.Getenv("BACKUP_INTERVAL"); interval != "" {
+		if backupConfig.BackupInterval, err = time.ParseDuration(interval); err != nil {
+			shutdown.Fatal(fmt.Errorf("error parsing BACKUP_INTERVAL: %s", err))
+		}
+	}
+
+	// keep serving the last known backends of services if discoverd
+	// becomes unreachable
+	discoverdBreaker := NewDiscoverdCircuitBreaker(discoverd.DefaultClient, *discoverdProbeInterval)
+
+	var httpAddr, httpsAddr string
+	additionalAddrs := listenAddrs(*additionalHTTPPorts)
+	additionalTLSAddrs := listenAddrs(*additionalHTTPSPorts)
+	if *httpPort != 0 {
+		httpAddr = net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpPort))
+	}
+	if *httpsPort != 0 {
+		httpsAddr = net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpsPort))
+	}
+	httpDataStore := NewPostgresDataStore("http", db.ConnPool)
+	httpDataStore.strictCertValidity = *strictCertValidity
+	apiAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), *apiPort)
+	httpListener := &HTTPListener{
+		Addr:          httpAddr,
+		TLSAddr:       httpsAddr,
+		cookieKey:     cookieKey,
+		keypair:       keypair,
+		ds:            httpDataStore,
+		discoverd:     discoverdBreaker,
+		proxyProtocol: proxyProtocol,
+
+		clientCAs:         clientCAs,
+		BackupConfig:      backupConfig,
+		SnapshotPath:      *snapshotPath,
+		SnapshotInterval:  *snapshotInterval,
+		RequestSamplePath: *requestSamplePath,
+		ConsulAddr:        *consulAddr,
+		ConsulCacheTTL:    *consulCacheTTL,
+		ReadOnly:          *readOnly,
+		Sidecar:           *sidecarDomain != "",
+		OutboundInterface: *outboundInterface,
+
+		AdditionalAddrs:    additionalAddrs,
+		AdditionalTLSAddrs: additionalTLSAddrs,
+
+		SessionTicketKeyFile:     *sessionTicketKeyFile,
+		SessionTicketKeyRotation: *sessionTicketKeyRotation,
+
+		PeerDiscovery: PeerConfig{
+			PeerService:  *peerService,
+			Addr:         apiAddr,
+			PollInterval: *peerPollInterval,
+			SyncKey:      *peerSyncKey,
+		},
+
+		SmuggleProtection: *smuggleProtection,
+		SocketOptions: SocketOpts{
+			NoDelay:           *tcpNoDelay,
+			ReusePort:         *reusePort,
+			KeepAlive:         *tcpKeepAlive,
+			KeepAliveInterval: *tcpKeepAliveInterval,
+
+			TCPReceiveBufferBytes: *tcpReceiveBuffer,
+			TCPSendBufferBytes:    *tcpSendBuffer,
+		},
+		TLSHandshakeTimeout: *tlsHandshakeTimeout,
+	}
+	if err := httpListener.Reload(listenerConfig); err != nil {
+		shutdown.Fatal(err)
+	}
+	httpListener.EnableConnectionJournal(*connectionJournal)
+	// TCP routes can't use any port the HTTP listener serves
+	httpPorts := append([]int{*httpPort, *httpsPort}, listenPorts(additionalAddrs)...)
+	httpPorts = append(httpPorts, listenPorts(additionalTLSAddrs)...)
 	r := Router{
 		TCP: &TCPListener{
 			IP:            *tcpIP,
 			startPort:     *tcpRangeStart,
 			endPort:       *tcpRangeEnd,
 			ds:            NewPostgresDataStore("tcp", db.ConnPool),
-			discoverd:     discoverd.DefaultClient,
-			reservedPorts: []int{*httpPort, *httpsPort},
-		},
-		HTTP: &HTTPListener{
-			Addr:          httpAddr,
-			TLSAddr:       httpsAddr,
-			cookieKey:     cookieKey,
-			keypair:       keypair,
-			ds:            NewPostgresDataStore("http", db.ConnPool),
-			discoverd:     discoverd.DefaultClient,
-			proxyProtocol: proxyProtocol,
+			discoverd:     discoverdBreaker,
+			reservedPorts: reservedPorts(httpPorts...),
+			ReadOnly:      *readOnly,
 		},
+		HTTP: httpListener,
 	}
 
 	if err := r.Start(); err != nil {
@@ -167,7 +362,44 @@ func main() {
 	}
 	shutdown.BeforeExit(r.Close)
 
-	apiAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), *apiPort)
+	if err := httpListener.LoadEnvRoutes(); err != nil {
+		shutdown.Fatal(err)
+	}
+
+	if httpListener.Sidecar {
+		// the listener's keypair is used for the domain
+		if err := httpListener.setSidecarRoute(*sidecarDomain, *sidecarService, "", ""); err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+
+	if *kubernetesIngresses {
+		config, err := KubernetesInClusterConfig()
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+		if err := httpListener.SyncKubernetesIngresses(config, *kubernetesNamespace); err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+
+	// reload the listener config on SIGHUP so that it can be changed
+	// without dropping connections
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Info("reloading listener config")
+			config, err := loadListenerConfig(baseConfig, *configFile)
+			if err == nil {
+				err = httpListener.Reload(config)
+			}
+			if err != nil {
+				log.Error("error reloading listener config", "err", err)
+			}
+		}
+	}()
+
 	log.Info("starting API listener")
 	listener, err := listenFunc("tcp4", apiAddr)
 	if err != nil {
@@ -176,8 +408,10 @@ func main() {
 	}
 
 	services := map[string]string{
-		"router-api":  apiAddr,
-		"router-http": httpAddr,
+		"router-api": apiAddr,
+	}
+	if httpAddr != "" {
+		services["router-http"] = httpAddr
 	}
 	for service, addr := range services {
 		log.Info("registering service", "name", service, "addr", addr)
@@ -190,7 +424,82 @@ func main() {
 	}
 
 	log.Info("serving API requests")
-	shutdown.Fatal(http.Serve(listener, apiHandler(&r)))
+	// peers pull route changes using HTTP/2 over cleartext TCP
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	apiServer := &http.Server{Handler: apiHandler(&r), Protocols: &protocols}
+	shutdown.Fatal(apiServer.Serve(listener))
+}
+
+// loadListenerConfig returns a copy of the base config overridden by the JSON
+// config file at path, if set.
+func loadListenerConfig(base ListenerConfig, path string) (*ListenerConfig, error) {
+	// json.Unmarshal reuses the backing arrays of slices, so unmarshal into
+	// a deep copy to leave the base config and any listener using it intact
+	config := base.clone()
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// splitHeaderList splits a comma separated list of header names
+func splitHeaderList(s string) []string {
+	var headers []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			headers = append(headers, name)
+		}
+	}
+	return headers
+}
+
+// listenAddrs returns the addresses to listen on for a comma separated list
+// of ports.
+func listenAddrs(ports string) []string {
+	var addrs []string
+	for _, port := range strings.Split(ports, ",") {
+		if port = strings.TrimSpace(port); port != "" {
+			addrs = append(addrs, net.JoinHostPort(os.Getenv("LISTEN_IP"), port))
+		}
+	}
+	return addrs
+}
+
+// listenPorts returns the ports of the given listen addresses, skipping any
+// that can't be parsed (they fail when the listener binds to them).
+func listenPorts(addrs []string) []int {
+	var ports []int
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// reservedPorts returns the ports TCP routes cannot bind to, skipping zero
+// ports of disabled listeners so they don't block port allocation.
+func reservedPorts(ports ...int) []int {
+	var reserved []int
+	for _, port := range ports {
+		if port != 0 {
+			reserved = append(reserved, port)
+		}
+	}
+	return reserved
 }
 
 type listenErr struct {
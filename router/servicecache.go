@@ -0,0 +1,132 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/metrics"
+)
+
+var (
+	staleServiceCaches = metrics.NewCounterVec(
+		"strowger_service_cache_stale_total",
+		"Number of times the cache of a service lost its connection to discoverd and was replaced.",
+		"service",
+	)
+	serviceCacheErrors = metrics.NewCounter(
+		"strowger_service_cache_errors_total",
+		"Number of failed attempts to replace a stale service cache.",
+	)
+)
+
+// staleCacheRetryInterval is how often creating a cache to replace a stale
+// one is retried
+var staleCacheRetryInterval = time.Second
+
+func (s *service) currentCache() *cache.ServiceCache {
+	s.cacheMtx.RLock()
+	defer s.cacheMtx.RUnlock()
+	return s.sc
+}
+
+// Addrs returns the addresses of the service's instances. They are read from
+// the cache until the instances it had when first watched have been received,
+// and after that from the instance events, so that requests use backends as
+// soon as the events for them are received.
+func (s *service) Addrs() []string {
+	addrs, ok := s.addrs.Load().([]string)
+	if !ok {
+		return s.currentCache().Addrs()
+	}
+	// the proxy reorders the addresses it is given
+	return append(make([]string, 0, len(addrs)), addrs...)
+}
+
+// updateAddrs stores the addresses of the service's current instances to be
+// returned by Addrs, unless the instances the cache had when first watched
+// are still being received, as some would be missing. It must be called by
+// the watchBackends goroutine or with exclusive access to s.instances.
+func (s *service) updateAddrs() {
+	if !s.addrsCurrent {
+		return
+	}
+	addrs := make([]string, 0, len(s.instances))
+	for _, inst := range s.instances {
+		addrs = append(addrs, inst.Addr)
+	}
+	s.addrs.Store(addrs)
+}
+
+// LeaderAddr returns the address of the service's leader.
+func (s *service) LeaderAddr() []string {
+	return s.currentCache().LeaderAddr()
+}
+
+// replaceStaleCaches replaces the service's cache with a new one watching
+// the given discoverd service each time it loses its connection to discoverd
+// (e.g. when discoverd restarts), so that the routes using the service keep
+// serving requests with up to date backends. It returns once the service is
+// closed.
+func (s *service) replaceStaleCaches(ds discoverd.Service) {
+	for {
+		select {
+		case <-s.currentCache().Stale():
+		case <-s.closed:
+			return
+		}
+		// the backends of the service are frozen until the cache is
+		// replaced, as updates from discoverd have stopped
+		staleServiceCaches.Inc(s.name)
+		staleAt := time.Now()
+		logger.Warn("service cache is stale, replacing it", "service", s.name, "instances", len(s.Addrs()))
+		for {
+			sc, err := cache.New(ds)
+			if err == nil {
+				s.replaceCache(sc)
+				logger.Info("replaced stale service cache", "service", s.name, "stale_for", time.Since(staleAt), "instances", len(sc.Addrs()))
+				break
+			}
+			serviceCacheErrors.Inc()
+			logger.Error("error creating service cache", "service", s.name, "stale_for", time.Since(staleAt), "err", err)
+			select {
+			case <-time.After(staleCacheRetryInterval):
+			case <-s.closed:
+				return
+			}
+		}
+	}
+}
+
+// replaceCache atomically replaces the service's cache. Instances which are
+// not in the new cache are treated as having gone down, so requests in flight
+// to them are drained.
+func (s *service) replaceCache(sc *cache.ServiceCache) {
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+	select {
+	case <-s.closed:
+		sc.Close()
+		return
+	default:
+	}
+
+	// stop watching the old cache before closing it
+	close(s.stopWatch)
+	<-s.watchDone
+	s.stream.Close()
+	s.sc.Close()
+
+	addrs := make(map[string]struct{})
+	for _, addr := range sc.Addrs() {
+		addrs[addr] = struct{}{}
+	}
+	for _, inst := range s.instances {
+		if _, ok := addrs[inst.Addr]; !ok {
+			s.handleInstanceEvent(&discoverd.Event{Kind: discoverd.EventKindDown, Instance: inst})
+		}
+	}
+
+	s.sc = sc
+	s.watch(sc)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// restartableDiscoverd is a DiscoverdClient with a single service whose
+// watches are closed when discoverd is restarted
+type restartableDiscoverd struct {
+	*restartableService
+}
+
+type restartableService struct {
+	discoverd.Service
+
+	mtx       sync.Mutex
+	instances []*discoverd.Instance
+	restarted chan struct{}
+	// watchErr, if set, is returned by Watch
+	watchErr error
+}
+
+func newRestartableDiscoverd(instances ...*discoverd.Instance) *restartableDiscoverd {
+	return &restartableDiscoverd{&restartableService{instances: instances, restarted: make(chan struct{})}}
+}
+
+func (d *restartableDiscoverd) Service(string) discoverd.Service {
+	return d.restartableService
+}
+
+func (d *restartableDiscoverd) AddService(string, *discoverd.ServiceConfig) error {
+	return nil
+}
+
+func (d *restartableService) Watch(events chan *discoverd.Event) (stream.Stream, error) {
+	d.mtx.Lock()
+	instances, restarted, err := d.instances, d.restarted, d.watchErr
+	d.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for _, inst := range instances {
+			events <- &discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst}
+		}
+		events <- &discoverd.Event{Kind: discoverd.EventKindCurrent}
+		<-restarted
+		close(events)
+	}()
+	return stream.New(), nil
+}
+
+// restart closes the current watches, replacing the instances of the
+// service without sending down events
+func (d *restartableService) restart(instances ...*discoverd.Instance) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.instances = instances
+	close(d.restarted)
+	d.restarted = make(chan struct{})
+}
+
+func (d *restartableService) setWatchErr(err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.watchErr = err
+}
+
+func (s *S) TestReplaceStaleServiceCache(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+	inst1 := &discoverd.Instance{ID: "1", Addr: srv1.Listener.Addr().String()}
+	inst2 := &discoverd.Instance{ID: "2", Addr: srv2.Listener.Addr().String()}
+
+	d := newRestartableDiscoverd(inst1, inst2)
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		discoverd: d,
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	h := &httpSyncHandler{l: l}
+	c.Assert(h.Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web", DrainBackends: true}), IsNil)
+	defer h.Remove("1")
+	svc := l.services["web"]
+	addrs := func() []string {
+		addrs := svc.Addrs()
+		sort.Strings(addrs)
+		return addrs
+	}
+	all := []string{inst1.Addr, inst2.Addr}
+	sort.Strings(all)
+	c.Assert(addrs(), DeepEquals, all)
+
+	// send requests while discoverd restarts
+	stop := make(chan struct{})
+	failures := make(chan string, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			w := httptest.NewRecorder()
+			l.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+			if w.Code != 200 {
+				select {
+				case failures <- w.Body.String():
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	// the first instance goes away while discoverd is restarting, so the
+	// cache is replaced with one without it
+	oldCache := svc.currentCache()
+	d.restart(inst2)
+	for i := 0; svc.currentCache() == oldCache || len(addrs()) != 1; i++ {
+		if i > 200 {
+			c.Fatal("timed out waiting for the service cache to be replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(addrs(), DeepEquals, []string{inst2.Addr})
+
+	close(stop)
+	wg.Wait()
+	select {
+	case body := <-failures:
+		c.Fatalf("request failed: %s", body)
+	default:
+	}
+
+	// requests are only routed to the remaining instance
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, 200)
+		body, _ := ioutil.ReadAll(w.Body)
+		c.Assert(string(body), Equals, "2")
+	}
+
+	// the replacement cache is also replaced when it becomes stale
+	oldCache = svc.currentCache()
+	d.restart(inst1, inst2)
+	for i := 0; svc.currentCache() == oldCache || len(addrs()) != 2; i++ {
+		if i > 200 {
+			c.Fatal("timed out waiting for the service cache to be replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// replacing the cache is retried until discoverd can be watched again
+	defer func(d time.Duration) { staleCacheRetryInterval = d }(staleCacheRetryInterval)
+	staleCacheRetryInterval = 10 * time.Millisecond
+	stale, errs := staleServiceCaches.Value("web"), serviceCacheErrors.Value()
+	oldCache = svc.currentCache()
+	d.setWatchErr(errors.New("discoverd unavailable"))
+	d.restart(inst2)
+	for i := 0; serviceCacheErrors.Value() == errs; i++ {
+		if i > 200 {
+			c.Fatal("timed out waiting for the service cache replacement to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(svc.currentCache(), Equals, oldCache)
+	d.setWatchErr(nil)
+	for i := 0; svc.currentCache() == oldCache || len(addrs()) != 1; i++ {
+		if i > 200 {
+			c.Fatal("timed out waiting for the service cache to be replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(staleServiceCaches.Value("web"), Equals, stale+1)
+}
+
+func (s *S) TestServiceAddrsFromEvents(c *C) {
+	// the addresses are read from the cache until the instances it had
+	// when first watched have been received
+	svc := newFakeService(c, "test",
+		&discoverd.Instance{ID: "a", Addr: "a"},
+		&discoverd.Instance{ID: "b", Addr: "b"},
+	)
+	defer svc.Close()
+	addrs := svc.Addrs()
+	sort.Strings(addrs)
+	c.Assert(addrs, DeepEquals, []string{"a", "b"})
+	for i := 0; ; i++ {
+		if _, ok := svc.addrs.Load().([]string); ok {
+			break
+		}
+		if i > 200 {
+			c.Fatal("timed out waiting for the instances to be received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addrs = svc.Addrs()
+	sort.Strings(addrs)
+	c.Assert(addrs, DeepEquals, []string{"a", "b"})
+
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+	inst1 := &discoverd.Instance{ID: "1", Addr: srv1.Listener.Addr().String()}
+	inst2 := &discoverd.Instance{ID: "2", Addr: srv2.Listener.Addr().String()}
+
+	// a service whose initial instances have been received uses the
+	// addresses from the events, without reading its cache
+	svc = &service{
+		instances:    make(map[string]*discoverd.Instance),
+		instanceUp:   make(chan struct{}),
+		addrsCurrent: true,
+	}
+	rp := proxy.NewReverseProxy(svc.Addrs, &[32]byte{}, false, svc, logger)
+	get := func() string {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, 200)
+		return w.Body.String()
+	}
+	svc.handleInstanceEvent(&discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst1})
+	c.Assert(svc.Addrs(), DeepEquals, []string{inst1.Addr})
+	c.Assert(get(), Equals, "1")
+
+	// the addresses change as soon as the events are handled
+	svc.handleInstanceEvent(&discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst2})
+	svc.handleInstanceEvent(&discoverd.Event{Kind: discoverd.EventKindDown, Instance: inst1})
+	c.Assert(svc.Addrs(), DeepEquals, []string{inst2.Addr})
+	for i := 0; i < 10; i++ {
+		c.Assert(get(), Equals, "2")
+	}
+
+	// callers can reorder the addresses without changing them
+	svc.handleInstanceEvent(&discoverd.Event{Kind: discoverd.EventKindUp, Instance: inst1})
+	addrs = svc.Addrs()
+	addrs[0], addrs[1] = addrs[1], addrs[0]
+	c.Assert(svc.Addrs(), Not(DeepEquals), addrs)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// sessionTicketKeyCount is the number of generated session ticket keys kept
+// when rotating them, so that tickets issued with the previous keys can still
+// be used to resume sessions
+const sessionTicketKeyCount = 3
+
+// SetSessionTicketKeys replaces the keys used to encrypt and decrypt TLS
+// session tickets, with new tickets encrypted using the first key. Sharing
+// the keys between listeners lets clients resume sessions with any of them.
+// The listener must have been started.
+func (s *HTTPListener) SetSessionTicketKeys(keys [][32]byte) error {
+	if len(keys) == 0 {
+		return errors.New("router: at least one session ticket key is required")
+	}
+	if s.tlsConfig == nil {
+		return errors.New("router: http listener not started")
+	}
+	s.tlsConfig.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// readSessionTicketKeys reads session ticket keys from a file containing a
+// base64 encoded 32 byte key on each line, the first of which is used to
+// encrypt new tickets.
+func readSessionTicketKeys(path string) ([][32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(string(text))
+		var key [32]byte
+		if err != nil || len(b) != len(key) {
+			return nil, fmt.Errorf("router: invalid session ticket key on line %d of %s", line, path)
+		}
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("router: no session ticket keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// startSessionTicketKeys sets the initial session ticket keys, either from
+// SessionTicketKeyFile or generated if SessionTicketKeyRotation is set,
+// starting a goroutine to rotate them until ctx is done. The listener's
+// keys are left as the crypto/tls defaults if neither are set.
+func (s *HTTPListener) startSessionTicketKeys(ctx context.Context) error {
+	interval := s.SessionTicketKeyRotation
+	if s.SessionTicketKeyFile == "" {
+		if interval <= 0 {
+			return nil
+		}
+		keys := make([][32]byte, 0, sessionTicketKeyCount)
+		next := func() error {
+			var key [32]byte
+			if _, err := rand.Read(key[:]); err != nil {
+				return err
+			}
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > sessionTicketKeyCount {
+				keys = keys[:sessionTicketKeyCount]
+			}
+			return s.SetSessionTicketKeys(keys)
+		}
+		if err := next(); err != nil {
+			return err
+		}
+		go s.rotateSessionTicketKeys(ctx, interval, next)
+		return nil
+	}
+
+	load := func() error {
+		keys, err := readSessionTicketKeys(s.SessionTicketKeyFile)
+		if err != nil {
+			return err
+		}
+		return s.SetSessionTicketKeys(keys)
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	if interval > 0 {
+		go s.rotateSessionTicketKeys(ctx, interval, load)
+	}
+	return nil
+}
+
+// rotateSessionTicketKeys calls rotate every interval until ctx is done,
+// logging errors and keeping the current keys if it fails.
+func (s *HTTPListener) rotateSessionTicketKeys(ctx context.Context, interval time.Duration, rotate func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := rotate(); err != nil {
+				logger.Error("error rotating session ticket keys", "path", s.SessionTicketKeyFile, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
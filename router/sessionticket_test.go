@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestSessionTicketKeys(c *C) {
+	dir := c.MkDir()
+	writeKeys := func(name string, keys ...string) string {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, []byte(strings.Join(keys, "\n")+"\n"), 0600), IsNil)
+		return path
+	}
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+	}
+	shared := writeKeys("shared", key('a'), key('b'))
+
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	start := func(keyFile string, rotation time.Duration) (*HTTPListener, error) {
+		l := &HTTPListener{
+			Addr:                     "127.0.0.1:0",
+			TLSAddr:                  "127.0.0.1:0",
+			keypair:                  pair,
+			ds:                       newMemDataStore("http"),
+			discoverd:                newMemDiscoverd(),
+			SessionTicketKeyFile:     keyFile,
+			SessionTicketKeyRotation: rotation,
+		}
+		if err := l.Start(); err != nil {
+			return nil, err
+		}
+		addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+		return l, nil
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(cert.Cert))
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName:         "example.com",
+			RootCAs:            pool,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+		DisableKeepAlives: true,
+	}}
+	resumed := func(l *HTTPListener) bool {
+		res, err := client.Get("https://" + l.TLSAddr)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.TLS.DidResume
+	}
+
+	// sessions can be resumed with any listener using the same keys
+	l1, err := start(shared, 0)
+	c.Assert(err, IsNil)
+	defer l1.Close()
+	l2, err := start(shared, 0)
+	c.Assert(err, IsNil)
+	defer l2.Close()
+	c.Assert(resumed(l1), Equals, false)
+	c.Assert(resumed(l2), Equals, true)
+
+	// but not with a listener using its own generated keys
+	l3, err := start("", time.Hour)
+	c.Assert(err, IsNil)
+	defer l3.Close()
+	c.Assert(resumed(l3), Equals, false)
+	c.Assert(resumed(l3), Equals, true)
+
+	// tickets encrypted with a key which is no longer the first are still
+	// accepted (with new tickets encrypted with the first key), but not once
+	// the key is removed
+	c.Assert(resumed(l1), Equals, false)
+	keys, err := readSessionTicketKeys(writeKeys("rotated", key('c'), key('a')))
+	c.Assert(err, IsNil)
+	c.Assert(l1.SetSessionTicketKeys(keys), IsNil)
+	c.Assert(resumed(l1), Equals, true)
+	keys, err = readSessionTicketKeys(writeKeys("rotated", key('d'), key('c')))
+	c.Assert(err, IsNil)
+	c.Assert(l1.SetSessionTicketKeys(keys), IsNil)
+	c.Assert(resumed(l1), Equals, true)
+	keys, err = readSessionTicketKeys(writeKeys("rotated", key('e')))
+	c.Assert(err, IsNil)
+	c.Assert(l1.SetSessionTicketKeys(keys), IsNil)
+	c.Assert(resumed(l1), Equals, false)
+
+	// invalid key files prevent the listener starting
+	for _, keys := range [][]string{{}, {"invalid"}, {key('a'), base64.StdEncoding.EncodeToString([]byte("short"))}} {
+		_, err := start(writeKeys("invalid", keys...), 0)
+		c.Assert(err, NotNil)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// sidecarRouteID is the ID of the route served by sidecar listeners
+const sidecarRouteID = "sidecar"
+
+// NewSidecarHTTPListener starts an HTTPListener which only serves the given
+// domain, routing it to service, for deployments where each service runs
+// its own router. cert and key are the PEM encoded certificate and key of
+// the domain, which are optional. Routes in the data store are not served,
+// though they can still be managed using the API, and the listener's events
+// can be watched as usual.
+func NewSidecarHTTPListener(addr, tlsAddr string, ds DataStore, discoverdc DiscoverdClient, domain, service, cert, key string) (*HTTPListener, error) {
+	l := &HTTPListener{
+		Addr:      addr,
+		TLSAddr:   tlsAddr,
+		ds:        ds,
+		discoverd: discoverdc,
+		Sidecar:   true,
+	}
+	if cert != "" || key != "" {
+		keypair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		l.keypair = keypair
+	}
+	if err := l.Start(); err != nil {
+		return nil, err
+	}
+	if err := l.setSidecarRoute(domain, service, cert, key); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// setSidecarRoute sets the route served by a sidecar listener.
+func (s *HTTPListener) setSidecarRoute(domain, service, cert, key string) error {
+	route := &router.Route{
+		Type:    "http",
+		ID:      sidecarRouteID,
+		Domain:  domain,
+		Path:    "/",
+		Service: service,
+	}
+	if cert != "" {
+		route.Certificate = &router.Certificate{Cert: cert, Key: key}
+	}
+	return (&httpSyncHandler{l: s}).Set(route)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestSidecarHTTPListener(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	cert := tlsConfigForDomain("sidecar.example.com")
+	ds := newMemDataStore("http")
+	d := newMemDiscoverd()
+	l, err := NewSidecarHTTPListener("127.0.0.1:0", "127.0.0.1:0", ds, d, "sidecar.example.com", "test", cert.Cert, cert.PrivateKey)
+	c.Assert(err, IsNil)
+	defer l.Close()
+
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+
+	assertGet(c, "http://"+l.Addr, "sidecar.example.com", "1")
+	assertGet(c, "https://"+l.TLSAddr, "sidecar.example.com", "1")
+
+	// routes added to the data store are stored but not served
+	events := make(chan *router.Event, 10)
+	l.Watch(events, false)
+	defer l.Unwatch(events)
+	c.Assert(l.AddRoute(router.HTTPRoute{Domain: "other.example.com", Service: "test"}.ToRoute()), IsNil)
+	routes, err := l.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	select {
+	case e := <-events:
+		c.Fatalf("unexpected %s event", e.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "other.example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(l.findRoute("sidecar.example.com", "/").ID, Equals, sidecarRouteID)
+
+	// changes to the sidecar route are sent to watchers
+	wait := waitForEvent(c, l, "set", "sidecar.example.com")
+	c.Assert(l.setSidecarRoute("sidecar.example.com", "test", cert.Cert, cert.PrivateKey), IsNil)
+	c.Assert(wait().Route.ID, Equals, sidecarRouteID)
+}
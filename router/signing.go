@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// responseSignatureHeader is the header (or trailer) containing the signature
+// of responses to routes with ResponseSigningKey set
+const responseSignatureHeader = "X-Response-Signature"
+
+// maxBufferedSignedResponseBytes is the largest response body which is
+// buffered so that its signature can be sent in a header, with larger bodies
+// (or ones of unknown length) being streamed with it sent in a trailer
+const maxBufferedSignedResponseBytes = 64 << 10
+
+// signResponse signs the response body with the route's ResponseSigningKey.
+// Small bodies are buffered so that the signature can be sent in a header
+// along with their Content-Length, while other bodies are signed as they are
+// streamed to the client, without a Content-Length so that the signature
+// can be sent in a trailer once the body has been read.
+func (r *httpRoute) signResponse(res *http.Response) error {
+	// responses to HEAD requests have no body to sign
+	if res.Request != nil && res.Request.Method == "HEAD" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(r.ResponseSigningKey))
+	if res.ContentLength >= 0 && res.ContentLength <= maxBufferedSignedResponseBytes {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBufferedSignedResponseBytes))
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		mac.Write(body)
+		res.Header.Set(responseSignatureHeader, responseSignature(mac))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		res.ContentLength = int64(len(body))
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	if res.Trailer == nil {
+		res.Trailer = make(http.Header)
+	}
+	res.Trailer[responseSignatureHeader] = nil
+	res.Body = &signingBody{
+		Reader: io.TeeReader(res.Body, mac),
+		body:   res.Body,
+		res:    res,
+		mac:    mac,
+	}
+	return nil
+}
+
+// signingBody signs a response body as it is read, setting the signature
+// trailer of the response once it has been read in full.
+type signingBody struct {
+	io.Reader
+	body io.Closer
+	res  *http.Response
+	mac  hash.Hash
+}
+
+func (b *signingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.res.Trailer.Set(responseSignatureHeader, responseSignature(b.mac))
+	}
+	return n, err
+}
+
+func (b *signingBody) Close() error {
+	return b.body.Close()
+}
+
+func responseSignature(mac hash.Hash) string {
+	return "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
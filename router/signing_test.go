@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestResponseSigning(c *C) {
+	const fox = "The quick brown fox jumps over the lazy dog"
+	large := strings.Repeat("x", 100<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/small":
+			w.Write([]byte(fox))
+		case "/large":
+			w.Write([]byte(large))
+		case "/stream":
+			// flushing before writing the body means it is chunked
+			// with an unknown length
+			w.(http.Flusher).Flush()
+			w.Write([]byte(fox))
+		}
+	}))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	route := router.HTTPRoute{Domain: "example.com", Service: "test", ResponseSigningKey: "key"}.ToRoute()
+	addRoute(c, l, route)
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+
+	get := func(method, path string) (*http.Response, string) {
+		req := newReq("http://"+l.Addr+path, "example.com")
+		req.Method = method
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res, string(body)
+	}
+
+	// small responses are buffered and signed in a header
+	res, body := get("GET", "/small")
+	c.Assert(body, Equals, fox)
+	c.Assert(res.ContentLength, Equals, int64(len(fox)))
+	c.Assert(res.Header.Get("X-Response-Signature"), Equals, "sha256=97yD9DBThCSxMpjmqm+xQ+9NWaFJRhdZl0edvC0aPNg=")
+
+	// large responses and responses of unknown length are streamed and
+	// signed in a trailer
+	res, body = get("GET", "/large")
+	c.Assert(body, Equals, large)
+	c.Assert(res.ContentLength, Equals, int64(-1))
+	c.Assert(res.Header.Get("X-Response-Signature"), Equals, "")
+	c.Assert(res.Trailer.Get("X-Response-Signature"), Equals, "sha256=bbYKQ3tACxib9cUfcUELRmkiogBvBCELpLnDnOx9+oU=")
+	res, body = get("GET", "/stream")
+	c.Assert(body, Equals, fox)
+	c.Assert(res.Trailer.Get("X-Response-Signature"), Equals, "sha256=97yD9DBThCSxMpjmqm+xQ+9NWaFJRhdZl0edvC0aPNg=")
+
+	// empty bodies are signed, but responses to HEAD requests aren't
+	res, body = get("GET", "/empty")
+	c.Assert(body, Equals, "")
+	c.Assert(res.Header.Get("X-Response-Signature"), Equals, "sha256=XV0TlWPJW1lnub2ajJsjOp3ttFByeUzSMtwbdIMmB9A=")
+	res, _ = get("HEAD", "/small")
+	c.Assert(res.Header.Get("X-Response-Signature"), Equals, "")
+	c.Assert(res.ContentLength, Equals, int64(len(fox)))
+}
+
+func (s *S) TestResponseSigningKeyWriteOnly(c *C) {
+	l, ds, _ := newFakeHTTPListener(c)
+	defer l.Close()
+	route := router.HTTPRoute{Domain: "example.com", Service: "test", ResponseSigningKey: "key"}.ToRoute()
+	addRoute(c, l, route)
+	storedKey := func() string {
+		stored, err := ds.Get(route.ID)
+		c.Assert(err, IsNil)
+		return stored.ResponseSigningKey
+	}
+
+	// the key is redacted in routes returned by the API and in snapshots
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	api := client.NewWithAddr(srv.Listener.Addr().String())
+	got, err := api.GetRoute("http", route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.ResponseSigningKey, Equals, router.RedactedSecret)
+	snapshot, err := l.Snapshot()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Routes, HasLen, 1)
+	c.Assert(snapshot.Routes[0].ResponseSigningKey, Equals, router.RedactedSecret)
+
+	// updating a route with the redacted key keeps the current one, while
+	// other keys replace it
+	got.Service = "other"
+	c.Assert(api.UpdateRoute(got), IsNil)
+	c.Assert(storedKey(), Equals, "key")
+	got.ResponseSigningKey = ""
+	c.Assert(api.UpdateRoute(got), IsNil)
+	c.Assert(storedKey(), Equals, "")
+
+	// redacted keys of routes which don't exist yet are dropped
+	added := router.HTTPRoute{Domain: "example.net", Service: "test", ResponseSigningKey: router.RedactedSecret}.ToRoute()
+	c.Assert(l.AddRoute(added), IsNil)
+	stored, err := ds.Get(added.ID)
+	c.Assert(err, IsNil)
+	c.Assert(stored.ResponseSigningKey, Equals, "")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+var slowRequests = metrics.NewCounterVec(
+	"strowger_slow_requests_total",
+	"Number of requests which took longer than their route's slow request threshold to serve.",
+	"domain",
+)
+
+const ctxKeySlowRequest = "_slow_request"
+
+// validateSlowRequestThreshold checks that the route's slow request
+// threshold is valid.
+func validateSlowRequestThreshold(r *router.Route) error {
+	if r.SlowRequestThresholdMS >= 0 {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Slow request threshold invalid: slow_request_threshold_ms can't be negative",
+	}
+}
+
+// slowRequest records the progress of a request which is logged if it is
+// slow.
+type slowRequest struct {
+	start  time.Time
+	method string
+	path   string
+
+	// backend is the backend which responded, and firstByte the time from
+	// start until its response headers were read
+	backend   string
+	firstByte time.Duration
+}
+
+// trackSlowRequest returns req with a slowRequest recording it in its
+// context, for the backend's response to be recorded by modifyResponse.
+func trackSlowRequest(req *http.Request, start time.Time) (*http.Request, *slowRequest) {
+	s := &slowRequest{start: start, method: req.Method, path: req.URL.Path}
+	return req.WithContext(context.WithValue(req.Context(), ctxKeySlowRequest, s)), s
+}
+
+// recordSlowRequestResponse records the backend which sent res and when its
+// headers were read if the request is being tracked by trackSlowRequest.
+func recordSlowRequestResponse(res *http.Response) {
+	if res.Request == nil {
+		return
+	}
+	if s, ok := res.Request.Context().Value(ctxKeySlowRequest).(*slowRequest); ok {
+		s.backend = res.Request.URL.Host
+		s.firstByte = time.Since(s.start)
+	}
+}
+
+// checkSlowRequest logs a warning and counts the request if it has taken
+// longer than the route's slow request threshold, using the logger of the
+// route's proxy.
+func (r *httpRoute) checkSlowRequest(s *slowRequest) {
+	elapsed := time.Since(s.start)
+	if elapsed <= time.Duration(r.SlowRequestThresholdMS)*time.Millisecond {
+		return
+	}
+	slowRequests.Inc(r.Domain)
+	r.rp.Logger.Warn("slow request", "domain", r.Domain, "path", s.path, "method", s.method, "backend", s.backend, "first_byte", s.firstByte, "elapsed", elapsed)
+}
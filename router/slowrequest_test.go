@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (s *S) TestSlowRequestLogging(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	var mtx sync.Mutex
+	var records []*log15.Record
+	l := log15.New()
+	l.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		if r.Msg == "slow request" {
+			mtx.Lock()
+			records = append(records, r)
+			mtx.Unlock()
+		}
+		return nil
+	}))
+
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{Domain: "slow.example.com", Service: "test", SlowRequestThresholdMS: 100}}
+	backendAddr := backend.Listener.Addr().String()
+	r.rp = proxy.NewReverseProxy(func() []string { return []string{backendAddr} }, &[32]byte{}, false, &service{}, l)
+	r.rp.ModifyResponse = r.modifyResponse
+	serve := func(path string) {
+		w := newCloseNotifyRecorder()
+		ctx := ctxhelper.NewContextStartTime(context.Background(), time.Now())
+		r.ServeHTTP(ctx, w, httptest.NewRequest("GET", "http://slow.example.com"+path, nil))
+		c.Assert(w.Code, Equals, http.StatusOK)
+	}
+
+	// fast requests aren't logged
+	serve("/fast")
+	c.Assert(records, HasLen, 0)
+
+	// slow requests are logged once each
+	serve("/slow")
+	serve("/slow")
+	c.Assert(records, HasLen, 2)
+	ctx := make(map[string]interface{})
+	for i := 0; i < len(records[0].Ctx); i += 2 {
+		ctx[records[0].Ctx[i].(string)] = records[0].Ctx[i+1]
+	}
+	c.Assert(records[0].Lvl, Equals, log15.LvlWarn)
+	c.Assert(ctx["domain"], Equals, "slow.example.com")
+	c.Assert(ctx["path"], Equals, "/slow")
+	c.Assert(ctx["method"], Equals, "GET")
+	c.Assert(ctx["backend"], Equals, backendAddr)
+	c.Assert(ctx["first_byte"].(time.Duration) >= 200*time.Millisecond, Equals, true)
+	c.Assert(ctx["elapsed"].(time.Duration) >= ctx["first_byte"].(time.Duration), Equals, true)
+	c.Assert(metricValue(c, `strowger_slow_requests_total{domain="slow.example.com"}`), Equals, uint64(2))
+
+	c.Assert(validateSlowRequestThreshold(&router.Route{SlowRequestThresholdMS: -1}), NotNil)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errAmbiguousFraming is returned by checkRequestFraming for requests which
+// have both a Content-Length and a Transfer-Encoding or differing
+// Content-Lengths
+var errAmbiguousFraming = errors.New("router: request has ambiguous Content-Length and Transfer-Encoding")
+
+// smuggleHeader is the header of the requests which replace requests with
+// ambiguous framing, its value being the listener's secret smuggleMarker
+const smuggleHeader = "X-Router-Ambiguous-Request"
+
+// smuggleListener wraps the connections of a listener serving HTTP/1.x so
+// that requests with ambiguous framing, which frontend proxies and backends
+// may disagree about the length of, are rejected rather than being passed to
+// backends.
+//
+// net/http itself rejects requests with differing Content-Length headers and
+// with Transfer-Encodings other than chunked, but serves requests with both a
+// Content-Length and a chunked Transfer-Encoding by ignoring the
+// Content-Length, and ignores the Transfer-Encoding of HTTP/1.0 requests.
+// As neither is visible to handlers, the framing of each request is checked
+// as it is read from the connection, only passing a request's bytes on to
+// net/http once its headers have been checked. A request with ambiguous
+// framing is replaced by one with the smuggleHeader set to marker, which
+// HTTPListener.ServeHTTP responds to with a 400 before closing the
+// connection, and the rest of the connection is discarded.
+//
+// Requests continue to be checked after upgrade requests, as the backend may
+// refuse the upgrade, until the proxy calls SwitchProtocols once it has sent
+// a 101 response.
+type smuggleListener struct {
+	net.Listener
+	marker string
+}
+
+func (l smuggleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &smuggleConn{Conn: c, marker: l.marker}, nil
+}
+
+// maxSmuggleHeaderBytes is the size of request headers after which they are
+// no longer checked, net/http rejects headers larger than this
+const maxSmuggleHeaderBytes = http.DefaultMaxHeaderBytes + 4096
+
+type smuggleState int
+
+const (
+	smuggleStateHeader smuggleState = iota
+	smuggleStateBody
+	smuggleStateChunkSize
+	smuggleStateChunkData
+	smuggleStateTrailer
+	smuggleStatePassthrough
+	smuggleStateRejected
+)
+
+type smuggleConn struct {
+	net.Conn
+	marker string
+
+	// buf contains the bytes read from the connection which have not yet
+	// been read from the smuggleConn, only the first checked bytes of which
+	// can be read
+	buf     []byte
+	checked int
+
+	state smuggleState
+	// remaining is the number of bytes remaining of a body or chunk
+	remaining int64
+}
+
+func (c *smuggleConn) Read(b []byte) (int, error) {
+	for c.checked == 0 {
+		var tmp [4096]byte
+		n, err := c.Conn.Read(tmp[:])
+		c.buf = append(c.buf, tmp[:n]...)
+		if c.check() == errAmbiguousFraming {
+			c.reject()
+		}
+		// read errors are returned as they happen rather than after the
+		// buffered requests as net/http interrupts reads using deadlines
+		if err != nil && c.checked == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf[:c.checked])
+	c.buf = c.buf[n:]
+	c.checked -= n
+	return n, nil
+}
+
+// SwitchProtocols stops checking the connection, which is no longer
+// HTTP/1.x now that a 101 response has been sent. It is called by the proxy
+// after hijacking the connection, when it is no longer being read by
+// net/http.
+func (c *smuggleConn) SwitchProtocols() {
+	c.state = smuggleStatePassthrough
+	c.checked = len(c.buf)
+}
+
+// reject replaces the unchecked request at the start of c.buf[c.checked:]
+// with one which is rejected by HTTPListener.ServeHTTP.
+func (c *smuggleConn) reject() {
+	c.buf = append(c.buf[:c.checked], "GET / HTTP/1.1\r\nHost: invalid\r\nConnection: close\r\n"+smuggleHeader+": "+c.marker+"\r\n\r\n"...)
+	c.checked = len(c.buf)
+	c.state = smuggleStateRejected
+}
+
+// check advances c.checked through the unchecked bytes in c.buf, returning
+// an error if a request with ambiguous framing is found.
+func (c *smuggleConn) check() error {
+	for c.checked < len(c.buf) {
+		data := c.buf[c.checked:]
+		switch c.state {
+		case smuggleStatePassthrough:
+			c.checked = len(c.buf)
+
+		case smuggleStateRejected:
+			c.buf = c.buf[:c.checked]
+
+		case smuggleStateHeader:
+			end := headerEnd(data)
+			if end < 0 {
+				if len(data) > maxSmuggleHeaderBytes {
+					c.state = smuggleStatePassthrough
+					continue
+				}
+				return nil
+			}
+			state, length, err := checkRequestFraming(data[:end])
+			if err != nil {
+				return err
+			}
+			c.checked += end
+			c.state = state
+			c.remaining = length
+			if state == smuggleStateBody && length == 0 {
+				c.state = smuggleStateHeader
+			}
+
+		case smuggleStateBody, smuggleStateChunkData:
+			n := int64(len(data))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.checked += int(n)
+			c.remaining -= n
+			if c.remaining == 0 {
+				if c.state == smuggleStateBody {
+					c.state = smuggleStateHeader
+				} else {
+					c.state = smuggleStateChunkSize
+				}
+			}
+
+		case smuggleStateChunkSize:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				if len(data) > maxSmuggleHeaderBytes {
+					c.state = smuggleStatePassthrough
+					continue
+				}
+				return nil
+			}
+			line := strings.TrimSpace(string(data[:i]))
+			if j := strings.IndexByte(line, ';'); j >= 0 {
+				line = strings.TrimSpace(line[:j])
+			}
+			size, err := strconv.ParseInt(line, 16, 64)
+			if err != nil || size < 0 {
+				// let net/http reject the malformed chunk
+				c.state = smuggleStatePassthrough
+				continue
+			}
+			c.checked += i + 1
+			if size == 0 {
+				c.state = smuggleStateTrailer
+			} else {
+				c.state = smuggleStateChunkData
+				// the chunk data is followed by a CRLF
+				c.remaining = size + 2
+			}
+
+		case smuggleStateTrailer:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				if len(data) > maxSmuggleHeaderBytes {
+					c.state = smuggleStatePassthrough
+					continue
+				}
+				return nil
+			}
+			c.checked += i + 1
+			if len(bytes.TrimRight(data[:i], "\r")) == 0 {
+				c.state = smuggleStateHeader
+			}
+		}
+	}
+	return nil
+}
+
+// headerEnd returns the length of the request header at the start of data
+// including the terminating blank line, or -1 if it is incomplete.
+func headerEnd(data []byte) int {
+	for i := 0; i < len(data); {
+		j := bytes.IndexByte(data[i:], '\n')
+		if j < 0 {
+			return -1
+		}
+		line := data[i : i+j]
+		i += j + 1
+		// blank lines before the request line are part of the header
+		if len(bytes.TrimRight(line, "\r")) == 0 && len(bytes.TrimSpace(data[:i])) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRequestFraming checks the framing of the given request header,
+// returning the state to read the request body in and the length of the body
+// if it has a Content-Length.
+func checkRequestFraming(header []byte) (smuggleState, int64, error) {
+	lines := strings.Split(strings.TrimSpace(string(header)), "\n")
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 || !strings.HasPrefix(requestLine[2], "HTTP/1.") {
+		// leave requests which aren't HTTP/1.x (e.g. the HTTP/2
+		// connection preface) or which are malformed to net/http
+		return smuggleStatePassthrough, 0, nil
+	}
+	proto := requestLine[2]
+
+	var contentLengths, transferEncodings []string
+	var last string
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// a continuation of the previous header
+			if last == "Content-Length" || last == "Transfer-Encoding" {
+				return 0, 0, errAmbiguousFraming
+			}
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		last = name
+		switch name {
+		case "Content-Length", "Transfer-Encoding":
+			if strings.TrimSpace(line[:i]) != line[:i] {
+				// whitespace around the name may cause it to be
+				// ignored by some servers but not others
+				return 0, 0, errAmbiguousFraming
+			}
+			if name == "Content-Length" {
+				contentLengths = append(contentLengths, value)
+			} else {
+				transferEncodings = append(transferEncodings, value)
+			}
+		}
+	}
+
+	if len(transferEncodings) > 0 {
+		if len(contentLengths) > 0 || proto == "HTTP/1.0" {
+			return 0, 0, errAmbiguousFraming
+		}
+		if len(transferEncodings) > 1 || !strings.EqualFold(transferEncodings[0], "chunked") {
+			// net/http rejects other transfer encodings
+			return smuggleStatePassthrough, 0, nil
+		}
+		return smuggleStateChunkSize, 0, nil
+	}
+
+	for _, cl := range contentLengths {
+		if cl != contentLengths[0] {
+			return 0, 0, errAmbiguousFraming
+		}
+	}
+
+	if len(contentLengths) == 0 {
+		return smuggleStateBody, 0, nil
+	}
+	length, err := strconv.ParseInt(contentLengths[0], 10, 64)
+	if err != nil || length < 0 {
+		// net/http rejects invalid lengths
+		return smuggleStatePassthrough, 0, nil
+	}
+	return smuggleStateBody, length, nil
+}
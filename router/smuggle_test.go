@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestSmuggleProtection(c *C) {
+	type backendRequest struct {
+		path string
+		body string
+	}
+	requests := make(chan backendRequest, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/echo" {
+			// accept the upgrade and echo the connection
+			conn, bufrw, _ := w.(http.Hijacker).Hijack()
+			defer conn.Close()
+			conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+			io.Copy(conn, bufrw)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- backendRequest{path: req.URL.Path, body: string(body)}
+	}))
+	defer backend.Close()
+
+	newListener := func(protect bool) *HTTPListener {
+		l := &HTTPListener{
+			Addr:              "127.0.0.1:0",
+			SmuggleProtection: protect,
+			routes:            make(map[string]*httpRoute),
+			domains:           make(map[string]*node),
+			services:          make(map[string]*service),
+			discoverd:         newMemDiscoverd(),
+			wm:                NewWatchManager(),
+			cookieKey:         &[32]byte{},
+		}
+		c.Assert((&httpSyncHandler{l: l}).Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web"}), IsNil)
+		r := l.findRoute("example.com", "/")
+		c.Assert(r, NotNil)
+		backends := func() []string { return []string{backend.Listener.Addr().String()} }
+		r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+		c.Assert(l.listenAndServe(), IsNil)
+		return l
+	}
+
+	// send writes the raw requests to a new connection and returns the
+	// status codes of the responses read before the connection is closed
+	send := func(l *HTTPListener, raw string) []int {
+		conn, err := net.Dial("tcp", l.listener.Addr().String())
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		_, err = conn.Write([]byte(raw))
+		c.Assert(err, IsNil)
+		var codes []int
+		r := bufio.NewReader(conn)
+		for {
+			res, err := http.ReadResponse(r, nil)
+			if err != nil {
+				return codes
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			codes = append(codes, res.StatusCode)
+			if res.Close {
+				return codes
+			}
+		}
+	}
+	assertRequests := func(expected ...backendRequest) {
+		for _, req := range expected {
+			select {
+			case actual := <-requests:
+				c.Assert(actual, Equals, req)
+			default:
+				c.Fatalf("expected backend request %v", req)
+			}
+		}
+		select {
+		case req := <-requests:
+			c.Fatalf("unexpected backend request %v", req)
+		default:
+		}
+	}
+
+	l := newListener(true)
+	defer l.listener.Close()
+
+	for _, t := range []struct {
+		name     string
+		raw      string
+		codes    []int
+		requests []backendRequest
+	}{
+		{
+			name: "content length",
+			raw: "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello" +
+				"GET /bar HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			codes:    []int{200, 200},
+			requests: []backendRequest{{"/foo", "hello"}, {"/bar", ""}},
+		},
+		{
+			name: "chunked",
+			raw: "POST /foo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n1\r\n!\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+				"GET /bar HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			codes:    []int{200, 200},
+			requests: []backendRequest{{"/foo", "hello!"}, {"/bar", ""}},
+		},
+		{
+			name:     "repeated identical content length",
+			raw:      "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+			codes:    []int{200},
+			requests: []backendRequest{{"/foo", "hello"}},
+		},
+		{
+			name:  "content length and transfer encoding",
+			raw:   "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes: []int{400},
+		},
+		{
+			name:  "transfer encoding and content length",
+			raw:   "POST /foo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+			codes: []int{400},
+		},
+		{
+			name:  "differing content lengths",
+			raw:   "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\nContent-Length: 44\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes: []int{400},
+		},
+		{
+			name:  "folded transfer encoding",
+			raw:   "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nX-Foo: bar\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+			codes: []int{400},
+		},
+		{
+			name:  "HTTP/1.0 transfer encoding",
+			raw:   "POST /foo HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes: []int{400},
+		},
+		{
+			// requests before the smuggled request are served
+			name: "pipelined",
+			raw: "POST /foo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" +
+				"POST /bar HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes:    []int{200, 400},
+			requests: []backendRequest{{"/foo", "hello"}},
+		},
+		{
+			// requests which aren't upgrades, despite an Upgrade header,
+			// don't stop later requests being checked
+			name: "upgrade header",
+			raw: "GET /foo HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n\r\n" +
+				"POST /bar HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes:    []int{200, 400},
+			requests: []backendRequest{{"/foo", ""}},
+		},
+		{
+			// nor do upgrade requests which the backend refuses
+			name: "refused upgrade",
+			raw: "GET /foo HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" +
+				"POST /bar HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			codes:    []int{200},
+			requests: []backendRequest{{"/foo", ""}},
+		},
+	} {
+		c.Assert(send(l, t.raw), DeepEquals, t.codes, Commentf(t.name))
+		assertRequests(t.requests...)
+	}
+
+	// connections which have been upgraded are no longer checked
+	conn, err := net.Dial("tcp", l.listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	c.Assert(err, IsNil)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusSwitchingProtocols)
+	ambiguous := "POST /bar HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n"
+	_, err = conn.Write([]byte(ambiguous))
+	c.Assert(err, IsNil)
+	echo := make([]byte, len(ambiguous))
+	_, err = io.ReadFull(br, echo)
+	c.Assert(err, IsNil)
+	c.Assert(string(echo), Equals, ambiguous)
+
+	// requests with a Content-Length and Transfer-Encoding are served
+	// using the Transfer-Encoding without protection
+	unprotected := newListener(false)
+	defer unprotected.listener.Close()
+	c.Assert(send(unprotected, "POST /foo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n0\r\n\r\n"), DeepEquals, []int{200})
+	assertRequests(backendRequest{"/foo", ""})
+}
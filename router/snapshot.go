@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultSnapshotInterval is how often the local snapshot is written if
+// SnapshotInterval is zero
+const defaultSnapshotInterval = time.Minute
+
+// runLocalSnapshots periodically writes a snapshot of the routing table to
+// SnapshotPath so that the routes can be served if the router restarts while
+// the data store is unavailable.
+func (s *HTTPListener) runLocalSnapshots(ctx context.Context) {
+	interval := s.SnapshotInterval
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// keep the last good snapshot while the data store is unavailable
+		if !s.SyncStatus().Degraded {
+			if err := s.writeLocalSnapshot(); err != nil {
+				logger.Error("error writing local route snapshot", "path", s.SnapshotPath, "err", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeLocalSnapshot atomically replaces the snapshot at SnapshotPath. The
+// snapshot includes private keys, so is only readable by the owner.
+func (s *HTTPListener) writeLocalSnapshot() error {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.SnapshotPath, data)
+}
+
+// writeFileAtomic atomically replaces the file at path with data, which is
+// only readable by the owner.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadLocalSnapshot serves the routes in the snapshot at SnapshotPath, which
+// are replaced by the routes in the data store once syncing succeeds.
+func (s *HTTPListener) loadLocalSnapshot() error {
+	data, err := ioutil.ReadFile(s.SnapshotPath)
+	if err != nil {
+		return err
+	}
+	snapshot := &RouteSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return fmt.Errorf("router: error decoding snapshot %s: %s", s.SnapshotPath, err)
+	}
+	h := &httpSyncHandler{l: s}
+	for _, r := range snapshot.Routes {
+		// snapshots don't include write-only secrets
+		keepSecrets(r, nil)
+		if err := h.Set(r); err != nil {
+			return fmt.Errorf("router: error loading route %s from snapshot: %s", r.ID, err)
+		}
+	}
+	logger.Warn("serving routes from local snapshot", "path", s.SnapshotPath, "created_at", snapshot.CreatedAt, "routes", len(snapshot.Routes))
+	return nil
+}
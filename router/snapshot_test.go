@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestLocalSnapshot(c *C) {
+	dir, err := ioutil.TempDir("", "router-snapshot")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+
+	cert := tlsConfigForDomain("snapshot.example.org")
+	routes := []*router.Route{
+		{Type: "http", ID: "1", Domain: "snapshot.example.org", Path: "/", Service: "web", Certificate: &router.Certificate{Cert: cert.Cert, Key: cert.PrivateKey}},
+		{Type: "http", ID: "2", Domain: "snapshot.example.org", Path: "/api/", Service: "api"},
+	}
+	newListener := func(ds DataStore) *HTTPListener {
+		return &HTTPListener{
+			Addr:         "127.0.0.1:0",
+			TLSAddr:      "127.0.0.1:0",
+			ds:           ds,
+			discoverd:    newMemDiscoverd(),
+			SnapshotPath: path,
+		}
+	}
+
+	// write a snapshot from a listener which synced successfully
+	l := newListener(&fakeSyncDataStore{routes: routes})
+	c.Assert(l.writeLocalSnapshot(), IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// a listener whose initial sync fails serves the snapshot until syncing
+	// succeeds
+	defer func(d time.Duration) { syncRetryInterval = d }(syncRetryInterval)
+	syncRetryInterval = 10 * time.Millisecond
+	ds := &fakeSyncDataStore{syncs: make(chan func(context.Context, SyncHandler, chan<- struct{}) error, 2)}
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		return errors.New("connection refused")
+	}
+	resync := make(chan struct{})
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		<-resync
+		// the route removed from the data store while the router was
+		// down is removed
+		if err := h.Set(routes[0]); err != nil {
+			return err
+		}
+		for id := range h.Current() {
+			if id != routes[0].ID {
+				h.Remove(id)
+			}
+		}
+		close(startc)
+		<-ctx.Done()
+		return nil
+	}
+	l = newListener(ds)
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	c.Assert(l.SyncStatus().Degraded, Equals, true)
+	r := l.findRoute("snapshot.example.org", "/api/foo")
+	c.Assert(r, NotNil)
+	c.Assert(r.ID, Equals, "2")
+	r = l.findRoute("snapshot.example.org", "/")
+	c.Assert(r, NotNil)
+	c.Assert(r.keypair, NotNil)
+
+	close(resync)
+	timeout := time.After(5 * time.Second)
+	for l.SyncStatus().Degraded {
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for sync")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(l.findRoute("snapshot.example.org", "/api/foo").ID, Equals, "1")
+
+	// without a snapshot, the initial sync failing is fatal
+	c.Assert(os.Remove(path), IsNil)
+	ds = &fakeSyncDataStore{syncs: make(chan func(context.Context, SyncHandler, chan<- struct{}) error, 1)}
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		return errors.New("connection refused")
+	}
+	c.Assert(newListener(ds).Start(), ErrorMatches, "connection refused")
+}
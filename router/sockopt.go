@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SocketOpts are socket options set on an HTTPListener's sockets.
+type SocketOpts struct {
+	// NoDelay sets TCP_NODELAY on accepted connections, sending small
+	// writes immediately rather than coalescing them
+	NoDelay bool
+
+	// ReusePort sets SO_REUSEPORT on the listening sockets, so that other
+	// processes can listen on the same port with the kernel balancing
+	// connections between them
+	ReusePort bool
+
+	// KeepAlive enables TCP keepalives on accepted connections, with probes
+	// sent every KeepAliveInterval (defaulting to defaultKeepAliveInterval)
+	// once they are idle for that long
+	KeepAlive         bool
+	KeepAliveInterval time.Duration
+
+	// TCPReceiveBufferBytes and TCPSendBufferBytes, if set, are the sizes of
+	// the SO_RCVBUF and SO_SNDBUF socket buffers of the listening sockets
+	// and accepted connections, e.g. to increase the throughput of large
+	// transfers. Linux doubles the values set to allow for its bookkeeping
+	// overhead (so getsockopt returns twice the value), and caps them at
+	// net.core.rmem_max and net.core.wmem_max respectively.
+	TCPReceiveBufferBytes int
+	TCPSendBufferBytes    int
+}
+
+// defaultKeepAliveInterval is the TCP keepalive interval if SocketOpts has
+// no KeepAliveInterval, matching keepalive.ReusableListen
+const defaultKeepAliveInterval = 3 * time.Minute
+
+func (o SocketOpts) keepAliveInterval() time.Duration {
+	if o.KeepAliveInterval > 0 {
+		return o.KeepAliveInterval
+	}
+	return defaultKeepAliveInterval
+}
+
+// listen listens on the given TCP address with the options set. If none of
+// them are set, the socket is created by listenFunc as before.
+func (o SocketOpts) listen(addr string) (net.Listener, error) {
+	if o == (SocketOpts{}) {
+		return listenFunc("tcp4", addr)
+	}
+	lc := net.ListenConfig{
+		Control: o.control,
+		// keepalives are configured on accepted connections by
+		// sockoptListener
+		KeepAlive: -1,
+	}
+	l, err := lc.Listen(context.Background(), "tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return sockoptListener{TCPListener: l.(*net.TCPListener), opts: o}, nil
+}
+
+// sockoptListener sets socket options on the connections it accepts
+type sockoptListener struct {
+	*net.TCPListener
+	opts SocketOpts
+}
+
+// Accept accepts the next connection which its socket options can be set
+// on. Connections which they can't be set on (e.g. because they were reset
+// by the client) are logged and closed rather than returning an error,
+// which would stop the server accepting connections.
+func (l sockoptListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.opts.setConnOpts(conn); err != nil {
+			logger.Error("error setting socket options", "remote_addr", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
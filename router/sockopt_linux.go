@@ -0,0 +1,88 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define
+const soReusePort = 0x0F
+
+// control sets the options of the listening socket before it is bound, so
+// that the buffer sizes are inherited by accepted connections before the TCP
+// window scale is negotiated.
+func (o SocketOpts) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if o.ReusePort {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+				return
+			}
+		}
+		err = o.setBufferSizes(fd)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// setBufferSizes sets the SO_RCVBUF and SO_SNDBUF buffer sizes of the socket
+// if they are configured.
+func (o SocketOpts) setBufferSizes(fd uintptr) error {
+	if o.TCPReceiveBufferBytes > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.TCPReceiveBufferBytes); err != nil {
+			return err
+		}
+	}
+	if o.TCPSendBufferBytes > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.TCPSendBufferBytes)
+	}
+	return nil
+}
+
+// setConnOpts sets the options of an accepted connection.
+func (o SocketOpts) setConnOpts(conn *net.TCPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var noDelay, keepAlive int
+	if o.NoDelay {
+		noDelay = 1
+	}
+	if o.KeepAlive {
+		keepAlive = 1
+	}
+	secs := int(o.keepAliveInterval().Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	if cerr := raw.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, noDelay); err != nil {
+			return
+		}
+		if err = o.setBufferSizes(fd); err != nil {
+			return
+		}
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, keepAlive); err != nil || !o.KeepAlive {
+			return
+		}
+		if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); err != nil {
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
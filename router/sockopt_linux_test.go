@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestSocketOptions(c *C) {
+	// getsockopt returns the value of an option of the next connection
+	// accepted by l
+	getsockopt := func(l net.Listener, level, opt int) int {
+		client, err := net.Dial("tcp", l.Addr().String())
+		c.Assert(err, IsNil)
+		defer client.Close()
+		conn, err := l.Accept()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		c.Assert(err, IsNil)
+		var v int
+		c.Assert(raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), level, opt)
+		}), IsNil)
+		c.Assert(err, IsNil)
+		return v
+	}
+
+	for _, noDelay := range []bool{true, false} {
+		l, err := SocketOpts{NoDelay: noDelay, KeepAlive: true, KeepAliveInterval: 30 * time.Second}.listen("127.0.0.1:0")
+		c.Assert(err, IsNil)
+		c.Assert(getsockopt(l, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0, Equals, noDelay)
+		c.Assert(getsockopt(l, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE), Not(Equals), 0)
+		c.Assert(getsockopt(l, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL), Equals, 30)
+		l.Close()
+	}
+
+	// the buffer sizes are set on accepted connections, which Linux doubles
+	l, err := SocketOpts{TCPReceiveBufferBytes: 64 << 10, TCPSendBufferBytes: 32 << 10}.listen("127.0.0.1:0")
+	c.Assert(err, IsNil)
+	c.Assert(getsockopt(l, syscall.SOL_SOCKET, syscall.SO_RCVBUF), Equals, 2*64<<10)
+	c.Assert(getsockopt(l, syscall.SOL_SOCKET, syscall.SO_SNDBUF), Equals, 2*32<<10)
+	l.Close()
+
+	// with SO_REUSEPORT a second listener can use the same port
+	opts := SocketOpts{ReusePort: true}
+	l, err = opts.listen("127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer l.Close()
+	l2, err := opts.listen(l.Addr().String())
+	c.Assert(err, IsNil)
+	l2.Close()
+	_, err = SocketOpts{NoDelay: true}.listen(l.Addr().String())
+	c.Assert(err, NotNil)
+}
+
+// BenchmarkSocketBufferSizes measures the throughput of large responses sent
+// from sockets with the default buffer sizes and with larger ones.
+func BenchmarkSocketBufferSizes(b *testing.B) {
+	const responseSize = 16 << 20
+	response := make([]byte, responseSize)
+	for _, size := range []int{0, 256 << 10, 4 << 20} {
+		name := "default"
+		if size > 0 {
+			name = fmt.Sprintf("%dKiB", size>>10)
+		}
+		b.Run(name, func(b *testing.B) {
+			l, err := SocketOpts{TCPReceiveBufferBytes: size, TCPSendBufferBytes: size}.listen("127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						conn.Write(response)
+					}()
+				}
+			}()
+
+			b.SetBytes(responseSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(ioutil.Discard, conn)
+				conn.Close()
+				if err != nil || n != responseSize {
+					b.Fatalf("error reading response: read %d bytes, err=%v", n, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// control is a no-op, as SO_REUSEPORT is only supported on Linux, and the
+// buffer sizes are set on accepted connections by setConnOpts.
+func (o SocketOpts) control(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// setConnOpts sets the options of an accepted connection.
+func (o SocketOpts) setConnOpts(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.TCPReceiveBufferBytes > 0 {
+		if err := conn.SetReadBuffer(o.TCPReceiveBufferBytes); err != nil {
+			return err
+		}
+	}
+	if o.TCPSendBufferBytes > 0 {
+		if err := conn.SetWriteBuffer(o.TCPSendBufferBytes); err != nil {
+			return err
+		}
+	}
+	if err := conn.SetKeepAlive(o.KeepAlive); err != nil || !o.KeepAlive {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(o.keepAliveInterval())
+}
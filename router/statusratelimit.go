@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// statusRateWindow is the window the responses counted against the
+// thresholds of status rate limits are caused in
+var statusRateWindow = time.Minute
+
+// statusRateThrottleDelay is how long the requests of clients throttled by a
+// status rate limit are delayed
+var statusRateThrottleDelay = time.Second
+
+var statusRateLimitedRequests = metrics.NewCounterVec(
+	"strowger_status_rate_limited_requests_total",
+	"Number of requests throttled or blocked because the client caused too many responses with a status code.",
+	"action",
+)
+
+// validateStatusRateLimit checks that the route's status rate limits are
+// valid.
+func validateStatusRateLimit(entries []router.StatusRateEntry) error {
+	var msg string
+	seen := make(map[int]struct{}, len(entries))
+	for _, e := range entries {
+		if _, ok := seen[e.StatusCode]; ok {
+			msg = fmt.Sprintf("status_code %d is limited more than once", e.StatusCode)
+		} else if e.StatusCode < 100 || e.StatusCode > 599 {
+			msg = fmt.Sprintf("status_code %d is not a valid status code", e.StatusCode)
+		} else if e.Threshold <= 0 {
+			msg = fmt.Sprintf("threshold of status_code %d must be positive", e.StatusCode)
+		} else if e.Action != router.StatusRateActionThrottle && e.Action != router.StatusRateActionBlock {
+			msg = fmt.Sprintf("action %q must be %q or %q", e.Action, router.StatusRateActionThrottle, router.StatusRateActionBlock)
+		}
+		if msg != "" {
+			break
+		}
+		seen[e.StatusCode] = struct{}{}
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Status rate limit invalid: " + msg,
+	}
+}
+
+// statusRateLimitColumnValues are the values of a route's status rate limit
+// columns, stored as parallel arrays in the order of the entries
+type statusRateLimitColumnValues struct {
+	StatusCodes []int32
+	Thresholds  []int32
+	Actions     []string
+}
+
+func statusRateLimitColumns(entries []router.StatusRateEntry) statusRateLimitColumnValues {
+	var cols statusRateLimitColumnValues
+	for _, e := range entries {
+		cols.StatusCodes = append(cols.StatusCodes, int32(e.StatusCode))
+		cols.Thresholds = append(cols.Thresholds, int32(e.Threshold))
+		cols.Actions = append(cols.Actions, e.Action)
+	}
+	return cols
+}
+
+func statusRateLimitFromColumns(cols statusRateLimitColumnValues) []router.StatusRateEntry {
+	if len(cols.StatusCodes) == 0 {
+		return nil
+	}
+	entries := make([]router.StatusRateEntry, len(cols.StatusCodes))
+	for i, code := range cols.StatusCodes {
+		entries[i].StatusCode = int(code)
+		if i < len(cols.Thresholds) {
+			entries[i].Threshold = int(cols.Thresholds[i])
+		}
+		if i < len(cols.Actions) {
+			entries[i].Action = cols.Actions[i]
+		}
+	}
+	return entries
+}
+
+// slidingWindowCounter approximates the number of events in the last window
+// by adding the count of the current fixed window to the count of the
+// previous one weighted by how much of it the sliding window still covers.
+type slidingWindowCounter struct {
+	start time.Time
+	prev  int
+	curr  int
+}
+
+// advance moves the current fixed window forward to the one now is in.
+func (c *slidingWindowCounter) advance(now time.Time, window time.Duration) {
+	if c.start.IsZero() {
+		c.start = now
+		return
+	}
+	n := now.Sub(c.start) / window
+	if n <= 0 {
+		return
+	}
+	if n == 1 {
+		c.prev = c.curr
+	} else {
+		c.prev = 0
+	}
+	c.curr = 0
+	c.start = c.start.Add(n * window)
+}
+
+func (c *slidingWindowCounter) inc(now time.Time, window time.Duration) {
+	c.advance(now, window)
+	c.curr++
+}
+
+func (c *slidingWindowCounter) count(now time.Time, window time.Duration) float64 {
+	c.advance(now, window)
+	overlap := 1 - float64(now.Sub(c.start))/float64(window)
+	return float64(c.prev)*overlap + float64(c.curr)
+}
+
+// clientStatusCounts are the counts of the responses a single client caused
+// with each of the limited status codes, in the order of the entries
+type clientStatusCounts struct {
+	ip     string
+	counts []slidingWindowCounter
+}
+
+// statusRateLimiter counts the responses with limited status codes each
+// client causes, keeping the counts of the most recently seen clients in an
+// LRU list.
+type statusRateLimiter struct {
+	entries []router.StatusRateEntry
+	window  time.Duration
+	max     int
+
+	mtx     sync.Mutex
+	clients map[string]*list.Element
+	// lru holds the *clientStatusCounts of each client, most recently seen
+	// first
+	lru *list.List
+}
+
+func newStatusRateLimiter(entries []router.StatusRateEntry) *statusRateLimiter {
+	return &statusRateLimiter{
+		entries: entries,
+		window:  statusRateWindow,
+		max:     defaultMaxTrackedClients,
+		clients: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// client returns the counts of the client, creating them if create is set.
+// The caller must hold l.mtx.
+func (l *statusRateLimiter) client(ip string, create bool) *clientStatusCounts {
+	if e, ok := l.clients[ip]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*clientStatusCounts)
+	}
+	if !create {
+		return nil
+	}
+	if l.lru.Len() >= l.max {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientStatusCounts).ip)
+	}
+	c := &clientStatusCounts{ip: ip, counts: make([]slidingWindowCounter, len(l.entries))}
+	l.clients[ip] = l.lru.PushFront(c)
+	return c
+}
+
+// record counts a response with the given status caused by the client.
+func (l *statusRateLimiter) record(ip string, status int, now time.Time) {
+	for i, e := range l.entries {
+		if e.StatusCode != status {
+			continue
+		}
+		l.mtx.Lock()
+		defer l.mtx.Unlock()
+		l.client(ip, true).counts[i].inc(now, l.window)
+		return
+	}
+}
+
+// action returns the action to apply to the client's requests, which is
+// "block" if it has exceeded the threshold of any blocking entry, "throttle"
+// if it has only exceeded throttling ones, or empty if it hasn't exceeded any.
+func (l *statusRateLimiter) action(ip string, now time.Time) string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	c := l.client(ip, false)
+	if c == nil {
+		return ""
+	}
+	var action string
+	for i, e := range l.entries {
+		if c.counts[i].count(now, l.window) <= float64(e.Threshold) {
+			continue
+		}
+		if e.Action == router.StatusRateActionBlock {
+			return e.Action
+		}
+		action = e.Action
+	}
+	return action
+}
+
+// equal returns whether l and other have the same limits.
+func (l *statusRateLimiter) equal(other *statusRateLimiter) bool {
+	if l.window != other.window || len(l.entries) != len(other.entries) {
+		return false
+	}
+	for i, e := range l.entries {
+		if e != other.entries[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkStatusRateLimit applies the action of the route's status rate limits
+// which the client has exceeded, responding with a 429 and returning false
+// if it is blocked, or delaying the request if it is throttled.
+func (r *httpRoute) checkStatusRateLimit(ctx context.Context, w http.ResponseWriter, ip string) bool {
+	switch action := r.statusLimiter.action(ip, time.Now()); action {
+	case router.StatusRateActionBlock:
+		statusRateLimitedRequests.Inc(action)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(r.statusLimiter.window.Seconds()))))
+		fail(w, http.StatusTooManyRequests)
+		return false
+	case router.StatusRateActionThrottle:
+		statusRateLimitedRequests.Inc(action)
+		select {
+		case <-time.After(statusRateThrottleDelay):
+		case <-ctx.Done():
+		}
+	}
+	return true
+}
+
+// statusRecordingWriter records the status of the response written through
+// it so that it can be counted against the route's status rate limits.
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingWriter) WriteHeader(status int) {
+	// informational responses (e.g. 103 Early Hints) precede the response
+	// rather than being part of it
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecordingWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *statusRecordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *statusRecordingWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
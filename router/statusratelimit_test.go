@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestStatusRateLimit(c *C) {
+	defer func(d time.Duration) { statusRateThrottleDelay = d }(statusRateThrottleDelay)
+	statusRateThrottleDelay = 50 * time.Millisecond
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	r, stop := addFakeRoute(c, l, d, &router.Route{
+		Type:    "http",
+		Domain:  "example.com",
+		Path:    "/",
+		Service: "web",
+		StatusRateLimit: []router.StatusRateEntry{
+			{StatusCode: 404, Threshold: 100, Action: router.StatusRateActionBlock},
+			{StatusCode: 401, Threshold: 5, Action: router.StatusRateActionThrottle},
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/login":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/":
+			w.Write([]byte("ok"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer stop()
+
+	get := func(path, remoteIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		// clients can't evade the limits by setting X-Forwarded-For
+		req.Header.Set("X-Forwarded-For", random.Hex(4))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(context.Background(), w, req)
+		return w
+	}
+
+	// a brute force client is blocked once it has caused more than 100
+	// 404s in a minute
+	blocked := statusRateLimitedRequests.Value(router.StatusRateActionBlock)
+	for i := 0; i < 100; i++ {
+		c.Assert(get("/guess", "10.0.0.1").Code, Equals, http.StatusNotFound)
+	}
+	c.Assert(get("/", "10.0.0.1").Code, Equals, http.StatusOK)
+	c.Assert(get("/guess", "10.0.0.1").Code, Equals, http.StatusNotFound)
+	for i := 0; i < 5; i++ {
+		w := get("/", "10.0.0.1")
+		c.Assert(w.Code, Equals, http.StatusTooManyRequests)
+		c.Assert(w.Header().Get("Retry-After"), Equals, "60")
+	}
+	c.Assert(statusRateLimitedRequests.Value(router.StatusRateActionBlock)-blocked, Equals, uint64(5))
+
+	// other clients are unaffected
+	c.Assert(get("/", "10.0.0.2").Code, Equals, http.StatusOK)
+
+	// clients which cause too many 401s are throttled
+	throttled := statusRateLimitedRequests.Value(router.StatusRateActionThrottle)
+	for i := 0; i < 6; i++ {
+		c.Assert(get("/login", "10.0.0.3").Code, Equals, http.StatusUnauthorized)
+	}
+	c.Assert(statusRateLimitedRequests.Value(router.StatusRateActionThrottle), Equals, throttled)
+	start := time.Now()
+	c.Assert(get("/", "10.0.0.3").Code, Equals, http.StatusOK)
+	c.Assert(time.Since(start) >= statusRateThrottleDelay, Equals, true)
+	c.Assert(statusRateLimitedRequests.Value(router.StatusRateActionThrottle)-throttled, Equals, uint64(1))
+}
+
+func (s *S) TestSlidingWindowCounter(c *C) {
+	var counter slidingWindowCounter
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		counter.inc(now, time.Minute)
+	}
+	c.Assert(counter.count(now.Add(30*time.Second), time.Minute), Equals, float64(10))
+
+	// the previous window's count is weighted by how much of it the
+	// sliding window covers
+	counter.inc(now.Add(90*time.Second), time.Minute)
+	c.Assert(counter.count(now.Add(90*time.Second), time.Minute), Equals, float64(6))
+
+	// counts older than the previous window are forgotten
+	c.Assert(counter.count(now.Add(4*time.Minute), time.Minute), Equals, float64(0))
+}
+
+func (s *S) TestValidateStatusRateLimit(c *C) {
+	c.Assert(validateStatusRateLimit(nil), IsNil)
+	c.Assert(validateStatusRateLimit([]router.StatusRateEntry{
+		{StatusCode: 401, Threshold: 100, Action: router.StatusRateActionBlock},
+		{StatusCode: 404, Threshold: 100, Action: router.StatusRateActionThrottle},
+	}), IsNil)
+	for _, entries := range [][]router.StatusRateEntry{
+		{{StatusCode: 700, Threshold: 100, Action: router.StatusRateActionBlock}},
+		{{StatusCode: 401, Action: router.StatusRateActionBlock}},
+		{{StatusCode: 401, Threshold: 100, Action: "ban"}},
+		{
+			{StatusCode: 401, Threshold: 100, Action: router.StatusRateActionBlock},
+			{StatusCode: 401, Threshold: 10, Action: router.StatusRateActionThrottle},
+		},
+	} {
+		c.Assert(validateStatusRateLimit(entries), NotNil)
+	}
+}
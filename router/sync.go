@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+// syncRetryInterval is how long to wait before restarting a failed sync
+var syncRetryInterval = 2 * time.Second
+
+var syncErrors = metrics.NewCounter(
+	"strowger_sync_errors_total",
+	"Number of times syncing routes from the data store failed.",
+)
+
+// SyncStatus returns the status of syncing routes from the data store.
+func (s *HTTPListener) SyncStatus() *router.SyncStatus {
+	s.syncMtx.Lock()
+	defer s.syncMtx.Unlock()
+	status := s.syncStatus
+	return &status
+}
+
+// synced records a successful sync, logging if syncing has recovered.
+func (s *HTTPListener) synced() {
+	s.syncMtx.Lock()
+	defer s.syncMtx.Unlock()
+	if s.syncStatus.Degraded {
+		logger.Info("route sync recovered", "degraded_for", time.Since(s.syncStatus.DegradedSince))
+	}
+	now := time.Now()
+	s.syncStatus = router.SyncStatus{
+		LastSyncedAt: now,
+		Index:        s.syncStatus.Index,
+		LastEventAt:  now,
+	}
+}
+
+// syncEvent records a route change synced from the data store.
+func (s *HTTPListener) syncEvent() {
+	s.syncMtx.Lock()
+	defer s.syncMtx.Unlock()
+	s.syncStatus.Index++
+	s.syncStatus.LastEventAt = time.Now()
+}
+
+// dataStoreSyncHandler is a SyncHandler which records the route changes
+// synced from the data store in the listener's sync status.
+type dataStoreSyncHandler struct {
+	*httpSyncHandler
+}
+
+func (h dataStoreSyncHandler) Set(route *router.Route) error {
+	if err := h.httpSyncHandler.Set(route); err != nil {
+		return err
+	}
+	h.l.syncEvent()
+	return nil
+}
+
+func (h dataStoreSyncHandler) Remove(id string) error {
+	if err := h.httpSyncHandler.Remove(id); err != nil {
+		return err
+	}
+	h.l.syncEvent()
+	return nil
+}
+
+// syncFailed records a failed sync, after which the last known routes are
+// served until syncing recovers.
+func (s *HTTPListener) syncFailed(err error) {
+	syncErrors.Inc()
+	s.syncMtx.Lock()
+	defer s.syncMtx.Unlock()
+	if !s.syncStatus.Degraded {
+		logger.Error("route sync failed, serving last known routes", "err", err, "last_synced_at", s.syncStatus.LastSyncedAt)
+		s.syncStatus.Degraded = true
+		s.syncStatus.DegradedSince = time.Now()
+	} else {
+		logger.Error("route sync retry failed", "err", err, "degraded_since", s.syncStatus.DegradedSince)
+	}
+	s.syncStatus.LastError = err.Error()
+}
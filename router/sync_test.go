@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+// fakeSyncDataStore is a DataStore whose syncs run the given functions in
+// order
+type fakeSyncDataStore struct {
+	DataStore
+	syncs  chan func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error
+	routes []*router.Route
+}
+
+func (d *fakeSyncDataStore) List() ([]*router.Route, error) {
+	return d.routes, nil
+}
+
+func (d *fakeSyncDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+	return (<-d.syncs)(ctx, h, startc)
+}
+
+func (s *S) TestSyncDegraded(c *C) {
+	defer func(d time.Duration) { syncRetryInterval = d }(syncRetryInterval)
+	syncRetryInterval = 10 * time.Millisecond
+
+	ds := &fakeSyncDataStore{syncs: make(chan func(context.Context, SyncHandler, chan<- struct{}) error, 3)}
+	l := &HTTPListener{
+		routes:    make(map[string]*httpRoute),
+		domains:   make(map[string]*node),
+		services:  make(map[string]*service),
+		ds:        ds,
+		discoverd: newMemDiscoverd(),
+		wm:        NewWatchManager(),
+		cookieKey: &[32]byte{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first sync loads a route then fails, the first retry fails once
+	// the test allows it to, and the second retry succeeds
+	disconnect := make(chan error)
+	retry := make(chan struct{})
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		if err := h.Set(&router.Route{Type: "http", ID: "1", Domain: "example.com", Path: "/", Service: "web"}); err != nil {
+			return err
+		}
+		close(startc)
+		return <-disconnect
+	}
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		<-retry
+		return errors.New("still disconnected")
+	}
+	ds.syncs <- func(ctx context.Context, h SyncHandler, startc chan<- struct{}) error {
+		if err := h.Set(&router.Route{Type: "http", ID: "2", Domain: "foo.example.com", Path: "/", Service: "foo"}); err != nil {
+			return err
+		}
+		close(startc)
+		<-ctx.Done()
+		return nil
+	}
+
+	waitForStatus := func(degraded bool) *router.SyncStatus {
+		timeout := time.After(5 * time.Second)
+		for {
+			status := l.SyncStatus()
+			if status.Degraded == degraded {
+				return status
+			}
+			select {
+			case <-timeout:
+				c.Fatalf("timed out waiting for sync status degraded=%t", degraded)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	failures := syncErrors.Value()
+	c.Assert(l.startSync(ctx), IsNil)
+	status := l.SyncStatus()
+	c.Assert(status.Degraded, Equals, false)
+	c.Assert(status.LastSyncedAt.IsZero(), Equals, false)
+	lastSynced := status.LastSyncedAt
+	c.Assert(status.Index, Equals, uint64(1))
+	c.Assert(status.LastEventAt, Equals, lastSynced)
+
+	// the last known routes are served while degraded
+	disconnect <- errors.New("connection lost")
+	status = waitForStatus(true)
+	c.Assert(status.LastError, Equals, "connection lost")
+	c.Assert(status.LastSyncedAt, Equals, lastSynced)
+	c.Assert(status.Index, Equals, uint64(1))
+	c.Assert(status.LastEventAt, Equals, lastSynced)
+	c.Assert(l.findRoute("example.com", "/"), NotNil)
+
+	close(retry)
+	status = waitForStatus(false)
+	c.Assert(status.LastError, Equals, "")
+	c.Assert(status.LastSyncedAt.After(lastSynced), Equals, true)
+	c.Assert(status.Index, Equals, uint64(2))
+	c.Assert(status.LastEventAt, Equals, status.LastSyncedAt)
+	c.Assert(syncErrors.Value(), Equals, failures+2)
+}
@@ -22,6 +22,10 @@ type TCPListener struct {
 
 	IP string
 
+	// ReadOnly, if set, prevents routes being modified through the listener
+	// while still syncing and serving them
+	ReadOnly bool
+
 	discoverd DiscoverdClient
 	ds        DataStore
 	wm        *WatchManager
@@ -46,15 +50,25 @@ func (l *TCPListener) AddRoute(route *router.Route) error {
 	if l.closed {
 		return ErrClosed
 	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
 	for _, port := range l.reservedPorts {
 		if r.Port == port {
 			return fmt.Errorf("cannot bind to reserved port %d", port)
 		}
 	}
+	var err error
 	if r.Port == 0 {
-		return l.addWithAllocatedPort(route)
+		err = l.addWithAllocatedPort(route)
+	} else {
+		err = l.ds.Add(route)
+	}
+	if err != nil {
+		return err
 	}
-	return l.ds.Add(route)
+	go checkServiceInstances(l.discoverd, route)
+	return nil
 }
 
 func (l *TCPListener) UpdateRoute(route *router.Route) error {
@@ -64,6 +78,9 @@ func (l *TCPListener) UpdateRoute(route *router.Route) error {
 	if l.closed {
 		return ErrClosed
 	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
 	if r.Port == 0 {
 		return errors.New("router: a port number needs to be specified")
 	}
@@ -92,6 +109,9 @@ func (l *TCPListener) RemoveRoute(id string) error {
 	if l.closed {
 		return ErrClosed
 	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
 	return l.ds.Remove(id)
 }
 
@@ -238,14 +258,15 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		}
 
 		service = newService(r.Service, sc, h.l.wm, r.DrainBackends)
+		go service.replaceStaleCaches(h.l.discoverd.Service(r.Service))
 		h.l.services[r.Service] = service
 	}
 	r.service = service
 	var bf proxy.BackendListFunc
 	if r.Leader {
-		bf = service.sc.LeaderAddr
+		bf = service.LeaderAddr
 	} else {
-		bf = service.sc.Addrs
+		bf = service.Addrs
 	}
 	r.rp = proxy.NewReverseProxy(bf, nil, false, service, logger)
 	if listener, ok := h.l.listeners[r.Port]; ok {
@@ -264,7 +285,7 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 	h.l.routes[data.ID] = r
 	h.l.ports[r.Port] = r
 
-	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: data.ID, Route: r.ToRoute()})
+	h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: data.ID, Route: r.ToRoute()})
 	return nil
 }
 
@@ -282,13 +303,13 @@ func (h *tcpSyncHandler) Remove(id string) error {
 
 	r.service.refs--
 	if r.service.refs <= 0 {
-		r.service.sc.Close()
+		r.service.Close()
 		delete(h.l.services, r.service.name)
 	}
 
 	delete(h.l.routes, id)
 	delete(h.l.ports, r.Port)
-	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
+	h.l.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
 	return nil
 }
 
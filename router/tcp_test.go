@@ -120,6 +120,18 @@ func (s *S) TestAddTCPRouteReservedPort(c *C) {
 	}
 }
 
+func (s *S) TestAddTCPRouteDisabledHTTPListener(c *C) {
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	// the HTTP listener is disabled with -http-port=0
+	l.reservedPorts = reservedPorts(0, 443)
+	c.Assert(l.reservedPorts, DeepEquals, []int{443})
+
+	route := addTCPRoute(c, l, 0)
+	c.Assert(route.Port >= l.startPort && route.Port <= l.endPort, Equals, true)
+}
+
 func addTCPRoute(c *C, l *TCPListener, port int) *router.TCPRoute {
 	wait := waitForEvent(c, l, "set", "")
 	r := router.TCPRoute{
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+)
+
+// validateBackendTimeout checks that the route's backend timeout is valid.
+func validateBackendTimeout(r *router.Route) error {
+	if r.BackendTimeoutMS >= 0 {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Backend timeout invalid: backend_timeout_ms can't be negative",
+	}
+}
+
+// backendTimeout returns how long the route's backends have to respond to a
+// request in full, or zero if there is no limit.
+func (r *httpRoute) backendTimeout() time.Duration {
+	ms := r.BackendTimeoutMS
+	if ms == 0 && r.config != nil {
+		ms = r.config().BackendTimeoutMS
+	}
+	return time.Duration(ms) * time.Millisecond
+}
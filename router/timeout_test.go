@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+)
+
+func (s *S) TestBackendTimeout(c *C) {
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		delay, _ := time.ParseDuration(req.URL.Query().Get("delay"))
+		if req.URL.Path == "/body" {
+			// respond with the headers straight away then stall
+			// sending the body
+			w.Header().Set("Content-Length", "2")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(delay):
+		case <-done:
+		}
+		w.Write([]byte("b"))
+	}))
+	defer backend.Close()
+	// unblock stalled handlers before closing the backend
+	defer close(done)
+
+	config := &ListenerConfig{BackendTimeoutMS: 50}
+	r := &httpRoute{
+		HTTPRoute: &router.HTTPRoute{Domain: "example.com", Service: "test"},
+		config:    func() *ListenerConfig { return config },
+	}
+	backends := func() []string { return []string{backend.Listener.Addr().String()} }
+	r.rp = proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, logger)
+	serve := func(path string) (*closeNotifyRecorder, time.Duration) {
+		w := newCloseNotifyRecorder()
+		start := time.Now()
+		r.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		return w, time.Since(start)
+	}
+
+	// backends which don't respond in time get a 504
+	w, elapsed := serve("/?delay=10s")
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+	c.Assert(elapsed < 5*time.Second, Equals, true)
+	c.Assert(metricValue(c, `strowger_backend_errors_total{kind="timeout"}`) > 0, Equals, true)
+
+	// those which respond in time are unaffected
+	w, _ = serve("/?delay=0s")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "b")
+
+	// the timeout covers reading the body, which is cut short once
+	// the response has been sent
+	w, elapsed = serve("/body?delay=10s")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "a")
+	c.Assert(elapsed < 5*time.Second, Equals, true)
+
+	// routes can override the listener's timeout
+	r.BackendTimeoutMS = 1000
+	w, _ = serve("/?delay=100ms")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	config = &ListenerConfig{}
+	r.BackendTimeoutMS = 0
+	w, _ = serve("/?delay=100ms")
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	c.Assert(validateBackendTimeout(&router.Route{BackendTimeoutMS: -1}), NotNil)
+	c.Assert((&HTTPListener{}).Reload(&ListenerConfig{BackendTimeoutMS: -1}), NotNil)
+}
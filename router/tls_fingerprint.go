@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+
+	extensionServerName      = 0
+	extensionSupportedGroups = 10
+	extensionPointFormats    = 11
+
+	// maxClientHelloSize limits how much data is buffered while reading a
+	// ClientHello which spans multiple records
+	maxClientHelloSize = 64 * 1024
+)
+
+var (
+	errInvalidClientHello = errors.New("router: invalid TLS ClientHello")
+	errBlockedFingerprint = errors.New("router: blocked TLS fingerprint")
+)
+
+// clientHello contains the fields of a TLS ClientHello used to compute its
+// JA3 fingerprint (https://github.com/salesforce/ja3).
+type clientHello struct {
+	version      uint16
+	cipherSuites []uint16
+	extensions   []uint16
+	curves       []uint16
+	points       []uint8
+	serverName   string
+}
+
+// JA3 returns the JA3 string of the ClientHello, with GREASE values removed.
+func (h *clientHello) JA3() string {
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(int(h.version)))
+	buf.WriteByte(',')
+	writeJA3List(&buf, h.cipherSuites)
+	buf.WriteByte(',')
+	writeJA3List(&buf, h.extensions)
+	buf.WriteByte(',')
+	writeJA3List(&buf, h.curves)
+	buf.WriteByte(',')
+	for i, p := range h.points {
+		if i > 0 {
+			buf.WriteByte('-')
+		}
+		buf.WriteString(strconv.Itoa(int(p)))
+	}
+	return buf.String()
+}
+
+// JA3Hash returns the MD5 hash of the JA3 string.
+func (h *clientHello) JA3Hash() string {
+	digest := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(digest[:])
+}
+
+func writeJA3List(buf *bytes.Buffer, values []uint16) {
+	first := true
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if !first {
+			buf.WriteByte('-')
+		}
+		buf.WriteString(strconv.Itoa(int(v)))
+		first = false
+	}
+}
+
+// isGREASE returns whether v is a GREASE value (RFC 8701), which are
+// ignored by JA3
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// readClientHello reads the TLS records containing the ClientHello from r,
+// returning the parsed ClientHello along with the raw bytes read.
+func readClientHello(r io.Reader) (*clientHello, []byte, error) {
+	var raw, msg []byte
+	for {
+		header := make([]byte, 5)
+		n, err := io.ReadFull(r, header)
+		raw = append(raw, header[:n]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		if header[0] != recordTypeHandshake {
+			return nil, raw, errInvalidClientHello
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if len(raw)+length > maxClientHelloSize {
+			return nil, raw, errInvalidClientHello
+		}
+		body := make([]byte, length)
+		n, err = io.ReadFull(r, body)
+		raw = append(raw, body[:n]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		msg = append(msg, body...)
+
+		if len(msg) < 4 {
+			continue
+		}
+		msgLen := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if len(msg) >= msgLen {
+			hello, err := parseClientHello(msg[:msgLen])
+			return hello, raw, err
+		}
+	}
+}
+
+// parseClientHello parses a ClientHello handshake message
+func parseClientHello(msg []byte) (*clientHello, error) {
+	if len(msg) < 4 || msg[0] != handshakeTypeClientHello {
+		return nil, errInvalidClientHello
+	}
+	s := helloReader(msg[4:])
+	hello := &clientHello{}
+
+	var random, sessionID, cipherSuites, compression []byte
+	if !s.readUint16(&hello.version) ||
+		!s.readBytes(32, &random) ||
+		!s.readUint8LengthPrefixed(&sessionID) ||
+		!s.readUint16LengthPrefixed(&cipherSuites) ||
+		!s.readUint8LengthPrefixed(&compression) {
+		return nil, errInvalidClientHello
+	}
+	if len(cipherSuites)%2 != 0 {
+		return nil, errInvalidClientHello
+	}
+	for i := 0; i < len(cipherSuites); i += 2 {
+		hello.cipherSuites = append(hello.cipherSuites, binary.BigEndian.Uint16(cipherSuites[i:]))
+	}
+
+	if len(s) == 0 {
+		// no extensions
+		return hello, nil
+	}
+	var extensions []byte
+	if !s.readUint16LengthPrefixed(&extensions) {
+		return nil, errInvalidClientHello
+	}
+	exts := helloReader(extensions)
+	for len(exts) > 0 {
+		var typ uint16
+		var data []byte
+		if !exts.readUint16(&typ) || !exts.readUint16LengthPrefixed(&data) {
+			return nil, errInvalidClientHello
+		}
+		hello.extensions = append(hello.extensions, typ)
+
+		d := helloReader(data)
+		switch typ {
+		case extensionServerName:
+			var names []byte
+			if !d.readUint16LengthPrefixed(&names) {
+				return nil, errInvalidClientHello
+			}
+			n := helloReader(names)
+			for len(n) > 0 {
+				var nameType uint8
+				var name []byte
+				if !n.readUint8(&nameType) || !n.readUint16LengthPrefixed(&name) {
+					return nil, errInvalidClientHello
+				}
+				if nameType == 0 {
+					hello.serverName = strings.TrimSuffix(string(name), ".")
+				}
+			}
+		case extensionSupportedGroups:
+			var groups []byte
+			if !d.readUint16LengthPrefixed(&groups) || len(groups)%2 != 0 {
+				return nil, errInvalidClientHello
+			}
+			for i := 0; i < len(groups); i += 2 {
+				hello.curves = append(hello.curves, binary.BigEndian.Uint16(groups[i:]))
+			}
+		case extensionPointFormats:
+			var points []byte
+			if !d.readUint8LengthPrefixed(&points) {
+				return nil, errInvalidClientHello
+			}
+			hello.points = append(hello.points, points...)
+		}
+	}
+	return hello, nil
+}
+
+// helloReader reads big-endian values from a ClientHello
+type helloReader []byte
+
+func (s *helloReader) readBytes(n int, out *[]byte) bool {
+	if len(*s) < n {
+		return false
+	}
+	*out = (*s)[:n]
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *helloReader) readUint8(out *uint8) bool {
+	var b []byte
+	if !s.readBytes(1, &b) {
+		return false
+	}
+	*out = b[0]
+	return true
+}
+
+func (s *helloReader) readUint16(out *uint16) bool {
+	var b []byte
+	if !s.readBytes(2, &b) {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(b)
+	return true
+}
+
+func (s *helloReader) readUint8LengthPrefixed(out *[]byte) bool {
+	var n uint8
+	return s.readUint8(&n) && s.readBytes(int(n), out)
+}
+
+func (s *helloReader) readUint16LengthPrefixed(out *[]byte) bool {
+	var n uint16
+	return s.readUint16(&n) && s.readBytes(int(n), out)
+}
+
+// fingerprintListener wraps accepted connections so that the JA3 fingerprint
+// of their ClientHello is computed before the TLS handshake proceeds.
+// Connections are closed without completing the handshake if allow returns
+// false. Connections accepted while enabled returns false are not
+// fingerprinted.
+type fingerprintListener struct {
+	net.Listener
+
+	enabled func() bool
+	allow   func(hello *clientHello) bool
+
+	mtx          sync.RWMutex
+	fingerprints map[string]string
+}
+
+func newFingerprintListener(l net.Listener, enabled func() bool, allow func(*clientHello) bool) *fingerprintListener {
+	return &fingerprintListener{
+		Listener:     l,
+		enabled:      enabled,
+		allow:        allow,
+		fingerprints: make(map[string]string),
+	}
+}
+
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.enabled() {
+		return conn, nil
+	}
+	return &fingerprintConn{Conn: conn, l: l}, nil
+}
+
+// Fingerprint returns the JA3 hash of the connection with the given remote
+// address.
+func (l *fingerprintListener) Fingerprint(remoteAddr string) string {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return l.fingerprints[remoteAddr]
+}
+
+type fingerprintConn struct {
+	net.Conn
+	l *fingerprintListener
+
+	once sync.Once
+	r    io.Reader
+	err  error
+}
+
+func (c *fingerprintConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readClientHello)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *fingerprintConn) readClientHello() {
+	hello, raw, err := readClientHello(c.Conn)
+	c.r = io.MultiReader(bytes.NewReader(raw), c.Conn)
+	if err != nil {
+		// let the TLS handshake deal with the invalid data
+		return
+	}
+	if !c.l.allow(hello) {
+		c.err = errBlockedFingerprint
+		c.Conn.Close()
+		return
+	}
+	c.l.mtx.Lock()
+	c.l.fingerprints[c.RemoteAddr().String()] = hello.JA3Hash()
+	c.l.mtx.Unlock()
+}
+
+func (c *fingerprintConn) Close() error {
+	c.l.mtx.Lock()
+	delete(c.l.fingerprints, c.RemoteAddr().String())
+	c.l.mtx.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// testClientHello is a TLS record containing a ClientHello with GREASE
+// values, an SNI of example.com, supported groups, point formats and an
+// empty session ticket extension.
+var testClientHello = []byte{
+	// record header
+	0x16, 0x03, 0x01, 0x00, 0x63,
+	// handshake header
+	0x01, 0x00, 0x00, 0x5f,
+	// client version
+	0x03, 0x03,
+	// random
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	// session id
+	0x00,
+	// cipher suites
+	0x00, 0x08, 0x0a, 0x0a, 0xc0, 0x2b, 0xc0, 0x2f, 0x00, 0x9c,
+	// compression methods
+	0x01, 0x00,
+	// extensions
+	0x00, 0x2e,
+	// GREASE
+	0x0a, 0x0a, 0x00, 0x00,
+	// server_name
+	0x00, 0x00, 0x00, 0x10, 0x00, 0x0e, 0x00, 0x00, 0x0b,
+	'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm',
+	// supported_groups
+	0x00, 0x0a, 0x00, 0x08, 0x00, 0x06, 0x1a, 0x1a, 0x00, 0x1d, 0x00, 0x17,
+	// ec_point_formats
+	0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+	// session_ticket
+	0x00, 0x23, 0x00, 0x00,
+}
+
+func (s *S) TestJA3Fingerprint(c *C) {
+	hello, raw, err := readClientHello(bytes.NewReader(testClientHello))
+	c.Assert(err, IsNil)
+	c.Assert(raw, DeepEquals, testClientHello)
+	c.Assert(hello.serverName, Equals, "example.com")
+	c.Assert(hello.JA3(), Equals, "771,49195-49199-156,0-10-11-35,29-23,0")
+	c.Assert(hello.JA3Hash(), Equals, "93be55a5acc7222764d47fb3ef3be70d")
+
+	// a ClientHello split across two records
+	msg := testClientHello[5:]
+	split := append([]byte{0x16, 0x03, 0x01, 0x00, 0x10}, msg[:0x10]...)
+	split = append(split, 0x16, 0x03, 0x01, 0x00, byte(len(msg)-0x10))
+	split = append(split, msg[0x10:]...)
+	hello, raw, err = readClientHello(bytes.NewReader(split))
+	c.Assert(err, IsNil)
+	c.Assert(raw, DeepEquals, split)
+	c.Assert(hello.JA3Hash(), Equals, "93be55a5acc7222764d47fb3ef3be70d")
+
+	// truncated and non-handshake data is invalid
+	_, _, err = readClientHello(bytes.NewReader(testClientHello[:50]))
+	c.Assert(err, NotNil)
+	_, _, err = readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))
+	c.Assert(err, Equals, errInvalidClientHello)
+}
+
+func (s *S) TestFingerprintListener(c *C) {
+	cert := tlsConfigForDomain("fingerprint.example.org")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+
+	var blocked string
+	enabled := true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	fl := newFingerprintListener(l, func() bool { return enabled }, func(hello *clientHello) bool {
+		return hello.JA3Hash() != blocked
+	})
+	defer fl.Close()
+
+	fingerprints := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fingerprints <- fl.Fingerprint(req.RemoteAddr)
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(tls.NewListener(fl, &tls.Config{Certificates: []tls.Certificate{pair}}))
+
+	get := func() error {
+		client := newHTTPClient("fingerprint.example.org")
+		defer client.Transport.(*http.Transport).CloseIdleConnections()
+		res, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = ioutil.ReadAll(res.Body)
+		return err
+	}
+
+	c.Assert(get(), IsNil)
+	fingerprint := <-fingerprints
+	c.Assert(fingerprint, HasLen, 32)
+
+	// connections with a blocked fingerprint should be closed
+	blocked = fingerprint
+	c.Assert(get(), NotNil)
+
+	// connections aren't fingerprinted while fingerprinting is disabled
+	enabled = false
+	c.Assert(get(), IsNil)
+	c.Assert(<-fingerprints, Equals, "")
+}
+
+func (s *S) TestTLSFingerprintRoutes(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	// connections are only fingerprinted while a route logs or blocks
+	// fingerprints
+	addHTTPRoute(c, l)
+	c.Assert(atomic.LoadInt32(&l.fingerprintRoutes), Equals, int32(0))
+
+	r := router.HTTPRoute{
+		Domain:            "fingerprint.example.org",
+		Service:           "test",
+		LogTLSFingerprint: true,
+	}.ToRoute()
+	addRoute(c, l, r)
+	c.Assert(atomic.LoadInt32(&l.fingerprintRoutes), Equals, int32(1))
+
+	// updating the route to still use fingerprints doesn't count it twice
+	r.LogTLSFingerprint = false
+	r.BlockedTLSFingerprints = []string{"93be55a5acc7222764d47fb3ef3be70d"}
+	wait := waitForEvent(c, l, "set", "")
+	c.Assert(l.UpdateRoute(r), IsNil)
+	wait()
+	c.Assert(atomic.LoadInt32(&l.fingerprintRoutes), Equals, int32(1))
+
+	removeRoute(c, l, r.ID)
+	c.Assert(atomic.LoadInt32(&l.fingerprintRoutes), Equals, int32(0))
+}
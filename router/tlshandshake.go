@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultTLSHandshakeTimeout is how long clients have to complete the TLS
+// handshake if neither the listener nor the route specify a timeout
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// maxTLSHandshakeTimeout is the longest TLS handshake timeout a route may
+// have, so that clients can't hold connections open without completing the
+// handshake
+const maxTLSHandshakeTimeout = time.Minute
+
+var tlsHandshakeFailures = metrics.NewCounterVec(
+	"strowger_tls_handshake_failures_total",
+	"Number of client connections closed without completing the TLS handshake, by reason (timeout or error).",
+	"reason",
+)
+
+// validateTLSHandshakeTimeout checks that the route's TLS handshake timeout is
+// valid.
+func validateTLSHandshakeTimeout(r *router.Route) error {
+	max := int(maxTLSHandshakeTimeout / time.Millisecond)
+	if r.TLSHandshakeTimeoutMS >= 0 && r.TLSHandshakeTimeoutMS <= max {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: fmt.Sprintf("TLS handshake timeout invalid: tls_handshake_timeout_ms must be between 0 and %d", max),
+	}
+}
+
+// tlsHandshakeListener is like the listener returned by tls.NewListener, but
+// completes the TLS handshake of accepted connections before returning them
+// from Accept, in a goroutine per connection so that slow clients don't hold
+// up Accept, and closes those which don't complete it within the timeout.
+//
+// The deadline can be changed during the handshake (e.g. to the timeout of
+// the route the ClientHello is for) by setting the deadline of the
+// connection passed to the config's callbacks, and is cleared once the
+// handshake is complete. Connections which fail the handshake are passed
+// to failed, if set, with the time they were accepted.
+type tlsHandshakeListener struct {
+	net.Listener
+
+	config  *tls.Config
+	timeout time.Duration
+	failed  func(conn net.Conn, accepted time.Time, err error)
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTLSHandshakeListener(l net.Listener, config *tls.Config, timeout time.Duration, failed func(net.Conn, time.Time, error)) *tlsHandshakeListener {
+	hl := &tlsHandshakeListener{
+		Listener: l,
+		config:   config,
+		timeout:  timeout,
+		failed:   failed,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go hl.acceptLoop()
+	return hl
+}
+
+func (l *tlsHandshakeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsHandshakeListener) handshake(conn net.Conn) {
+	accepted := time.Now()
+	conn.SetDeadline(accepted.Add(l.timeout))
+	tlsConn := tls.Server(conn, l.config)
+	if err := tlsConn.Handshake(); err != nil {
+		reason := "error"
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			reason = "timeout"
+		}
+		tlsHandshakeFailures.Inc(reason)
+		if l.failed != nil {
+			l.failed(conn, accepted, err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *tlsHandshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *tlsHandshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// stalledConn is a net.Conn whose reads block until unblock is closed, so
+// that a TLS client using it stalls after sending its ClientHello
+type stalledConn struct {
+	net.Conn
+	unblock chan struct{}
+}
+
+func (c *stalledConn) Read(b []byte) (int, error) {
+	<-c.unblock
+	return 0, io.EOF
+}
+
+func (s *S) TestTLSHandshakeTimeout(c *C) {
+	cert := tlsConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	l := &HTTPListener{
+		Addr:                "127.0.0.1:0",
+		TLSAddr:             "127.0.0.1:0",
+		TLSHandshakeTimeout: 100 * time.Millisecond,
+		keypair:             pair,
+		ds:                  newMemDataStore("http"),
+		discoverd:           newMemDiscoverd(),
+	}
+	l.EnableConnectionJournal(10)
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+	addRoute(c, l, router.HTTPRoute{Domain: "fast.example.com", Service: "test"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{Domain: "slow.example.com", Service: "test", TLSHandshakeTimeoutMS: 60000}.ToRoute())
+
+	// stalledHandshake starts a handshake with the listener which stalls
+	// after the ClientHello, returning how long the connection took to be
+	// closed by the listener, or an error if it wasn't within wait
+	stalledHandshake := func(serverName string, wait time.Duration) (time.Duration, error) {
+		conn, err := net.Dial("tcp", l.TLSAddr)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		unblock := make(chan struct{})
+		defer close(unblock)
+		client := tls.Client(&stalledConn{Conn: conn, unblock: unblock}, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		go client.Handshake()
+
+		start := time.Now()
+		conn.SetReadDeadline(start.Add(wait))
+		_, err = io.Copy(ioutil.Discard, conn)
+		return time.Since(start), err
+	}
+
+	// the connection is closed after the listener's timeout, recording
+	// the failed handshake
+	timeouts := tlsHandshakeFailures.Value("timeout")
+	elapsed, err := stalledHandshake("fast.example.com", 5*time.Second)
+	if nerr, ok := err.(net.Error); ok {
+		c.Assert(nerr.Timeout(), Equals, false)
+	}
+	c.Assert(elapsed < 5*time.Second, Equals, true)
+	c.Assert(tlsHandshakeFailures.Value("timeout"), Equals, timeouts+1)
+	entries := l.ConnectionJournal(0)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Proto, Equals, "https")
+	c.Assert(journalEventTypes(entries[0]), DeepEquals, []string{connEventAccepted, connEventTLSHandshake, connEventClosed})
+	c.Assert(entries[0].Events[1].Error, Matches, ".*timeout.*")
+	c.Assert(entries[0].Events[1].Time.Sub(entries[0].Events[0].Time) >= 100*time.Millisecond, Equals, true)
+
+	// the route's timeout overrides the listener's
+	_, err = stalledHandshake("slow.example.com", 500*time.Millisecond)
+	nerr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(nerr.Timeout(), Equals, true)
+
+	// connections which complete the handshake are served
+	conn, err := tls.Dial("tcp", l.TLSAddr, &tls.Config{ServerName: "fast.example.com", InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	for _, ms := range []int{-1, 60001} {
+		c.Assert(validateTLSHandshakeTimeout(&router.Route{TLSHandshakeTimeoutMS: ms}), NotNil)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// Formats in which trace context is propagated to backends
+const (
+	// traceFormatW3C is the W3C Trace Context traceparent and tracestate
+	// headers
+	traceFormatW3C = "w3c"
+	// traceFormatB3 is Zipkin's B3 headers, either the single b3 header if
+	// the client sent one or the X-B3-* headers
+	traceFormatB3 = "b3"
+)
+
+func validTraceFormat(format string) bool {
+	switch format {
+	case "", traceFormatW3C, traceFormatB3:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+	b3TraceIDPattern   = regexp.MustCompile(`^(?:[0-9a-f]{16}){1,2}$`)
+	b3SpanIDPattern    = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// traceSpan is the span of a request's hop through the router
+type traceSpan struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+}
+
+// Log logs the span as having started at start and ended now.
+func (s *traceSpan) Log(req *http.Request, start time.Time) {
+	logger.Info("span", "trace_id", s.TraceID, "span_id", s.SpanID, "parent_id", s.ParentID, "host", req.Host, "path", req.URL.Path, "duration", time.Since(start))
+}
+
+// setTraceContext propagates the trace context of req in the listener
+// config's TraceFormat, continuing the trace the client sent if it is valid
+// and starting a new one otherwise, with the router's hop as the parent of
+// the backend's span. It returns the router's span, or nil if trace
+// propagation is disabled.
+func (r *httpRoute) setTraceContext(req *http.Request) *traceSpan {
+	if r.config == nil {
+		return nil
+	}
+	switch r.config().TraceFormat {
+	case traceFormatW3C:
+		return setW3CTraceContext(req.Header)
+	case traceFormatB3:
+		return setB3TraceContext(req.Header)
+	default:
+		return nil
+	}
+}
+
+func newTraceID() string { return random.Hex(16) }
+func newSpanID() string  { return random.Hex(8) }
+
+func isZeroID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+func setW3CTraceContext(h http.Header) *traceSpan {
+	span := &traceSpan{SpanID: newSpanID()}
+	flags := "01"
+	if m := traceparentPattern.FindStringSubmatch(h.Get("Traceparent")); m != nil && m[1] != "ff" && !isZeroID(m[2]) && !isZeroID(m[3]) {
+		span.TraceID, span.ParentID, flags = m[2], m[3], m[4]
+	} else {
+		// tracestate is meaningless without a valid traceparent
+		h.Del("Tracestate")
+		span.TraceID = newTraceID()
+	}
+	h.Set("Traceparent", "00-"+span.TraceID+"-"+span.SpanID+"-"+flags)
+	return span
+}
+
+func setB3TraceContext(h http.Header) *traceSpan {
+	span := &traceSpan{SpanID: newSpanID()}
+
+	// the single header format is {trace}-{span}[-{sampled}[-{parent}]], or
+	// just the sampling decision
+	if single := h.Get("B3"); single != "" {
+		parts := strings.Split(single, "-")
+		sampled := ""
+		if len(parts) >= 2 && b3TraceIDPattern.MatchString(parts[0]) && b3SpanIDPattern.MatchString(parts[1]) {
+			span.TraceID, span.ParentID = parts[0], parts[1]
+			if len(parts) >= 3 {
+				sampled = parts[2]
+			}
+		} else {
+			span.TraceID = newTraceID()
+			if len(parts) == 1 {
+				sampled = parts[0]
+			}
+		}
+		value := span.TraceID + "-" + span.SpanID
+		if sampled != "" {
+			value += "-" + sampled
+		}
+		if span.ParentID != "" {
+			value += "-" + span.ParentID
+		}
+		h.Set("B3", value)
+		return span
+	}
+
+	if traceID, spanID := h.Get("X-B3-Traceid"), h.Get("X-B3-Spanid"); b3TraceIDPattern.MatchString(traceID) && b3SpanIDPattern.MatchString(spanID) {
+		span.TraceID, span.ParentID = traceID, spanID
+		h.Set("X-B3-Parentspanid", span.ParentID)
+	} else {
+		span.TraceID = newTraceID()
+		h.Del("X-B3-Parentspanid")
+	}
+	h.Set("X-B3-Traceid", span.TraceID)
+	h.Set("X-B3-Spanid", span.SpanID)
+	return span
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestTraceContext(c *C) {
+	l := &HTTPListener{}
+	r := &httpRoute{HTTPRoute: &router.HTTPRoute{}, config: l.getConfig}
+
+	// propagation is opt-in
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(r.setTraceContext(req), IsNil)
+	c.Assert(req.Header.Get("Traceparent"), Equals, "")
+
+	c.Assert(l.Reload(&ListenerConfig{TraceFormat: "zipkin"}), NotNil)
+
+	// W3C, continuing a valid trace with a new span
+	c.Assert(l.Reload(&ListenerConfig{TraceFormat: "w3c"}), IsNil)
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+	span := r.setTraceContext(req)
+	c.Assert(span.TraceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(span.ParentID, Equals, "00f067aa0ba902b7")
+	c.Assert(span.SpanID, HasLen, 16)
+	c.Assert(span.SpanID, Not(Equals), span.ParentID)
+	c.Assert(req.Header.Get("Traceparent"), Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanID+"-01")
+	c.Assert(req.Header.Get("Tracestate"), Equals, "congo=t61rcWkgMzE")
+
+	// W3C, starting a new trace when the client's is invalid
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+	span = r.setTraceContext(req)
+	c.Assert(span.TraceID, HasLen, 32)
+	c.Assert(span.ParentID, Equals, "")
+	c.Assert(req.Header.Get("Traceparent"), Equals, "00-"+span.TraceID+"-"+span.SpanID+"-01")
+	c.Assert(req.Header.Get("Tracestate"), Equals, "")
+
+	// B3 multiple headers
+	c.Assert(l.Reload(&ListenerConfig{TraceFormat: "b3"}), IsNil)
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+	req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+	req.Header.Set("X-B3-Sampled", "1")
+	span = r.setTraceContext(req)
+	c.Assert(span.TraceID, Equals, "463ac35c9f6413ad")
+	c.Assert(span.ParentID, Equals, "a2fb4a1d1a96d312")
+	c.Assert(req.Header.Get("X-B3-TraceId"), Equals, "463ac35c9f6413ad")
+	c.Assert(req.Header.Get("X-B3-SpanId"), Equals, span.SpanID)
+	c.Assert(req.Header.Get("X-B3-ParentSpanId"), Equals, "a2fb4a1d1a96d312")
+	c.Assert(req.Header.Get("X-B3-Sampled"), Equals, "1")
+
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	span = r.setTraceContext(req)
+	c.Assert(req.Header.Get("X-B3-TraceId"), Equals, span.TraceID)
+	c.Assert(req.Header.Get("X-B3-SpanId"), Equals, span.SpanID)
+	c.Assert(req.Header.Get("X-B3-ParentSpanId"), Equals, "")
+
+	// B3 single header
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("B3", "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90")
+	span = r.setTraceContext(req)
+	c.Assert(req.Header.Get("B3"), Equals, "80f198ee56343ba864fe8b2a57d3eff7-"+span.SpanID+"-1-e457b5a2e4d86bd1")
+	c.Assert(req.Header.Get("X-B3-TraceId"), Equals, "")
+
+	// a single header with only the sampling decision keeps it
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("B3", "0")
+	span = r.setTraceContext(req)
+	c.Assert(strings.HasSuffix(req.Header.Get("B3"), span.SpanID+"-0"), Equals, true)
+}
@@ -67,6 +67,386 @@ type Route struct {
 	// (used by the scheduler to only stop jobs once all requests have
 	// completed).
 	DrainBackends bool `json:"drain_backends,omitempty"`
+
+	// BasicAuth is optional HTTP Basic Auth protection for this route. It is
+	// only used for HTTP routes.
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+
+	// ErrorHandlerService is the optional ID of a service which requests are
+	// forwarded to (with an X-Router-Error header containing the HTTP status
+	// code) when the router fails to proxy a request to Service, typically
+	// used to serve branded error pages. It is only used for HTTP routes.
+	ErrorHandlerService string `json:"error_handler_service,omitempty"`
+
+	// LogTLSFingerprint is whether or not to log the JA3 fingerprint of the
+	// TLS ClientHello of requests to this route. It is only used for HTTP
+	// routes.
+	LogTLSFingerprint bool `json:"log_tls_fingerprint,omitempty"`
+	// BlockedTLSFingerprints is a list of JA3 fingerprint hashes for which
+	// TLS connections to this route are closed before completing the
+	// handshake. It is only used for HTTP routes.
+	BlockedTLSFingerprints []string `json:"blocked_tls_fingerprints,omitempty"`
+
+	// RewriteLocationHosts is an optional list of hostnames (or "*" for any
+	// hostname) which, when present in the Location header of a backend
+	// response, are rewritten to the host and scheme of the client request.
+	// It is only used for HTTP routes.
+	RewriteLocationHosts []string `json:"rewrite_location_hosts,omitempty"`
+
+	// StripPathPrefix is an optional prefix which is removed from the path of
+	// requests before they are forwarded to the backend, typically set to
+	// Path. It is only used for HTTP routes.
+	StripPathPrefix string `json:"strip_path_prefix,omitempty"`
+	// AddPathPrefix is an optional prefix which is prepended to the path of
+	// requests (after StripPathPrefix is removed) before they are forwarded
+	// to the backend. It is only used for HTTP routes. The inverse rewrite is
+	// applied to the paths of Location and Content-Location response headers.
+	AddPathPrefix string `json:"add_path_prefix,omitempty"`
+
+	// MulticastMode is whether or not to send GET, HEAD and OPTIONS requests
+	// to all backends concurrently and return the first successful response,
+	// reducing tail latency at the cost of extra backend load. It is only
+	// used for HTTP routes.
+	MulticastMode bool `json:"multicast_mode,omitempty"`
+
+	// CORS is the optional CORS configuration for this route. When set, the
+	// router answers CORS preflight requests from allowed origins itself and
+	// adds CORS headers to responses. It is only used for HTTP routes.
+	CORS *CORS `json:"cors,omitempty"`
+
+	// PushPaths is an optional list of paths which are pushed to HTTP/2
+	// clients along with successful HTML responses. Pushed requests don't
+	// include client credentials, and their responses are cached by the
+	// router according to their Cache-Control max-age. It is only used for
+	// HTTP routes.
+	PushPaths []string `json:"push_paths,omitempty"`
+
+	// RequestCollapsingEnabled is whether or not to collapse concurrent
+	// identical GET requests into a single backend request, sharing its
+	// response between all of the clients. It should only be enabled for
+	// routes whose responses don't depend on the client. It is only used
+	// for HTTP routes.
+	RequestCollapsingEnabled bool `json:"request_collapsing_enabled,omitempty"`
+
+	// BufferFullRequestBody is whether or not to read the whole request body
+	// before sending the request to the backend with a Content-Length header,
+	// for backends which require one. Requests with bodies larger than the
+	// listener's MaxBufferedRequestBytes are rejected with a 413. It is only
+	// used for HTTP routes.
+	BufferFullRequestBody bool `json:"buffer_full_request_body,omitempty"`
+
+	// ForwardTrailers is whether or not to forward the trailer fields of
+	// requests whose bodies have a known length (e.g. from HTTP/2 clients)
+	// to the backend, which is required by some gRPC backends, by sending the
+	// body chunked. Trailers of chunked requests are always forwarded. The
+	// trailer fields of backend responses are only forwarded to clients if
+	// it is set. It can't be combined with BufferFullRequestBody. It is only
+	// used for HTTP routes.
+	ForwardTrailers bool `json:"forward_trailers,omitempty"`
+
+	// ConsulHealthBackends is whether or not to route to the instances of the
+	// service which are passing their Consul health checks, rather than the
+	// instances registered in discoverd. It requires the router to be
+	// configured with a Consul address. It is only used for HTTP routes.
+	ConsulHealthBackends bool `json:"consul_health_backends,omitempty"`
+
+	// MaxConcurrentRequests is the maximum number of requests to this route
+	// which are proxied concurrently, regardless of the number of backends.
+	// Up to MaxQueuedRequests requests beyond the limit wait for up to
+	// QueueTimeoutMS milliseconds (defaulting to 5000) for another request to
+	// complete, other requests and those which time out are rejected with a
+	// 503. Zero means no limit. It is only used for HTTP routes.
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+	MaxQueuedRequests     int `json:"max_queued_requests,omitempty"`
+	QueueTimeoutMS        int `json:"queue_timeout_ms,omitempty"`
+
+	// PerClientRateLimit is whether or not to limit the rate of requests from
+	// each client IP address (the address requests are received from, or
+	// the right-most untrusted address in X-Forwarded-For for requests from
+	// the listener's TrustedProxies) to ClientRequestsPerSecond, with
+	// bursts of up to ClientBurst requests (defaulting to
+	// ClientRequestsPerSecond). Requests over the limit are rejected with a
+	// 429. The limits of up to MaxTrackedClients clients (defaulting to 10000)
+	// are tracked, the least recently seen client being forgotten when a new
+	// one is seen. It is only used for HTTP routes.
+	PerClientRateLimit      bool    `json:"per_client_rate_limit,omitempty"`
+	ClientRequestsPerSecond float64 `json:"client_requests_per_second,omitempty"`
+	ClientBurst             int     `json:"client_burst,omitempty"`
+	MaxTrackedClients       int     `json:"max_tracked_clients,omitempty"`
+
+	// RequestFingerprintDedup is whether or not to deduplicate requests
+	// other than GET, HEAD and OPTIONS requests by a SHA-256 fingerprint of
+	// their method, host, URI, body and credentials (the Authorization and
+	// Cookie headers). A request with the same fingerprint
+	// as one which completed within the last DedupWindowMS milliseconds
+	// (defaulting to 10000) gets the same response without being proxied.
+	// Requests with bodies larger than FingerprintMaxBytes (defaulting to
+	// 65536) are not deduplicated. It is only used for HTTP routes.
+	RequestFingerprintDedup bool `json:"request_fingerprint_dedup,omitempty"`
+	FingerprintMaxBytes     int  `json:"fingerprint_max_bytes,omitempty"`
+	DedupWindowMS           int  `json:"dedup_window_ms,omitempty"`
+
+	// EnvoyHCPath is the path of Envoy health checks of the route. GET and
+	// HEAD requests to it with the x-envoy-health-check: true header from
+	// one of the listener's TrustedProxies are answered with a 200 by the
+	// router without reaching the backend, or if EnvoyHCBackendCheck is set,
+	// are proxied to the backend like any other request, including the
+	// route's authentication and rate limits. The header is removed from
+	// other requests to the route. It is only used for HTTP routes.
+	EnvoyHCPath         string `json:"envoy_hc_path,omitempty"`
+	EnvoyHCBackendCheck bool   `json:"envoy_hc_backend_check,omitempty"`
+
+	// BackendH2CEnabled is whether or not to proxy requests to backends using
+	// HTTP/2 over cleartext TCP (h2c) if they accept an h2c upgrade request,
+	// falling back to HTTP/1.1 otherwise. It is only used for HTTP routes.
+	BackendH2CEnabled bool `json:"backend_h2c_enabled,omitempty"`
+
+	// TLSPassthrough routes TLS connections to the route's backends based on
+	// their SNI host name without terminating TLS, leaving the backends to
+	// terminate it themselves. It is only valid for routes with the path /
+	// and no certificate.
+	TLSPassthrough bool `json:"tls_passthrough,omitempty"`
+
+	// MaxRequestHeaderBytes is the maximum total size of the header fields of
+	// requests to the route, with larger requests being rejected with a 431
+	// (defaults to 1 MB if zero).
+	MaxRequestHeaderBytes int `json:"max_request_header_bytes,omitempty"`
+	// MaxResponseHeaderBytes is the maximum total size of the header fields of
+	// responses from the backends, with larger responses being replaced with a
+	// 502 (defaults to 1 MB if zero).
+	MaxResponseHeaderBytes int `json:"max_response_header_bytes,omitempty"`
+
+	// BackendTimeoutMS bounds the time in milliseconds from a request being
+	// sent to a backend until its response has been read, overriding the
+	// listener's backend timeout if non-zero. Requests which time out before
+	// the backend responds get a 504.
+	BackendTimeoutMS int `json:"backend_timeout_ms,omitempty"`
+
+	// SlowRequestThresholdMS, if set, logs a warning for requests which take
+	// longer than it in milliseconds to be served.
+	SlowRequestThresholdMS int `json:"slow_request_threshold_ms,omitempty"`
+
+	// ABTest is the optional A/B test of this route, which splits its users
+	// between variants served by other services, each user being assigned a
+	// variant on their first request and remembered with a cookie. It is
+	// only used for HTTP routes.
+	ABTest *ABTest `json:"ab_test,omitempty"`
+
+	// MethodRoutes optionally maps request methods (e.g. "GET") to the IDs of
+	// services which requests with those methods are routed to instead of
+	// Service, for example to send reads to a read replica service. Methods
+	// are case-sensitive. It is only used for HTTP routes.
+	MethodRoutes map[string]string `json:"method_routes,omitempty"`
+
+	// ConsistentHashKey, if set, sends requests with the same key to the same
+	// backend using rendezvous hashing, for example to maximize the cache hits
+	// of a caching tier. It is "path", "header:<name>" or "cookie:<name>",
+	// and requests without the key are sent to a random backend. It is only
+	// used for HTTP routes.
+	ConsistentHashKey string `json:"consistent_hash_key,omitempty"`
+
+	// VaultServiceAuth, if set, authenticates requests to the route's backends
+	// with a short-lived Vault token obtained using AppRole authentication,
+	// which is shared by all requests to the service and refreshed before it
+	// expires. It is only used for HTTP routes.
+	VaultServiceAuth *VaultConfig `json:"vault_service_auth,omitempty"`
+
+	// ResponseSigningKey, if set, is the key used to sign the bodies of
+	// responses from the backends with HMAC-SHA256, sent in the
+	// X-Response-Signature header (or trailer for large responses) as
+	// "sha256=<base64 signature>" so that clients which know the key can
+	// verify them. It is write-only, so it is replaced with RedactedSecret
+	// in routes returned by the API, sent in events and written to
+	// snapshots and backups, and updating a route with RedactedSecret keeps
+	// the current key. It is only used for HTTP routes.
+	ResponseSigningKey string `json:"response_signing_key,omitempty"`
+
+	// ClientHints is a list of client hints (e.g. "Sec-CH-UA-Mobile") which
+	// browsers are asked to send using the Accept-CH and Critical-CH headers
+	// in responses to requests without them, so that the hints are sent to
+	// the backends in subsequent requests. It is only used for HTTP routes.
+	ClientHints []string `json:"client_hints,omitempty"`
+
+	// PermissionsPolicy, if set, is sent in the Permissions-Policy header of
+	// responses which don't already have one, for example to delegate client
+	// hints to third party origins. It is only used for HTTP routes.
+	PermissionsPolicy string `json:"permissions_policy,omitempty"`
+
+	// RetryBudget, if set, limits the requests retried with another backend
+	// after failing to a proportion of the requests to the route, so that
+	// retries don't multiply the load on backends which are failing. It is
+	// only used for HTTP routes.
+	RetryBudget *RetryBudgetConfig `json:"retry_budget,omitempty"`
+
+	// StatusRateLimit optionally throttles or blocks clients which cause too
+	// many responses with a given status code, e.g. the 401 responses of
+	// credential stuffing attacks. It is only used for HTTP routes.
+	StatusRateLimit []StatusRateEntry `json:"status_rate_limit,omitempty"`
+
+	// FanoutServices optionally lists services which requests are also sent
+	// to asynchronously, for example to write to other regions or keep an
+	// audit copy. Their responses are discarded, the client only receiving
+	// the response of Service. It is only used for HTTP routes.
+	FanoutServices []string `json:"fanout_services,omitempty"`
+
+	// FanoutMaxBodyBytes is the maximum size of the request bodies buffered to
+	// be sent to FanoutServices, defaulting to 1MiB. Requests with larger
+	// bodies are rejected. It is only used for HTTP routes.
+	FanoutMaxBodyBytes int64 `json:"fanout_max_body_bytes,omitempty"`
+
+	// TLSHandshakeTimeoutMS bounds the time in milliseconds clients have to
+	// complete the TLS handshake once they have sent a ClientHello for the
+	// route, overriding the listener's TLS handshake timeout if non-zero (e.g.
+	// to allow for embedded devices or high-latency links). It may be at
+	// most 60000. It is only used for HTTP routes.
+	TLSHandshakeTimeoutMS int `json:"tls_handshake_timeout_ms,omitempty"`
+
+	// ReservoirSampleSize, if set, keeps a uniform random sample of that many
+	// of the requests to the route, logging requests as they are added to it,
+	// so that routes with little traffic have a representative sample of
+	// their requests logged. It is only used for HTTP routes.
+	ReservoirSampleSize int `json:"reservoir_sample_size,omitempty"`
+}
+
+// BasicAuth describes the HTTP Basic Auth credentials required to access a
+// route.
+type BasicAuth struct {
+	// Username is the username clients must provide.
+	Username string `json:"username"`
+	// Password is the plaintext password. It is only used when creating or
+	// updating a route, it is hashed before being stored and is never
+	// returned.
+	Password string `json:"password,omitempty"`
+	// PasswordHash is the salted PBKDF2 hash of the password. Like
+	// Route.ResponseSigningKey it is write-only, so it is replaced with
+	// RedactedSecret in routes returned by the API, and updating a route
+	// with RedactedSecret keeps the current hash.
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// ABTest describes an A/B test of a route.
+type ABTest struct {
+	// Variants are the variants users are assigned to in proportion to
+	// their weights.
+	Variants []ABVariant `json:"variants"`
+	// BucketCookie is the name of the cookie the variant a user was
+	// assigned is stored in, defaulting to "_ab_bucket".
+	BucketCookie string `json:"bucket_cookie,omitempty"`
+}
+
+// ABVariant is a variant of an A/B test.
+type ABVariant struct {
+	// Name is the unique name of the variant, which is the value of the
+	// bucket cookie of its users.
+	Name string `json:"name"`
+	// Weight is the relative share of users assigned to the variant.
+	Weight int `json:"weight"`
+	// Service is the ID of the service requests from the variant's users
+	// are routed to.
+	Service string `json:"service"`
+}
+
+// RemovedService is the result of removing all the HTTP routes of a service.
+type RemovedService struct {
+	Service string `json:"service"`
+
+	// Domains are the domains of the routes which were removed
+	Domains []string `json:"domains"`
+
+	// Error, if set, is why some of the routes couldn't be removed
+	Error string `json:"error,omitempty"`
+}
+
+// ABTestStats are the request counts of the variants of a route's A/B test
+// since the router started.
+type ABTestStats struct {
+	RouteID  string           `json:"route_id"`
+	Path     string           `json:"path"`
+	Variants []ABVariantStats `json:"variants"`
+}
+
+// ABVariantStats are the request counts of an A/B test variant.
+type ABVariantStats struct {
+	Name     string `json:"name"`
+	Service  string `json:"service"`
+	Requests int64  `json:"requests"`
+}
+
+// CORS describes how the router handles cross-origin requests to a route.
+type CORS struct {
+	// AllowedOrigins is the list of origins (e.g. "https://example.com") which
+	// may make cross-origin requests, or "*" for any origin. An origin may
+	// contain a single wildcard matching part of the host or port, for
+	// example "https://*.example.com" matches any subdomain of example.com.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// AllowedMethods is the list of methods allowed in cross-origin requests,
+	// defaulting to GET, HEAD and POST.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedHeaders is the list of request headers allowed in cross-origin
+	// requests, or "*" for any header.
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// ExposedHeaders is the list of response headers exposed to clients.
+	ExposedHeaders []string `json:"exposed_headers,omitempty"`
+	// AllowCredentials is whether or not cross-origin requests may include
+	// credentials such as cookies.
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// MaxAge is the number of seconds clients may cache preflight responses.
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+// RedactedSecret replaces the write-only secrets of routes which aren't
+// empty (see Route.ResponseSigningKey).
+const RedactedSecret = "[redacted]"
+
+// VaultConfig describes how the router obtains Vault tokens to authenticate
+// requests to a route's backends.
+type VaultConfig struct {
+	// VaultAddr is the address of the Vault API (e.g.
+	// "https://vault.example.com:8200").
+	VaultAddr string `json:"vault_addr"`
+	// RoleID is the ID of the AppRole used to log in to Vault.
+	RoleID string `json:"role_id"`
+	// SecretID is the secret ID of the AppRole. It is write-only, so it is
+	// removed from routes returned by the API, sent in events and written
+	// to snapshots and backups, and it is kept when a route is updated
+	// without one.
+	SecretID string `json:"secret_id,omitempty"`
+	// TokenPath is the name of the request header the token is sent to the
+	// backends in (e.g. "X-Vault-Token").
+	TokenPath string `json:"token_path"`
+}
+
+// RetryBudgetConfig limits the proportion of requests to a route which are
+// retried.
+type RetryBudgetConfig struct {
+	// BudgetPercent is the maximum percentage of recent requests which may
+	// be retried, once more than MinimumRetries have been (e.g. 20).
+	BudgetPercent float64 `json:"budget_percent"`
+	// MinimumRetries is the number of recent retries which are allowed
+	// regardless of the budget, so that routes with few requests can
+	// still retry them.
+	MinimumRetries int `json:"minimum_retries,omitempty"`
+}
+
+const (
+	// StatusRateActionThrottle delays the requests of clients which exceed
+	// a StatusRateEntry's threshold.
+	StatusRateActionThrottle = "throttle"
+	// StatusRateActionBlock rejects the requests of clients which exceed a
+	// StatusRateEntry's threshold with a 429.
+	StatusRateActionBlock = "block"
+)
+
+// StatusRateEntry limits the rate of responses with a status code which a
+// client may cause.
+type StatusRateEntry struct {
+	// StatusCode is the status code of the responses which are counted.
+	StatusCode int `json:"status_code"`
+	// Threshold is the number of responses with StatusCode a client may
+	// cause per minute before Action is applied to its requests.
+	Threshold int `json:"threshold"`
+	// Action is either "throttle" or "block".
+	Action string `json:"action"`
 }
 
 func (r Route) FormattedID() string {
@@ -89,6 +469,52 @@ func (r Route) HTTPRoute() *HTTPRoute {
 		LegacyTLSKey:  r.LegacyTLSKey,
 		Sticky:        r.Sticky,
 		Path:          r.Path,
+		BasicAuth:     r.BasicAuth,
+
+		ErrorHandlerService:      r.ErrorHandlerService,
+		LogTLSFingerprint:        r.LogTLSFingerprint,
+		BlockedTLSFingerprints:   r.BlockedTLSFingerprints,
+		RewriteLocationHosts:     r.RewriteLocationHosts,
+		StripPathPrefix:          r.StripPathPrefix,
+		AddPathPrefix:            r.AddPathPrefix,
+		MulticastMode:            r.MulticastMode,
+		CORS:                     r.CORS,
+		PushPaths:                r.PushPaths,
+		RequestCollapsingEnabled: r.RequestCollapsingEnabled,
+		BufferFullRequestBody:    r.BufferFullRequestBody,
+		ForwardTrailers:          r.ForwardTrailers,
+		ConsulHealthBackends:     r.ConsulHealthBackends,
+		MaxConcurrentRequests:    r.MaxConcurrentRequests,
+		MaxQueuedRequests:        r.MaxQueuedRequests,
+		QueueTimeoutMS:           r.QueueTimeoutMS,
+		PerClientRateLimit:       r.PerClientRateLimit,
+		ClientRequestsPerSecond:  r.ClientRequestsPerSecond,
+		ClientBurst:              r.ClientBurst,
+		MaxTrackedClients:        r.MaxTrackedClients,
+		RequestFingerprintDedup:  r.RequestFingerprintDedup,
+		FingerprintMaxBytes:      r.FingerprintMaxBytes,
+		DedupWindowMS:            r.DedupWindowMS,
+		EnvoyHCPath:              r.EnvoyHCPath,
+		EnvoyHCBackendCheck:      r.EnvoyHCBackendCheck,
+		BackendH2CEnabled:        r.BackendH2CEnabled,
+		TLSPassthrough:           r.TLSPassthrough,
+		MaxRequestHeaderBytes:    r.MaxRequestHeaderBytes,
+		MaxResponseHeaderBytes:   r.MaxResponseHeaderBytes,
+		BackendTimeoutMS:         r.BackendTimeoutMS,
+		SlowRequestThresholdMS:   r.SlowRequestThresholdMS,
+		ABTest:                   r.ABTest,
+		MethodRoutes:             r.MethodRoutes,
+		ConsistentHashKey:        r.ConsistentHashKey,
+		VaultServiceAuth:         r.VaultServiceAuth,
+		ResponseSigningKey:       r.ResponseSigningKey,
+		ClientHints:              r.ClientHints,
+		PermissionsPolicy:        r.PermissionsPolicy,
+		RetryBudget:              r.RetryBudget,
+		StatusRateLimit:          r.StatusRateLimit,
+		FanoutServices:           r.FanoutServices,
+		FanoutMaxBodyBytes:       r.FanoutMaxBodyBytes,
+		TLSHandshakeTimeoutMS:    r.TLSHandshakeTimeoutMS,
+		ReservoirSampleSize:      r.ReservoirSampleSize,
 	}
 }
 
@@ -122,6 +548,52 @@ type HTTPRoute struct {
 	LegacyTLSKey  string       `json:"tls_key,omitempty"`
 	Sticky        bool
 	Path          string
+	BasicAuth     *BasicAuth
+
+	ErrorHandlerService      string
+	LogTLSFingerprint        bool
+	BlockedTLSFingerprints   []string
+	RewriteLocationHosts     []string
+	StripPathPrefix          string
+	AddPathPrefix            string
+	MulticastMode            bool
+	CORS                     *CORS
+	PushPaths                []string
+	RequestCollapsingEnabled bool
+	BufferFullRequestBody    bool
+	ForwardTrailers          bool
+	ConsulHealthBackends     bool
+	MaxConcurrentRequests    int
+	MaxQueuedRequests        int
+	QueueTimeoutMS           int
+	PerClientRateLimit       bool
+	ClientRequestsPerSecond  float64
+	ClientBurst              int
+	MaxTrackedClients        int
+	RequestFingerprintDedup  bool
+	FingerprintMaxBytes      int
+	DedupWindowMS            int
+	EnvoyHCPath              string
+	EnvoyHCBackendCheck      bool
+	BackendH2CEnabled        bool
+	TLSPassthrough           bool
+	MaxRequestHeaderBytes    int
+	MaxResponseHeaderBytes   int
+	BackendTimeoutMS         int
+	SlowRequestThresholdMS   int
+	ABTest                   *ABTest
+	MethodRoutes             map[string]string
+	ConsistentHashKey        string
+	VaultServiceAuth         *VaultConfig
+	ResponseSigningKey       string
+	ClientHints              []string
+	PermissionsPolicy        string
+	RetryBudget              *RetryBudgetConfig
+	StatusRateLimit          []StatusRateEntry
+	FanoutServices           []string
+	FanoutMaxBodyBytes       int64
+	TLSHandshakeTimeoutMS    int
+	ReservoirSampleSize      int
 }
 
 func (r HTTPRoute) FormattedID() string {
@@ -151,6 +623,52 @@ func (r HTTPRoute) ToRoute() *Route {
 		LegacyTLSKey:  r.LegacyTLSKey,
 		Sticky:        r.Sticky,
 		Path:          r.Path,
+		BasicAuth:     r.BasicAuth,
+
+		ErrorHandlerService:      r.ErrorHandlerService,
+		LogTLSFingerprint:        r.LogTLSFingerprint,
+		BlockedTLSFingerprints:   r.BlockedTLSFingerprints,
+		RewriteLocationHosts:     r.RewriteLocationHosts,
+		StripPathPrefix:          r.StripPathPrefix,
+		AddPathPrefix:            r.AddPathPrefix,
+		MulticastMode:            r.MulticastMode,
+		CORS:                     r.CORS,
+		PushPaths:                r.PushPaths,
+		RequestCollapsingEnabled: r.RequestCollapsingEnabled,
+		BufferFullRequestBody:    r.BufferFullRequestBody,
+		ForwardTrailers:          r.ForwardTrailers,
+		ConsulHealthBackends:     r.ConsulHealthBackends,
+		MaxConcurrentRequests:    r.MaxConcurrentRequests,
+		MaxQueuedRequests:        r.MaxQueuedRequests,
+		QueueTimeoutMS:           r.QueueTimeoutMS,
+		PerClientRateLimit:       r.PerClientRateLimit,
+		ClientRequestsPerSecond:  r.ClientRequestsPerSecond,
+		ClientBurst:              r.ClientBurst,
+		MaxTrackedClients:        r.MaxTrackedClients,
+		RequestFingerprintDedup:  r.RequestFingerprintDedup,
+		FingerprintMaxBytes:      r.FingerprintMaxBytes,
+		DedupWindowMS:            r.DedupWindowMS,
+		EnvoyHCPath:              r.EnvoyHCPath,
+		EnvoyHCBackendCheck:      r.EnvoyHCBackendCheck,
+		BackendH2CEnabled:        r.BackendH2CEnabled,
+		TLSPassthrough:           r.TLSPassthrough,
+		MaxRequestHeaderBytes:    r.MaxRequestHeaderBytes,
+		MaxResponseHeaderBytes:   r.MaxResponseHeaderBytes,
+		BackendTimeoutMS:         r.BackendTimeoutMS,
+		SlowRequestThresholdMS:   r.SlowRequestThresholdMS,
+		ABTest:                   r.ABTest,
+		MethodRoutes:             r.MethodRoutes,
+		ConsistentHashKey:        r.ConsistentHashKey,
+		VaultServiceAuth:         r.VaultServiceAuth,
+		ResponseSigningKey:       r.ResponseSigningKey,
+		ClientHints:              r.ClientHints,
+		PermissionsPolicy:        r.PermissionsPolicy,
+		RetryBudget:              r.RetryBudget,
+		StatusRateLimit:          r.StatusRateLimit,
+		FanoutServices:           r.FanoutServices,
+		FanoutMaxBodyBytes:       r.FanoutMaxBodyBytes,
+		TLSHandshakeTimeoutMS:    r.TLSHandshakeTimeoutMS,
+		ReservoirSampleSize:      r.ReservoirSampleSize,
 	}
 }
 
@@ -198,6 +716,13 @@ const (
 	EventTypeBackendUp      EventType = "backend-up"
 	EventTypeBackendDown    EventType = "backend-down"
 	EventTypeBackendDrained EventType = "backend-drained"
+
+	// EventTypeBackendUnhealthy and EventTypeBackendHealthy are sent when
+	// the passively tracked health of a backend changes (see
+	// BackendHealth), with the backend's last error and consecutive
+	// failures in the event's metadata.
+	EventTypeBackendUnhealthy EventType = "backend-unhealthy"
+	EventTypeBackendHealthy   EventType = "backend-healthy"
 )
 
 type Event struct {
@@ -206,6 +731,15 @@ type Event struct {
 	Route   *Route
 	Backend *Backend
 	Error   error
+
+	// Timestamp is the time the event was sent.
+	Timestamp time.Time
+	// Sequence is a number which increases by one for each event sent by a
+	// listener, allowing subscribers to detect dropped events. It is zero
+	// for events describing the current state sent when watching starts.
+	Sequence uint64
+	// Metadata is optional additional information about the event.
+	Metadata map[string]string
 }
 
 type Backend struct {
@@ -214,11 +748,141 @@ type Backend struct {
 	JobID   string `json:"job_id"`
 }
 
+// BackendHealth is the health of a backend, which is tracked passively using
+// the results of requests proxied to it.
+type BackendHealth struct {
+	Addr string `json:"addr"`
+	// Healthy is false if the most recent requests to the backend failed
+	Healthy bool `json:"healthy"`
+	// LastError is the error from the most recent failed request to the
+	// backend
+	LastError string `json:"last_error,omitempty"`
+	// ConsecutiveFailures is the number of requests to the backend which
+	// have failed since the last successful request
+	ConsecutiveFailures int `json:"consecutive_failures"`
+}
+
+// HealthSummary summarizes the health of the backends of all HTTP routes. A
+// domain is healthy if the services of all its routes have a healthy backend.
+type HealthSummary struct {
+	TotalDomains    int `json:"total_domains"`
+	HealthyDomains  int `json:"healthy_domains"`
+	TotalBackends   int `json:"total_backends"`
+	HealthyBackends int `json:"healthy_backends"`
+}
+
+// CertStatus is the status of the certificate served for a domain.
+type CertStatus struct {
+	// Domain is the domain the status was requested for.
+	Domain string `json:"domain"`
+	// RouteID is the ID of the route the certificate belongs to.
+	RouteID string `json:"route_id"`
+	// Subject is the distinguished name of the certificate's subject.
+	Subject string `json:"subject"`
+	// DNSNames are the certificate's subject alternative names.
+	DNSNames []string `json:"dns_names,omitempty"`
+	// NotBefore is the time the certificate becomes valid.
+	NotBefore time.Time `json:"not_before"`
+	// NotAfter is the time the certificate expires.
+	NotAfter time.Time `json:"not_after"`
+	// Valid is whether the current time is within the certificate's validity
+	// period.
+	Valid bool `json:"valid"`
+}
+
+// SyncStatus is the status of syncing the routing table from the data store.
+// When syncing fails, the routes from the last successful sync continue to be
+// served until it recovers.
+type SyncStatus struct {
+	// Degraded is whether the routing table may be out of date because
+	// syncing is currently failing.
+	Degraded bool `json:"degraded"`
+	// LastError is the error which caused syncing to fail while degraded.
+	LastError string `json:"last_error,omitempty"`
+	// DegradedSince is the time syncing started failing.
+	DegradedSince time.Time `json:"degraded_since,omitempty"`
+	// LastSyncedAt is the time of the last successful sync.
+	LastSyncedAt time.Time `json:"last_synced_at,omitempty"`
+	// Index is the number of route changes synced from the data store since
+	// the router started, it stops increasing if the sync loop stops.
+	Index uint64 `json:"index"`
+	// LastEventAt is the time of the last route change synced from the data
+	// store or of the last successful sync, whichever is more recent, so that
+	// monitoring can alert when the routing table may be stale.
+	LastEventAt time.Time `json:"last_event_at,omitempty"`
+}
+
+// RouteChange is a change to the routing table of a router, either a route
+// being set or removed, which peers use to catch up on route changes while
+// they can't sync with the data store.
+type RouteChange struct {
+	// Seq is the position of the change in the router's change log.
+	Seq uint64 `json:"seq"`
+	// ID is the ID of the changed route.
+	ID string `json:"id"`
+	// Route is the route which was set, it is nil if the route was removed.
+	Route *Route `json:"route,omitempty"`
+	// RemovedAt is the time the route was removed.
+	RemovedAt time.Time `json:"removed_at,omitempty"`
+}
+
+// RouteChanges are the latest changes to each route of a router since a
+// position in its change log.
+type RouteChanges struct {
+	// Instance is the ID of the router instance the change log belongs to,
+	// which is passed with since so that a restarted router at the same
+	// address returns all its changes.
+	Instance string `json:"instance"`
+	// Seq is the position of the latest change, which is passed as since to
+	// get the next changes.
+	Seq     uint64         `json:"seq"`
+	Changes []*RouteChange `json:"changes"`
+}
+
+// LatencyStats are the percentiles of the latencies of requests to a domain
+// over a window of time, in milliseconds.
+type LatencyStats struct {
+	// Count is the number of requests in the window.
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p999"`
+	Max   float64 `json:"max"`
+}
+
+// ConnectionJournalEntry is the lifecycle of a connection to the HTTP
+// listener recorded by its connection journal.
+type ConnectionJournalEntry struct {
+	RemoteAddr string `json:"remote_addr"`
+	// Proto is the protocol of the listener which accepted the connection,
+	// either "http" or "https".
+	Proto string `json:"proto"`
+	// Requests is the number of requests read from the connection.
+	Requests int `json:"requests"`
+	// Responded is whether a response was sent to the first request.
+	Responded bool              `json:"responded"`
+	Events    []ConnectionEvent `json:"events"`
+}
+
+// ConnectionEvent is an event in the lifecycle of a connection, one of
+// "accepted", "tls_handshake", "request" (the first request being read),
+// "response" (the response to the first request being sent), "hijacked" or
+// "closed".
+type ConnectionEvent struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
 type StreamEvent struct {
-	Event   EventType `json:"event"`
-	Route   *Route    `json:"route,omitempty"`
-	Backend *Backend  `json:"backend,omitempty"`
-	Error   error     `json:"error,omitempty"`
+	Event     EventType         `json:"event"`
+	Route     *Route            `json:"route,omitempty"`
+	Backend   *Backend          `json:"backend,omitempty"`
+	Error     error             `json:"error,omitempty"`
+	Timestamp time.Time         `json:"timestamp,omitempty"`
+	Sequence  uint64            `json:"sequence,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
 type StreamEventsOptions struct {
@@ -0,0 +1,21 @@
+package main
+
+const (
+	// unknownSNIDrop fails the TLS handshake of clients whose SNI host name
+	// matches no route, which they see as the connection being reset
+	unknownSNIDrop = "drop"
+	// unknownSNIDefaultCert completes the TLS handshake of clients whose SNI
+	// host name matches no route using the listener's default certificate,
+	// so that their requests are answered with a 404, or a 421 if their
+	// Host has a route so that clients retry with the right SNI host name
+	unknownSNIDefaultCert = "default-cert"
+)
+
+func validUnknownSNI(action string) bool {
+	switch action {
+	case "", unknownSNIDrop, unknownSNIDefaultCert:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestUnknownSNI(c *C) {
+	l, _, _ := newFakeHTTPListener(c)
+	defer l.Close()
+	defer l.Reload(&ListenerConfig{})
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute())
+
+	dial := func(serverName string) (*tls.Conn, error) {
+		return tls.Dial("tcp", l.TLSAddr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	}
+
+	// the handshake fails by default
+	conn, err := dial("example.com")
+	c.Assert(err, IsNil)
+	conn.Close()
+	_, err = dial("unknown.example.org")
+	c.Assert(err, NotNil)
+
+	// the handshake completes with the default certificate, and requests
+	// are answered with a 404
+	c.Assert(l.Reload(&ListenerConfig{UnknownSNI: unknownSNIDefaultCert}), IsNil)
+	conn, err = dial("unknown.example.org")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.ConnectionState().PeerCertificates[0].DNSNames, DeepEquals, l.keypair.Leaf.DNSNames)
+	req, err := http.NewRequest("GET", "https://unknown.example.org/", nil)
+	c.Assert(err, IsNil)
+	c.Assert(req.Write(conn), IsNil)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+
+	// requests for routed hosts aren't routed over the connection
+	req, err = http.NewRequest("GET", "https://example.com/", nil)
+	c.Assert(err, IsNil)
+	c.Assert(req.Write(conn), IsNil)
+	res, err = http.ReadResponse(bufio.NewReader(conn), req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusMisdirectedRequest)
+
+	c.Assert(l.Reload(&ListenerConfig{UnknownSNI: unknownSNIDrop}), IsNil)
+	_, err = dial("unknown.example.org")
+	c.Assert(err, NotNil)
+
+	c.Assert(l.Reload(&ListenerConfig{UnknownSNI: "landing-page"}), NotNil)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	"github.com/golang/groupcache/singleflight"
+)
+
+// vaultRefreshFraction is the fraction of a Vault token's lease after which
+// it is replaced with a new one, leaving time to log in again before it
+// expires
+const vaultRefreshFraction = 2.0 / 3
+
+// vaultRetryInterval is how long a failed Vault login is cached for before
+// logging in is tried again
+var vaultRetryInterval = 5 * time.Second
+
+// validateVaultServiceAuth checks that the route's Vault config is valid.
+func validateVaultServiceAuth(vault *router.VaultConfig) error {
+	if vault == nil {
+		return nil
+	}
+	var msg string
+	if u, err := url.Parse(vault.VaultAddr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msg = fmt.Sprintf("vault_addr %q must be an http or https URL", vault.VaultAddr)
+	} else if vault.RoleID == "" {
+		msg = "role_id must be set"
+	} else if !tokenPattern.MatchString(vault.TokenPath) {
+		msg = fmt.Sprintf("token_path %q is not a valid header name", vault.TokenPath)
+	}
+	if msg == "" {
+		return nil
+	}
+	return httphelper.JSONError{
+		Code:    httphelper.ValidationErrorCode,
+		Message: "Vault service auth invalid: " + msg,
+	}
+}
+
+func vaultColumns(vault *router.VaultConfig) router.VaultConfig {
+	if vault == nil {
+		return router.VaultConfig{}
+	}
+	return *vault
+}
+
+func vaultFromColumns(vault router.VaultConfig) *router.VaultConfig {
+	if vault.VaultAddr == "" {
+		return nil
+	}
+	return &vault
+}
+
+// vaultTokenKey identifies the tokens shared by the routes to a service with
+// the same Vault config
+type vaultTokenKey struct {
+	service string
+	config  router.VaultConfig
+}
+
+// vaultTokens caches the Vault tokens used by routes with VaultServiceAuth
+// set, so that all requests to a service share a token rather than logging
+// in to Vault for each route or request.
+type vaultTokens struct {
+	client *http.Client
+
+	mtx    sync.Mutex
+	tokens map[vaultTokenKey]*vaultToken
+}
+
+func newVaultTokens() *vaultTokens {
+	return &vaultTokens{
+		client: &http.Client{Timeout: 5 * time.Second},
+		tokens: make(map[vaultTokenKey]*vaultToken),
+	}
+}
+
+// get returns the token of the given service and Vault config, incrementing
+// its reference count.
+func (v *vaultTokens) get(service string, config *router.VaultConfig) *vaultToken {
+	key := vaultTokenKey{service: service, config: *config}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	t, ok := v.tokens[key]
+	if !ok {
+		t = &vaultToken{key: key, client: v.client}
+		v.tokens[key] = t
+		// log in before the first request so it doesn't wait for Vault
+		go t.login()
+	}
+	t.refs++
+	return t
+}
+
+// release decrements the reference count of t, forgetting it once it is no
+// longer used by any routes.
+func (v *vaultTokens) release(t *vaultToken) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	t.refs--
+	if t.refs <= 0 {
+		delete(v.tokens, t.key)
+	}
+}
+
+// vaultToken is a Vault token obtained using AppRole authentication, which
+// is replaced with a new one in the background once vaultRefreshFraction of
+// its lease has passed, so that requests don't wait for Vault.
+type vaultToken struct {
+	key    vaultTokenKey
+	client *http.Client
+	refs   int
+
+	mtx        sync.Mutex
+	token      string
+	refresh    time.Time
+	expires    time.Time
+	refreshing bool
+
+	// err is the error from the last login if it failed, which is returned
+	// until retry rather than logging in for each request
+	err   error
+	retry time.Time
+
+	// logins ensures there is only one login in flight
+	logins singleflight.Group
+}
+
+// Token returns the current token, starting a login for a new one in the
+// background if it is due to be refreshed. Requests only wait for Vault if
+// there is no current token, and fail without logging in again if the last
+// login failed less than vaultRetryInterval ago.
+func (t *vaultToken) Token() (string, error) {
+	now := time.Now()
+	t.mtx.Lock()
+	if t.token != "" && (t.expires.IsZero() || now.Before(t.expires)) {
+		token := t.token
+		if !t.refresh.IsZero() && !now.Before(t.refresh) && !t.refreshing {
+			t.refreshing = true
+			go t.login()
+		}
+		t.mtx.Unlock()
+		return token, nil
+	}
+	if t.err != nil && now.Before(t.retry) {
+		err := t.err
+		t.mtx.Unlock()
+		return "", err
+	}
+	t.mtx.Unlock()
+	return t.login()
+}
+
+// login logs in to Vault for a new token and stores it. If logging in fails,
+// the error is cached for vaultRetryInterval, with any current token being
+// refreshed again after that.
+func (t *vaultToken) login() (string, error) {
+	v, err := t.logins.Do("", func() (interface{}, error) {
+		token, lease, err := t.appRoleLogin()
+		now := time.Now()
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		t.refreshing = false
+		if err != nil {
+			t.err, t.retry = err, now.Add(vaultRetryInterval)
+			if t.token != "" {
+				logger.Warn("error refreshing vault token, using the current token", "service", t.key.service, "err", err)
+				t.refresh = t.retry
+			}
+			return nil, err
+		}
+		t.token, t.err = token, nil
+		t.refresh, t.expires = time.Time{}, time.Time{}
+		if lease > 0 {
+			t.refresh = now.Add(time.Duration(float64(lease) * vaultRefreshFraction))
+			t.expires = now.Add(lease)
+		}
+		return token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// vaultLoginResponse is the response to a Vault AppRole login
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// appRoleLogin logs in to Vault using the AppRole credentials of the token's
+// config, returning the new token and its lease duration (zero if it doesn't
+// expire).
+func (t *vaultToken) appRoleLogin() (string, time.Duration, error) {
+	config := t.key.config
+	body, _ := json.Marshal(map[string]string{
+		"role_id":   config.RoleID,
+		"secret_id": config.SecretID,
+	})
+	u := strings.TrimSuffix(config.VaultAddr, "/") + "/v1/auth/approle/login"
+	res, err := t.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("router: unexpected status %d from vault", res.StatusCode)
+	}
+	var data vaultLoginResponse
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return "", 0, err
+	}
+	if data.Auth.ClientToken == "" {
+		return "", 0, fmt.Errorf("router: vault login response is missing a token")
+	}
+	return data.Auth.ClientToken, time.Duration(data.Auth.LeaseDuration) * time.Second, nil
+}
+
+// setVaultToken sets the route's Vault token header on req, replacing any
+// value sent by the client, and returns false after responding with a 502 if
+// a token can't be obtained.
+func (r *httpRoute) setVaultToken(w http.ResponseWriter, req *http.Request) bool {
+	token, err := r.vaultToken.Token()
+	if err != nil {
+		logger.Error("error getting vault token", "route.id", r.ID, "service", r.Service, "err", err)
+		fail(w, http.StatusBadGateway)
+		return false
+	}
+	req.Header.Set(r.VaultServiceAuth.TokenPath, token)
+	return true
+}
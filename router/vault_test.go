@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+// fakeVault serves AppRole logins for a single role, issuing numbered tokens.
+type fakeVault struct {
+	mtx      sync.Mutex
+	attempts int
+	logins   int
+	fail     bool
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var creds struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+	if req.Method != "POST" || req.URL.Path != "/v1/auth/approle/login" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.attempts++
+	if err := json.NewDecoder(req.Body).Decode(&creds); err != nil || f.fail || creds.RoleID != "role" || creds.SecretID != "secret" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.logins++
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token":   fmt.Sprintf("token%d", f.logins),
+			"lease_duration": 3600,
+		},
+	})
+}
+
+func (f *fakeVault) setFail(fail bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeVault) counts() (attempts, logins int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.attempts, f.logins
+}
+
+func (s *S) TestVaultServiceAuth(c *C) {
+	vault := &fakeVault{}
+	vaultSrv := httptest.NewServer(vault)
+	defer vaultSrv.Close()
+
+	// the backend responds with the token it received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Vault-Token")))
+	}))
+	defer srv.Close()
+
+	l, _, d := newFakeHTTPListener(c)
+	defer l.Close()
+	config := &router.VaultConfig{
+		VaultAddr: vaultSrv.URL,
+		RoleID:    "role",
+		SecretID:  "secret",
+		TokenPath: "X-Vault-Token",
+	}
+	route := router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute()
+	route.VaultServiceAuth = config
+	addRoute(c, l, route)
+	defer registerFakeBackend(c, l, d, "test", srv.Listener.Addr().String())()
+
+	// the token is shared by requests to the service, replacing any sent
+	// by the client
+	req := newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Vault-Token", "client")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "token1")
+	assertGet(c, "http://"+l.Addr, "example.com", "token1")
+	_, logins := vault.counts()
+	c.Assert(logins, Equals, 1)
+
+	// the token is refreshed in the background before it expires, with the
+	// current token used until a login succeeds
+	r := l.findRoute("example.com", "/")
+	refresh := func() {
+		r.vaultToken.mtx.Lock()
+		r.vaultToken.refresh = time.Now()
+		r.vaultToken.mtx.Unlock()
+	}
+	waitFor := func(desc string, f func() bool) {
+		timeout := time.After(waitTimeout)
+		for !f() {
+			select {
+			case <-timeout:
+				c.Fatalf("timed out waiting for %s", desc)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	waitForAttempts := func(n int) {
+		waitFor("vault logins", func() bool {
+			attempts, _ := vault.counts()
+			return attempts >= n
+		})
+	}
+	attempts, _ := vault.counts()
+	refresh()
+	vault.setFail(true)
+	assertGet(c, "http://"+l.Addr, "example.com", "token1")
+	waitForAttempts(attempts + 1)
+	assertGet(c, "http://"+l.Addr, "example.com", "token1")
+	vault.setFail(false)
+	refresh()
+	assertGet(c, "http://"+l.Addr, "example.com", "token1")
+	waitFor("the new token", func() bool {
+		token, _ := r.vaultToken.Token()
+		return token == "token2"
+	})
+	assertGet(c, "http://"+l.Addr, "example.com", "token2")
+	_, logins = vault.counts()
+	c.Assert(logins, Equals, 2)
+
+	// requests fail if a token can't be obtained
+	attempts, _ = vault.counts()
+	route.VaultServiceAuth = &router.VaultConfig{
+		VaultAddr: vaultSrv.URL,
+		RoleID:    "role",
+		SecretID:  "wrong",
+		TokenPath: "X-Vault-Token",
+	}
+	wait := waitForRouteSet(c, l, route.ID)
+	c.Assert(l.UpdateRoute(route), IsNil)
+	wait()
+	for i := 0; i < 2; i++ {
+		res, err = httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusBadGateway)
+	}
+
+	// the failed login is cached rather than retried for each request
+	waitForAttempts(attempts + 1)
+	current, _ := vault.counts()
+	c.Assert(current, Equals, attempts+1)
+}
+
+func (s *S) TestVaultSecretIDWriteOnly(c *C) {
+	l, ds, _ := newFakeHTTPListener(c)
+	defer l.Close()
+	route := router.HTTPRoute{Domain: "example.com", Service: "test"}.ToRoute()
+	route.VaultServiceAuth = &router.VaultConfig{
+		VaultAddr: "http://127.0.0.1:0",
+		RoleID:    "role",
+		SecretID:  "secret",
+		TokenPath: "X-Vault-Token",
+	}
+	addRoute(c, l, route)
+	secretID := func(r *router.Route) string {
+		c.Assert(r.VaultServiceAuth, NotNil)
+		return r.VaultServiceAuth.SecretID
+	}
+
+	// the secret ID isn't returned by the API or included in snapshots
+	srv := httptest.NewServer(apiHandler(&Router{HTTP: l}))
+	defer srv.Close()
+	api := client.NewWithAddr(srv.Listener.Addr().String())
+	got, err := api.GetRoute("http", route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.VaultServiceAuth.RoleID, Equals, "role")
+	c.Assert(secretID(got), Equals, "")
+	res, err := http.Get(srv.URL + "/sync/routes")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+	l.PeerDiscovery.SyncKey = "key"
+	req, _ := http.NewRequest("GET", srv.URL+"/sync/routes?peer=test", nil)
+	signPeerRequest(req, "key", time.Now())
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var changes router.RouteChanges
+	err = json.NewDecoder(res.Body).Decode(&changes)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(changes.Changes, HasLen, 1)
+	c.Assert(secretID(changes.Changes[0].Route), Equals, "")
+	snapshot, err := l.Snapshot()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Routes, HasLen, 1)
+	c.Assert(secretID(snapshot.Routes[0]), Equals, "")
+	c.Assert(secretID(route), Equals, "secret")
+
+	// routes updated without the secret ID keep it
+	got.Service = "other"
+	c.Assert(api.UpdateRoute(got), IsNil)
+	stored, err := ds.Get(route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(stored.Service, Equals, "other")
+	c.Assert(secretID(stored), Equals, "secret")
+
+	// as do routes pulled from peers
+	got.UpdatedAt = time.Now().Add(time.Hour)
+	c.Assert(l.applyPeerChange(&router.RouteChange{ID: got.ID, Route: got}), IsNil)
+	c.Assert(secretID(l.findRoute("example.com", "/").ToRoute()), Equals, "secret")
+}
+
+func (s *S) TestValidateVaultServiceAuth(c *C) {
+	valid := router.VaultConfig{VaultAddr: "https://vault.example.com:8200", RoleID: "role", TokenPath: "X-Vault-Token"}
+	c.Assert(validateVaultServiceAuth(nil), IsNil)
+	c.Assert(validateVaultServiceAuth(&valid), IsNil)
+	for _, t := range []struct {
+		modify func(*router.VaultConfig)
+		msg    string
+	}{
+		{func(v *router.VaultConfig) { v.VaultAddr = "vault:8200" }, `vault_addr "vault:8200" must be an http or https URL`},
+		{func(v *router.VaultConfig) { v.RoleID = "" }, "role_id must be set"},
+		{func(v *router.VaultConfig) { v.TokenPath = "X Token" }, `token_path "X Token" is not a valid header name`},
+	} {
+		config := valid
+		t.modify(&config)
+		c.Assert(validateVaultServiceAuth(&config), DeepEquals, httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Vault service auth invalid: " + t.msg,
+		})
+	}
+}
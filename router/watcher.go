@@ -1,43 +1,130 @@
 package main
 
 import (
+	"errors"
 	"sync"
+	"time"
 
+	"github.com/flynn/flynn/router/metrics"
 	"github.com/flynn/flynn/router/types"
 )
 
+var droppedEvents = metrics.NewCounterVec(
+	"strowger_dropped_events_total",
+	"Number of events dropped because a watcher wasn't receiving them fast enough, by route domain (empty for backend events).",
+	"domain",
+)
+
 type Watcher interface {
 	Watch(ch chan *router.Event, sendCurrent bool)
+	WatchWithOptions(ch chan *router.Event, sendCurrent bool, opts WatchOptions)
 	Unwatch(ch chan *router.Event)
+	ReplayEvents(from uint64, ch chan *router.Event) error
 }
 
+// eventBufferSize is the number of recent events kept for replay
+const eventBufferSize = 1000
+
+// defaultWatchBufferSize is the number of events buffered for watchers if
+// WatchOptions.BufferSize is zero, including those registered with Watch
+const defaultWatchBufferSize = 100
+
+// BackpressurePolicy determines what happens to events sent to a watcher
+// which isn't receiving them as fast as they are sent.
+type BackpressurePolicy int
+
+const (
+	// BackpressureDropNewest buffers events for the watcher, dropping new
+	// events while the buffer is full. It is the default policy.
+	BackpressureDropNewest BackpressurePolicy = iota
+
+	// BackpressureDropOldest buffers events for the watcher, dropping the
+	// oldest buffered event to make room when the buffer is full.
+	BackpressureDropOldest
+
+	// BackpressureBlock buffers events for the watcher, and delays
+	// delivering events to all watchers while the buffer is full, for up
+	// to WatchOptions.Timeout, after which the event is dropped for the
+	// watcher. Sending events never blocks.
+	BackpressureBlock
+)
+
+// WatchOptions configure how events are delivered to a watcher. Watchers
+// can detect dropped events by gaps in the events' sequence numbers, and
+// get them using ReplayEvents if they are still buffered for replay.
+type WatchOptions struct {
+	Policy BackpressurePolicy
+
+	// BufferSize is the number of events buffered for the watcher,
+	// defaulting to defaultWatchBufferSize
+	BufferSize int
+
+	// Timeout is how long to wait for the buffer of watchers which block
+	// to have room before dropping an event, and must be positive for
+	// BackpressureBlock
+	Timeout time.Duration
+}
+
+// ErrEventsUnavailable is returned from ReplayEvents when some of the
+// requested events are no longer buffered, in which case the subscriber
+// should resync.
+var ErrEventsUnavailable = errors.New("router: requested events are no longer available")
+
 func NewWatchManager() *WatchManager {
 	return &WatchManager{
-		watchers: make(map[chan *router.Event]struct{}),
+		watchers: make(map[chan *router.Event]*watcher),
 		backends: make(map[string]map[string]*router.Backend),
 	}
 }
 
 type WatchManager struct {
 	mtx      sync.RWMutex
-	watchers map[chan *router.Event]struct{}
+	watchers map[chan *router.Event]*watcher
 	backends map[string]map[string]*router.Backend
+
+	// seq is the sequence number of the last event sent, the event with
+	// sequence number n is stored in events[n%eventBufferSize]
+	seq    uint64
+	events [eventBufferSize]*router.Event
+
+	// queue holds the events sent but not yet delivered to the watchers,
+	// which a goroutine delivers in order while dispatching is set, so that
+	// Send doesn't wait for watchers
+	queue       []*router.Event
+	dispatching bool
 }
 
+// Watch sends events to ch using the default WatchOptions, so that a watcher
+// which stops receiving events can't hold up the others, first sending the
+// current backends if sendCurrent is true.
 func (m *WatchManager) Watch(ch chan *router.Event, sendCurrent bool) {
+	m.WatchWithOptions(ch, sendCurrent, WatchOptions{})
+}
+
+// WatchWithOptions is like Watch but delivers events as configured by opts.
+// The current backends are sent before any later events, and are never
+// dropped. It panics if opts.Policy is BackpressureBlock without a Timeout.
+func (m *WatchManager) WatchWithOptions(ch chan *router.Event, sendCurrent bool, opts WatchOptions) {
+	if opts.Policy == BackpressureBlock && opts.Timeout <= 0 {
+		panic("router: BackpressureBlock requires a positive Timeout")
+	}
 	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var current []*router.Event
 	if sendCurrent {
 		for _, backends := range m.backends {
 			for _, backend := range backends {
-				ch <- &router.Event{
-					Event:   router.EventTypeBackendUp,
-					Backend: backend,
-				}
+				current = append(current, &router.Event{
+					Event:     router.EventTypeBackendUp,
+					Backend:   backend,
+					Timestamp: time.Now(),
+				})
 			}
 		}
 	}
-	m.watchers[ch] = struct{}{}
-	m.mtx.Unlock()
+	// events which are sent but not yet delivered are reflected in the
+	// current backends, so they aren't delivered to the new watcher
+	m.watchers[ch] = newWatcher(ch, opts, m.seq, current)
 }
 
 func (m *WatchManager) Unwatch(ch chan *router.Event) {
@@ -47,11 +134,39 @@ func (m *WatchManager) Unwatch(ch chan *router.Event) {
 		}
 	}()
 	m.mtx.Lock()
+	w, ok := m.watchers[ch]
 	delete(m.watchers, ch)
 	m.mtx.Unlock()
+	if ok {
+		w.stop()
+	}
 	close(ch)
 }
 
+// ReplayEvents sends all buffered events with a sequence number greater than
+// from to ch, returning ErrEventsUnavailable if any of those events have
+// already been dropped from the buffer. The events are copied before being
+// sent so that a slow receiver doesn't block sending new events.
+func (m *WatchManager) ReplayEvents(from uint64, ch chan *router.Event) error {
+	m.mtx.RLock()
+	if from > m.seq || m.seq-from > eventBufferSize {
+		m.mtx.RUnlock()
+		return ErrEventsUnavailable
+	}
+	events := make([]*router.Event, 0, m.seq-from)
+	for seq := from + 1; seq <= m.seq; seq++ {
+		events = append(events, m.events[seq%eventBufferSize])
+	}
+	m.mtx.RUnlock()
+
+	for _, event := range events {
+		ch <- event
+	}
+	return nil
+}
+
+// Send sends the event to all watchers. It doesn't wait for the event to be
+// delivered, so it can be called while holding the listener's lock.
 func (m *WatchManager) Send(event *router.Event) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -72,18 +187,169 @@ func (m *WatchManager) Send(event *router.Event) {
 	case router.EventTypeRouteRemove:
 		if backends, ok := m.backends[event.Route.Service]; ok {
 			for _, backend := range backends {
-				for ch := range m.watchers {
-					ch <- &router.Event{
-						Event:   router.EventTypeBackendDown,
-						Backend: backend,
-					}
-				}
+				m.broadcast(&router.Event{
+					Event:   router.EventTypeBackendDown,
+					Backend: backend,
+				})
 			}
 			delete(m.backends, event.Route.Service)
 		}
 	}
 
-	for ch := range m.watchers {
-		ch <- event
+	m.broadcast(event)
+}
+
+// broadcast assigns the next sequence number to the event, buffers it for
+// replay and queues it to be delivered to all watchers. The caller must hold
+// m.mtx.
+func (m *WatchManager) broadcast(event *router.Event) {
+	m.seq++
+	event.Sequence = m.seq
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	m.events[m.seq%eventBufferSize] = event
+
+	m.queue = append(m.queue, event)
+	if !m.dispatching {
+		m.dispatching = true
+		go m.dispatch()
+	}
+}
+
+// dispatch delivers queued events to the watchers until the queue is empty.
+// Only watchers which block wait here, without holding m.mtx.
+func (m *WatchManager) dispatch() {
+	for {
+		m.mtx.Lock()
+		if len(m.queue) == 0 {
+			m.queue = nil
+			m.dispatching = false
+			m.mtx.Unlock()
+			return
+		}
+		event := m.queue[0]
+		m.queue[0] = nil
+		m.queue = m.queue[1:]
+		watchers := make([]*watcher, 0, len(m.watchers))
+		for _, w := range m.watchers {
+			watchers = append(watchers, w)
+		}
+		m.mtx.Unlock()
+
+		for _, w := range watchers {
+			w.send(event)
+		}
+	}
+}
+
+// watcher delivers events to a channel registered with WatchWithOptions from
+// a goroutine, buffering them according to its policy
+type watcher struct {
+	ch    chan *router.Event
+	opts  WatchOptions
+	queue chan *router.Event
+
+	// after is the sequence number of the last event sent before the
+	// watcher was registered
+	after uint64
+
+	done   chan struct{}
+	stopCh chan struct{}
+}
+
+func newWatcher(ch chan *router.Event, opts WatchOptions, after uint64, current []*router.Event) *watcher {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = defaultWatchBufferSize
+	}
+	w := &watcher{
+		ch:     ch,
+		opts:   opts,
+		queue:  make(chan *router.Event, size),
+		after:  after,
+		done:   make(chan struct{}),
+		stopCh: make(chan struct{}),
+	}
+	go w.deliver(current)
+	return w
+}
+
+// send buffers the event for the watcher according to its policy.
+func (w *watcher) send(event *router.Event) {
+	if event.Sequence <= w.after {
+		return
+	}
+	select {
+	case w.queue <- event:
+		return
+	default:
+	}
+
+	switch w.opts.Policy {
+	case BackpressureBlock:
+		t := time.NewTimer(w.opts.Timeout)
+		defer t.Stop()
+		select {
+		case w.queue <- event:
+		case <-t.C:
+			droppedEvents.Inc(eventDomain(event))
+		case <-w.stopCh:
+		}
+	case BackpressureDropOldest:
+		for {
+			select {
+			case w.queue <- event:
+				return
+			default:
+			}
+			select {
+			case oldest := <-w.queue:
+				droppedEvents.Inc(eventDomain(oldest))
+			default:
+			}
+		}
+	default:
+		droppedEvents.Inc(eventDomain(event))
+	}
+}
+
+// deliver sends the given current events and then the buffered events to
+// the watcher's channel until it is stopped.
+func (w *watcher) deliver(current []*router.Event) {
+	defer close(w.done)
+	for _, event := range current {
+		select {
+		case w.ch <- event:
+		case <-w.stopCh:
+			return
+		}
+	}
+	for {
+		select {
+		case event := <-w.queue:
+			select {
+			case w.ch <- event:
+			case <-w.stopCh:
+				return
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// stop stops delivering buffered events, waiting for the delivery goroutine
+// to exit so that the channel can be closed.
+func (w *watcher) stop() {
+	close(w.stopCh)
+	<-w.done
+}
+
+// eventDomain returns the domain of the route of the given event, if any.
+func eventDomain(event *router.Event) string {
+	if event.Route == nil {
+		return ""
 	}
+	return event.Route.Domain
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func sendTestEvents(m *WatchManager, n int) {
+	for i := 0; i < n; i++ {
+		m.Send(&router.Event{
+			Event: router.EventTypeRouteSet,
+			Route: &router.Route{Service: "test"},
+		})
+	}
+}
+
+// waitDispatched waits for the events sent to m to be delivered to the
+// watchers' buffers.
+func waitDispatched(c *C, m *WatchManager) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		m.mtx.RLock()
+		dispatching := m.dispatching
+		m.mtx.RUnlock()
+		if !dispatching {
+			return
+		}
+		if time.Since(start) > waitTimeout {
+			c.Fatal("timed out waiting for events to be dispatched")
+		}
+	}
+}
+
+func (s *S) TestWatchManagerEventSequence(c *C) {
+	m := NewWatchManager()
+	ch := make(chan *router.Event, 10)
+	m.Watch(ch, false)
+	defer m.Unwatch(ch)
+
+	sendTestEvents(m, 5)
+	for i := 1; i <= 5; i++ {
+		e := <-ch
+		c.Assert(e.Sequence, Equals, uint64(i))
+		c.Assert(e.Timestamp.IsZero(), Equals, false)
+	}
+
+	// a route removal with tracked backends generates a backend-down event
+	// which should also be sequenced
+	m.Send(&router.Event{
+		Event:   router.EventTypeBackendUp,
+		Backend: &router.Backend{Service: "test", JobID: "job1"},
+	})
+	m.Send(&router.Event{
+		Event: router.EventTypeRouteRemove,
+		Route: &router.Route{Service: "test"},
+	})
+	for i, typ := range []router.EventType{
+		router.EventTypeBackendUp,
+		router.EventTypeBackendDown,
+		router.EventTypeRouteRemove,
+	} {
+		e := <-ch
+		c.Assert(e.Event, Equals, typ)
+		c.Assert(e.Sequence, Equals, uint64(6+i))
+	}
+}
+
+func (s *S) TestWatchManagerReplayEvents(c *C) {
+	m := NewWatchManager()
+
+	// replaying with no events sends nothing
+	ch := make(chan *router.Event, eventBufferSize)
+	c.Assert(m.ReplayEvents(0, ch), IsNil)
+	c.Assert(ch, HasLen, 0)
+
+	sendTestEvents(m, 10)
+
+	c.Assert(m.ReplayEvents(7, ch), IsNil)
+	c.Assert(ch, HasLen, 3)
+	for i := 8; i <= 10; i++ {
+		c.Assert((<-ch).Sequence, Equals, uint64(i))
+	}
+
+	// replaying from the latest sequence sends nothing
+	c.Assert(m.ReplayEvents(10, ch), IsNil)
+	c.Assert(ch, HasLen, 0)
+
+	// replaying from a sequence which hasn't been sent yet is an error
+	c.Assert(m.ReplayEvents(11, ch), Equals, ErrEventsUnavailable)
+
+	// fill the buffer so the earliest events are dropped
+	sendTestEvents(m, eventBufferSize)
+	c.Assert(m.ReplayEvents(9, ch), Equals, ErrEventsUnavailable)
+	c.Assert(ch, HasLen, 0)
+
+	c.Assert(m.ReplayEvents(10, ch), IsNil)
+	c.Assert(ch, HasLen, eventBufferSize)
+	for i := 11; i <= 10+eventBufferSize; i++ {
+		c.Assert((<-ch).Sequence, Equals, uint64(i))
+	}
+
+	// a receiver which is slow to receive replayed events doesn't block
+	// sending new ones
+	slow := make(chan *router.Event)
+	replayed := make(chan error)
+	go func() { replayed <- m.ReplayEvents(10, slow) }()
+	// receive the first event so the replay has copied the events before
+	// a new one evicts the earliest
+	c.Assert((<-slow).Sequence, Equals, uint64(11))
+	sent := make(chan struct{})
+	go func() {
+		sendTestEvents(m, 1)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(waitTimeout):
+		c.Fatal("timed out sending an event during replay")
+	}
+	for i := 12; i <= 10+eventBufferSize; i++ {
+		c.Assert((<-slow).Sequence, Equals, uint64(i))
+	}
+	c.Assert(<-replayed, IsNil)
+}
+
+func (s *S) TestWatchManagerBackpressure(c *C) {
+	m := NewWatchManager()
+
+	// receive returns the sequence numbers of the events received on ch
+	// until n have been received
+	receive := func(ch chan *router.Event, n int) []uint64 {
+		seqs := make([]uint64, 0, n)
+		for len(seqs) < n {
+			select {
+			case e := <-ch:
+				seqs = append(seqs, e.Sequence)
+			case <-time.After(waitTimeout):
+				c.Fatalf("timed out waiting for events, got %v", seqs)
+			}
+		}
+		return seqs
+	}
+
+	// watchers which aren't receiving events have them buffered according
+	// to their policy, without blocking other watchers
+	oldest := make(chan *router.Event)
+	m.WatchWithOptions(oldest, false, WatchOptions{Policy: BackpressureDropOldest, BufferSize: 3})
+	newest := make(chan *router.Event)
+	m.WatchWithOptions(newest, false, WatchOptions{Policy: BackpressureDropNewest, BufferSize: 3})
+	defer m.Unwatch(newest)
+
+	// the first event is taken from the buffer by the delivery goroutine,
+	// which then blocks sending it, so the next 3 fill the buffer
+	sendTestEvents(m, 1)
+	time.Sleep(10 * time.Millisecond)
+	sendTestEvents(m, 5)
+	waitDispatched(c, m)
+	c.Assert(receive(oldest, 4), DeepEquals, []uint64{1, 4, 5, 6})
+	c.Assert(receive(newest, 4), DeepEquals, []uint64{1, 2, 3, 4})
+
+	// blocking watchers with a timeout have events dropped if their buffer
+	// doesn't have room in time
+	timeout := make(chan *router.Event)
+	m.WatchWithOptions(timeout, false, WatchOptions{Policy: BackpressureBlock, BufferSize: 1, Timeout: 100 * time.Millisecond})
+	defer m.Unwatch(timeout)
+	dropped := droppedEvents.Value("")
+	sendTestEvents(m, 3)
+	for start := time.Now(); droppedEvents.Value("") == dropped; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			c.Fatal("timed out waiting for an event to be dropped")
+		}
+	}
+	c.Assert(receive(timeout, 2), DeepEquals, []uint64{7, 8})
+	for _, ch := range []chan *router.Event{oldest, newest} {
+		c.Assert(receive(ch, 3), DeepEquals, []uint64{7, 8, 9})
+	}
+
+	// unwatching stops delivery and closes the channel
+	sendTestEvents(m, 1)
+	m.Unwatch(oldest)
+	_, ok := <-oldest
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestWatchOptionsDefaults(c *C) {
+	// the zero value drops new events rather than blocking
+	c.Assert(WatchOptions{}.Policy, Equals, BackpressureDropNewest)
+
+	m := NewWatchManager()
+	ch := make(chan *router.Event)
+	c.Assert(func() {
+		m.WatchWithOptions(ch, false, WatchOptions{Policy: BackpressureBlock})
+	}, PanicMatches, "router: BackpressureBlock requires a positive Timeout")
+}
+
+func (s *S) TestWatchManagerSendDoesNotBlock(c *C) {
+	m := NewWatchManager()
+
+	// a blocking watcher which doesn't receive events delays delivering
+	// them to other watchers, but not sending them
+	blocked := make(chan *router.Event)
+	m.WatchWithOptions(blocked, false, WatchOptions{Policy: BackpressureBlock, BufferSize: 1, Timeout: time.Minute})
+	defer m.Unwatch(blocked)
+	done := make(chan struct{})
+	go func() {
+		sendTestEvents(m, 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		c.Fatal("timed out sending events")
+	}
+}
+
+func (s *S) TestWatchManagerSlowWatcher(c *C) {
+	m := NewWatchManager()
+	slow := make(chan *router.Event)
+	m.Watch(slow, false)
+	defer m.Unwatch(slow)
+
+	// a watcher which doesn't receive events has them dropped once its
+	// buffer is full rather than blocking the sender
+	const total = defaultWatchBufferSize + 10
+	dropped := droppedEvents.Value("slow.example.com")
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < total; i++ {
+			m.Send(&router.Event{
+				Event: router.EventTypeRouteSet,
+				Route: &router.Route{Domain: "slow.example.com"},
+			})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		c.Fatal("timed out sending events")
+	}
+	// events are dropped once the delivery goroutine is blocked on one
+	// event and the buffer is full
+	for start := time.Now(); droppedEvents.Value("slow.example.com")-dropped < total-defaultWatchBufferSize-1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			c.Fatal("timed out waiting for events to be dropped")
+		}
+	}
+	dropped = droppedEvents.Value("slow.example.com") - dropped
+
+	// the events which weren't dropped are received in order
+	var last uint64
+	for i := uint64(0); i < total-dropped; i++ {
+		select {
+		case e := <-slow:
+			c.Assert(e.Sequence > last, Equals, true)
+			last = e.Sequence
+		case <-time.After(waitTimeout):
+			c.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	select {
+	case e := <-slow:
+		c.Fatalf("unexpected event %d", e.Sequence)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
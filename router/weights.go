@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// defaultBackendWeight is the weight of backends which don't set a weight
+// in their discoverd metadata
+const defaultBackendWeight = 100
+
+// weightTable is used to pick backends with a probability proportional to
+// the weight in their discoverd metadata.
+type weightTable struct {
+	addrs []string
+	// cumulativeWeights[i] is the sum of the weights of addrs[0] to
+	// addrs[i]
+	cumulativeWeights []int
+}
+
+// newWeightTable returns a weight table for the given instances, or nil if
+// all instances have the same weight (in which case backends are picked
+// uniformly at random).
+func newWeightTable(instances []*discoverd.Instance) *weightTable {
+	t := &weightTable{
+		addrs:             make([]string, 0, len(instances)),
+		cumulativeWeights: make([]int, 0, len(instances)),
+	}
+	total := 0
+	uniform := true
+	for i, inst := range instances {
+		weight := instanceWeight(inst)
+		if i > 0 && weight != instanceWeight(instances[0]) {
+			uniform = false
+		}
+		if weight == 0 {
+			continue
+		}
+		total += weight
+		t.addrs = append(t.addrs, inst.Addr)
+		t.cumulativeWeights = append(t.cumulativeWeights, total)
+	}
+	if uniform || total == 0 {
+		return nil
+	}
+	return t
+}
+
+// instanceWeight returns the weight of an instance from its "weight"
+// metadata, which must be a non-negative integer.
+func instanceWeight(inst *discoverd.Instance) int {
+	s, ok := inst.Meta["weight"]
+	if !ok {
+		return defaultBackendWeight
+	}
+	weight, err := strconv.Atoi(s)
+	if err != nil || weight < 0 {
+		return defaultBackendWeight
+	}
+	return weight
+}
+
+// pick returns a backend address with a probability proportional to its
+// weight.
+func (t *weightTable) pick() string {
+	n := random.Math.Intn(t.cumulativeWeights[len(t.cumulativeWeights)-1])
+	return t.addrs[sort.SearchInts(t.cumulativeWeights, n+1)]
+}
+
+// updateWeights recomputes the service's weight table from its current
+// instances. It is called as instances change so that the table can be read
+// without locking when handling requests.
+func (s *service) updateWeights(instances []*discoverd.Instance) {
+	s.weights.Store(&weightTableRef{newWeightTable(instances)})
+}
+
+func instanceList(instances map[string]*discoverd.Instance) []*discoverd.Instance {
+	list := make([]*discoverd.Instance, 0, len(instances))
+	for _, inst := range instances {
+		list = append(list, inst)
+	}
+	return list
+}
+
+// pickBackend is a proxy.BackendPickerFunc which picks a backend using the
+// service's weight table.
+func (s *service) pickBackend() string {
+	ref, _ := s.weights.Load().(*weightTableRef)
+	if ref == nil || ref.table == nil {
+		return ""
+	}
+	return ref.table.pick()
+}
+
+// weightTableRef wraps a possibly nil weight table so that it can be stored
+// in an atomic.Value
+type weightTableRef struct {
+	table *weightTable
+}
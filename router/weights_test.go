@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/proxy"
+	. "github.com/flynn/go-check"
+	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (s *S) TestBackendWeights(c *C) {
+	instance := func(addr, weight string) *discoverd.Instance {
+		inst := &discoverd.Instance{Addr: addr, Meta: map[string]string{}}
+		if weight != "" {
+			inst.Meta["weight"] = weight
+		}
+		return inst
+	}
+	svc := &service{}
+	picks := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			counts[svc.pickBackend()]++
+		}
+		return counts
+	}
+
+	// backends are picked uniformly at random by the proxy when no weights
+	// are set or they are all equal
+	c.Assert(svc.pickBackend(), Equals, "")
+	svc.updateWeights([]*discoverd.Instance{instance("a", ""), instance("b", "100")})
+	c.Assert(svc.pickBackend(), Equals, "")
+
+	// changing a weight shifts the distribution
+	svc.updateWeights([]*discoverd.Instance{instance("a", "50"), instance("b", "150")})
+	counts := picks()
+	c.Assert(counts["a"]+counts["b"], Equals, 1000)
+	c.Assert(counts["b"] > 650 && counts["b"] < 850, Equals, true, Commentf("counts = %v", counts))
+
+	svc.updateWeights([]*discoverd.Instance{instance("a", "150"), instance("b", "50")})
+	counts = picks()
+	c.Assert(counts["a"] > 650 && counts["a"] < 850, Equals, true, Commentf("counts = %v", counts))
+
+	// backends with a zero weight are never picked, and invalid weights
+	// use the default
+	svc.updateWeights([]*discoverd.Instance{instance("a", "0"), instance("b", "invalid"), instance("c", "300")})
+	counts = picks()
+	c.Assert(counts["a"], Equals, 0)
+	c.Assert(counts["b"] > 150 && counts["b"] < 350, Equals, true, Commentf("counts = %v", counts))
+}
+
+func (s *S) TestServiceWeightsFromCache(c *C) {
+	svc := newFakeService(c, "test",
+		&discoverd.Instance{ID: "a", Addr: "a", Meta: map[string]string{"weight": "0"}},
+		&discoverd.Instance{ID: "b", Addr: "b"},
+		&discoverd.Instance{ID: "c", Addr: "c", Meta: map[string]string{"weight": "0"}},
+	)
+	defer svc.Close()
+
+	// the weights are updated from the current instances without
+	// blocking the cache
+	timeout := time.After(5 * time.Second)
+	for svc.pickBackend() != "b" {
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for backend weights")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(svc.sc.Addrs(), HasLen, 3)
+}
+
+func (s *S) TestExplainBackendSelection(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+	addr1, addr2 := srv1.Listener.Addr().String(), srv2.Listener.Addr().String()
+
+	var records []*log15.Record
+	l := log15.New()
+	l.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		if r.Msg == "backend selection" {
+			records = append(records, r)
+		}
+		return nil
+	}))
+	backends := func() []string { return []string{addr1, addr2} }
+	rp := proxy.NewReverseProxy(backends, &[32]byte{}, false, &service{}, l)
+	rp.SetBackendPicker(func() string { return addr2 })
+	get := func() {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(context.Background(), w, httptest.NewRequest("GET", "http://example.com/", nil))
+		c.Assert(w.Code, Equals, http.StatusOK)
+	}
+
+	// nothing is logged by default
+	get()
+	c.Assert(records, HasLen, 0)
+
+	proxy.ExplainSampleRate = 1
+	defer func() { proxy.ExplainSampleRate = 0 }()
+	get()
+	c.Assert(records, HasLen, 1)
+	ctx := make(map[interface{}]interface{})
+	for i := 0; i < len(records[0].Ctx); i += 2 {
+		ctx[records[0].Ctx[i]] = records[0].Ctx[i+1]
+	}
+	c.Assert(ctx["reason"], Equals, "weighted")
+	c.Assert(ctx["backend"], Equals, addr2)
+	c.Assert(ctx["candidates"], Equals, addr2+","+addr1)
+}
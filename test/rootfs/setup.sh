@@ -202,20 +202,19 @@ sed 's/#user_allow_other/user_allow_other/' -i /etc/fuse.conf
 
 # install go
 curl https://godeb.s3.amazonaws.com/godeb-amd64.tar.gz | tar xz
-./godeb install 1.7.5
+./godeb install 1.24.0
 rm godeb
 
-# install go-tuf
+# install go-tuf at the revision in Godeps, building it in GOPATH mode
 export GOPATH="$(mktemp --directory)"
+export GO111MODULE=off
 trap "rm -rf ${GOPATH}" EXIT
-go get github.com/flynn/go-tuf/cmd/tuf
+git clone --quiet https://github.com/flynn/go-tuf.git "${GOPATH}/src/github.com/flynn/go-tuf"
+git -C "${GOPATH}/src/github.com/flynn/go-tuf" checkout --quiet 0d42b7c36a69aa39943423a287fbc9f195eb2f30
+go get github.com/flynn/go-tuf/cmd/tuf github.com/flynn/go-tuf/cmd/tuf-client
 mv "${GOPATH}/bin/tuf" /usr/bin/tuf
-go get github.com/flynn/go-tuf/cmd/tuf-client
 mv "${GOPATH}/bin/tuf-client" /usr/bin/tuf-client
 
-# install go cover
-go get golang.org/x/tools/cmd/cover
-
 # allow the test runner to set certain environment variables
 echo AcceptEnv TEST_RUNNER_AUTH_KEY BLOBSTORE_S3_CONFIG BLOBSTORE_GCS_CONFIG BLOBSTORE_AZURE_CONFIG >> /etc/ssh/sshd_config
 
@@ -20,7 +20,7 @@ main() {
   cd "${src_dir}"
   git fetch origin
   git checkout --force --quiet origin/master
-  GOPATH="${dir}" go build -race -o test/bin/flynn-test-runner ./test/runner
+  GOPATH="${dir}" GO111MODULE=off go build -race -o test/bin/flynn-test-runner ./test/runner
 
   # run the cleanup script
   "${src_dir}/test/scripts/cleanup.sh"
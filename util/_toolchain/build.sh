@@ -2,8 +2,8 @@
 
 set -eo pipefail
 
-version=1.7.5
-shasum=2e4dd6c44f0693bef4e7b46cc701513d74c3cc44f2419bf519d7868b12931ac3
+version=1.24.0
+shasum=dea9ca38a0b852a74e81c26134671af7c0fbe65d81b0dc1c5bfe22cf7d4c8858
 pkg="go${version}.linux-amd64"
 go=go/bin/go
 